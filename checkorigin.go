@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Upgrader.CheckOrigin that only lets browsers on one of allowedOrigins open a websocket.
+// "*" allows any origin, for development.
+// Requests without an Origin header don't come from a browser, so can't be cross-site, and are allowed.
+func makeCheckOrigin(allowedOrigins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		return slices.ContainsFunc(allowedOrigins, func(allowed string) bool {
+			return allowed == "*" || strings.EqualFold(allowed, origin)
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckOrigin(t *testing.T) {
+
+	t.Run("Checks the Origin header against the allowlist", func(t *testing.T) {
+		tests := []struct {
+			description    string
+			allowedOrigins []string
+			origin         string
+			expectAllowed  bool
+		}{
+			{"allowed origin", []string{"https://harmony.example"}, "https://harmony.example", true},
+			{"allowed origin in a different case", []string{"https://harmony.example"}, "https://Harmony.example", true},
+			{"disallowed origin", []string{"https://harmony.example"}, "https://evil.example", false},
+			{"nothing allowed", []string{}, "https://harmony.example", false},
+			{"missing Origin header", []string{"https://harmony.example"}, "", true},
+			{"missing Origin header with nothing allowed", []string{}, "", true},
+			{"wildcard", []string{"*"}, "https://anything.example", true},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+				if tt.origin != "" {
+					r.Header.Set("Origin", tt.origin)
+				}
+				allowed := makeCheckOrigin(tt.allowedOrigins)(r)
+				if allowed != tt.expectAllowed {
+					t.Errorf("Expected allowed=%v got %v", tt.expectAllowed, allowed)
+				}
+			})
+		}
+	})
+
+	t.Run("Handshake from a disallowed origin fails with 403", func(t *testing.T) {
+		upgrader := websocket.Upgrader{CheckOrigin: makeCheckOrigin([]string{"https://harmony.example"})}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err == nil {
+				conn.Close()
+			}
+		}))
+		defer server.Close()
+		url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+		tests := []struct {
+			origin         string
+			expectedStatus int
+		}{
+			{"https://evil.example", http.StatusForbidden},
+			{"https://harmony.example", http.StatusSwitchingProtocols},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.origin, func(t *testing.T) {
+				conn, resp, _ := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {tt.origin}})
+				if conn != nil {
+					conn.Close()
+				}
+				if resp == nil {
+					t.Fatalf("Expected a response")
+				}
+				if resp.StatusCode != tt.expectedStatus {
+					t.Errorf("Expected status %d got %d", tt.expectedStatus, resp.StatusCode)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"harmony/backend/model"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server settings. Each can be set with a flag or an environment variable; flags take precedence.
+//
+//   - -addr, HARMONY_ADDR: address to listen on (default 0.0.0.0:8080)
+//   - -read-buffer, HARMONY_READ_BUFFER: websocket read buffer size in bytes (default 1024)
+//   - -write-buffer, HARMONY_WRITE_BUFFER: websocket write buffer size in bytes (default 1024)
+//   - -allowed-origins, HARMONY_ALLOWED_ORIGINS: comma separated origins that can open websockets, or * for any (default none)
+//   - -max-message-size, HARMONY_MAX_MESSAGE_SIZE: largest message a client can send in bytes, not counting the transaction id (default 131072)
+//   - -max-clients, HARMONY_MAX_CLIENTS: devices that can be signed in at once, 0 for no limit. Further sign-ins are told the server is at capacity (default 100000)
+//   - -max-devices-per-key, HARMONY_MAX_DEVICES_PER_KEY: devices that can be signed in with one public key at once, 0 for no limit. Further sign-ins with the key are told it has too many devices, unless they take over its session (default 5)
+//   - -idle-timeout, HARMONY_IDLE_TIMEOUT: how long a client that has not come online and has no transactions can stay silent, 0 for no limit (default 60s)
+//   - -auth-timeout, HARMONY_AUTH_TIMEOUT: how long a client signing in with comeOnline has to reply at each step before it is told "Authentication timed out" (default 10s)
+//   - -ws-rate, HARMONY_WS_RATE: websockets per second each IP address can open once its burst is used up, 0 for no limit (default 2)
+//   - -ws-burst, HARMONY_WS_BURST: websockets each IP address can open at once (default 20)
+//   - -message-rate, HARMONY_MESSAGE_RATE: messages per second each client can send once its burst is used up, 0 for no limit (default 20)
+//   - -message-burst, HARMONY_MESSAGE_BURST: messages each client can send at once (default 50)
+//   - -trusted-proxy-header, HARMONY_TRUSTED_PROXY_HEADER: header that a proxy in front of the server puts the client's IP address in, such as X-Forwarded-For (default none)
+//   - -admin-secret, HARMONY_ADMIN_SECRET: bearer token for the /admin endpoints, which are disabled if it is empty (default none)
+//   - -max-write-failures, HARMONY_MAX_WRITE_FAILURES: writes to a client in a row that can fail before it is disconnected, 1 to disconnect on the first failure, 0 for never (default 3)
+//   - -critical-write-retries, HARMONY_CRITICAL_WRITE_RETRIES: times a message peers depend on, such as a terminate or a forwarded answer, is written again with backoff if writing it fails on a connection that can recover, before the client is disconnected. Websocket connections can't, so they are disconnected straight away. 0 writes them like any other message (default 3)
+//   - -max-transaction-lifetime, HARMONY_MAX_TRANSACTION_LIFETIME: how long a transaction can last before it is cancelled, however active it is, 0 for no limit (default 5m)
+//   - -resume-grace, HARMONY_RESUME_GRACE: how long a client that drops has to reconnect and resume its transactions before its peers are told it has gone, 0 to tell them straight away (default 10s)
+//   - -banned-keys, HARMONY_BANNED_KEYS: comma separated base64 public keys that can't come online or be sent requests. More can be banned at runtime through /admin/ban (default none)
+//   - -key-algorithms, HARMONY_KEY_ALGORITHMS: comma separated kinds of key clients can sign in with, ed25519 and/or p256 (default ed25519)
+//   - -error-verbosity, HARMONY_ERROR_VERBOSITY: production to tell clients only "Malformed message" when their message doesn't match the schema and log the details, or debug to send them the details (default production)
+type config struct {
+	addr               string
+	readBufferSize     int
+	writeBufferSize    int
+	allowedOrigins     []string
+	maxMessageSize     int
+	maxClients         int
+	maxDevicesPerKey   int
+	idleTimeout        time.Duration
+	authTimeout        time.Duration
+	wsRate             float64
+	wsBurst            int
+	messageRate        float64
+	messageBurst       int
+	trustedProxyHeader string
+	adminSecret        string
+	maxWriteFailures   int
+	criticalRetries    int
+	maxTxLifetime      time.Duration
+	resumeGrace        time.Duration
+	bannedKeys         []string
+	errorVerbosity     model.ErrorVerbosity
+	keyAlgorithms      []model.KeyAlgorithm
+}
+
+func defaultConfig() config {
+	return config{
+		addr:             "0.0.0.0:8080",
+		readBufferSize:   1024,
+		writeBufferSize:  1024,
+		allowedOrigins:   []string{},
+		bannedKeys:       []string{},
+		maxMessageSize:   model.DEFAULT_MAX_MESSAGE_SIZE,
+		maxClients:       model.DEFAULT_MAX_CLIENTS,
+		maxDevicesPerKey: model.DEFAULT_MAX_DEVICES_PER_KEY,
+		idleTimeout:      model.DEFAULT_IDLE_TIMEOUT,
+		authTimeout:      model.DEFAULT_AUTH_TIMEOUT,
+		wsRate:           defaultWsRate,
+		wsBurst:          defaultWsBurst,
+		messageRate:      model.DEFAULT_MESSAGE_RATE,
+		messageBurst:     model.DEFAULT_MESSAGE_BURST,
+		maxWriteFailures: model.DEFAULT_MAX_WRITE_FAILURES,
+		criticalRetries:  model.DEFAULT_CRITICAL_WRITE_RETRIES,
+		maxTxLifetime:    model.DEFAULT_MAX_TRANSACTION_LIFETIME,
+		resumeGrace:      model.DEFAULT_RESUME_GRACE,
+		errorVerbosity:   model.ErrorVerbosity_Production,
+		keyAlgorithms:    []model.KeyAlgorithm{model.KeyAlgorithm_Ed25519},
+	}
+}
+
+// Build the config from command line arguments (without the program name) and environment variables.
+// getenv is os.Getenv outside of tests.
+func loadConfig(args []string, getenv func(string) string) (config, error) {
+	cfg := defaultConfig()
+
+	// environment variables first, so that flags can override them
+	if addr := getenv("HARMONY_ADDR"); addr != "" {
+		cfg.addr = addr
+	}
+	var err error
+	if size := getenv("HARMONY_READ_BUFFER"); size != "" {
+		cfg.readBufferSize, err = strconv.Atoi(size)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_READ_BUFFER must be an integer, got %q", size)
+		}
+	}
+	if size := getenv("HARMONY_WRITE_BUFFER"); size != "" {
+		cfg.writeBufferSize, err = strconv.Atoi(size)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_WRITE_BUFFER must be an integer, got %q", size)
+		}
+	}
+	if size := getenv("HARMONY_MAX_MESSAGE_SIZE"); size != "" {
+		cfg.maxMessageSize, err = strconv.Atoi(size)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_MAX_MESSAGE_SIZE must be an integer, got %q", size)
+		}
+	}
+	if clients := getenv("HARMONY_MAX_CLIENTS"); clients != "" {
+		cfg.maxClients, err = strconv.Atoi(clients)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_MAX_CLIENTS must be an integer, got %q", clients)
+		}
+	}
+	if devices := getenv("HARMONY_MAX_DEVICES_PER_KEY"); devices != "" {
+		cfg.maxDevicesPerKey, err = strconv.Atoi(devices)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_MAX_DEVICES_PER_KEY must be an integer, got %q", devices)
+		}
+	}
+	if timeout := getenv("HARMONY_IDLE_TIMEOUT"); timeout != "" {
+		cfg.idleTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_IDLE_TIMEOUT must be a duration such as 60s, got %q", timeout)
+		}
+	}
+	if timeout := getenv("HARMONY_AUTH_TIMEOUT"); timeout != "" {
+		cfg.authTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_AUTH_TIMEOUT must be a duration such as 10s, got %q", timeout)
+		}
+	}
+	if rate := getenv("HARMONY_WS_RATE"); rate != "" {
+		cfg.wsRate, err = strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_WS_RATE must be a number, got %q", rate)
+		}
+	}
+	if burst := getenv("HARMONY_WS_BURST"); burst != "" {
+		cfg.wsBurst, err = strconv.Atoi(burst)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_WS_BURST must be an integer, got %q", burst)
+		}
+	}
+	if rate := getenv("HARMONY_MESSAGE_RATE"); rate != "" {
+		cfg.messageRate, err = strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_MESSAGE_RATE must be a number, got %q", rate)
+		}
+	}
+	if burst := getenv("HARMONY_MESSAGE_BURST"); burst != "" {
+		cfg.messageBurst, err = strconv.Atoi(burst)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_MESSAGE_BURST must be an integer, got %q", burst)
+		}
+	}
+	if header := getenv("HARMONY_TRUSTED_PROXY_HEADER"); header != "" {
+		cfg.trustedProxyHeader = header
+	}
+	if secret := getenv("HARMONY_ADMIN_SECRET"); secret != "" {
+		cfg.adminSecret = secret
+	}
+	if failures := getenv("HARMONY_MAX_WRITE_FAILURES"); failures != "" {
+		cfg.maxWriteFailures, err = strconv.Atoi(failures)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_MAX_WRITE_FAILURES must be an integer, got %q", failures)
+		}
+	}
+	if retries := getenv("HARMONY_CRITICAL_WRITE_RETRIES"); retries != "" {
+		cfg.criticalRetries, err = strconv.Atoi(retries)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_CRITICAL_WRITE_RETRIES must be an integer, got %q", retries)
+		}
+	}
+	if lifetime := getenv("HARMONY_MAX_TRANSACTION_LIFETIME"); lifetime != "" {
+		cfg.maxTxLifetime, err = time.ParseDuration(lifetime)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_MAX_TRANSACTION_LIFETIME must be a duration such as 5m, got %q", lifetime)
+		}
+	}
+	if grace := getenv("HARMONY_RESUME_GRACE"); grace != "" {
+		cfg.resumeGrace, err = time.ParseDuration(grace)
+		if err != nil {
+			return config{}, fmt.Errorf("HARMONY_RESUME_GRACE must be a duration such as 10s, got %q", grace)
+		}
+	}
+	allowedOrigins := getenv("HARMONY_ALLOWED_ORIGINS")
+	bannedKeys := getenv("HARMONY_BANNED_KEYS")
+	errorVerbosity := string(cfg.errorVerbosity)
+	if verbosity := getenv("HARMONY_ERROR_VERBOSITY"); verbosity != "" {
+		errorVerbosity = verbosity
+	}
+	keyAlgorithms := string(model.KeyAlgorithm_Ed25519)
+	if algorithms := getenv("HARMONY_KEY_ALGORITHMS"); algorithms != "" {
+		keyAlgorithms = algorithms
+	}
+
+	flags := flag.NewFlagSet("harmony", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&cfg.addr, "addr", cfg.addr, "address to listen on")
+	flags.IntVar(&cfg.readBufferSize, "read-buffer", cfg.readBufferSize, "websocket read buffer size in bytes")
+	flags.IntVar(&cfg.writeBufferSize, "write-buffer", cfg.writeBufferSize, "websocket write buffer size in bytes")
+	flags.IntVar(&cfg.maxMessageSize, "max-message-size", cfg.maxMessageSize, "largest message a client can send in bytes, not counting the transaction id")
+	flags.IntVar(&cfg.maxClients, "max-clients", cfg.maxClients, "devices that can be signed in at once, 0 for no limit")
+	flags.IntVar(&cfg.maxDevicesPerKey, "max-devices-per-key", cfg.maxDevicesPerKey, "devices that can be signed in with one public key at once, 0 for no limit")
+	flags.DurationVar(&cfg.idleTimeout, "idle-timeout", cfg.idleTimeout, "how long a client that has not come online and has no transactions can stay silent, 0 for no limit")
+	flags.DurationVar(&cfg.authTimeout, "auth-timeout", cfg.authTimeout, "how long a client signing in has to reply at each step")
+	flags.Float64Var(&cfg.wsRate, "ws-rate", cfg.wsRate, "websockets per second each IP address can open once its burst is used up, 0 for no limit")
+	flags.IntVar(&cfg.wsBurst, "ws-burst", cfg.wsBurst, "websockets each IP address can open at once")
+	flags.Float64Var(&cfg.messageRate, "message-rate", cfg.messageRate, "messages per second each client can send once its burst is used up, 0 for no limit")
+	flags.IntVar(&cfg.messageBurst, "message-burst", cfg.messageBurst, "messages each client can send at once")
+	flags.StringVar(&cfg.trustedProxyHeader, "trusted-proxy-header", cfg.trustedProxyHeader, "header that a proxy in front of the server puts the client's IP address in, such as X-Forwarded-For")
+	flags.StringVar(&cfg.adminSecret, "admin-secret", cfg.adminSecret, "bearer token for the /admin endpoints, which are disabled if it is empty")
+	flags.IntVar(&cfg.maxWriteFailures, "max-write-failures", cfg.maxWriteFailures, "writes to a client in a row that can fail before it is disconnected, 1 to disconnect on the first failure, 0 for never")
+	flags.IntVar(&cfg.criticalRetries, "critical-write-retries", cfg.criticalRetries, "times a message peers depend on is written again if writing it fails, before the client is disconnected, 0 to write them like any other")
+	flags.DurationVar(&cfg.maxTxLifetime, "max-transaction-lifetime", cfg.maxTxLifetime, "how long a transaction can last before it is cancelled, however active it is, 0 for no limit")
+	flags.DurationVar(&cfg.resumeGrace, "resume-grace", cfg.resumeGrace, "how long a client that drops has to reconnect and resume its transactions before its peers are told it has gone, 0 to tell them straight away")
+	flags.StringVar(&allowedOrigins, "allowed-origins", allowedOrigins, "comma separated origins that can open websockets, or * for any")
+	flags.StringVar(&bannedKeys, "banned-keys", bannedKeys, "comma separated base64 public keys that can't come online or be sent requests")
+	flags.StringVar(&keyAlgorithms, "key-algorithms", keyAlgorithms, "comma separated kinds of key clients can sign in with, ed25519 and/or p256")
+	flags.StringVar(&errorVerbosity, "error-verbosity", errorVerbosity, "production to tell clients only that their message is malformed, or debug to send them the schema errors")
+	err = flags.Parse(args)
+	if err != nil {
+		return config{}, err
+	}
+	cfg.allowedOrigins = splitList(allowedOrigins)
+	cfg.bannedKeys = splitList(bannedKeys)
+	cfg.errorVerbosity = model.ErrorVerbosity(errorVerbosity)
+	cfg.keyAlgorithms = []model.KeyAlgorithm{}
+	for _, algorithm := range splitList(keyAlgorithms) {
+		cfg.keyAlgorithms = append(cfg.keyAlgorithms, model.KeyAlgorithm(algorithm))
+	}
+
+	return cfg, cfg.validate()
+}
+
+// "a, b,,c" -> ["a" "b" "c"]
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (cfg config) validate() error {
+	_, port, err := net.SplitHostPort(cfg.addr)
+	if err != nil {
+		return fmt.Errorf("listen address %q must be in the form host:port", cfg.addr)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum < 0 || portNum > 65535 {
+		return fmt.Errorf("listen address %q has an invalid port", cfg.addr)
+	}
+	if cfg.readBufferSize <= 0 {
+		return errors.New("read buffer size must be positive")
+	}
+	if cfg.writeBufferSize <= 0 {
+		return errors.New("write buffer size must be positive")
+	}
+	if cfg.maxMessageSize <= 0 {
+		return errors.New("max message size must be positive")
+	}
+	if cfg.maxClients < 0 {
+		return errors.New("max clients must not be negative")
+	}
+	if cfg.maxDevicesPerKey < 0 {
+		return errors.New("max devices per key must not be negative")
+	}
+	if cfg.idleTimeout < 0 {
+		return errors.New("idle timeout must not be negative")
+	}
+	if cfg.authTimeout <= 0 {
+		return errors.New("auth timeout must be positive")
+	}
+	if cfg.wsRate < 0 || math.IsNaN(cfg.wsRate) || math.IsInf(cfg.wsRate, 0) {
+		return errors.New("websocket rate must be a non-negative number")
+	}
+	if cfg.wsBurst <= 0 {
+		return errors.New("websocket burst must be positive")
+	}
+	if cfg.messageRate < 0 || math.IsNaN(cfg.messageRate) || math.IsInf(cfg.messageRate, 0) {
+		return errors.New("message rate must be a non-negative number")
+	}
+	if cfg.messageBurst <= 0 {
+		return errors.New("message burst must be positive")
+	}
+	if cfg.maxWriteFailures < 0 {
+		return errors.New("max write failures must not be negative")
+	}
+	if cfg.criticalRetries < 0 {
+		return errors.New("critical write retries must not be negative")
+	}
+	if cfg.maxTxLifetime < 0 {
+		return errors.New("max transaction lifetime must not be negative")
+	}
+	if cfg.resumeGrace < 0 {
+		return errors.New("resume grace must not be negative")
+	}
+	for _, key := range cfg.bannedKeys {
+		if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+			return fmt.Errorf("banned key %q must be base64", key)
+		}
+	}
+	if len(cfg.keyAlgorithms) == 0 {
+		return errors.New("at least one key algorithm must be allowed")
+	}
+	for _, algorithm := range cfg.keyAlgorithms {
+		if algorithm != model.KeyAlgorithm_Ed25519 && algorithm != model.KeyAlgorithm_P256 {
+			return fmt.Errorf("key algorithm must be %s or %s, got %q", model.KeyAlgorithm_Ed25519, model.KeyAlgorithm_P256, algorithm)
+		}
+	}
+	if cfg.errorVerbosity != model.ErrorVerbosity_Production && cfg.errorVerbosity != model.ErrorVerbosity_Debug {
+		return fmt.Errorf("error verbosity must be %s or %s, got %q", model.ErrorVerbosity_Production, model.ErrorVerbosity_Debug, cfg.errorVerbosity)
+	}
+	return nil
+}
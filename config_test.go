@@ -0,0 +1,158 @@
+package main
+
+import (
+	"harmony/backend/model"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// getenv backed by a map
+func envFrom(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	t.Run("Uses the defaults when nothing is set", func(t *testing.T) {
+		cfg, err := loadConfig([]string{}, envFrom(nil))
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err.Error())
+		}
+		if !reflect.DeepEqual(cfg, defaultConfig()) {
+			t.Errorf("Expected %+v got %+v", defaultConfig(), cfg)
+		}
+		if cfg.addr != "0.0.0.0:8080" {
+			t.Errorf("Expected the default address to be 0.0.0.0:8080, got %s", cfg.addr)
+		}
+	})
+
+	t.Run("Reads environment variables", func(t *testing.T) {
+		cfg, err := loadConfig([]string{}, envFrom(map[string]string{
+			"HARMONY_ADDR":                     "127.0.0.1:9000",
+			"HARMONY_READ_BUFFER":              "2048",
+			"HARMONY_WRITE_BUFFER":             "4096",
+			"HARMONY_ALLOWED_ORIGINS":          "https://a.example, https://b.example",
+			"HARMONY_MAX_MESSAGE_SIZE":         "100",
+			"HARMONY_IDLE_TIMEOUT":             "2m",
+			"HARMONY_AUTH_TIMEOUT":             "5s",
+			"HARMONY_WS_RATE":                  "0.5",
+			"HARMONY_WS_BURST":                 "3",
+			"HARMONY_MESSAGE_RATE":             "4.5",
+			"HARMONY_MESSAGE_BURST":            "6",
+			"HARMONY_TRUSTED_PROXY_HEADER":     "X-Real-IP",
+			"HARMONY_ADMIN_SECRET":             "hunter2",
+			"HARMONY_MAX_WRITE_FAILURES":       "1",
+			"HARMONY_CRITICAL_WRITE_RETRIES":   "5",
+			"HARMONY_MAX_TRANSACTION_LIFETIME": "10m",
+			"HARMONY_RESUME_GRACE":             "30s",
+			"HARMONY_BANNED_KEYS":              "YWJj, ZGVm",
+			"HARMONY_MAX_CLIENTS":              "50",
+			"HARMONY_MAX_DEVICES_PER_KEY":      "2",
+			"HARMONY_ERROR_VERBOSITY":          "debug",
+			"HARMONY_KEY_ALGORITHMS":           "ed25519, p256",
+		}))
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err.Error())
+		}
+		expected := config{addr: "127.0.0.1:9000", readBufferSize: 2048, writeBufferSize: 4096, allowedOrigins: []string{"https://a.example", "https://b.example"}, maxMessageSize: 100, idleTimeout: 2 * time.Minute, authTimeout: 5 * time.Second, wsRate: 0.5, wsBurst: 3, messageRate: 4.5, messageBurst: 6, trustedProxyHeader: "X-Real-IP", adminSecret: "hunter2", maxWriteFailures: 1, criticalRetries: 5, maxTxLifetime: 10 * time.Minute, resumeGrace: 30 * time.Second, bannedKeys: []string{"YWJj", "ZGVm"}, errorVerbosity: model.ErrorVerbosity_Debug, maxClients: 50, maxDevicesPerKey: 2, keyAlgorithms: []model.KeyAlgorithm{model.KeyAlgorithm_Ed25519, model.KeyAlgorithm_P256}}
+		if !reflect.DeepEqual(cfg, expected) {
+			t.Errorf("Expected %+v got %+v", expected, cfg)
+		}
+	})
+
+	t.Run("Flags override environment variables", func(t *testing.T) {
+		cfg, err := loadConfig(
+			[]string{"-addr", ":7000", "-read-buffer", "512", "-allowed-origins", "*", "-max-message-size", "200", "-idle-timeout", "0", "-auth-timeout", "1m", "-ws-rate", "0", "-ws-burst", "1", "-message-rate", "0", "-message-burst", "1", "-trusted-proxy-header", "X-Forwarded-For", "-admin-secret", "s3cret", "-max-write-failures", "0", "-critical-write-retries", "0", "-max-transaction-lifetime", "0", "-resume-grace", "0", "-banned-keys", "", "-error-verbosity", "production", "-max-clients", "0", "-max-devices-per-key", "0", "-key-algorithms", "p256"},
+			envFrom(map[string]string{
+				"HARMONY_ADDR":                     "127.0.0.1:9000",
+				"HARMONY_READ_BUFFER":              "2048",
+				"HARMONY_ALLOWED_ORIGINS":          "https://a.example",
+				"HARMONY_MAX_MESSAGE_SIZE":         "100",
+				"HARMONY_IDLE_TIMEOUT":             "2m",
+				"HARMONY_AUTH_TIMEOUT":             "5s",
+				"HARMONY_WS_RATE":                  "0.5",
+				"HARMONY_WS_BURST":                 "3",
+				"HARMONY_MESSAGE_RATE":             "4.5",
+				"HARMONY_MESSAGE_BURST":            "6",
+				"HARMONY_TRUSTED_PROXY_HEADER":     "X-Real-IP",
+				"HARMONY_ADMIN_SECRET":             "hunter2",
+				"HARMONY_MAX_WRITE_FAILURES":       "1",
+				"HARMONY_CRITICAL_WRITE_RETRIES":   "5",
+				"HARMONY_MAX_TRANSACTION_LIFETIME": "10m",
+				"HARMONY_RESUME_GRACE":             "30s",
+				"HARMONY_BANNED_KEYS":              "YWJj",
+				"HARMONY_MAX_CLIENTS":              "50",
+				"HARMONY_MAX_DEVICES_PER_KEY":      "2",
+				"HARMONY_ERROR_VERBOSITY":          "debug",
+				"HARMONY_KEY_ALGORITHMS":           "ed25519",
+			}),
+		)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err.Error())
+		}
+		expected := config{addr: ":7000", readBufferSize: 512, writeBufferSize: 1024, allowedOrigins: []string{"*"}, maxMessageSize: 200, idleTimeout: 0, authTimeout: time.Minute, wsRate: 0, wsBurst: 1, messageRate: 0, messageBurst: 1, trustedProxyHeader: "X-Forwarded-For", adminSecret: "s3cret", maxWriteFailures: 0, criticalRetries: 0, maxTxLifetime: 0, resumeGrace: 0, bannedKeys: []string{}, errorVerbosity: model.ErrorVerbosity_Production, maxClients: 0, maxDevicesPerKey: 0, keyAlgorithms: []model.KeyAlgorithm{model.KeyAlgorithm_P256}}
+		if !reflect.DeepEqual(cfg, expected) {
+			t.Errorf("Expected %+v got %+v", expected, cfg)
+		}
+	})
+
+	t.Run("Rejects bad values", func(t *testing.T) {
+		tests := []struct {
+			description string
+			args        []string
+			env         map[string]string
+		}{
+			{"address without a port", []string{}, map[string]string{"HARMONY_ADDR": "localhost"}},
+			{"port out of range", []string{"-addr", "localhost:70000"}, nil},
+			{"port is not a number", []string{"-addr", "localhost:http"}, nil},
+			{"read buffer is not a number", []string{}, map[string]string{"HARMONY_READ_BUFFER": "big"}},
+			{"write buffer is not a number", []string{}, map[string]string{"HARMONY_WRITE_BUFFER": "1k"}},
+			{"read buffer is zero", []string{"-read-buffer", "0"}, nil},
+			{"write buffer is negative", []string{"-write-buffer", "-1"}, nil},
+			{"max message size is not a number", []string{}, map[string]string{"HARMONY_MAX_MESSAGE_SIZE": "lots"}},
+			{"max message size is zero", []string{"-max-message-size", "0"}, nil},
+			{"idle timeout has no unit", []string{}, map[string]string{"HARMONY_IDLE_TIMEOUT": "60"}},
+			{"idle timeout is negative", []string{"-idle-timeout", "-1s"}, nil},
+			{"auth timeout has no unit", []string{}, map[string]string{"HARMONY_AUTH_TIMEOUT": "10"}},
+			{"auth timeout is zero", []string{"-auth-timeout", "0"}, nil},
+			{"websocket rate is not a number", []string{}, map[string]string{"HARMONY_WS_RATE": "fast"}},
+			{"websocket rate is negative", []string{"-ws-rate", "-1"}, nil},
+			{"websocket rate is infinite", []string{"-ws-rate", "Inf"}, nil},
+			{"websocket burst is zero", []string{"-ws-burst", "0"}, nil},
+			{"message rate is not a number", []string{}, map[string]string{"HARMONY_MESSAGE_RATE": "fast"}},
+			{"message rate is negative", []string{"-message-rate", "-1"}, nil},
+			{"message rate is NaN", []string{"-message-rate", "NaN"}, nil},
+			{"message burst is not a number", []string{}, map[string]string{"HARMONY_MESSAGE_BURST": "lots"}},
+			{"message burst is zero", []string{"-message-burst", "0"}, nil},
+			{"max write failures is not a number", []string{}, map[string]string{"HARMONY_MAX_WRITE_FAILURES": "few"}},
+			{"max write failures is negative", []string{"-max-write-failures", "-1"}, nil},
+			{"critical write retries is not a number", []string{}, map[string]string{"HARMONY_CRITICAL_WRITE_RETRIES": "few"}},
+			{"critical write retries is negative", []string{"-critical-write-retries", "-1"}, nil},
+			{"max transaction lifetime has no unit", []string{}, map[string]string{"HARMONY_MAX_TRANSACTION_LIFETIME": "300"}},
+			{"max transaction lifetime is negative", []string{"-max-transaction-lifetime", "-1m"}, nil},
+			{"resume grace has no unit", []string{}, map[string]string{"HARMONY_RESUME_GRACE": "10"}},
+			{"resume grace is negative", []string{"-resume-grace", "-1s"}, nil},
+			{"banned key is not base64", []string{"-banned-keys", "YWJj,not base64!"}, nil},
+			{"max clients is not an integer", []string{}, map[string]string{"HARMONY_MAX_CLIENTS": "lots"}},
+			{"max clients is negative", []string{"-max-clients", "-1"}, nil},
+			{"max devices per key is not an integer", []string{}, map[string]string{"HARMONY_MAX_DEVICES_PER_KEY": "few"}},
+			{"max devices per key is negative", []string{"-max-devices-per-key", "-1"}, nil},
+			{"unknown key algorithm", []string{"-key-algorithms", "ed25519,rsa"}, nil},
+			{"no key algorithms", []string{"-key-algorithms", ","}, nil},
+			{"unknown error verbosity", []string{}, map[string]string{"HARMONY_ERROR_VERBOSITY": "verbose"}},
+			{"unknown flag", []string{"-verbose"}, nil},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				_, err := loadConfig(tt.args, envFrom(tt.env))
+				if err == nil {
+					t.Errorf("Expected an error")
+				}
+			})
+		}
+	})
+}
@@ -5,7 +5,6 @@ go 1.22.5
 require (
 	github.com/gin-gonic/gin v1.10.0
 	github.com/gorilla/websocket v1.5.3
-	golang.org/x/exp v0.0.0-20240823005443-9b4947da3948
 )
 
 require (
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/subtle"
+	"harmony/backend/model"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// page size of /admin/clients when none is given
+const defaultAdminPageSize = 100
+
+// largest page size of /admin/clients
+const maxAdminPageSize = 1000
+
+// middleware that only lets through requests with the header `Authorization: Bearer <secret>`.
+func makeRequireAdmin(secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// GET /admin/clients?offset=0&limit=100
+//
+// Responds with a page of the public keys that are online, sorted, and how many there are in total:
+// `{"keys":["...", ...],"total":123}`
+func makeHandleListClients(hub *model.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.String(http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAdminPageSize)))
+		if err != nil || limit < 1 || limit > maxAdminPageSize {
+			c.String(http.StatusBadRequest, "limit must be an integer from 1 to %d", maxAdminPageSize)
+			return
+		}
+
+		keys, total := hub.ListClients(offset, limit)
+		c.JSON(http.StatusOK, struct {
+			Keys  []model.PublicKey `json:"keys"`
+			Total int               `json:"total"`
+		}{keys, total})
+	}
+}
+
+// POST /admin/disconnect with the body `{"publicKey":"..."}`
+//
+// Disconnects every device signed in with the public key, as if each had disconnected itself, so their peers are told.
+// Responds with 404 if the key isn't online.
+func makeHandleDisconnectClient(hub *model.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pk, ok := bindPublicKey(c)
+		if !ok {
+			return
+		}
+
+		clients := hub.GetClients(pk)
+		if len(clients) == 0 {
+			c.String(http.StatusNotFound, "public key is not online")
+			return
+		}
+		for _, client := range clients {
+			client.Disconnect(model.DisconnectReason_Admin, `{"terminate":"disconnectedByAdmin"}`)
+		}
+		logger.Info("Public key disconnected by admin", "publicKey", string(pk), "devices", len(clients))
+		c.Status(http.StatusOK)
+	}
+}
+
+// GET /admin/transactions?publicKey=...
+//
+// Responds with the open transactions of every device signed in with the public key, for diagnosing stuck clients:
+// `{"devices":[{"transactions":[{"id":"...","ageSeconds":1.5,"routine":"comeOnline"}, ...]}, ...]}`
+// Responds with 404 if the key isn't online.
+func makeHandleListTransactions(hub *model.Hub) gin.HandlerFunc {
+	type transactionJSON struct {
+		Id         string  `json:"id"`
+		AgeSeconds float64 `json:"ageSeconds"`
+		Routine    string  `json:"routine"`
+	}
+	type deviceJSON struct {
+		Transactions []transactionJSON `json:"transactions"`
+	}
+
+	return func(c *gin.Context) {
+		pk := model.PublicKey(c.Query("publicKey"))
+		if pk == "" {
+			c.String(http.StatusBadRequest, "publicKey is required")
+			return
+		}
+
+		clients := hub.GetClients(pk)
+		if len(clients) == 0 {
+			c.String(http.StatusNotFound, "public key is not online")
+			return
+		}
+		devices := make([]deviceJSON, len(clients))
+		for i, client := range clients {
+			devices[i].Transactions = []transactionJSON{}
+			for _, info := range client.DescribeTransactions() {
+				devices[i].Transactions = append(devices[i].Transactions, transactionJSON{
+					Id:         string(info.Id[:]),
+					AgeSeconds: info.Age.Seconds(),
+					Routine:    info.Routine,
+				})
+			}
+		}
+		c.JSON(http.StatusOK, struct {
+			Devices []deviceJSON `json:"devices"`
+		}{devices})
+	}
+}
+
+// GET /admin/banned
+//
+// Responds with every banned public key, sorted: `{"keys":["...", ...]}`
+func makeHandleListBanned(hub *model.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, struct {
+			Keys []model.PublicKey `json:"keys"`
+		}{hub.Blocklist().Keys()})
+	}
+}
+
+// POST /admin/ban with the body `{"publicKey":"..."}`
+//
+// Stops the public key from coming online, and from being sent requests. Devices already signed in with it stay connected,
+// use /admin/disconnect to end their sessions.
+func makeHandleBan(hub *model.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pk, ok := bindPublicKey(c)
+		if !ok {
+			return
+		}
+		if hub.Blocklist().Add(pk) {
+			logger.Info("Public key banned by admin", "publicKey", string(pk))
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// POST /admin/unban with the body `{"publicKey":"..."}`
+//
+// Lifts the ban on the public key. Responds with 404 if it isn't banned.
+func makeHandleUnban(hub *model.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pk, ok := bindPublicKey(c)
+		if !ok {
+			return
+		}
+		if !hub.Blocklist().Remove(pk) {
+			c.String(http.StatusNotFound, "public key is not banned")
+			return
+		}
+		logger.Info("Public key unbanned by admin", "publicKey", string(pk))
+		c.Status(http.StatusOK)
+	}
+}
+
+// read a body of `{"publicKey":"..."}`. Responds with 400 and returns false if the body is anything else.
+func bindPublicKey(c *gin.Context) (model.PublicKey, bool) {
+	body := struct {
+		PublicKey model.PublicKey `json:"publicKey"`
+	}{}
+	if err := c.ShouldBindJSON(&body); err != nil || body.PublicKey == "" {
+		c.String(http.StatusBadRequest, "body must be a JSON object with a publicKey")
+		return "", false
+	}
+	return body.PublicKey, true
+}
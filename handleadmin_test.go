@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"harmony/backend/model"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func TestListClients(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	hub := model.NewHub()
+	for _, key := range []model.PublicKey{"b", "a", "c"} {
+		hub.AddClient(key, &model.Client{})
+	}
+
+	router := gin.New()
+	router.GET("/admin/clients", makeRequireAdmin("secret"), makeHandleListClients(hub))
+
+	get := func(url string, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Requires the secret", func(t *testing.T) {
+		for _, authorization := range []string{"", "Bearer wrong", "secret", "Bearer secret2", "Basic secret"} {
+			if code := get("/admin/clients", authorization).Code; code != http.StatusUnauthorized {
+				t.Errorf("Authorization %q: expected %d got %d", authorization, http.StatusUnauthorized, code)
+			}
+		}
+	})
+
+	t.Run("Lists pages of keys", func(t *testing.T) {
+		tests := []struct {
+			url      string
+			expected []model.PublicKey
+		}{
+			{"/admin/clients", []model.PublicKey{"a", "b", "c"}},
+			{"/admin/clients?limit=2", []model.PublicKey{"a", "b"}},
+			{"/admin/clients?offset=2&limit=2", []model.PublicKey{"c"}},
+			{"/admin/clients?offset=3", []model.PublicKey{}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.url, func(t *testing.T) {
+				w := get(tt.url, "Bearer secret")
+				if w.Code != http.StatusOK {
+					t.Fatalf("Expected %d got %d", http.StatusOK, w.Code)
+				}
+				body := struct {
+					Keys  []model.PublicKey `json:"keys"`
+					Total int               `json:"total"`
+				}{}
+				err := json.Unmarshal(w.Body.Bytes(), &body)
+				if err != nil {
+					t.Fatalf("Expected a JSON body, got %s", w.Body.String())
+				}
+				if !slices.Equal(body.Keys, tt.expected) || body.Total != 3 {
+					t.Errorf("Expected keys %v and total 3, got %s", tt.expected, w.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("Rejects bad parameters", func(t *testing.T) {
+		for _, url := range []string{"/admin/clients?offset=-1", "/admin/clients?offset=x", "/admin/clients?limit=0", "/admin/clients?limit=1001"} {
+			if code := get(url, "Bearer secret").Code; code != http.StatusBadRequest {
+				t.Errorf("%s: expected %d got %d", url, http.StatusBadRequest, code)
+			}
+		}
+	})
+}
+
+// connection that records what is written to it. Reads block until it is closed.
+type adminTestConn struct {
+	lock       sync.Mutex
+	written    []string
+	closeCodes []int
+	closed     bool
+	done       chan struct{}
+}
+
+func newAdminTestConn() *adminTestConn {
+	return &adminTestConn{done: make(chan struct{})}
+}
+
+func (c *adminTestConn) ReadMessage() (int, []byte, error) {
+	<-c.done
+	return 0, nil, errors.New("connection closed")
+}
+func (c *adminTestConn) WriteMessage(messageType int, data []byte) error {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	c.written = append(c.written, string(data))
+	return nil
+}
+func (c *adminTestConn) Close() error {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+func (c *adminTestConn) SetReadLimit(limit int64)           {}
+func (c *adminTestConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *adminTestConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *adminTestConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	if messageType == websocket.CloseMessage && len(data) >= 2 {
+		c.closeCodes = append(c.closeCodes, int(data[0])<<8|int(data[1]))
+	}
+	return nil
+}
+
+func TestDisconnectClient(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	hub := model.NewHub()
+	// "a" is signed in on two devices
+	conns := []*adminTestConn{newAdminTestConn(), newAdminTestConn()}
+	for _, conn := range conns {
+		client := model.MakeClient(conn)
+		hub.AddClient("a", &client)
+	}
+
+	router := gin.New()
+	router.POST("/admin/disconnect", makeRequireAdmin("secret"), makeHandleDisconnectClient(hub))
+
+	post := func(body string, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/admin/disconnect", strings.NewReader(body))
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Requires the secret", func(t *testing.T) {
+		if code := post(`{"publicKey":"a"}`, "Bearer wrong").Code; code != http.StatusUnauthorized {
+			t.Errorf("Expected %d got %d", http.StatusUnauthorized, code)
+		}
+		for _, conn := range conns {
+			if conn.closed {
+				t.Errorf("Expected the client to stay connected")
+			}
+		}
+	})
+
+	t.Run("Rejects bad bodies", func(t *testing.T) {
+		for _, body := range []string{"", "a", `{}`, `{"publicKey":""}`, `{"publicKey":1}`} {
+			if code := post(body, "Bearer secret").Code; code != http.StatusBadRequest {
+				t.Errorf("%q: expected %d got %d", body, http.StatusBadRequest, code)
+			}
+		}
+	})
+
+	t.Run("Not found if the key isn't online", func(t *testing.T) {
+		if code := post(`{"publicKey":"b"}`, "Bearer secret").Code; code != http.StatusNotFound {
+			t.Errorf("Expected %d got %d", http.StatusNotFound, code)
+		}
+	})
+
+	t.Run("Disconnects every device of the key", func(t *testing.T) {
+		if code := post(`{"publicKey":"a"}`, "Bearer secret").Code; code != http.StatusOK {
+			t.Fatalf("Expected %d got %d", http.StatusOK, code)
+		}
+		expected := string(model.CONTROL_ID[:]) + `{"terminate":"disconnectedByAdmin"}`
+		for i, conn := range conns {
+			conn.lock.Lock()
+			if !slices.Equal(conn.written, []string{expected}) {
+				t.Errorf("Device %d: expected %s to be written. Got %v", i, expected, conn.written)
+			}
+			if !slices.Equal(conn.closeCodes, []int{websocket.ClosePolicyViolation}) || !conn.closed {
+				t.Errorf("Device %d: expected a close frame and the connection closed. Got codes %v, closed %v", i, conn.closeCodes, conn.closed)
+			}
+			conn.lock.Unlock()
+		}
+	})
+}
+
+func TestListTransactions(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	hub := model.NewHub()
+	// "a" is signed in on two devices, neither with transactions open
+	for range 2 {
+		client := model.MakeClient(newAdminTestConn())
+		hub.AddClient("a", &client)
+	}
+
+	router := gin.New()
+	router.GET("/admin/transactions", makeRequireAdmin("secret"), makeHandleListTransactions(hub))
+
+	get := func(url string, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Requires the secret", func(t *testing.T) {
+		if code := get("/admin/transactions?publicKey=a", "Bearer wrong").Code; code != http.StatusUnauthorized {
+			t.Errorf("Expected %d got %d", http.StatusUnauthorized, code)
+		}
+	})
+
+	t.Run("Requires a public key", func(t *testing.T) {
+		if code := get("/admin/transactions", "Bearer secret").Code; code != http.StatusBadRequest {
+			t.Errorf("Expected %d got %d", http.StatusBadRequest, code)
+		}
+	})
+
+	t.Run("Not found if the key isn't online", func(t *testing.T) {
+		if code := get("/admin/transactions?publicKey=b", "Bearer secret").Code; code != http.StatusNotFound {
+			t.Errorf("Expected %d got %d", http.StatusNotFound, code)
+		}
+	})
+
+	t.Run("Lists every device", func(t *testing.T) {
+		w := get("/admin/transactions?publicKey=a", "Bearer secret")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected %d got %d", http.StatusOK, w.Code)
+		}
+		expected := `{"devices":[{"transactions":[]},{"transactions":[]}]}`
+		if w.Body.String() != expected {
+			t.Errorf("Expected %s got %s", expected, w.Body.String())
+		}
+	})
+}
+
+func TestBlocklist(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	hub := model.NewHub()
+	hub.Blocklist().Add("b")
+
+	router := gin.New()
+	admin := router.Group("/admin", makeRequireAdmin("secret"))
+	admin.GET("/banned", makeHandleListBanned(hub))
+	admin.POST("/ban", makeHandleBan(hub))
+	admin.POST("/unban", makeHandleUnban(hub))
+
+	request := func(method string, url string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	expectBanned := func(t *testing.T, expected []model.PublicKey) {
+		t.Helper()
+		w := request(http.MethodGet, "/admin/banned", "")
+		body := struct {
+			Keys []model.PublicKey `json:"keys"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected %d and a JSON body, got %d %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if !slices.Equal(body.Keys, expected) {
+			t.Errorf("Expected %v banned. Got %v", expected, body.Keys)
+		}
+	}
+
+	expectBanned(t, []model.PublicKey{"b"})
+
+	for _, key := range []string{"a", "a", "c"} {
+		if code := request(http.MethodPost, "/admin/ban", `{"publicKey":"`+key+`"}`).Code; code != http.StatusOK {
+			t.Errorf("Ban %s: expected %d got %d", key, http.StatusOK, code)
+		}
+	}
+	expectBanned(t, []model.PublicKey{"a", "b", "c"})
+	if !hub.Blocklist().Contains("a") {
+		t.Errorf("Expected the hub's blocklist to be updated")
+	}
+
+	if code := request(http.MethodPost, "/admin/unban", `{"publicKey":"b"}`).Code; code != http.StatusOK {
+		t.Errorf("Expected %d got %d", http.StatusOK, code)
+	}
+	if code := request(http.MethodPost, "/admin/unban", `{"publicKey":"b"}`).Code; code != http.StatusNotFound {
+		t.Errorf("Unbanning a key that isn't banned: expected %d got %d", http.StatusNotFound, code)
+	}
+	if code := request(http.MethodPost, "/admin/ban", `{}`).Code; code != http.StatusBadRequest {
+		t.Errorf("Expected %d got %d", http.StatusBadRequest, code)
+	}
+	expectBanned(t, []model.PublicKey{"a", "c"})
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"harmony/backend/model"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// set once the server is listening for websocket connections, cleared when it starts shutting down
+var acceptingConnections atomic.Bool
+
+// liveness probe: the process is up and serving HTTP.
+func handleLive(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+// readiness probe: 200 while the server is accepting websockets,
+// 503 before it starts listening and once the hub starts shutting down.
+func makeHandleReady(hub *model.Hub, accepting *atomic.Bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !accepting.Load() || hub.IsShuttingDown() {
+			c.String(http.StatusServiceUnavailable, "not ready")
+			return
+		}
+		c.String(http.StatusOK, "ok")
+	}
+}
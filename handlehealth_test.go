@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"harmony/backend/model"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHealth(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	get := func(handler gin.HandlerFunc) int {
+		router := gin.New()
+		router.GET("/probe", handler)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/probe", nil))
+		return w.Code
+	}
+
+	t.Run("Live", func(t *testing.T) {
+		if code := get(handleLive); code != http.StatusOK {
+			t.Errorf("Expected %d got %d", http.StatusOK, code)
+		}
+	})
+
+	t.Run("Ready", func(t *testing.T) {
+		tests := []struct {
+			description  string
+			accepting    bool
+			shutdown     bool
+			expectedCode int
+		}{
+			{"accepting connections", true, false, http.StatusOK},
+			{"not listening yet", false, false, http.StatusServiceUnavailable},
+			{"hub shutting down", true, true, http.StatusServiceUnavailable},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				hub := model.NewHub()
+				if tt.shutdown {
+					hub.Shutdown(context.Background())
+				}
+				var accepting atomic.Bool
+				accepting.Store(tt.accepting)
+
+				if code := get(makeHandleReady(hub, &accepting)); code != tt.expectedCode {
+					t.Errorf("Expected %d got %d", tt.expectedCode, code)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"harmony/backend/model"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// counters incremented by routines, reported by handleMetrics
+var metrics = model.NewCounters()
+
+// Prometheus text exposition format.
+//
+// Metrics:
+//   - harmony_connected_clients (gauge): clients that have come online and are in the hub
+//   - harmony_active_transactions (gauge): transactions currently open, counted by the client that initiated them
+//   - harmony_come_online_completed_total (counter): comeOnline routines that signed a client in
+//   - harmony_connection_handshakes_total (counter): establishConnectionToPeer routines that finished exchanging ICE candidates
+//   - harmony_connections_established_total (counter): establishConnectionToPeer routines where both peers confirmed their connection opened
+//   - harmony_transactions_ended_total (counter): transaction sockets ended by routines, labelled by routine and reason
+//   - harmony_routine_next_seconds (histogram): how long routines take to handle each input, labelled by routine and state
+//   - harmony_connection_state_seconds (histogram): how long establishConnectionToPeer spends in each state, labelled by state
+//   - harmony_connection_handshake_seconds (histogram): how long establishConnectionToPeer takes from start to finish
+func handleMetrics(c *gin.Context) {
+
+	var sb strings.Builder
+
+	writeMetric := func(name string, metricType string, help string, value uint64) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", name, metricType)
+		fmt.Fprintf(&sb, "%s %d\n", name, value)
+	}
+
+	writeMetric("harmony_connected_clients", "gauge", "Clients that have come online.", uint64(hub.ClientCount()))
+	writeMetric("harmony_active_transactions", "gauge", "Transactions currently open.", uint64(hub.ActiveTransactionCount()))
+	writeMetric(model.METRIC_COME_ONLINE_COMPLETED, "counter", "Clients signed in by comeOnline.", metrics.Get(model.METRIC_COME_ONLINE_COMPLETED))
+	writeMetric(model.METRIC_CONNECTION_HANDSHAKES, "counter", "Completed connection request handshakes.", metrics.Get(model.METRIC_CONNECTION_HANDSHAKES))
+	writeMetric(model.METRIC_CONNECTIONS_ESTABLISHED, "counter", "Connection requests confirmed by both peers.", metrics.Get(model.METRIC_CONNECTIONS_ESTABLISHED))
+
+	// sorted, so that the output doesn't change order from one scrape to the next
+	sortLabels := func(labelSets []model.MetricLabels) {
+		slices.SortFunc(labelSets, func(a, b model.MetricLabels) int {
+			return strings.Compare(a.Routine+"\x00"+a.State+"\x00"+a.Reason, b.Routine+"\x00"+b.State+"\x00"+b.Reason)
+		})
+	}
+
+	writeLabelledCounter := func(name string, help string) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&sb, "# TYPE %s counter\n", name)
+		counts := metrics.GetAllLabelled(name)
+		labelSets := make([]model.MetricLabels, 0, len(counts))
+		for labels := range counts {
+			labelSets = append(labelSets, labels)
+		}
+		sortLabels(labelSets)
+		for _, labels := range labelSets {
+			fmt.Fprintf(&sb, "%s%s %d\n", name, formatLabels(labels, ""), counts[labels])
+		}
+	}
+
+	writeLabelledCounter(model.METRIC_TRANSACTIONS_ENDED, "Transaction sockets ended by routines.")
+
+	writeHistogram := func(name string, help string) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&sb, "# TYPE %s histogram\n", name)
+		histograms := metrics.GetHistograms(name)
+		labelSets := make([]model.MetricLabels, 0, len(histograms))
+		for labels := range histograms {
+			labelSets = append(labelSets, labels)
+		}
+		sortLabels(labelSets)
+		for _, labels := range labelSets {
+			h := histograms[labels]
+			for i, bound := range model.HISTOGRAM_BUCKETS {
+				fmt.Fprintf(&sb, "%s_bucket%s %d\n", name, formatLabels(labels, fmt.Sprintf("%g", bound.Seconds())), h.Buckets[i])
+			}
+			fmt.Fprintf(&sb, "%s_bucket%s %d\n", name, formatLabels(labels, "+Inf"), h.Count)
+			fmt.Fprintf(&sb, "%s_sum%s %g\n", name, formatLabels(labels, ""), h.Sum.Seconds())
+			fmt.Fprintf(&sb, "%s_count%s %d\n", name, formatLabels(labels, ""), h.Count)
+		}
+	}
+
+	writeHistogram(model.METRIC_ROUTINE_NEXT_SECONDS, "Time taken by routines to handle an input.")
+	writeHistogram(model.METRIC_CONNECTION_STATE_SECONDS, "Time spent by connection requests in each state.")
+	writeHistogram(model.METRIC_CONNECTION_HANDSHAKE_SECONDS, "Time taken by connection requests to finish exchanging ICE candidates.")
+
+	c.Data(200, "text/plain; version=0.0.4", []byte(sb.String()))
+}
+
+// labels in the Prometheus text format, e.g. {routine="comeOnline",state="hello",le="0.001"}. Empty ones are left out.
+func formatLabels(labels model.MetricLabels, le string) string {
+	var pairs []string
+	if labels.Routine != "" {
+		pairs = append(pairs, fmt.Sprintf("routine=%q", labels.Routine))
+	}
+	if labels.State != "" {
+		pairs = append(pairs, fmt.Sprintf("state=%q", labels.State))
+	}
+	if labels.Reason != "" {
+		pairs = append(pairs, fmt.Sprintf("reason=%q", labels.Reason))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
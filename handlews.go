@@ -1,12 +1,17 @@
 package main
 
 import (
+	"errors"
 	"harmony/backend/model"
 	"harmony/backend/routines"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
+// websocket subprotocol that asks for model.Framing_Envelope. Clients that can't set subprotocols can add ?framing=envelope instead.
+const envelopeSubprotocol = "harmony.envelope"
+
 func handleWs(c *gin.Context) {
 	// upgrade to websocket protocol
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
@@ -16,28 +21,50 @@ func handleWs(c *gin.Context) {
 	// defer means it executes after the function returns.
 	defer conn.Close()
 
-	createAndRouteClient(conn)
+	createAndRouteClient(conn, negotiateFraming(c.Request, conn.Subprotocol()), negotiateServerAssignedIds(c.Request))
+
+}
+
+// the framing the client asked for when it connected. subprotocol is the one agreed in the upgrade, "" if none.
+func negotiateFraming(r *http.Request, subprotocol string) model.Framing {
+	if subprotocol == envelopeSubprotocol || r.URL.Query().Get("framing") == "envelope" {
+		return model.Framing_Envelope
+	}
+	return model.Framing_Prefix
+}
 
+// whether the client asked, with ?ids=server, for the server to pick the ids of the transactions it starts.
+func negotiateServerAssignedIds(r *http.Request) bool {
+	return r.URL.Query().Get("ids") == "server"
 }
 
-func createAndRouteClient(conn model.Conn) {
+func createAndRouteClient(conn model.Conn, framing model.Framing, serverAssignedIds bool) {
 
-	client := model.MakeClient(conn)
+	options := clientOptions
+	options.Framing = framing
+	options.ServerAssignedIds = serverAssignedIds
+	client := model.MakeClient(conn, options)
 
 	// delete client when done (closed connection)
-	defer func() {
-		pk := client.GetPublicKey()
-		if pk != nil {
-			// client was added to the hub
-			err := hub.DeleteClient(*pk)
-			if err != nil {
-				panic(err)
-			}
-		}
-	}()
-
-	client.Route(hub, func() model.Routine {
+	defer removeFromHub(hub, &client)
+
+	client.Route(clientsCtx, hub, func() model.Routine {
 		return routines.NewMasterRoutine(&client, hub)
 	})
 
 }
+
+// Remove a disconnected client from the hub if it signed in. Safe to call more than once, since takeover,
+// forced disconnects and shutdown may have already removed it.
+func removeFromHub(h *model.Hub, client *model.Client) {
+	pk := client.GetPublicKey()
+	if pk == nil {
+		return
+	}
+	err := h.DeleteClient(*pk, client)
+	if errors.Is(err, model.ErrClientNotFound) {
+		logger.Debug("Client already removed from the hub", "publicKey", string(*pk))
+	} else if err != nil {
+		logger.Error("Failed to remove client from the hub", "publicKey", string(*pk), "error", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"harmony/backend/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFraming(t *testing.T) {
+	tests := []struct {
+		description string
+		url         string
+		subprotocol string
+		expected    model.Framing
+	}{
+		{"nothing asked for", "/ws", "", model.Framing_Prefix},
+		{"subprotocol", "/ws", envelopeSubprotocol, model.Framing_Envelope},
+		{"query parameter", "/ws?framing=envelope", "", model.Framing_Envelope},
+		{"unknown query parameter value", "/ws?framing=xml", "", model.Framing_Prefix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			framing := negotiateFraming(httptest.NewRequest(http.MethodGet, tt.url, nil), tt.subprotocol)
+			if framing != tt.expected {
+				t.Errorf("Expected %v got %v", tt.expected, framing)
+			}
+		})
+	}
+}
+
+func TestNegotiateServerAssignedIds(t *testing.T) {
+	tests := []struct {
+		description string
+		url         string
+		expected    bool
+	}{
+		{"nothing asked for", "/ws", false},
+		{"query parameter", "/ws?ids=server", true},
+		{"alongside envelope framing", "/ws?framing=envelope&ids=server", true},
+		{"client-chosen ids", "/ws?ids=client", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			assigned := negotiateServerAssignedIds(httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if assigned != tt.expected {
+				t.Errorf("Expected %t got %t", tt.expected, assigned)
+			}
+		})
+	}
+}
+
+func TestRemoveFromHub(t *testing.T) {
+
+	t.Run("Removing the same client twice doesn't panic", func(t *testing.T) {
+		hub := model.NewHub()
+		pk := model.PublicKey("a")
+		client := &model.Client{}
+		client.SetPublicKey(&pk)
+		hub.AddClient(pk, client)
+
+		removeFromHub(hub, client)
+		if _, online := hub.GetClient(pk); online {
+			t.Fatalf("Expected the client to be removed")
+		}
+		// e.g. it was already removed by a takeover before its connection closed
+		removeFromHub(hub, client)
+	})
+
+	t.Run("Leaves other devices with the key", func(t *testing.T) {
+		hub := model.NewHub()
+		pk := model.PublicKey("a")
+		client := &model.Client{}
+		client.SetPublicKey(&pk)
+		other := &model.Client{}
+		other.SetPublicKey(&pk)
+		hub.AddClient(pk, client)
+		hub.AddClient(pk, other)
+
+		removeFromHub(hub, client)
+		removeFromHub(hub, client)
+
+		if devices := hub.GetClients(pk); len(devices) != 1 || devices[0] != other {
+			t.Errorf("Expected only the other device to be signed in. Got %v", devices)
+		}
+	})
+
+	t.Run("Clients that never signed in are ignored", func(t *testing.T) {
+		removeFromHub(model.NewHub(), &model.Client{})
+	})
+}
@@ -4,7 +4,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	// "time"
 
@@ -18,18 +26,27 @@ import (
 // endpoints
 // get test
 func getTest(c *gin.Context) {
-	fmt.Println("Recieved GET /test")
+	logger.Info("Recieved GET /test")
 }
 
 // used to upgrade HTTP protocol to websocket protocol
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
+// buffer sizes and origin checking are set from the config in main
+var upgrader = websocket.Upgrader{Subprotocols: []string{envelopeSubprotocol}}
 
 // pointers to online clients stored in here
 var hub = model.NewHub()
 
+var logger = model.DefaultLogger()
+
+// options for every client. Set from the config in main
+var clientOptions = model.DefaultClientOptions()
+
+// how long to wait for clients to disconnect when shutting down
+const shutdownTimeout = 10 * time.Second
+
+// every client routes with this context. Cancelled when shutting down, after the clients have had shutdownTimeout to leave.
+var clientsCtx, cancelClients = context.WithCancel(context.Background())
+
 func main() {
 
 	// // set up profiling
@@ -48,13 +65,58 @@ func main() {
 	// 	pprof.StopCPUProfile()
 	// }()
 
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+	upgrader.ReadBufferSize = cfg.readBufferSize
+	upgrader.WriteBufferSize = cfg.writeBufferSize
+	upgrader.CheckOrigin = makeCheckOrigin(cfg.allowedOrigins)
+	clientOptions.MaxMessageSize = cfg.maxMessageSize
+	clientOptions.IdleTimeout = cfg.idleTimeout
+	clientOptions.MessageRate = cfg.messageRate
+	clientOptions.MessageBurst = cfg.messageBurst
+	clientOptions.MaxWriteFailures = cfg.maxWriteFailures
+	clientOptions.CriticalWriteRetries = cfg.criticalRetries
+	clientOptions.MaxTransactionLifetime = cfg.maxTxLifetime
+	clientOptions.ResumeGrace = cfg.resumeGrace
+
+	hub.SetMetrics(metrics)
+	hub.SetErrorVerbosity(cfg.errorVerbosity)
+	hub.SetMaxClients(cfg.maxClients)
+	hub.SetMaxDevicesPerKey(cfg.maxDevicesPerKey)
+	hub.SetAuthTimeout(cfg.authTimeout)
+	hub.SetKeyAlgorithms(cfg.keyAlgorithms)
+	for _, key := range cfg.bannedKeys {
+		hub.Blocklist().Add(model.PublicKey(key))
+	}
+
 	router := gin.Default()
 
+	wsLimiter := newIPRateLimiter(cfg.wsRate, cfg.wsBurst, model.RealClock{})
+	go wsLimiter.collectGarbageEvery(rateLimiterGCInterval)
+
 	// Main entry point
-	router.GET("/ws", handleWs)
+	router.GET("/ws", makeRateLimit(wsLimiter, cfg.trustedProxyHeader), handleWs)
 
 	router.GET("/test", getTest)
 
+	router.GET("/metrics", handleMetrics)
+
+	if cfg.adminSecret != "" {
+		admin := router.Group("/admin", makeRequireAdmin(cfg.adminSecret))
+		admin.GET("/clients", makeHandleListClients(hub))
+		admin.POST("/disconnect", makeHandleDisconnectClient(hub))
+		admin.GET("/transactions", makeHandleListTransactions(hub))
+		admin.GET("/banned", makeHandleListBanned(hub))
+		admin.POST("/ban", makeHandleBan(hub))
+		admin.POST("/unban", makeHandleUnban(hub))
+	}
+
+	router.GET("/healthz/live", handleLive)
+	router.GET("/healthz/ready", makeHandleReady(hub, &acceptingConnections))
+
 	router.GET("/chatDemo", func(ctx *gin.Context) {
 		conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
 		if err != nil {
@@ -62,11 +124,44 @@ func main() {
 		}
 		defer conn.Close()
 
-		client := model.MakeClient(conn)
-		client.Route(hub, func() model.Routine {
+		client := model.MakeClient(conn, clientOptions)
+		client.Route(clientsCtx, hub, func() model.Routine {
 			return routines.NewChatRoutineDemo(&client, hub)
 		})
 	})
 
-	router.Run("0.0.0.0:8080")
+	srv := &http.Server{
+		Addr:    cfg.addr,
+		Handler: router,
+	}
+
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		panic(err)
+	}
+	acceptingConnections.Store(true)
+
+	go func() {
+		err := srv.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// drain on SIGINT/SIGTERM: stop accepting connections, then tell connected clients to go elsewhere.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	logger.Info("Shutting down")
+	acceptingConnections.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	srv.Shutdown(ctx)
+	err = hub.Shutdown(ctx)
+	if err != nil {
+		logger.Warn("Not all clients disconnected before the shutdown timeout", "error", err)
+	}
+	// tear down whatever is left
+	cancelClients()
 }
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"slices"
+	"sync"
+)
+
+// Public keys that are banned from coming online, and that nobody can send requests to.
+// Threadsafe.
+type Blocklist struct {
+	keys map[PublicKey]struct{}
+	lock sync.Mutex
+}
+
+func NewBlocklist(keys ...PublicKey) *Blocklist {
+	b := &Blocklist{keys: make(map[PublicKey]struct{}, len(keys))}
+	for _, key := range keys {
+		b.keys[key] = struct{}{}
+	}
+	return b
+}
+
+// Ban key. Returns false if it was already banned.
+func (b *Blocklist) Add(key PublicKey) bool {
+	defer b.lock.Unlock()
+	b.lock.Lock()
+	if _, banned := b.keys[key]; banned {
+		return false
+	}
+	b.keys[key] = struct{}{}
+	return true
+}
+
+// Lift the ban on key. Returns false if it wasn't banned.
+func (b *Blocklist) Remove(key PublicKey) bool {
+	defer b.lock.Unlock()
+	b.lock.Lock()
+	if _, banned := b.keys[key]; !banned {
+		return false
+	}
+	delete(b.keys, key)
+	return true
+}
+
+func (b *Blocklist) Contains(key PublicKey) bool {
+	defer b.lock.Unlock()
+	b.lock.Lock()
+	_, banned := b.keys[key]
+	return banned
+}
+
+// every banned key, sorted.
+func (b *Blocklist) Keys() []PublicKey {
+	defer b.lock.Unlock()
+	b.lock.Lock()
+	keys := make([]PublicKey, 0, len(b.keys))
+	for key := range b.keys {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -5,8 +5,12 @@
 package model
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
@@ -16,21 +20,134 @@ import (
 // routine input buffer size
 const RI_BUFFER_SIZE = 10
 
+// default number of transactions a client can initiate at the same time
+const DEFAULT_MAX_TRANSACTIONS = 20
+
+// default maximum size in bytes of a message from a client, not counting the transaction id
+const DEFAULT_MAX_MESSAGE_SIZE = 128 * 1024
+
+// default time a client message waits for space in a full routine input buffer before it is rejected
+const DEFAULT_BUFFER_WAIT_WINDOW = 100 * time.Millisecond
+
+// default messages per second a client can send once its burst is used up. The rest are rejected.
+const DEFAULT_MESSAGE_RATE = 20.0
+
+// default messages a client can send at once
+const DEFAULT_MESSAGE_BURST = 50
+
+// default time an unauthenticated client with no transactions can stay connected without sending anything
+const DEFAULT_IDLE_TIMEOUT = 60 * time.Second
+
+// default number of writes in a row that can fail before the client is disconnected
+const DEFAULT_MAX_WRITE_FAILURES = 3
+
+// default number of times a critical message is written again after writing it fails, before the client is disconnected
+const DEFAULT_CRITICAL_WRITE_RETRIES = 3
+
+// wait before the first retry of a critical message. Doubles for each retry after that.
+const CRITICAL_RETRY_BACKOFF = 50 * time.Millisecond
+
+// default time a transaction started by a client can last, however active it is
+const DEFAULT_MAX_TRANSACTION_LIFETIME = 5 * time.Minute
+
+// largest last will a client can register, in bytes
+const MAX_LAST_WILL_SIZE = 1024
+
+// how long writing the close frame can take when disconnecting a client
+const CLOSE_WRITE_WAIT = time.Second
+
+// how long the id of a closed transaction is remembered, so that late messages to it aren't mistaken for new transactions
+const RECENTLY_CLOSED_WINDOW = 30 * time.Second
+
+var errMaxTransactions = errors.New("max number of transactions reached")
+
+// why the server is ending a client's connection. Decides the close code and reason sent in the close frame.
+type DisconnectReason int
+
+const (
+	DisconnectReason_Idle DisconnectReason = iota
+	DisconnectReason_ServerShutdown
+	DisconnectReason_ProtocolViolation
+	DisconnectReason_WriteFailures
+	DisconnectReason_SessionTakenOver
+	DisconnectReason_Admin
+)
+
+// the websocket close code and reason for r.
+func (r DisconnectReason) closeFrame() (code int, text string) {
+	switch r {
+	case DisconnectReason_Idle:
+		return websocket.CloseNormalClosure, "idle timeout"
+	case DisconnectReason_ServerShutdown:
+		return websocket.CloseGoingAway, "server shutting down"
+	case DisconnectReason_ProtocolViolation:
+		return websocket.CloseProtocolError, "protocol violation"
+	case DisconnectReason_WriteFailures:
+		return websocket.CloseInternalServerErr, "writes failed"
+	case DisconnectReason_SessionTakenOver:
+		return websocket.ClosePolicyViolation, "session taken over"
+	case DisconnectReason_Admin:
+		return websocket.ClosePolicyViolation, "disconnected by admin"
+	default:
+		return websocket.CloseNormalClosure, ""
+	}
+}
+
 type PublicKey string
 
+// transaction id reserved for messages from the server that are not part of any transaction.
+var CONTROL_ID = [IDLEN]byte{}
+
+// transaction id that a client with server-assigned ids starts a transaction on, for the server to pick its id.
+// Not a possible newId, so it can't be assigned.
+var NEW_TRANSACTION_ID = [IDLEN]byte([]byte("****************"))
+
 // *websocket.Conn, but only the methods that are being used here
 // So that *websocket.Conn can be mocked.
 type Conn interface {
 	ReadMessage() (messageType int, p []byte, err error)
 	WriteMessage(messageType int, data []byte) error
+	Close() error
+	// ReadMessage fails for messages over limit bytes
+	SetReadLimit(limit int64)
+	// reads and writes fail once t has passed. The zero time means no deadline.
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	// write a ping, pong or close message, giving up at deadline
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+}
+
+// Optionally implemented by Conns that can recover from a failed write, so that writing again might succeed.
+// *websocket.Conn doesn't: once a write has failed, every later write fails with the same error.
+// Critical messages are only retried on Conns that implement it.
+type RecoverableConn interface {
+	// whether writing again might succeed after a write failed with err
+	CanRetryWrite(err error) bool
 }
 
+// *websocket.Conn is used as a Conn as it is
+var _ Conn = (*websocket.Conn)(nil)
+
 type Client struct {
 	// PRIVATE METHODS: not accessible outside current package
 	publicKey *PublicKey
+	// protocol version agreed in comeOnline, e.g. "1.0". "" if not yet agreed.
+	protocolVersion string
+	// JSON object set by a {"lastWill":...} control message, passed to routines if the client disconnects. "" if none.
+	lastWill     string
+	lastWillLock sync.Mutex
+	// peers the client has a connection request in progress to, so it can't ask the same peer twice at once. nil until the first.
+	connectionRequests     map[PublicKey]struct{}
+	connectionRequestsLock sync.Mutex
 	// lock to prevent simultaneous writes to the websocket conn
 	conn          Conn
 	connWriteLock sync.Mutex
+	// writes in a row that have failed, and how many can fail before the connection is closed. 0 means never.
+	// must use connWriteLock when reading or editing writeFailures
+	writeFailures    int
+	maxWriteFailures int
+	// times a critical message is written again if writing it fails. 0 means critical messages are written like any other.
+	criticalWriteRetries int
 	// map of active transactionSockets for this client; id -> transactionSocket
 	// should not access directly outside client.go
 	transactionSockets     map[[IDLEN]byte]*transactionSocket
@@ -38,6 +155,46 @@ type Client struct {
 	// used to prevent new transactions being added after broken out of the main loop
 	// must use modifyTransactionsLock when reading or editing
 	disconnected bool
+	// number of transaction sockets initiated by this client, and the limit on them. 0 means no limit.
+	// must use modifyTransactionsLock when reading or editing
+	transactionCount int
+	maxTransactions  int
+	// ids of transaction sockets deleted in the last RECENTLY_CLOSED_WINDOW; id -> when it is forgotten
+	// must use modifyTransactionsLock when reading or editing
+	recentlyClosed map[[IDLEN]byte]time.Time
+	// how long a client message waits for space in a full routine input buffer. 0 means it is rejected straight away.
+	bufferWaitWindow time.Duration
+	// maximum size of a message from the client, not counting the transaction id. 0 means no limit.
+	maxMessageSize int
+	// token bucket limiting the messages the client sends. messageRate is tokens added per second, 0 means no limit.
+	// the bucket starts full when Route is called. messageTokens and messageTokensAt are only used by the Route goroutine.
+	messageRate     float64
+	messageBurst    float64
+	messageTokens   float64
+	messageTokensAt time.Time
+	// how long the client can go without sending a message while it has no public key and no transactions. 0 means no limit.
+	idleTimeout time.Duration
+	// how long a transaction started by the client can last. 0 means no limit.
+	maxLifetime time.Duration
+	// how long the client's transactions wait for it to resume them after it disconnects. 0 means they don't.
+	resumeGrace time.Duration
+	// set by Route. nil until then.
+	hub *Hub
+	// set by RouteSync. nil if the client is routed by Route.
+	syncRouter *SyncRouter
+	// how transaction ids and messages are put together in websocket messages
+	framing Framing
+	// whether the server picks the ids of the transactions the client starts, rather than the client.
+	serverAssignedIds bool
+	// picks server-assigned transaction ids. nil means newId.
+	idGenerator func() [IDLEN]byte
+	// nil means DefaultLogger()
+	logger Logger
+	// nil means RealClock{}
+	clock Clock
+	// set by Route. When it is cancelled, Route and the transaction socket goroutines return without waiting for the connection to close.
+	// must use modifyTransactionsLock when reading or editing, since peers can start transaction sockets before Route is called
+	ctx context.Context
 	// channels that should be closed byt the main loop
 	// these channels cause transaction goroutines to return when closed.
 	danglingClientMsgChannels           []chan string
@@ -45,21 +202,163 @@ type Client struct {
 	//
 	danglingClientCloseChannels           []chan struct{}
 	modifyDanglingClientCloseChannelsLock sync.Mutex
+	// transaction sockets that have been added but whose channels have not yet been moved to the dangling lists.
+	// once the client has disconnected and this drains, the dangling channels can be closed.
+	openTransactionSockets sync.WaitGroup
 
 	// PUBLIC METHODS
 	// lock to prevent simultaneous comeOnline transactions
 	ComeOnlineLock sync.Mutex
 }
 
-func MakeClient(conn Conn) Client {
+type ClientOptions struct {
+	// number of transactions the client can initiate at the same time. 0 means no limit.
+	// while it has this many open, peers can't start transactions with it either.
+	MaxTransactions int
+	// how long a client message waits for space in a full routine input buffer. 0 means it is rejected straight away.
+	BufferWaitWindow time.Duration
+	// maximum size in bytes of a message from the client, not counting the transaction id. 0 means no limit.
+	MaxMessageSize int
+	// messages per second the client can send once it has used up MessageBurst. Messages over the limit are rejected. 0 means no limit.
+	MessageRate  float64
+	MessageBurst int
+	// how long the client can go without sending a message while it has no public key and no transactions. 0 means no limit.
+	IdleTimeout time.Duration
+	// number of writes in a row that can fail before the client is disconnected. 1 makes any failed write fatal, 0 means never.
+	MaxWriteFailures int
+	// times a message in a critical RoutineOutput is written again, with backoff, if writing it fails on a RecoverableConn.
+	// the client is disconnected if it still can't be written, or straight away on other Conns. 0 means critical messages are written like any other.
+	CriticalWriteRetries int
+	// how long a transaction the client starts can last before it is cancelled for everyone in it. 0 means no limit.
+	MaxTransactionLifetime time.Duration
+	// how long the client's transactions wait for it to reconnect and resume them after it disconnects. 0 means they don't.
+	ResumeGrace time.Duration
+	// how transaction ids and messages are put together in websocket messages. Framing_Prefix unless the client asked for another when it connected.
+	Framing Framing
+	// whether the client starts transactions on NEW_TRANSACTION_ID and is told the id the server picked for each,
+	// rather than picking its own. False unless the client asked for server-assigned ids when it connected.
+	ServerAssignedIds bool
+	// nil means DefaultLogger()
+	Logger Logger
+	// times the routine timeouts. nil means RealClock{}
+	Clock Clock
+}
+
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		MaxTransactions:        DEFAULT_MAX_TRANSACTIONS,
+		BufferWaitWindow:       DEFAULT_BUFFER_WAIT_WINDOW,
+		MaxMessageSize:         DEFAULT_MAX_MESSAGE_SIZE,
+		MessageRate:            DEFAULT_MESSAGE_RATE,
+		MessageBurst:           DEFAULT_MESSAGE_BURST,
+		IdleTimeout:            DEFAULT_IDLE_TIMEOUT,
+		MaxWriteFailures:       DEFAULT_MAX_WRITE_FAILURES,
+		CriticalWriteRetries:   DEFAULT_CRITICAL_WRITE_RETRIES,
+		MaxTransactionLifetime: DEFAULT_MAX_TRANSACTION_LIFETIME,
+		ResumeGrace:            DEFAULT_RESUME_GRACE,
+		Logger:                 DefaultLogger(),
+	}
+}
+
+// options are optional; DefaultClientOptions() is used if none are given.
+func MakeClient(conn Conn, options ...ClientOptions) Client {
+
+	var opts ClientOptions
+	if len(options) >= 1 {
+		opts = options[0]
+	} else {
+		opts = DefaultClientOptions()
+	}
+
 	return Client{
 		publicKey: nil, // initially unset. When set, it implies the client has been added to the hub.
 
-		conn:               conn,
-		transactionSockets: make(map[[IDLEN]byte]*transactionSocket),
+		conn:                 conn,
+		transactionSockets:   make(map[[IDLEN]byte]*transactionSocket),
+		recentlyClosed:       make(map[[IDLEN]byte]time.Time),
+		maxTransactions:      opts.MaxTransactions,
+		bufferWaitWindow:     opts.BufferWaitWindow,
+		maxMessageSize:       opts.MaxMessageSize,
+		messageRate:          opts.MessageRate,
+		messageBurst:         float64(opts.MessageBurst),
+		messageTokens:        float64(opts.MessageBurst),
+		idleTimeout:          opts.IdleTimeout,
+		maxWriteFailures:     opts.MaxWriteFailures,
+		criticalWriteRetries: opts.CriticalWriteRetries,
+		maxLifetime:          opts.MaxTransactionLifetime,
+		resumeGrace:          opts.ResumeGrace,
+		framing:              opts.Framing,
+		serverAssignedIds:    opts.ServerAssignedIds,
+		logger:               opts.Logger,
+		clock:                opts.Clock,
+		ctx:                  context.Background(),
 	}
 }
 
+func (c *Client) Logger() Logger {
+	if c.logger == nil {
+		return DefaultLogger()
+	}
+	return c.logger
+}
+
+func (c *Client) Clock() Clock {
+	if c.clock == nil {
+		return RealClock{}
+	}
+	return c.clock
+}
+
+// public key of the client for logging. "nil" if unset.
+func (c *Client) logPk() string {
+	if c.publicKey == nil {
+		return "nil"
+	}
+	return (string)(*c.publicKey)
+}
+
+// key-value fields identifying a transaction socket of this client, for logging.
+func (c *Client) logFields(id [IDLEN]byte, keyvals ...any) []any {
+	return append([]any{"transactionId", string(id[:]), "publicKey", c.logPk()}, keyvals...)
+}
+
+// the context passed to Route, or context.Background() if it hasn't been called yet.
+// Threadsafe.
+func (c *Client) routingContext() context.Context {
+	defer c.modifyTransactionsLock.Unlock()
+	c.modifyTransactionsLock.Lock()
+	return c.ctx
+}
+
+// number of transactions initiated by this client that are still open.
+// Threadsafe.
+func (c *Client) TransactionCount() int {
+	defer c.modifyTransactionsLock.Unlock()
+	c.modifyTransactionsLock.Lock()
+	return c.transactionCount
+}
+
+// 0 means no limit. Transactions that are already running are not affected.
+// Threadsafe.
+func (c *Client) SetMaxTransactions(max int) {
+	defer c.modifyTransactionsLock.Unlock()
+	c.modifyTransactionsLock.Lock()
+	c.maxTransactions = max
+}
+
+// number of transactions the client can initiate at the same time. 0 means no limit.
+// Threadsafe.
+func (c *Client) MaxTransactions() int {
+	defer c.modifyTransactionsLock.Unlock()
+	c.modifyTransactionsLock.Lock()
+	return c.maxTransactions
+}
+
+// maximum size in bytes of a message from the client, not counting the transaction id. 0 means no limit.
+func (c *Client) MaxMessageSize() int {
+	return c.maxMessageSize
+}
+
 func (c *Client) GetPublicKey() *PublicKey {
 	return c.publicKey
 }
@@ -73,89 +372,429 @@ func (c *Client) SetPublicKey(pk *PublicKey) error {
 	return nil
 }
 
-// a loop that demultiplexes messages and forwards them to correct handlers
-func (c *Client) Route(hub *Hub, makeRoutine func() Routine) {
+func (c *Client) GetProtocolVersion() string {
+	return c.protocolVersion
+}
+
+func (c *Client) SetProtocolVersion(version string) {
+	c.protocolVersion = version
+}
+
+// Record that the client has started a connection request to pk.
+// Returns false, recording nothing, if it already has one in progress to pk.
+// Threadsafe.
+func (c *Client) TryStartConnectionRequest(pk PublicKey) bool {
+	defer c.connectionRequestsLock.Unlock()
+	c.connectionRequestsLock.Lock()
+	if _, inProgress := c.connectionRequests[pk]; inProgress {
+		return false
+	}
+	if c.connectionRequests == nil {
+		c.connectionRequests = make(map[PublicKey]struct{})
+	}
+	c.connectionRequests[pk] = struct{}{}
+	return true
+}
+
+// The client's connection request to pk has ended, so it can start another.
+// Threadsafe.
+func (c *Client) EndConnectionRequest(pk PublicKey) {
+	defer c.connectionRequestsLock.Unlock()
+	c.connectionRequestsLock.Lock()
+	delete(c.connectionRequests, pk)
+}
+
+// a loop that demultiplexes messages and forwards them to correct handlers.
+// Returns when the connection closes, or when ctx is cancelled. Cancelling ctx also ends all of the client's transaction sockets.
+func (c *Client) Route(ctx context.Context, hub *Hub, makeRoutine func() Routine) {
+
+	c.startRouting(ctx, hub)
+
+	// ReadMessage blocks, so read on another goroutine so that the idle timer can be watched at the same time.
+	reads := make(chan connRead)
+	stopReading := make(chan struct{})
+	defer close(stopReading)
+	go c.readConn(reads, stopReading)
+
+	// nil channel (never fires) if there is no idle timeout
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	if c.idleTimeout > 0 {
+		idleTimer = time.NewTimer(c.idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
 
+ReadLoop:
 	for {
 
 		// check to see if there are any dangling channels that were created in this goroutine which need to be closed
 		c.closeDanglingChannels()
 
-		// read from websocket (blocking)
-		_, msgBytes, err := c.conn.ReadMessage()
-		if err != nil {
-			break
+		var read connRead
+		select {
+		case read = <-reads:
+		case <-idle:
+			if !c.isIdle() {
+				idleTimer.Reset(c.idleTimeout)
+				continue
+			}
+			c.Logger().Warn("Disconnecting client: idle", "publicKey", c.logPk(), "idleTimeout", c.idleTimeout)
+			c.closeConn(DisconnectReason_Idle)
+			break ReadLoop
+		case <-ctx.Done():
+			c.Logger().Debug("Disconnecting client: context cancelled", "publicKey", c.logPk(), "error", ctx.Err())
+			c.closeConn(DisconnectReason_ServerShutdown)
+			break ReadLoop
 		}
 
-		// the first IDLEN bytes represent the id of the transaction
-		// which uniquely identifies the instance of the active routine that the message needs to be forwarded to.
-		// if the routine instance number is unrecognized, create a new routine.
-		if len(msgBytes) < IDLEN {
-			fmt.Println("User sent a malformed message: " + string(msgBytes))
-			continue
+		if !c.readOk(read) {
+			break
 		}
-		id := ([IDLEN]byte)(msgBytes[:IDLEN])
 
-		// check if a transaction with this id exists already
-		tSocket, exists := c.transactionSockets[id]
-		// if so, pass the message to that transaction
-		if exists {
+		if idleTimer != nil {
+			idleTimer.Stop()
 			select {
-			case tSocket.clientMsgChan <- string(msgBytes[IDLEN:]):
+			case <-idleTimer.C:
 			default:
-				c.writeTransactionMessage(tSocket.id, `{"error":"Buffer is occupied, message ignored"}`)
 			}
-			continue
+			idleTimer.Reset(c.idleTimeout)
 		}
 
-		// otherwise create a new transaction
-		tNew := c.newTransaction(makeRoutine())
-		tSocketNew := c.newTransactionSocket(tNew, id)
+		c.handleRead(hub, makeRoutine, read.msgBytes)
+	}
 
-		// add to transaction list
-		err = c.addTransactionSocket(tSocketNew)
-		if err != nil {
-			// client has disconnected
-			// It's ok to close there here because nowhere else has access to them
-			// and nowhere else will
-			close(tSocketNew.clientMsgChan)
-			close(tSocketNew.clientCloseChan)
-			close(tSocketNew.roChan)
-			continue
+	// breaks out here when the websocket is closed.
+	c.close()
+
+}
+
+// set up the client to be routed by Route or RouteSync.
+func (c *Client) startRouting(ctx context.Context, hub *Hub) {
+	func() {
+		defer c.modifyTransactionsLock.Unlock()
+		c.modifyTransactionsLock.Lock()
+		c.ctx = ctx
+	}()
+	c.hub = hub
+	c.messageTokensAt = c.Clock().Now()
+
+	// messages over the limit end the connection
+	if c.maxMessageSize > 0 {
+		overhead := IDLEN
+		if c.framing == Framing_Envelope {
+			overhead = envelopeOverhead
+		}
+		c.conn.SetReadLimit(int64(overhead + c.maxMessageSize))
+	}
+}
+
+// false if the read failed, meaning the connection has closed.
+func (c *Client) readOk(read connRead) bool {
+	if read.err == nil {
+		return true
+	}
+	// gorilla has already sent a close frame for messages over the read limit.
+	if errors.Is(read.err, websocket.ErrReadLimit) {
+		c.Logger().Warn("Disconnecting client: message too large", "publicKey", c.logPk(), "maxMessageSize", c.maxMessageSize)
+	}
+	return false
+}
+
+// pass a message read from the websocket to the transaction it is for, starting a new transaction if there isn't one.
+func (c *Client) handleRead(hub *Hub, makeRoutine func() Routine, msgBytes []byte) {
+
+	// the id of the transaction uniquely identifies the instance of the active routine that the message needs to be forwarded to.
+	// with the default framing it is the first IDLEN bytes.
+	// if the routine instance number is unrecognized, create a new routine.
+	id, body, err := c.framing.decode(msgBytes)
+	if err != nil {
+		c.Logger().Warn("Malformed message: "+err.Error(), "publicKey", c.logPk(), "msg", string(msgBytes))
+		return
+	}
+	// rejected rather than delayed, so that the read loop is never held up
+	if !c.allowMessage() {
+		c.Logger().Warn("Message ignored: rate limited", c.logFields(id)...)
+		c.writeTransactionMessage(id, `{"error":"rate limited"}`)
+		return
+	}
+	if id == CONTROL_ID {
+		if closeId, ok := parseCloseTransaction(body); ok {
+			c.closeTransactionSocket(closeId)
+			return
+		}
+		if lastWill, ok := parseLastWill(body); ok {
+			c.setLastWill(lastWill)
+			return
+		}
+		if resumeId, ok := parseResumeTransaction(body); ok {
+			c.resumeTransactionSocket(hub, resumeId)
+			return
 		}
+		c.Logger().Warn("Malformed message: transaction id is reserved", c.logFields(id)...)
+		c.writeTransactionMessage(id, `{"error":"transaction id is reserved"}`)
+		return
+	}
+
+	// check if a transaction with this id exists already
+	tSocket, exists := c.getTransactionSocket(id)
+	// if so, pass the message to that transaction
+	if exists {
+		select {
+		case tSocket.clientMsgChan <- string(body):
+		default:
+			c.Logger().Warn("Message ignored: buffer is occupied", c.logFields(tSocket.id)...)
+			c.writeTransactionMessage(tSocket.id, `{"error":"Buffer is occupied, message ignored"}`)
+		}
+		return
+	}
+
+	// a client with server-assigned ids can only start transactions on NEW_TRANSACTION_ID
+	assignId := c.serverAssignedIds && id == NEW_TRANSACTION_ID
+	if c.serverAssignedIds && !assignId {
+		if c.wasRecentlyClosed(id) {
+			c.Logger().Debug("Message ignored: transaction has terminated", c.logFields(id)...)
+			c.writeTransactionMessage(id, `{"error":"transaction has terminated"}`)
+		} else {
+			c.Logger().Warn("Message ignored: transaction does not exist", c.logFields(id)...)
+			c.writeTransactionMessage(id, `{"error":"transaction does not exist"}`)
+		}
+		return
+	}
 
-		// route transaction
+	// otherwise create a new transaction
+	tNew := c.newTransaction(makeRoutine())
+	tSocketNew := c.newTransactionSocket(tNew, id)
+	tSocketNew.initiatedByClient = true
+	tSocketNew.assignId = assignId
+
+	// add to transaction list
+	err = c.addTransactionSocket(tSocketNew)
+	if err != nil {
+		// client has disconnected, or has too many transactions open
+		// It's ok to close there here because nowhere else has access to them
+		// and nowhere else will
+		close(tSocketNew.clientMsgChan)
+		close(tSocketNew.clientCloseChan)
+		close(tSocketNew.roChan)
+		if errors.Is(err, errMaxTransactions) {
+			// a late message to a transaction that has just ended shouldn't look like a new one being refused
+			if c.wasRecentlyClosed(id) {
+				c.Logger().Debug("Message ignored: transaction has terminated", c.logFields(id)...)
+				c.writeTransactionMessage(id, `{"error":"transaction has terminated"}`)
+			} else {
+				c.writeTransactionMessage(id, `{"error":"Max number of transactions reached"}`)
+			}
+		}
+		return
+	}
+
+	// each message on NEW_TRANSACTION_ID gets one reply on it, in order, so the client can tell which transaction is which.
+	// written before the routine gets the message, so that the client knows the id before anything is sent on it.
+	if assignId {
+		c.writeTransactionMessage(NEW_TRANSACTION_ID, `{"transactionId":"`+c.framing.formatId(tSocketNew.id)+`"}`)
+	}
+
+	// route transaction
+	if c.syncRouter != nil {
+		c.syncRouter.addTransaction(tNew)
+	} else {
 		go tNew.route(hub)
+	}
 
-		// route transaction socket (one for each client that interacts with this routine)
-		go c.routeTransactionSocket(tSocketNew)
+	// route transaction socket (one for each client that interacts with this routine)
+	c.startTransactionSocket(tSocketNew)
 
-		// send first message
-		// read by routeTransactionSocket
-		tSocketNew.clientMsgChan <- string(msgBytes[IDLEN:])
+	// send first message
+	// read by routeTransactionSocket
+	tSocketNew.clientMsgChan <- string(body)
+}
+
+// take a token from the client's message bucket, if there is one. Only called by the Route goroutine.
+func (c *Client) allowMessage() bool {
+	if c.messageRate <= 0 {
+		return true
 	}
+	now := c.Clock().Now()
+	c.messageTokens = min(c.messageBurst, c.messageTokens+now.Sub(c.messageTokensAt).Seconds()*c.messageRate)
+	c.messageTokensAt = now
 
-	// breaks out here when the websocket is closed.
-	c.close()
+	if c.messageTokens < 1 {
+		return false
+	}
+	c.messageTokens--
+	return true
+}
 
+// the id in a control message from the client asking to close one of its transactions, like {"closeTransaction":"abcdefghijklmnop"}.
+// ok is false if body isn't one of these. The id might not be IDLEN long.
+func parseCloseTransaction(body []byte) (id string, ok bool) {
+	msg := struct {
+		CloseTransaction *string `json:"closeTransaction"`
+	}{}
+	err := json.Unmarshal(body, &msg)
+	if err != nil || msg.CloseTransaction == nil {
+		return "", false
+	}
+	return *msg.CloseTransaction, true
+}
+
+// the value in a control message from the client registering a last will, like {"lastWill":{"reason":"networkLost"}}.
+// ok is false if body isn't one of these. The value is not validated.
+func parseLastWill(body []byte) (lastWill json.RawMessage, ok bool) {
+	msg := map[string]json.RawMessage{}
+	err := json.Unmarshal(body, &msg)
+	if err != nil || len(msg) != 1 {
+		return nil, false
+	}
+	lastWill, ok = msg["lastWill"]
+	return lastWill, ok
+}
+
+// Register lastWill to be passed to routines if the client disconnects mid-transaction. null clears it.
+// Anything other than a JSON object of at most MAX_LAST_WILL_SIZE bytes is rejected with an error on the control id.
+func (c *Client) setLastWill(lastWill json.RawMessage) {
+	var obj map[string]json.RawMessage
+	if string(lastWill) != "null" && (len(lastWill) > MAX_LAST_WILL_SIZE || json.Unmarshal(lastWill, &obj) != nil || obj == nil) {
+		c.Logger().Warn("Malformed message: invalid last will", "publicKey", c.logPk(), "size", len(lastWill))
+		c.writeTransactionMessage(CONTROL_ID, `{"error":"last will must be a JSON object of at most `+strconv.Itoa(MAX_LAST_WILL_SIZE)+` bytes"}`)
+		return
+	}
+	defer c.lastWillLock.Unlock()
+	c.lastWillLock.Lock()
+	c.lastWill = ""
+	if obj != nil {
+		c.lastWill = string(lastWill)
+	}
+}
+
+// the client's last will if it has disconnected, "" if it hasn't or didn't register one.
+// transactions closed while the client stays connected don't get it.
+func (c *Client) lastWillIfDisconnected() string {
+	disconnected := func() bool {
+		defer c.modifyTransactionsLock.Unlock()
+		c.modifyTransactionsLock.Lock()
+		return c.disconnected
+	}()
+	if !disconnected {
+		return ""
+	}
+	defer c.lastWillLock.Unlock()
+	c.lastWillLock.Lock()
+	return c.lastWill
+}
+
+// Close the client's transaction socket with this id without closing the connection.
+// The routine gets a RoutineMsgType_ClientClose, just as if the client had disconnected.
+// Should only be called from the Route goroutine, so that the socket's channels can't be closed under it.
+func (c *Client) closeTransactionSocket(idStr string) {
+	var ts *transactionSocket
+	exists := false
+	if id, ok := c.framing.parseId(idStr); ok {
+		ts, exists = c.getTransactionSocket(id)
+	}
+	if !exists {
+		c.Logger().Debug("Close ignored: transaction does not exist", "publicKey", c.logPk(), "closeTransaction", idStr)
+		c.writeTransactionMessage(CONTROL_ID, `{"error":"transaction does not exist"}`)
+		return
+	}
+
+	c.Logger().Debug("Transaction closed by client", c.logFields(ts.id)...)
+	// read by routeTransactionSocket, which ignores it if the transaction has already finished
+	ts.clientCloseChan <- struct{}{}
+}
+
+// result of a ReadMessage call
+type connRead struct {
+	msgBytes []byte
+	err      error
+}
+
+// read from the websocket until a read fails, passing every result to reads.
+// Returns early if stop is closed.
+func (c *Client) readConn(reads chan<- connRead, stop <-chan struct{}) {
+	for {
+		_, msgBytes, err := c.conn.ReadMessage()
+		select {
+		case reads <- connRead{msgBytes: msgBytes, err: err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// true if the client has not come online and has no open transactions.
+// Threadsafe.
+func (c *Client) isIdle() bool {
+	defer c.modifyTransactionsLock.Unlock()
+	c.modifyTransactionsLock.Lock()
+	return c.GetPublicKey() == nil && len(c.transactionSockets) == 0
+}
+
+// Threadsafe.
+func (c *Client) getTransactionSocket(id [IDLEN]byte) (*transactionSocket, bool) {
+	defer c.modifyTransactionsLock.Unlock()
+	c.modifyTransactionsLock.Lock()
+	ts, exists := c.transactionSockets[id]
+	return ts, exists
+}
+
+// Send msg to the client as a control message, then close the connection with a close frame for reason.
+// This makes Route return, so the client is torn down as if it had disconnected itself.
+// Threadsafe. Can be called from outside Route.
+func (c *Client) Disconnect(reason DisconnectReason, msg string) {
+	err := c.writeTransactionMessage(CONTROL_ID, msg)
+	if err != nil {
+		c.Logger().Error("Error writing message", c.logFields(CONTROL_ID, "error", err)...)
+	}
+	c.closeConn(reason)
+}
+
+// Send a close frame for reason, then close the connection.
+// The connection is closed even if the close frame can't be written.
+// Threadsafe: gorilla allows WriteControl and Close to be called alongside the other methods.
+func (c *Client) closeConn(reason DisconnectReason) {
+	code, text := reason.closeFrame()
+	err := c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(CLOSE_WRITE_WAIT))
+	if err != nil {
+		c.Logger().Debug("Error writing close frame", "publicKey", c.logPk(), "closeCode", code, "error", err)
+	}
+	c.conn.Close()
 }
 
 func (c *Client) newTransactionSocket(transaction *transaction, id [IDLEN]byte) *transactionSocket {
 	roChan := make(chan RoutineOutput)
+	clientCloseChan := make(chan struct{})
+	// with a SyncRouter, the goroutine sending on these is the one that reads them, so they mustn't block
+	if c.syncRouter != nil {
+		roChan = make(chan RoutineOutput, SYNC_RO_BUFFER_SIZE)
+		clientCloseChan = make(chan struct{}, 2)
+	}
 	return &transactionSocket{
 		clientMsgChan:   make(chan string, 50),
-		clientCloseChan: make(chan struct{}),
+		clientCloseChan: clientCloseChan,
 		roChan:          roChan,
 		transaction:     transaction,
 		id:              id,
+		openedAt:        c.Clock().Now(),
 	}
 }
 
 func (c *Client) newTransaction(routine Routine) *transaction {
 	return &transaction{
-		pkToROChan: make(map[PublicKey](chan RoutineOutput)),
-		riChan:     make(chan routineInputWrapper, RI_BUFFER_SIZE),
-		routine:    routine,
+		pkToROChan:       make(map[PublicKey](chan RoutineOutput)),
+		riChan:           make(chan routineInputWrapper, RI_BUFFER_SIZE),
+		routine:          routine,
+		routineName:      routineNameOf(routine),
+		logger:           c.Logger(),
+		maxLifetime:      c.maxLifetime,
+		unclaimedROChans: make(map[PublicKey][]chan RoutineOutput),
+		suspended:        make(map[PublicKey]*suspendedSocket),
+		clock:            c.Clock(),
+		closedRoChans:    make(map[chan RoutineOutput]struct{}),
 	}
 }
 
@@ -164,30 +803,55 @@ func (c *Client) newTransaction(routine Routine) *transaction {
 // Threadsafe.
 func (c *Client) addTransactionSocket(t *transactionSocket) error {
 
-	_, idExists := c.transactionSockets[t.id]
-	if idExists {
-		panic("Attempted to registed a transaction id that already exists!")
-	}
-
 	err := func() error {
 		defer c.modifyTransactionsLock.Unlock()
 		c.modifyTransactionsLock.Lock()
+
+		// the limit check and the insert below happen under the same lock,
+		// so concurrent adds can't push the count over maxTransactions.
+		_, idExists := c.transactionSockets[t.id]
+		if idExists {
+			panic("Attempted to registed a transaction id that already exists!")
+		}
+
 		if c.disconnected {
 			return errors.New("client has disconnected")
+		} else if c.maxTransactions > 0 && c.transactionCount >= c.maxTransactions && (t.initiatedByClient || !t.resumed) {
+			// a client at its limit is busy: peers can't start new transactions with it either.
+			// it can still resume a peer's transaction that it was already in.
+			return errMaxTransactions
 		} else {
+			if t.assignId {
+				t.id = c.unusedIdLocked()
+			}
 
-			func() {
+			err := func() error {
 				// modify the transaction to add roChan
 				defer t.transaction.pkToROChanLock.Unlock()
 				t.transaction.pkToROChanLock.Lock()
 				pk := c.GetPublicKey()
-				if pk != nil {
+				if t.resumed {
+					// the transaction hands over the public key once it has sent the held outputs
+					err := t.transaction.claimSuspendedLocked(*pk, t.id)
+					if err != nil {
+						return err
+					}
+				} else if pk != nil {
 					t.transaction.pkToROChan[*pk] = t.roChan
 				}
+				t.transaction.roChans = append(t.transaction.roChans, t.roChan)
 				t.transaction.transactionSocketCount += 1
+				return nil
 			}()
+			if err != nil {
+				return err
+			}
 
 			c.transactionSockets[t.id] = t
+			c.openTransactionSockets.Add(1)
+			if t.initiatedByClient {
+				c.transactionCount += 1
+			}
 			return nil
 		}
 	}()
@@ -211,6 +875,10 @@ func (c *Client) deleteTransactionSocket(id [IDLEN]byte) error {
 		// save the socket so we can deal with the dangling channels
 		ts = t0
 		delete(c.transactionSockets, id)
+		if ts.initiatedByClient {
+			c.transactionCount -= 1
+		}
+		c.rememberClosedLocked(id)
 		return nil
 	}()
 	if err != nil {
@@ -221,15 +889,17 @@ func (c *Client) deleteTransactionSocket(id [IDLEN]byte) error {
 	func() {
 		defer ts.transaction.pkToROChanLock.Unlock()
 		ts.transaction.pkToROChanLock.Lock()
+		// another device might have claimed the public key
 		pk := c.publicKey
-		if pk != nil {
+		if pk != nil && ts.transaction.pkToROChan[*pk] == ts.roChan {
 			delete(ts.transaction.pkToROChan, *pk)
 		}
 
 		// if transaction has no more sockets (no clients can still communicate)
 		// then close riChan - this causes routeRoutine to return, terminating its goroutine. This marks the end of the transaction
+		// unless a socket is suspended, and might be resumed.
 		ts.transaction.transactionSocketCount -= 1
-		if ts.transaction.transactionSocketCount == 0 {
+		if ts.transaction.transactionSocketCount == 0 && len(ts.transaction.suspended) == 0 {
 			close(ts.transaction.riChan)
 		}
 	}()
@@ -247,199 +917,403 @@ func (c *Client) deleteTransactionSocket(id [IDLEN]byte) error {
 		c.modifyDanglingClientCloseChannelsLock.Lock()
 		c.danglingClientCloseChannels = append(c.danglingClientCloseChannels, ts.clientCloseChan)
 	}()
+	c.openTransactionSockets.Done()
 
 	return nil
 }
 
+// Remember that the transaction socket with this id was closed, and forget any that were closed too long ago.
+// Must hold modifyTransactionsLock.
+func (c *Client) rememberClosedLocked(id [IDLEN]byte) {
+	now := c.Clock().Now()
+	for closedId, expiry := range c.recentlyClosed {
+		if !now.Before(expiry) {
+			delete(c.recentlyClosed, closedId)
+		}
+	}
+	c.recentlyClosed[id] = now.Add(RECENTLY_CLOSED_WINDOW)
+}
+
+// a new transaction id that none of the client's open or recently closed transaction sockets has.
+// Must hold modifyTransactionsLock.
+func (c *Client) unusedIdLocked() [IDLEN]byte {
+	generate := c.idGenerator
+	if generate == nil {
+		generate = newId
+	}
+	for {
+		id := generate()
+		_, open := c.transactionSockets[id]
+		_, closed := c.recentlyClosed[id]
+		if !open && !closed && id != CONTROL_ID && id != NEW_TRANSACTION_ID {
+			return id
+		}
+	}
+}
+
+// ids of the client's open transaction sockets, sorted. For debugging.
+// Threadsafe.
+func (c *Client) ActiveTransactions() [][IDLEN]byte {
+	defer c.modifyTransactionsLock.Unlock()
+	c.modifyTransactionsLock.Lock()
+	ids := make([][IDLEN]byte, 0, len(c.transactionSockets))
+	for id := range c.transactionSockets {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b [IDLEN]byte) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	return ids
+}
+
+// what DescribeTransactions reports about one of a client's transaction sockets.
+type TransactionInfo struct {
+	Id [IDLEN]byte
+	// how long ago the socket was opened
+	Age time.Duration
+	// name of the routine running the transaction, e.g. "comeOnline"
+	Routine string
+}
+
+// the client's open transaction sockets, sorted by id. For debugging.
+// Threadsafe.
+func (c *Client) DescribeTransactions() []TransactionInfo {
+	now := c.Clock().Now()
+	defer c.modifyTransactionsLock.Unlock()
+	c.modifyTransactionsLock.Lock()
+	infos := make([]TransactionInfo, 0, len(c.transactionSockets))
+	for id, ts := range c.transactionSockets {
+		ts.transaction.pkToROChanLock.Lock()
+		routineName := ts.transaction.routineName
+		ts.transaction.pkToROChanLock.Unlock()
+		infos = append(infos, TransactionInfo{Id: id, Age: now.Sub(ts.openedAt), Routine: routineName})
+	}
+	slices.SortFunc(infos, func(a, b TransactionInfo) int {
+		return bytes.Compare(a.Id[:], b.Id[:])
+	})
+	return infos
+}
+
+// Whether a transaction socket with this id was closed in the last RECENTLY_CLOSED_WINDOW.
+// Threadsafe.
+func (c *Client) wasRecentlyClosed(id [IDLEN]byte) bool {
+	defer c.modifyTransactionsLock.Unlock()
+	c.modifyTransactionsLock.Lock()
+	expiry, ok := c.recentlyClosed[id]
+	return ok && c.Clock().Now().Before(expiry)
+}
+
 func (c *Client) close() {
 	// set disconnected - prevent more transactions being added.
+	// take a copy of the remaining transactions, since they delete themselves from the map concurrently.
+	var remaining []*transactionSocket
 	func() {
 		defer c.modifyTransactionsLock.Unlock()
 		c.modifyTransactionsLock.Lock()
 		c.disconnected = true
+		for _, t := range c.transactionSockets {
+			remaining = append(remaining, t)
+		}
 	}()
 
 	// delete all remaining transactions.
 	// they might also try to delete themselves in their own goroutines,
 	// but deleteTransactionSocket has synchronization to ensure that the transactions get deleted at most once.
 	// also send a ClientClose message to the routines
-	for _, t := range c.transactionSockets {
+	for _, t := range remaining {
 		t.clientCloseChan <- struct{}{}
 	}
 
 	go func() {
 		// close all dangling channels.
-		// wait a bit for all routines to be deleted, and the channels added to this list
-		time.Sleep(10 * time.Second)
+		// no sockets can be added after disconnecting, so this waits for every remaining socket to be deleted and its channels added to the lists.
+		c.openTransactionSockets.Wait()
 		c.closeDanglingChannels()
 	}()
 }
 
+// route the transaction socket on a goroutine of its own, or on the SyncRouter's goroutine if the client has one.
+func (c *Client) startTransactionSocket(ts *transactionSocket) {
+	if c.syncRouter != nil {
+		c.syncRouter.addSocket(ts)
+		return
+	}
+	go c.routeTransactionSocket(ts)
+}
+
 // should run in a separate goroutine to the main Route() loop.
 func (c *Client) routeTransactionSocket(ts *transactionSocket) {
 
-	// this function exits when ALL the below channels have closed.
-	// both these channels are closed by the write end.
-	roChanClosed := false
-	clientMsgChanClosed := false
-	clientCloseChanClosed := false
-	allClosed := func() bool {
-		return roChanClosed && clientMsgChanClosed && clientCloseChanClosed
-	}
-
-	ts.status = transactionStatus{
-		done:         false,
-		timeoutTimer: nil,
-	}
+	// set to nil once it has fired, so that it is only handled once
+	ctxDone := c.routingContext().Done()
 
-	for {
+	// this function exits when ALL of roChan, clientMsgChan and clientCloseChan have closed.
+	for !ts.allClosed() {
 		select {
 
 		// output from routine
 		case ro, ok := <-ts.roChan:
-
-			if !ok {
-				roChanClosed = true
-				ts.roChan = nil
-				if allClosed() {
-					return
-				} else {
-					continue
-				}
-			}
-
-			// routine output received from another goroutine
-			ts.status = c.processRoutineOutput(ts, ro)
-			if ro.Done {
-				c.deleteTransactionSocket(ts.id) // this also adds t.clientMsgChan to the dangling channels list
-			}
+			c.socketRoutineOutput(ts, ro, ok)
 
 		// client close
 		case _, ok := <-ts.clientCloseChan:
-			if !ok {
-				clientCloseChanClosed = true
-				ts.clientCloseChan = nil
-				if allClosed() {
-					return
-				} else {
-					continue
-				}
-			}
+			c.socketClientClose(ts, ok)
 
-			if ts.status.done {
-				continue
-			}
-			riw := routineInputWrapper{
-				args: RoutineInput{
-					MsgType: RoutineMsgType_ClientClose,
-					Pk:      c.GetPublicKey(),
-					Msg:     "",
-				},
-				senderRoChan: ts.roChan,
-			}
-
-			select {
-			// try to send. might be blocked
-			case ts.transaction.riChan <- riw:
-			default:
-				// keep trying to send riw while listening and processing roChan at the same time
-				// this ensures that the route transaction goroutine won't be blocked if it tries to send a ro to us - riChan buffer can empty so that we can eventually send the riw
-				roChanWasClosedDuringThis := c.sendMessageAndAvoidRoChanDeadlock(riw, ts)
-				if roChanWasClosedDuringThis {
-
-					roChanClosed = true
-				}
-			}
-			ts.status.done = true
-			c.deleteTransactionSocket(ts.id)
+		// the client's context was cancelled. Behave as if the client had closed, without waiting for Route to send on clientCloseChan.
+		// the loop still runs until the channels are closed, so that the transaction can finish with this socket.
+		case <-ctxDone:
+			ctxDone = nil
+			c.socketClientClose(ts, true)
 
 		// timeout
 		case <-ts.status.timeoutTimer:
+			c.socketTimeout(ts)
 
-			ts.status.timeoutTimer = nil
-
-			if ts.status.done {
-				continue
-			}
+		// presence event that the routine has subscribed to
+		case event := <-ts.status.presenceEvents:
+			c.socketPresenceEvent(ts, event)
 
-			riw := routineInputWrapper{
-				args: RoutineInput{
-					MsgType: RoutineMsgType_Timeout,
-					Pk:      c.GetPublicKey(),
-					Msg:     "",
-				},
-				senderRoChan: ts.roChan,
-			}
-
-			select {
-			// try to send. might be blocked
-			case ts.transaction.riChan <- riw:
-			default:
-				// keep trying to send riw while listening and processing roChan at the same time
-				roChanWasClosedDuringThis := c.sendMessageAndAvoidRoChanDeadlock(riw, ts)
-				if roChanWasClosedDuringThis {
-					roChanClosed = true
-				}
-			}
+		// the routine asked to be woken
+		case <-ts.status.wakeTimer:
+			c.socketWake(ts)
 
 		// message from client
 		case msg, ok := <-ts.clientMsgChan:
+			c.socketClientMsg(ts, msg, ok)
 
-			if !ok {
-				ts.clientMsgChan = nil
-				clientMsgChanClosed = true
-				if allClosed() {
-					return
-				} else {
-					continue
-				}
-			}
+		}
+	}
 
-			if ts.status.done {
-				// the routine has ended and the Transaction struct has been deleted,
-				// but the main Route loop hasn't figured that out yet and is continuing to send us messages.
-				// the next time Route gets to the top of its loop it should close clientMsgChan.
-				// ignore message, and keep waiting for clientMsgChan to be closed.
-				c.writeTransactionMessage(ts.id, `{"error":"transaction has terminated"}`)
-				continue
-			}
+}
 
-			ri := routineInputWrapper{
-				args: RoutineInput{
-					MsgType: RoutineMsgType_UsrMsg,
-					Pk:      c.GetPublicKey(),
-					Msg:     msg,
-				},
-				senderRoChan: ts.roChan,
-			}
-			// reject user messages if the buffer is occupied - prevent spam
-			// should be very rare that any messages get rejected
-			select {
-			case ts.transaction.riChan <- ri:
-			default:
-				c.writeTransactionMessage(ts.id, `{"error":"buffer occupied"}`)
-			}
+// handle one input to the socket that is ready, without blocking. Returns false if none were ready.
+// Inputs are handled in a fixed order so that SyncRouter steps are repeatable.
+func (c *Client) stepTransactionSocket(ts *transactionSocket) bool {
+	select {
+	case ro, ok := <-ts.roChan:
+		c.socketRoutineOutput(ts, ro, ok)
+		return true
+	default:
+	}
+	select {
+	case _, ok := <-ts.clientCloseChan:
+		c.socketClientClose(ts, ok)
+		return true
+	default:
+	}
+	select {
+	case <-ts.status.timeoutTimer:
+		c.socketTimeout(ts)
+		return true
+	default:
+	}
+	select {
+	case event := <-ts.status.presenceEvents:
+		c.socketPresenceEvent(ts, event)
+		return true
+	default:
+	}
+	select {
+	case <-ts.status.wakeTimer:
+		c.socketWake(ts)
+		return true
+	default:
+	}
+	select {
+	case msg, ok := <-ts.clientMsgChan:
+		c.socketClientMsg(ts, msg, ok)
+		return true
+	default:
+	}
+	return false
+}
 
-		}
+// routine output received from another goroutine. ok is false if roChan has been closed.
+func (c *Client) socketRoutineOutput(ts *transactionSocket, ro RoutineOutput, ok bool) {
+	if !ok {
+		ts.roChan = nil
+		return
+	}
 
+	ts.status = c.processRoutineOutput(ts, ro)
+	if ro.Done {
+		c.deleteTransactionSocket(ts.id) // this also adds t.clientMsgChan to the dangling channels list
 	}
+}
 
+// the client closed the socket, or disconnected. ok is false if clientCloseChan has been closed.
+func (c *Client) socketClientClose(ts *transactionSocket, ok bool) {
+	if !ok {
+		ts.clientCloseChan = nil
+		return
+	}
+
+	if ts.status.done {
+		return
+	}
+	c.sendClientClose(ts)
+}
+
+func (c *Client) socketTimeout(ts *transactionSocket) {
+
+	ts.status.timeoutTimer = nil
+
+	if ts.status.done {
+		return
+	}
+
+	riw := routineInputWrapper{
+		args: RoutineInput{
+			MsgType: RoutineMsgType_Timeout,
+			Pk:      c.GetPublicKey(),
+			Msg:     "",
+		},
+		senderRoChan: ts.roChan,
+	}
+
+	select {
+	// try to send. might be blocked
+	case ts.transaction.riChan <- riw:
+	default:
+		// keep trying to send riw while listening and processing roChan at the same time
+		c.sendMessageAndAvoidRoChanDeadlock(riw, ts)
+	}
+}
+
+func (c *Client) socketPresenceEvent(ts *transactionSocket, event PresenceEvent) {
+
+	if ts.status.done {
+		return
+	}
+
+	riw := routineInputWrapper{
+		args: RoutineInput{
+			MsgType:       RoutineMsgType_PresenceEvent,
+			Pk:            c.GetPublicKey(),
+			PresenceEvent: event,
+		},
+		senderRoChan: ts.roChan,
+	}
+
+	select {
+	// try to send. might be blocked
+	case ts.transaction.riChan <- riw:
+	default:
+		// keep trying to send riw while listening and processing roChan at the same time
+		c.sendMessageAndAvoidRoChanDeadlock(riw, ts)
+	}
+}
+
+func (c *Client) socketWake(ts *transactionSocket) {
+
+	ts.status.wakeTimer = nil
+
+	if ts.status.done {
+		return
+	}
+
+	riw := routineInputWrapper{
+		args: RoutineInput{
+			MsgType: RoutineMsgType_SelfWake,
+			Pk:      c.GetPublicKey(),
+		},
+		senderRoChan: ts.roChan,
+	}
+
+	select {
+	// try to send. might be blocked
+	case ts.transaction.riChan <- riw:
+	default:
+		// the routine is waiting for it, so it can't be dropped like a user message
+		c.sendMessageAndAvoidRoChanDeadlock(riw, ts)
+	}
+}
+
+// message from the client. ok is false if clientMsgChan has been closed.
+func (c *Client) socketClientMsg(ts *transactionSocket, msg string, ok bool) {
+	if !ok {
+		ts.clientMsgChan = nil
+		return
+	}
+
+	if ts.status.done {
+		// the routine has ended and the Transaction struct has been deleted,
+		// but the main Route loop hasn't figured that out yet and is continuing to send us messages.
+		// the next time Route gets to the top of its loop it should close clientMsgChan.
+		// ignore message, and keep waiting for clientMsgChan to be closed.
+		c.Logger().Debug("Message ignored: transaction has terminated", c.logFields(ts.id)...)
+		c.writeTransactionMessage(ts.id, `{"error":"transaction has terminated"}`)
+		return
+	}
+
+	ri := routineInputWrapper{
+		args: RoutineInput{
+			MsgType: RoutineMsgType_UsrMsg,
+			Pk:      c.GetPublicKey(),
+			Msg:     msg,
+		},
+		senderRoChan: ts.roChan,
+	}
+	// if the buffer is occupied, wait a short while for it to empty so bursts aren't dropped.
+	// after that, reject user messages - prevent spam
+	select {
+	case ts.transaction.riChan <- ri:
+	default:
+		sent := c.sendMessageWithinWindow(ri, ts)
+		if !sent && !ts.status.done {
+			c.Logger().Warn("Message ignored: buffer is occupied", c.logFields(ts.id)...)
+			c.writeTransactionMessage(ts.id, `{"error":"buffer occupied"}`)
+		}
+	}
+}
+
+// tell the routine that the client has closed, and delete the transaction socket.
+func (c *Client) sendClientClose(ts *transactionSocket) {
+	riw := routineInputWrapper{
+		args: RoutineInput{
+			MsgType:  RoutineMsgType_ClientClose,
+			Pk:       c.GetPublicKey(),
+			Msg:      "",
+			LastWill: c.lastWillIfDisconnected(),
+		},
+		senderRoChan: ts.roChan,
+	}
+	// the routine is only told once the grace period is over, if the client doesn't resume the socket first
+	riw.suspended = c.suspendTransactionSocket(ts, riw)
+
+	select {
+	// try to send. might be blocked
+	case ts.transaction.riChan <- riw:
+	default:
+		// keep trying to send riw while listening and processing roChan at the same time
+		// this ensures that the route transaction goroutine won't be blocked if it tries to send a ro to us - riChan buffer can empty so that we can eventually send the riw
+		c.sendMessageAndAvoidRoChanDeadlock(riw, ts)
+	}
+	if riw.suspended && ts.status.done {
+		// the routine ended the socket before riw could be sent, so there is nothing to resume
+		ts.transaction.forgetSuspended(c.hub, *riw.args.Pk, ts.roChan)
+	} else if riw.suspended {
+		// the timeout, presence events and wake belong to the socket that resumes this one
+		ts.status.timeoutTimer = nil
+		ts.status.presenceEvents = nil
+		ts.status.wakeTimer = nil
+	}
+	ts.status.done = true
+	c.deleteTransactionSocket(ts.id)
 }
 
 // some messages (client close and timeout) we must send this message to the routine - we can't throw them away if the buffer is full
 // otherwise the routine might never terminate properly
 // but also we can't block this goroutine by trying to write to riChan, because this could cause a deadlock if the route transaction goroutine tries to send a routine output to us.
 // solution - do both at once.
-// Returns true if roChan was closed during this loop.
-func (c *Client) sendMessageAndAvoidRoChanDeadlock(riw routineInputWrapper, ts *transactionSocket) bool {
-
-	roChanClosed := false
+func (c *Client) sendMessageAndAvoidRoChanDeadlock(riw routineInputWrapper, ts *transactionSocket) {
 
 AntiDeadlockLoop:
 	for {
 		if ts.status.done {
 			break AntiDeadlockLoop
 		}
+		c.makeRoom(ts.transaction)
 		select {
 		// try to send the message
 		case ts.transaction.riChan <- riw:
@@ -448,7 +1322,6 @@ AntiDeadlockLoop:
 		case ro, ok := <-ts.roChan:
 			if !ok {
 				ts.roChan = nil
-				roChanClosed = true
 				continue
 			}
 			// do usual processing stuff with the ro
@@ -459,24 +1332,37 @@ AntiDeadlockLoop:
 		}
 	}
 
-	return roChanClosed
-
 }
 
 // process RO for THIS client.
 func (c *Client) processRoutineOutput(t *transactionSocket, ro RoutineOutput) transactionStatus {
 	status := transactionStatus{}
 
-	for _, toClMsg := range ro.Msgs {
-		// write message
-		err := c.writeTransactionMessage(t.id, toClMsg)
-		if err != nil {
-			fmt.Printf("Error writing message: " + err.Error())
-		}
+	// written together, so that no other transaction's messages end up between them
+	var err error
+	if ro.Critical && c.criticalWriteRetries > 0 {
+		err = c.writeCriticalTransactionMessages(t.id, ro.Msgs)
+	} else {
+		err = c.writeTransactionMessages(t.id, ro.Msgs)
+	}
+	if err != nil {
+		c.Logger().Error("Error writing message", c.logFields(t.id, "error", err)...)
 	}
 	// set the timeout
 	if ro.TimeoutEnabled {
-		status.timeoutTimer = time.After(ro.TimeoutDuration)
+		status.timeoutTimer = c.Clock().After(ro.TimeoutDuration)
+	} else if ro.KeepTimeout {
+		status.timeoutTimer = t.status.timeoutTimer
+	}
+	// presence events stay subscribed once set
+	status.presenceEvents = t.status.presenceEvents
+	if ro.PresenceEvents != nil {
+		status.presenceEvents = ro.PresenceEvents
+	}
+	// a scheduled wake keeps running until it fires or is replaced
+	status.wakeTimer = t.status.wakeTimer
+	if ro.WakeAfter > 0 {
+		status.wakeTimer = c.Clock().After(ro.WakeAfter)
 	}
 
 	status.done = ro.Done
@@ -484,6 +1370,48 @@ func (c *Client) processRoutineOutput(t *transactionSocket, ro RoutineOutput) tr
 	return status
 }
 
+// like sendMessageAndAvoidRoChanDeadlock, but gives up once c.bufferWaitWindow has elapsed.
+// Returns whether the message was sent.
+func (c *Client) sendMessageWithinWindow(riw routineInputWrapper, ts *transactionSocket) bool {
+
+	if c.bufferWaitWindow <= 0 {
+		return false
+	}
+
+	window := time.NewTimer(c.bufferWaitWindow)
+	defer window.Stop()
+
+	for {
+		if ts.status.done {
+			return false
+		}
+		c.makeRoom(ts.transaction)
+		select {
+		case ts.transaction.riChan <- riw:
+			return true
+		case ro, ok := <-ts.roChan:
+			if !ok {
+				ts.roChan = nil
+				continue
+			}
+			ts.status = c.processRoutineOutput(ts, ro)
+			if ro.Done {
+				c.deleteTransactionSocket(ts.id)
+			}
+		case <-window.C:
+			return false
+		}
+	}
+}
+
+// with a SyncRouter, nothing else reads the riChan of the client's own transactions.
+// So if t's is full, make room in it by handling an input now.
+func (c *Client) makeRoom(t *transaction) {
+	if c.syncRouter != nil && len(t.riChan) == cap(t.riChan) {
+		c.syncRouter.stepTransaction(t)
+	}
+}
+
 // close leftover channels, causing routeTransactionSocket() goroutines which use those channels to close
 func (c *Client) closeDanglingChannels() {
 
@@ -511,10 +1439,83 @@ func (c *Client) closeDanglingChannels() {
 }
 
 // thread safe & blocking.
+// Closes the connection once c.maxWriteFailures writes in a row have failed, so that Route tears the client down and its peers are told it has disconnected.
 func (c *Client) writeTransactionMessage(transactionID [IDLEN]byte, msg string) error {
-	// concatenate transactionID and msg
-	msgWithId := append(transactionID[:], []byte(msg)...)
+	return c.writeTransactionMessages(transactionID, []string{msg})
+}
+
+// like writeTransactionMessage, but writes every message in msgs, in order, without any other write to the connection in between.
+// The rest are still written if one fails. Returns the errors of any that failed.
+func (c *Client) writeTransactionMessages(transactionID [IDLEN]byte, msgs []string) error {
+	defer c.connWriteLock.Unlock()
+	c.connWriteLock.Lock()
+	var errs []error
+	for _, msg := range msgs {
+		if err := c.writeTransactionMessageLocked(transactionID, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// like writeTransactionMessages, but if a message can't be written the connection is closed, since the peer would be left waiting for it, and the rest aren't written.
+// On a RecoverableConn, each message that fails to be written is tried again up to c.criticalWriteRetries times first, waiting longer each time.
+// Other Conns can't recover from a failed write, so they are closed straight away rather than holding up the client's other writes.
+func (c *Client) writeCriticalTransactionMessages(transactionID [IDLEN]byte, msgs []string) error {
+	ctxDone := c.routingContext().Done()
 	defer c.connWriteLock.Unlock()
 	c.connWriteLock.Lock()
-	return c.conn.WriteMessage(websocket.TextMessage, msgWithId)
+	for _, msg := range msgs {
+		if err := c.writeCriticalTransactionMessageLocked(transactionID, msg, ctxDone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// must hold connWriteLock. Other writes wait for the retries, so that messages stay in order.
+// Gives up retrying once ctxDone is closed.
+func (c *Client) writeCriticalTransactionMessageLocked(transactionID [IDLEN]byte, msg string, ctxDone <-chan struct{}) error {
+	backoff := CRITICAL_RETRY_BACKOFF
+	for retries := 0; ; retries++ {
+		err := c.conn.WriteMessage(websocket.TextMessage, c.framing.encode(transactionID, msg))
+		if err == nil {
+			c.writeFailures = 0
+			return nil
+		}
+		if retries == c.criticalWriteRetries || !c.canRetryWrite(err) {
+			c.Logger().Warn("Disconnecting client: critical message could not be written", c.logFields(transactionID, "retries", retries, "error", err)...)
+			c.closeConn(DisconnectReason_WriteFailures)
+			return err
+		}
+		c.Logger().Debug("Retrying critical message", c.logFields(transactionID, "error", err)...)
+		select {
+		case <-c.Clock().After(backoff):
+		case <-ctxDone:
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// whether writing again might succeed after a write to the connection failed with err.
+func (c *Client) canRetryWrite(err error) bool {
+	recoverable, ok := c.conn.(RecoverableConn)
+	return ok && recoverable.CanRetryWrite(err)
+}
+
+// must hold connWriteLock
+func (c *Client) writeTransactionMessageLocked(transactionID [IDLEN]byte, msg string) error {
+	// concatenate transactionID and msg, or put them in an envelope
+	err := c.conn.WriteMessage(websocket.TextMessage, c.framing.encode(transactionID, msg))
+	if err == nil {
+		c.writeFailures = 0
+		return nil
+	}
+	c.writeFailures += 1
+	if c.maxWriteFailures > 0 && c.writeFailures == c.maxWriteFailures {
+		c.Logger().Warn("Disconnecting client: writes are failing", "publicKey", c.logPk(), "writeFailures", c.writeFailures, "error", err)
+		c.closeConn(DisconnectReason_WriteFailures)
+	}
+	return err
 }
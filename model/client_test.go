@@ -1,13 +1,22 @@
 package model
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/xeipuuv/gojsonschema"
+	"github.com/gorilla/websocket"
 )
 
 type instantTimeoutRoutine struct {
@@ -55,159 +64,2250 @@ func (c *mockConn) WriteMessage(messageType int, data []byte) error {
 	c.outMsgs = append(c.outMsgs, data)
 	return nil
 }
+func (c *mockConn) Close() error {
+	return nil
+}
+func (c *mockConn) SetReadLimit(limit int64) {}
+func (c *mockConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (c *mockConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+func (c *mockConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return nil
+}
+
+// routine that replies "ok" to every message and never terminates by itself
+type idleRoutine struct{}
+
+func (r *idleRoutine) Next(args RoutineInput) []RoutineOutput {
+	switch args.MsgType {
+	case RoutineMsgType_UsrMsg:
+		return []RoutineOutput{MakeRoutineOutput(false, "ok")}
+	default:
+		return []RoutineOutput{}
+	}
+}
+
+// idleRoutine that closes ended when its transaction has ended
+type endHandlerRoutine struct {
+	idleRoutine
+	ended chan struct{}
+}
+
+func (r *endHandlerRoutine) Ended() {
+	close(r.ended)
+}
+
+// routine that arms a short timeout on the first message, and replies "kept" without touching it on later ones
+type keepTimeoutRoutine struct {
+	armed bool
+}
+
+func (r *keepTimeoutRoutine) Next(args RoutineInput) []RoutineOutput {
+	switch args.MsgType {
+	case RoutineMsgType_UsrMsg:
+		if !r.armed {
+			r.armed = true
+			out := MakeRoutineOutput(false, "armed")
+			out.TimeoutEnabled = true
+			out.TimeoutDuration = 50 * time.Millisecond
+			return []RoutineOutput{out}
+		}
+		out := MakeRoutineOutput(false, "kept")
+		out.KeepTimeout = true
+		return []RoutineOutput{out}
+	case RoutineMsgType_Timeout:
+		return []RoutineOutput{MakeRoutineOutput(true, "timed out")}
+	default:
+		return []RoutineOutput{}
+	}
+}
+
+// routine that asks to be woken after 50ms on the first message, replies "ok" to later ones, and replies "woken" when woken.
+type wakeRoutine struct {
+	scheduled bool
+}
+
+func (r *wakeRoutine) Next(args RoutineInput) []RoutineOutput {
+	switch args.MsgType {
+	case RoutineMsgType_UsrMsg:
+		if !r.scheduled {
+			r.scheduled = true
+			out := MakeRoutineOutput(false, "scheduled")
+			out.WakeAfter = 50 * time.Millisecond
+			return []RoutineOutput{out}
+		}
+		return []RoutineOutput{MakeRoutineOutput(false, "ok")}
+	case RoutineMsgType_SelfWake:
+		if args.Pk == nil {
+			return []RoutineOutput{MakeRoutineOutput(false, "woken without a public key")}
+		}
+		return []RoutineOutput{MakeRoutineOutput(false, "woken")}
+	default:
+		return []RoutineOutput{}
+	}
+}
+
+// routine that replies "ok" to every message and never terminates by itself. every input is also sent on inputs.
+type recordingRoutine struct {
+	inputs chan RoutineInput
+}
+
+func (r *recordingRoutine) Next(args RoutineInput) []RoutineOutput {
+	r.inputs <- args
+	if args.MsgType != RoutineMsgType_UsrMsg {
+		return []RoutineOutput{}
+	}
+	return []RoutineOutput{MakeRoutineOutput(false, "ok")}
+}
+
+// routine that messages pkB when the initiator messages it, and tells the initiator if that couldn't be delivered.
+type undeliverableRoutine struct {
+	pkB PublicKey
+}
+
+func (r *undeliverableRoutine) Next(args RoutineInput) []RoutineOutput {
+	if args.MsgType != RoutineMsgType_UsrMsg {
+		return []RoutineOutput{}
+	}
+	return []RoutineOutput{{Pk: &r.pkB, Msgs: []string{"ping"}}}
+}
+
+func (r *undeliverableRoutine) Undeliverable(args RoutineInput, pk PublicKey, ro RoutineOutput, reason UndeliverableReason) []RoutineOutput {
+	if reason == UndeliverableReason_AtCapacity {
+		return []RoutineOutput{MakeRoutineOutput(true, string(pk)+" is busy")}
+	}
+	return []RoutineOutput{MakeRoutineOutput(true, "undeliverable to "+string(pk))}
+}
+
+// routine that passes every message between the initiator and pkB, forever.
+type chatRoutine struct {
+	pkA *PublicKey
+	pkB PublicKey
+	// receives every input, if not nil
+	inputs chan RoutineInput
+}
+
+func (r *chatRoutine) Next(args RoutineInput) []RoutineOutput {
+	if r.inputs != nil {
+		r.inputs <- args
+	}
+	if args.MsgType != RoutineMsgType_UsrMsg {
+		return []RoutineOutput{}
+	}
+	if r.pkA == nil {
+		r.pkA = args.Pk
+	}
+	to := &r.pkB
+	if *args.Pk == r.pkB {
+		to = r.pkA
+	}
+	return []RoutineOutput{{Pk: to, Msgs: []string{"said " + args.Msg}}}
+}
+
+// mock Conn implementation which can be safely read from while the client is routing
+type chanConn struct {
+	fromCl    chan []byte
+	toCl      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	// set by SetReadLimit. 0 means no limit.
+	readLimit int64
+	// every deadline set and control message written, in order
+	deadlinesLock  sync.Mutex
+	readDeadlines  []time.Time
+	writeDeadlines []time.Time
+	controlMsgs    []controlMsg
+	// how many control messages had been written when the connection was closed
+	controlsBeforeClose int
+}
+
+// a call to WriteControl
+type controlMsg struct {
+	messageType int
+	data        []byte
+	deadline    time.Time
+}
+
+func newChanConn() *chanConn {
+	return &chanConn{
+		fromCl: make(chan []byte),
+		toCl:   make(chan []byte, 100),
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *chanConn) ReadMessage() (messageType int, p []byte, err error) {
+	select {
+	case <-c.done:
+		return 0, []byte{}, errors.New("connection closed")
+	case msg := <-c.fromCl:
+		if c.readLimit > 0 && int64(len(msg)) > c.readLimit {
+			return 0, []byte{}, websocket.ErrReadLimit
+		}
+		return 0, msg, nil
+	}
+}
+func (c *chanConn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+func (c *chanConn) WriteMessage(messageType int, data []byte) error {
+	c.toCl <- data
+	return nil
+}
+func (c *chanConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.deadlinesLock.Lock()
+		c.controlsBeforeClose = len(c.controlMsgs)
+		c.deadlinesLock.Unlock()
+		close(c.done)
+	})
+	return nil
+}
+func (c *chanConn) SetReadDeadline(t time.Time) error {
+	defer c.deadlinesLock.Unlock()
+	c.deadlinesLock.Lock()
+	c.readDeadlines = append(c.readDeadlines, t)
+	return nil
+}
+func (c *chanConn) SetWriteDeadline(t time.Time) error {
+	defer c.deadlinesLock.Unlock()
+	c.deadlinesLock.Lock()
+	c.writeDeadlines = append(c.writeDeadlines, t)
+	return nil
+}
+func (c *chanConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	defer c.deadlinesLock.Unlock()
+	c.deadlinesLock.Lock()
+	c.controlMsgs = append(c.controlMsgs, controlMsg{messageType, data, deadline})
+	return nil
+}
+
+// connection that records every write, and is slow to write so that other writers queue up behind it
+type slowConn struct {
+	mockConn
+	lock    sync.Mutex
+	written []string
+}
+
+func (c *slowConn) WriteMessage(messageType int, data []byte) error {
+	time.Sleep(100 * time.Microsecond)
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	c.written = append(c.written, string(data))
+	return nil
+}
+
+// chanConn whose writes fail while failWrites is set, or while failCount is above 0.
+// Like *websocket.Conn, every write fails once one has, unless recoverable is set.
+type failingConn struct {
+	*chanConn
+	failWrites atomic.Bool
+	// number of writes left to fail
+	failCount atomic.Int32
+	// whether writes can succeed after one has failed, and the conn says so as a RecoverableConn
+	recoverable bool
+	failed      atomic.Bool
+	// number of calls to WriteMessage
+	writes atomic.Int32
+}
+
+func (c *failingConn) WriteMessage(messageType int, data []byte) error {
+	c.writes.Add(1)
+	if (c.failed.Load() && !c.recoverable) || c.failWrites.Load() || c.failCount.Add(-1) >= 0 {
+		c.failed.Store(true)
+		return errors.New("write failed")
+	}
+	return c.chanConn.WriteMessage(messageType, data)
+}
+
+func (c *failingConn) CanRetryWrite(err error) bool {
+	return c.recoverable
+}
+
+type logEntry struct {
+	level   string
+	msg     string
+	keyvals []any
+}
+
+// Logger that records everything logged to it
+type capturingLogger struct {
+	entries []logEntry
+	lock    sync.Mutex
+}
+
+func (l *capturingLogger) log(level string, msg string, keyvals []any) {
+	defer l.lock.Unlock()
+	l.lock.Lock()
+	l.entries = append(l.entries, logEntry{level, msg, keyvals})
+}
+func (l *capturingLogger) Debug(msg string, keyvals ...any) { l.log("debug", msg, keyvals) }
+func (l *capturingLogger) Info(msg string, keyvals ...any)  { l.log("info", msg, keyvals) }
+func (l *capturingLogger) Warn(msg string, keyvals ...any)  { l.log("warn", msg, keyvals) }
+func (l *capturingLogger) Error(msg string, keyvals ...any) { l.log("error", msg, keyvals) }
+
+// find the first entry at level with the key-value pair key=value
+func (l *capturingLogger) find(level string, key string, value any) (logEntry, bool) {
+	defer l.lock.Unlock()
+	l.lock.Lock()
+	for _, entry := range l.entries {
+		if entry.level != level {
+			continue
+		}
+		for i := 0; i+1 < len(entry.keyvals); i += 2 {
+			if entry.keyvals[i] == key && entry.keyvals[i+1] == value {
+				return entry, true
+			}
+		}
+	}
+	return logEntry{}, false
+}
+
+// wait for the next message sent to the client
+func (c *chanConn) expectMsg(t *testing.T, id string, msg string) {
+	t.Helper()
+	select {
+	case data := <-c.toCl:
+		if string(data) != id+msg {
+			t.Errorf("Expected %s got %s", id+msg, string(data))
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected %s, got nothing", id+msg)
+	}
+}
+
+// wait for the next message sent to the client, whatever its transaction id. Returns the id.
+func (c *chanConn) expectMsgAnyId(t *testing.T, msg string) string {
+	t.Helper()
+	select {
+	case data := <-c.toCl:
+		if len(data) < IDLEN || string(data[IDLEN:]) != msg {
+			t.Errorf("Expected %s got %s", msg, string(data))
+			return ""
+		}
+		return string(data[:IDLEN])
+	case <-time.After(time.Second):
+		t.Errorf("Expected %s, got nothing", msg)
+		return ""
+	}
+}
+
+func (c *chanConn) expectNoMsg(t *testing.T) {
+	t.Helper()
+	select {
+	case data := <-c.toCl:
+		t.Errorf("Expected no message, got %s", string(data))
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// expect the connection to have been closed, after a close frame with code was written.
+func (c *chanConn) expectCloseFrame(t *testing.T, code int) {
+	t.Helper()
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the connection to be closed")
+	}
+	defer c.deadlinesLock.Unlock()
+	c.deadlinesLock.Lock()
+	for _, msg := range c.controlMsgs[:c.controlsBeforeClose] {
+		if msg.messageType != websocket.CloseMessage {
+			continue
+		}
+		if len(msg.data) < 2 || int(binary.BigEndian.Uint16(msg.data)) != code {
+			t.Errorf("Expected close code %d. Got close frame %v", code, msg.data)
+		}
+		return
+	}
+	t.Errorf("Expected a close frame before the connection was closed. Got %v", c.controlMsgs)
+}
+
+// routine that replies "done" to the first message and terminates.
+type instantDoneRoutine struct{}
+
+func (r *instantDoneRoutine) Next(args RoutineInput) []RoutineOutput {
+	if args.MsgType != RoutineMsgType_UsrMsg {
+		return []RoutineOutput{}
+	}
+	ro := MakeRoutineOutput(true, "done")
+	ro.DoneReason = DoneReason_Completed
+	return []RoutineOutput{ro}
+}
+
+// routine that replies "critical" to every message, in a critical output.
+type criticalRoutine struct{}
+
+func (r *criticalRoutine) Next(args RoutineInput) []RoutineOutput {
+	if args.MsgType != RoutineMsgType_UsrMsg {
+		return []RoutineOutput{}
+	}
+	return []RoutineOutput{{Msgs: []string{"critical"}, Critical: true}}
+}
+
+// routine that sends "ping" to pkB when the initiator messages it,
+// then finishes with "pong" to whoever replies from pkB and "answered" to the initiator.
+// every input is also sent on inputs.
+type relayRoutine struct {
+	pkA    *PublicKey
+	pkB    PublicKey
+	inputs chan RoutineInput
+}
+
+func (r *relayRoutine) Next(args RoutineInput) []RoutineOutput {
+	r.inputs <- args
+	if args.MsgType != RoutineMsgType_UsrMsg {
+		return []RoutineOutput{}
+	}
+	if r.pkA == nil {
+		r.pkA = args.Pk
+		return []RoutineOutput{{Pk: &r.pkB, Msgs: []string{"ping"}}}
+	}
+	return []RoutineOutput{
+		{Msgs: []string{"pong"}, Done: true},
+		{Pk: r.pkA, Msgs: []string{"answered"}, Done: true},
+	}
+}
+
+// routine that replies "ok" to every message, but only once gate is closed.
+// entered receives a value each time Next is called with a user message.
+type gatedRoutine struct {
+	gate    chan struct{}
+	entered chan struct{}
+}
+
+func (r *gatedRoutine) Next(args RoutineInput) []RoutineOutput {
+	if args.MsgType != RoutineMsgType_UsrMsg {
+		return []RoutineOutput{}
+	}
+	select {
+	case r.entered <- struct{}{}:
+	default:
+	}
+	<-r.gate
+	return []RoutineOutput{MakeRoutineOutput(false, "ok")}
+}
+
+// routine that terminates pkB's socket as soon as it is created, then messages pkB again in the same step.
+type terminatePeerRoutine struct {
+	pkB PublicKey
+}
+
+func (r *terminatePeerRoutine) Next(args RoutineInput) []RoutineOutput {
+	if args.MsgType != RoutineMsgType_UsrMsg {
+		return []RoutineOutput{}
+	}
+	return []RoutineOutput{
+		{Pk: &r.pkB, Msgs: []string{"notice"}, Done: true},
+		{Pk: &r.pkB, Msgs: []string{"again"}, Done: true},
+		{Msgs: []string{"sent"}, Done: true},
+	}
+}
+
+func TestClient(t *testing.T) {
+
+	t.Run("Rejects transactions over the limit", func(t *testing.T) {
+
+		const max = 3
+
+		conn := newChanConn()
+		client := MakeClient(conn, ClientOptions{MaxTransactions: max})
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &idleRoutine{}
+		})
+		defer conn.Close()
+
+		// open max transactions with distinct ids
+		for i := 0; i < max; i++ {
+			id := strings.Repeat(strconv.Itoa(i), IDLEN)
+			conn.fromCl <- []byte(id)
+			conn.expectMsg(t, id, "ok")
+		}
+
+		// the next is rejected
+		rejectedId := strings.Repeat(strconv.Itoa(max), IDLEN)
+		conn.fromCl <- []byte(rejectedId)
+		conn.expectMsg(t, rejectedId, `{"error":"Max number of transactions reached"}`)
+
+		// the first ones still work
+		for i := 0; i < max; i++ {
+			id := strings.Repeat(strconv.Itoa(i), IDLEN)
+			conn.fromCl <- []byte(id)
+			conn.expectMsg(t, id, "ok")
+		}
+	})
+
+	t.Run("Stale ids at the limit are told the transaction has terminated", func(t *testing.T) {
+
+		conn := newChanConn()
+		clock := &fakeClock{}
+		client := MakeClient(conn, ClientOptions{MaxTransactions: 1, Clock: clock})
+		routines := 0
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			routines++
+			if routines == 1 {
+				return &instantDoneRoutine{}
+			}
+			return &idleRoutine{}
+		})
+		defer conn.Close()
+
+		// the first transaction finishes straight away
+		staleId := strings.Repeat("s", IDLEN)
+		conn.fromCl <- []byte(staleId)
+		conn.expectMsg(t, staleId, "done")
+
+		deadline := time.Now().Add(time.Second)
+		for client.TransactionCount() != 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		// fill the limit with another
+		openId := strings.Repeat("o", IDLEN)
+		conn.fromCl <- []byte(openId)
+		conn.expectMsg(t, openId, "ok")
+
+		// a late message to the finished transaction isn't mistaken for a new one
+		conn.fromCl <- []byte(staleId)
+		conn.expectMsg(t, staleId, `{"error":"transaction has terminated"}`)
+
+		// ids that were never used are still over the limit
+		newId := strings.Repeat("n", IDLEN)
+		conn.fromCl <- []byte(newId)
+		conn.expectMsg(t, newId, `{"error":"Max number of transactions reached"}`)
+
+		// the closed id is forgotten after a while
+		clock.Advance(RECENTLY_CLOSED_WINDOW)
+		conn.fromCl <- []byte(staleId)
+		conn.expectMsg(t, staleId, `{"error":"Max number of transactions reached"}`)
+	})
+
+	t.Run("Lists open transactions", func(t *testing.T) {
+
+		conn := newChanConn()
+		clock := &fakeClock{}
+		client := MakeClient(conn, ClientOptions{Clock: clock})
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &idleRoutine{}
+		})
+		defer conn.Close()
+
+		ids := [][IDLEN]byte{}
+		for _, c := range []string{"a", "b"} {
+			var id [IDLEN]byte
+			copy(id[:], strings.Repeat(c, IDLEN))
+			ids = append(ids, id)
+			conn.fromCl <- id[:]
+			conn.expectMsg(t, string(id[:]), "ok")
+			clock.Advance(time.Second)
+		}
+
+		if got := client.ActiveTransactions(); !slices.Equal(got, ids) {
+			t.Errorf("Expected transactions %q. Got %q", ids, got)
+		}
+
+		expected := []TransactionInfo{
+			{Id: ids[0], Age: 2 * time.Second, Routine: "model.idleRoutine"},
+			{Id: ids[1], Age: time.Second, Routine: "model.idleRoutine"},
+		}
+		if got := client.DescribeTransactions(); !slices.Equal(got, expected) {
+			t.Errorf("Expected %+v. Got %+v", expected, got)
+		}
+	})
+
+	t.Run("Transaction limit holds under concurrent transaction creation", func(t *testing.T) {
+
+		const max = 5
+		const workers = 100
+
+		client := MakeClient(newChanConn(), ClientOptions{MaxTransactions: max})
+
+		// count of transactions open at once, checked while holding the lock
+		countWithinLimit := func() bool {
+			defer client.modifyTransactionsLock.Unlock()
+			client.modifyTransactionsLock.Lock()
+			return client.transactionCount <= max && len(client.transactionSockets) <= max
+		}
+
+		var wg sync.WaitGroup
+		var added atomic.Int32
+		var exceeded atomic.Bool
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var id [IDLEN]byte
+				copy(id[:], fmt.Sprintf("%0*d", IDLEN, i))
+
+				ts := client.newTransactionSocket(client.newTransaction(&idleRoutine{}), id)
+				ts.initiatedByClient = true
+				if client.addTransactionSocket(ts) != nil {
+					return
+				}
+				added.Add(1)
+				if !countWithinLimit() {
+					exceeded.Store(true)
+				}
+				// half of them finish, making room for others
+				if i%2 == 0 {
+					client.deleteTransactionSocket(id)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if exceeded.Load() {
+			t.Errorf("Transaction count exceeded the limit of %d", max)
+		}
+		if !countWithinLimit() {
+			t.Errorf("Expected at most %d transactions after the workers finished. Got %d", max, client.transactionCount)
+		}
+		if added.Load() < max {
+			t.Errorf("Expected at least %d transactions to be added. Got %d", max, added.Load())
+		}
+	})
+
+	t.Run("Absorbs a burst of messages while the routine is busy", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn, ClientOptions{BufferWaitWindow: time.Second})
+		routine := &gatedRoutine{gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return routine
+		})
+		defer conn.Close()
+
+		id := strings.Repeat("b", IDLEN)
+		conn.fromCl <- []byte(id)
+		<-routine.entered
+
+		// more than the buffer can hold while the routine is stuck on the first message
+		const burst = RI_BUFFER_SIZE + 3
+		for i := 0; i < burst; i++ {
+			conn.fromCl <- []byte(id)
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(routine.gate)
+
+		for i := 0; i < burst+1; i++ {
+			conn.expectMsg(t, id, "ok")
+		}
+		conn.expectNoMsg(t)
+	})
+
+	t.Run("Rejects messages once the buffer wait window has elapsed", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn, ClientOptions{BufferWaitWindow: 20 * time.Millisecond})
+		routine := &gatedRoutine{gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return routine
+		})
+		defer conn.Close()
+
+		id := strings.Repeat("b", IDLEN)
+		conn.fromCl <- []byte(id)
+		<-routine.entered
+
+		// fill the buffer, then one more
+		for i := 0; i < RI_BUFFER_SIZE+1; i++ {
+			conn.fromCl <- []byte(id)
+		}
+		conn.expectMsg(t, id, `{"error":"buffer occupied"}`)
+
+		close(routine.gate)
+		for i := 0; i < RI_BUFFER_SIZE+1; i++ {
+			conn.expectMsg(t, id, "ok")
+		}
+		conn.expectNoMsg(t)
+	})
+
+	t.Run("Rate limits messages", func(t *testing.T) {
+
+		conn := newChanConn()
+		clock := &fakeClock{}
+		client := MakeClient(conn, ClientOptions{MessageRate: 2, MessageBurst: 3, Clock: clock})
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &idleRoutine{}
+		})
+		defer conn.Close()
+
+		// each in its own transaction, so that the replies can come in any order
+		replies := func(ids ...string) map[string]string {
+			t.Helper()
+			for _, id := range ids {
+				conn.fromCl <- []byte(id)
+			}
+			got := make(map[string]string)
+			for range ids {
+				select {
+				case data := <-conn.toCl:
+					got[string(data[:IDLEN])] = string(data[IDLEN:])
+				case <-time.After(time.Second):
+					t.Fatalf("Expected %d replies, got %v", len(ids), got)
+				}
+			}
+			return got
+		}
+		ids := func(prefix string, n int) []string {
+			ids := make([]string, n)
+			for i := range ids {
+				ids[i] = prefix + strconv.Itoa(i) + strings.Repeat("x", IDLEN-len(prefix)-1)
+			}
+			return ids
+		}
+
+		// a burst over the limit
+		burst := replies(ids("b", 5)...)
+		ok, limited := 0, 0
+		for _, reply := range burst {
+			switch reply {
+			case "ok":
+				ok++
+			case `{"error":"rate limited"}`:
+				limited++
+			default:
+				t.Errorf("Unexpected reply %s", reply)
+			}
+		}
+		if ok != 3 || limited != 2 {
+			t.Errorf("Expected the burst to allow 3 messages and limit 2. Got %v", burst)
+		}
+
+		// messages at the steady rate get through
+		for i := 0; i < 3; i++ {
+			clock.Advance(500 * time.Millisecond)
+			id := ids("s"+strconv.Itoa(i), 1)[0]
+			if reply := replies(id)[id]; reply != "ok" {
+				t.Errorf("Expected a message at the steady rate to be allowed. Got %s", reply)
+			}
+		}
+
+		// messages to open transactions are limited too
+		id := ids("s0", 1)[0]
+		conn.fromCl <- []byte(id)
+		conn.expectMsg(t, id, `{"error":"rate limited"}`)
+		conn.expectNoMsg(t)
+	})
+
+	t.Run("Disconnects clients that send a message over the size limit", func(t *testing.T) {
+
+		const max = 32
+
+		conn := newChanConn()
+		logger := &capturingLogger{}
+		client := MakeClient(conn, ClientOptions{MaxMessageSize: max, Logger: logger})
+		routeReturned := make(chan struct{})
+		go func() {
+			client.Route(context.Background(), NewHub(), func() Routine {
+				return &idleRoutine{}
+			})
+			close(routeReturned)
+		}()
+		defer conn.Close()
+
+		// the limit doesn't count the transaction id
+		id := strings.Repeat("c", IDLEN)
+		conn.fromCl <- []byte(id + strings.Repeat("a", max))
+		conn.expectMsg(t, id, "ok")
+
+		conn.fromCl <- []byte(id + strings.Repeat("a", max+1))
+		select {
+		case <-routeReturned:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected Route to return after an oversized message")
+		}
+
+		if conn.readLimit != IDLEN+max {
+			t.Errorf("Expected a read limit of %d got %d", IDLEN+max, conn.readLimit)
+		}
+		if _, found := logger.find("warn", "maxMessageSize", max); !found {
+			t.Errorf("Expected the oversized message to be logged")
+		}
+	})
+
+	t.Run("Closes dangling channels once all transactions have been deleted after disconnecting", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn)
+		routeReturned := make(chan struct{})
+		go func() {
+			client.Route(context.Background(), NewHub(), func() Routine {
+				return &idleRoutine{}
+			})
+			close(routeReturned)
+		}()
+
+		// several in-flight transactions
+		for i := 0; i < 5; i++ {
+			id := strings.Repeat(strconv.Itoa(i), IDLEN)
+			conn.fromCl <- []byte(id)
+			conn.expectMsg(t, id, "ok")
+		}
+
+		conn.Close()
+		<-routeReturned
+
+		cleanedUp := func() bool {
+			defer client.modifyTransactionsLock.Unlock()
+			client.modifyTransactionsLock.Lock()
+			defer client.modifyDanglingClientMsgChannelsLock.Unlock()
+			client.modifyDanglingClientMsgChannelsLock.Lock()
+			defer client.modifyDanglingClientCloseChannelsLock.Unlock()
+			client.modifyDanglingClientCloseChannelsLock.Lock()
+			return len(client.transactionSockets) == 0 &&
+				len(client.danglingClientMsgChannels) == 0 &&
+				len(client.danglingClientCloseChannels) == 0
+		}
+
+		// well within the old fixed delay of 10 seconds
+		deadline := time.After(time.Second)
+		for !cleanedUp() {
+			select {
+			case <-deadline:
+				t.Fatalf("Expected all transactions deleted and dangling channels closed")
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
+
+	t.Run("Disconnect sends a control message and makes Route return", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn)
+		routeReturned := make(chan struct{})
+		go func() {
+			client.Route(context.Background(), NewHub(), func() Routine {
+				return &idleRoutine{}
+			})
+			close(routeReturned)
+		}()
+
+		id := strings.Repeat("0", IDLEN)
+		conn.fromCl <- []byte(id)
+		conn.expectMsg(t, id, "ok")
+
+		client.Disconnect(DisconnectReason_ServerShutdown, `{"terminate":"serverShutdown"}`)
+		conn.expectMsg(t, string(CONTROL_ID[:]), `{"terminate":"serverShutdown"}`)
+		conn.expectCloseFrame(t, websocket.CloseGoingAway)
+
+		select {
+		case <-routeReturned:
+		case <-time.After(time.Second):
+			t.Errorf("Expected Route to return after Disconnect")
+		}
+	})
+
+	t.Run("Write failures", func(t *testing.T) {
+
+		// starts Route and returns a channel that is closed when it returns
+		route := func(client *Client, hub *Hub, routine Routine) chan struct{} {
+			routeReturned := make(chan struct{})
+			go func() {
+				client.Route(context.Background(), hub, func() Routine {
+					return routine
+				})
+				close(routeReturned)
+			}()
+			return routeReturned
+		}
+
+		t.Run("Client is disconnected once the threshold is reached", func(t *testing.T) {
+			conn := &failingConn{chanConn: newChanConn()}
+			conn.failWrites.Store(true)
+			logger := &capturingLogger{}
+			client := MakeClient(conn, ClientOptions{MaxWriteFailures: 3, Logger: logger})
+			routeReturned := route(&client, NewHub(), &idleRoutine{})
+			defer conn.Close()
+
+			// each message gets an "ok" that fails to send
+			id := strings.Repeat("a", IDLEN)
+			for i := 0; i < 2; i++ {
+				conn.fromCl <- []byte(id)
+			}
+			select {
+			case <-routeReturned:
+				t.Fatalf("Expected the client to stay connected below the threshold")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			conn.fromCl <- []byte(id)
+			select {
+			case <-routeReturned:
+			case <-time.After(time.Second):
+				t.Fatalf("Expected Route to return once the threshold was reached")
+			}
+			conn.expectCloseFrame(t, websocket.CloseInternalServerErr)
+			if _, found := logger.find("warn", "writeFailures", 3); !found {
+				t.Errorf("Expected the disconnect to be logged")
+			}
+		})
+
+		t.Run("Critical messages are retried on connections that can recover", func(t *testing.T) {
+			conn := &failingConn{chanConn: newChanConn(), recoverable: true}
+			conn.failCount.Store(1)
+			// a single failure would disconnect the client if the message wasn't retried
+			client := MakeClient(conn, ClientOptions{MaxWriteFailures: 1, CriticalWriteRetries: 2})
+			routeReturned := route(&client, NewHub(), &criticalRoutine{})
+			defer conn.Close()
+
+			id := strings.Repeat("a", IDLEN)
+			conn.fromCl <- []byte(id)
+			conn.expectMsg(t, id, "critical")
+			select {
+			case <-routeReturned:
+				t.Errorf("Expected the client to stay connected once the retry succeeded")
+			case <-time.After(20 * time.Millisecond):
+			}
+		})
+
+		t.Run("Client is disconnected once critical retries run out", func(t *testing.T) {
+			conn := &failingConn{chanConn: newChanConn(), recoverable: true}
+			conn.failCount.Store(3)
+			// the count of failures in a row never disconnects, so the retries are what give up
+			client := MakeClient(conn, ClientOptions{MaxWriteFailures: 0, CriticalWriteRetries: 2})
+			routeReturned := route(&client, NewHub(), &criticalRoutine{})
+			defer conn.Close()
+
+			conn.fromCl <- []byte(strings.Repeat("a", IDLEN))
+			select {
+			case <-routeReturned:
+			case <-time.After(time.Second):
+				t.Fatalf("Expected Route to return once the retries ran out")
+			}
+			conn.expectCloseFrame(t, websocket.CloseInternalServerErr)
+		})
+
+		t.Run("Critical messages aren't retried on connections that can't recover", func(t *testing.T) {
+			conn := &failingConn{chanConn: newChanConn()}
+			conn.failCount.Store(1)
+			// retrying would hold up the client's other writes for nothing, since every later write fails too
+			client := MakeClient(conn, ClientOptions{MaxWriteFailures: 0, CriticalWriteRetries: 3})
+			routeReturned := route(&client, NewHub(), &criticalRoutine{})
+			defer conn.Close()
+
+			conn.fromCl <- []byte(strings.Repeat("a", IDLEN))
+			select {
+			case <-routeReturned:
+			case <-time.After(time.Second):
+				t.Fatalf("Expected Route to return once the critical message failed")
+			}
+			if writes := conn.writes.Load(); writes != 1 {
+				t.Errorf("Expected the critical message to be written once, got %d writes", writes)
+			}
+		})
+
+		t.Run("A successful write resets the count", func(t *testing.T) {
+			conn := &failingConn{chanConn: newChanConn(), recoverable: true}
+			client := MakeClient(conn, ClientOptions{MaxWriteFailures: 2})
+			routeReturned := route(&client, NewHub(), &idleRoutine{})
+			defer conn.Close()
+
+			id := strings.Repeat("a", IDLEN)
+			for i := 0; i < 3; i++ {
+				conn.failWrites.Store(true)
+				conn.fromCl <- []byte(id)
+				// wait for the failed write before letting the next one through
+				time.Sleep(10 * time.Millisecond)
+				conn.failWrites.Store(false)
+				conn.fromCl <- []byte(id)
+				conn.expectMsg(t, id, "ok")
+			}
+			select {
+			case <-routeReturned:
+				t.Errorf("Expected the client to stay connected when failures are not consecutive")
+			default:
+			}
+		})
+
+		t.Run("0 never disconnects", func(t *testing.T) {
+			conn := &failingConn{chanConn: newChanConn()}
+			conn.failWrites.Store(true)
+			client := MakeClient(conn, ClientOptions{MaxWriteFailures: 0})
+			routeReturned := route(&client, NewHub(), &idleRoutine{})
+			defer conn.Close()
+
+			id := strings.Repeat("a", IDLEN)
+			for i := 0; i < 10; i++ {
+				conn.fromCl <- []byte(id)
+			}
+			select {
+			case <-routeReturned:
+				t.Errorf("Expected the client to stay connected")
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+
+		t.Run("Peers are told that the client disconnected", func(t *testing.T) {
+			hub := NewHub()
+			routine := &relayRoutine{pkB: pk1, inputs: make(chan RoutineInput, 10)}
+
+			connA := newChanConn()
+			clientA := MakeClient(connA)
+			clientA.SetPublicKey(&pk0)
+			hub.AddClient(pk0, &clientA)
+			route(&clientA, hub, routine)
+			defer connA.Close()
+
+			// a single failed write is fatal for B
+			connB := &failingConn{chanConn: newChanConn()}
+			connB.failWrites.Store(true)
+			clientB := MakeClient(connB, ClientOptions{MaxWriteFailures: 1})
+			clientB.SetPublicKey(&pk1)
+			hub.AddClient(pk1, &clientB)
+			routeReturnedB := make(chan struct{})
+			go func() {
+				clientB.Route(context.Background(), hub, func() Routine { return &idleRoutine{} })
+				close(routeReturnedB)
+			}()
+			defer connB.Close()
+
+			connA.fromCl <- []byte(strings.Repeat("a", IDLEN))
+			select {
+			case <-routeReturnedB:
+			case <-time.After(time.Second):
+				t.Fatalf("Expected B to be disconnected after the ping failed to send")
+			}
+
+			deadline := time.After(time.Second)
+			for {
+				select {
+				case input := <-routine.inputs:
+					if input.MsgType == RoutineMsgType_ClientClose && input.Pk != nil && *input.Pk == pk1 {
+						return
+					}
+				case <-deadline:
+					t.Fatalf("Expected the routine to be told that B disconnected")
+				}
+			}
+		})
+	})
+
+	t.Run("Idle timeout", func(t *testing.T) {
+
+		idleTimeout := 50 * time.Millisecond
+
+		// starts Route and returns a channel that is closed when it returns
+		route := func(client *Client) chan struct{} {
+			routeReturned := make(chan struct{})
+			go func() {
+				client.Route(context.Background(), NewHub(), func() Routine {
+					return &idleRoutine{}
+				})
+				close(routeReturned)
+			}()
+			return routeReturned
+		}
+
+		t.Run("Silent client is disconnected", func(t *testing.T) {
+			conn := newChanConn()
+			logger := &capturingLogger{}
+			client := MakeClient(conn, ClientOptions{IdleTimeout: idleTimeout, Logger: logger})
+			routeReturned := route(&client)
+
+			select {
+			case <-routeReturned:
+			case <-time.After(time.Second):
+				t.Fatalf("Expected Route to return after the idle timeout")
+			}
+			conn.expectCloseFrame(t, websocket.CloseNormalClosure)
+			if _, found := logger.find("warn", "idleTimeout", idleTimeout); !found {
+				t.Errorf("Expected the disconnect to be logged")
+			}
+		})
+
+		t.Run("Messages reset the timer", func(t *testing.T) {
+			conn := newChanConn()
+			client := MakeClient(conn, ClientOptions{IdleTimeout: idleTimeout})
+			routeReturned := route(&client)
+			defer conn.Close()
+
+			// too short to start a transaction, but still activity
+			for i := 0; i < 5; i++ {
+				time.Sleep(idleTimeout / 2)
+				conn.fromCl <- []byte("hi")
+			}
+			select {
+			case <-routeReturned:
+				t.Errorf("Expected the client to stay connected while it is sending messages")
+			default:
+			}
+		})
+
+		t.Run("Client with an open transaction is not disconnected", func(t *testing.T) {
+			conn := newChanConn()
+			client := MakeClient(conn, ClientOptions{IdleTimeout: idleTimeout})
+			routeReturned := route(&client)
+			defer conn.Close()
+
+			id := strings.Repeat("a", IDLEN)
+			conn.fromCl <- []byte(id)
+			conn.expectMsg(t, id, "ok")
+
+			select {
+			case <-routeReturned:
+				t.Errorf("Expected the client to stay connected")
+			case <-time.After(3 * idleTimeout):
+			}
+		})
+
+		t.Run("Client with a public key is not disconnected", func(t *testing.T) {
+			conn := newChanConn()
+			client := MakeClient(conn, ClientOptions{IdleTimeout: idleTimeout})
+			client.SetPublicKey(&pk0)
+			routeReturned := route(&client)
+			defer conn.Close()
+
+			select {
+			case <-routeReturned:
+				t.Errorf("Expected the client to stay connected")
+			case <-time.After(3 * idleTimeout):
+			}
+		})
+	})
+
+	t.Run("Rejects messages sent with the control id", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn)
+		routineCount := 0
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			routineCount += 1
+			return &idleRoutine{}
+		})
+		defer conn.Close()
+
+		controlId := string(CONTROL_ID[:])
+		conn.fromCl <- []byte(controlId)
+		conn.expectMsg(t, controlId, `{"error":"transaction id is reserved"}`)
+
+		// Route has moved on to the next read, so routineCount is no longer being written
+		conn.fromCl <- []byte(strings.Repeat("1", IDLEN))
+		conn.expectMsg(t, strings.Repeat("1", IDLEN), "ok")
+		if routineCount != 1 {
+			t.Errorf("Expected 1 routine to be created. Got %d", routineCount)
+		}
+	})
+
+	t.Run("Clients can close a single transaction", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn)
+		inputs := make(chan RoutineInput, 10)
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &recordingRoutine{inputs: inputs}
+		})
+		defer conn.Close()
+
+		controlId := string(CONTROL_ID[:])
+		idA := strings.Repeat("a", IDLEN)
+		idB := strings.Repeat("b", IDLEN)
+		conn.fromCl <- []byte(idA)
+		conn.expectMsg(t, idA, "ok")
+		conn.fromCl <- []byte(idB)
+		conn.expectMsg(t, idB, "ok")
+		<-inputs
+		<-inputs
+
+		conn.fromCl <- []byte(controlId + `{"closeTransaction":"` + idA + `"}`)
+		select {
+		case input := <-inputs:
+			if input.MsgType != RoutineMsgType_ClientClose {
+				t.Errorf("Expected the routine to get a client close. Got %v", input)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the routine to get a client close")
+		}
+
+		// the other transaction, and the connection, carry on
+		conn.fromCl <- []byte(idB + "again")
+		conn.expectMsg(t, idB, "ok")
+		<-inputs
+		// the closed socket is deleted on its own goroutine
+		deadline := time.Now().Add(time.Second)
+		for client.TransactionCount() != 1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if count := client.TransactionCount(); count != 1 {
+			t.Errorf("Expected 1 open transaction. Got %d", count)
+		}
+
+		conn.fromCl <- []byte(controlId + `{"closeTransaction":"` + strings.Repeat("z", IDLEN) + `"}`)
+		conn.expectMsg(t, controlId, `{"error":"transaction does not exist"}`)
+
+		// the closed id can be used for a new transaction
+		conn.fromCl <- []byte(idA)
+		conn.expectMsg(t, idA, "ok")
+	})
+
+	t.Run("Counts the reasons transaction sockets were ended for", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn)
+		hub := NewHub()
+		metrics := NewCounters()
+		hub.SetMetrics(metrics)
+		go client.Route(context.Background(), hub, func() Routine {
+			return &instantDoneRoutine{}
+		})
+		defer conn.Close()
+
+		idA := strings.Repeat("a", IDLEN)
+		idB := strings.Repeat("b", IDLEN)
+		conn.fromCl <- []byte(idA)
+		conn.expectMsg(t, idA, "done")
+		conn.fromCl <- []byte(idB)
+		conn.expectMsg(t, idB, "done")
+
+		labels := MetricLabels{Routine: "model.instantDoneRoutine", Reason: "completed"}
+		if count := metrics.GetLabelled(METRIC_TRANSACTIONS_ENDED, labels); count != 2 {
+			t.Errorf("Expected 2 transactions to have ended with %+v. Got %d", labels, count)
+		}
+		if counts := metrics.GetAllLabelled(METRIC_TRANSACTIONS_ENDED); len(counts) != 1 {
+			t.Errorf("Expected transactions to have ended for one reason. Got %v", counts)
+		}
+	})
+
+	t.Run("Routines get the last will of clients that disconnect", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn)
+		inputs := make(chan RoutineInput, 10)
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &recordingRoutine{inputs: inputs}
+		})
+		defer conn.Close()
+		nextClose := func() RoutineInput {
+			t.Helper()
+			for {
+				select {
+				case input := <-inputs:
+					if input.MsgType == RoutineMsgType_ClientClose {
+						return input
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Expected the routine to get a client close")
+				}
+			}
+		}
+
+		controlId := string(CONTROL_ID[:])
+		for _, bad := range []string{`"networkLost"`, `[1]`, `{"reason":"` + strings.Repeat("a", MAX_LAST_WILL_SIZE) + `"}`} {
+			conn.fromCl <- []byte(controlId + `{"lastWill":` + bad + `}`)
+			conn.expectMsg(t, controlId, `{"error":"last will must be a JSON object of at most 1024 bytes"}`)
+		}
+		conn.fromCl <- []byte(controlId + `{"lastWill":{"reason":"networkLost"}}`)
+		conn.expectNoMsg(t)
+
+		idA := strings.Repeat("a", IDLEN)
+		idB := strings.Repeat("b", IDLEN)
+		conn.fromCl <- []byte(idA)
+		conn.expectMsg(t, idA, "ok")
+		conn.fromCl <- []byte(idB)
+		conn.expectMsg(t, idB, "ok")
+
+		// closing one transaction isn't disconnecting
+		conn.fromCl <- []byte(controlId + `{"closeTransaction":"` + idA + `"}`)
+		if input := nextClose(); input.LastWill != "" {
+			t.Errorf("Expected no last will when closing a transaction. Got %s", input.LastWill)
+		}
+
+		conn.Close()
+		if input := nextClose(); input.LastWill != `{"reason":"networkLost"}` {
+			t.Errorf("Expected the last will. Got %q", input.LastWill)
+		}
+	})
+
+	t.Run("Mock connections record deadlines and control messages", func(t *testing.T) {
+
+		chConn := newChanConn()
+		var conn Conn = chConn
+		readAt := time.Now().Add(time.Second)
+		writeAt := readAt.Add(time.Second)
+
+		if err := conn.SetReadDeadline(readAt); err != nil {
+			t.Fatalf("SetReadDeadline: %v", err)
+		}
+		if err := conn.SetWriteDeadline(writeAt); err != nil {
+			t.Fatalf("SetWriteDeadline: %v", err)
+		}
+		// clearing a deadline is recorded too
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			t.Fatalf("SetReadDeadline: %v", err)
+		}
+		if err := conn.WriteControl(websocket.PingMessage, []byte("ping"), writeAt); err != nil {
+			t.Fatalf("WriteControl: %v", err)
+		}
+
+		if !slices.Equal(chConn.readDeadlines, []time.Time{readAt, {}}) {
+			t.Errorf("Expected read deadlines %v then zero. Got %v", readAt, chConn.readDeadlines)
+		}
+		if !slices.Equal(chConn.writeDeadlines, []time.Time{writeAt}) {
+			t.Errorf("Expected write deadline %v. Got %v", writeAt, chConn.writeDeadlines)
+		}
+		if len(chConn.controlMsgs) != 1 {
+			t.Fatalf("Expected 1 control message. Got %d", len(chConn.controlMsgs))
+		}
+		control := chConn.controlMsgs[0]
+		if control.messageType != websocket.PingMessage || string(control.data) != "ping" || !control.deadline.Equal(writeAt) {
+			t.Errorf("Expected a ping with deadline %v. Got %v", writeAt, control)
+		}
+	})
 
-func TestClient(t *testing.T) {
+	t.Run("Messages of one routine output are not interleaved with other writes", func(t *testing.T) {
+
+		conn := &slowConn{}
+		client := MakeClient(conn)
+
+		const sockets = 10
+		const outputsPerSocket = 2
+		const msgsPerOutput = 10
+		msgs := make([]string, msgsPerOutput)
+		for i := range msgs {
+			msgs[i] = strconv.Itoa(i)
+		}
+
+		// several transactions on the same connection write at once, each with several outputs
+		var wg sync.WaitGroup
+		for i := 0; i < sockets; i++ {
+			ts := &transactionSocket{id: ([IDLEN]byte)([]byte(fmt.Sprintf("%0*d", IDLEN, i)))}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < outputsPerSocket; j++ {
+					client.processRoutineOutput(ts, RoutineOutput{Msgs: msgs})
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(conn.written) != sockets*outputsPerSocket*msgsPerOutput {
+			t.Fatalf("Expected %d messages. Got %d", sockets*outputsPerSocket*msgsPerOutput, len(conn.written))
+		}
+		// every output is written as one run of messages
+		for start := 0; start < len(conn.written); start += msgsPerOutput {
+			id := conn.written[start][:IDLEN]
+			for i, msg := range msgs {
+				written := conn.written[start+i]
+				if written != id+msg {
+					t.Fatalf("Expected %s%s at %d. Got %s", id, msg, start+i, written)
+				}
+			}
+		}
+	})
+
+	t.Run("Logs malformed messages with the transaction id", func(t *testing.T) {
+
+		conn := newChanConn()
+		logger := &capturingLogger{}
+		options := DefaultClientOptions()
+		options.Logger = logger
+		client := MakeClient(conn, options)
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &idleRoutine{}
+		})
+		defer conn.Close()
+
+		controlId := string(CONTROL_ID[:])
+		conn.fromCl <- []byte(controlId)
+		conn.expectMsg(t, controlId, `{"error":"transaction id is reserved"}`)
+
+		entry, found := logger.find("warn", "transactionId", controlId)
+		if !found {
+			t.Fatalf("Expected a warning with the transaction id. Got %v", logger.entries)
+		}
+		if !strings.Contains(entry.msg, "Malformed message") {
+			t.Errorf("Expected a malformed message warning. Got %s", entry.msg)
+		}
+	})
+
+	t.Run("Sends to every device of a public key and the first to reply wins", func(t *testing.T) {
+
+		hub := NewHub()
+		routine := &relayRoutine{pkB: pk1, inputs: make(chan RoutineInput, 10)}
+
+		// A, and B signed in on two devices
+		connA := newChanConn()
+		clientA := MakeClient(connA)
+		clientA.SetPublicKey(&pk0)
+		hub.AddClient(pk0, &clientA)
+		go clientA.Route(context.Background(), hub, func() Routine { return routine })
+		defer connA.Close()
+
+		connsB := []*chanConn{newChanConn(), newChanConn()}
+		for _, conn := range connsB {
+			clientB := MakeClient(conn)
+			clientB.SetPublicKey(&pk1)
+			hub.AddClient(pk1, &clientB)
+			go clientB.Route(context.Background(), hub, func() Routine { return &idleRoutine{} })
+			defer conn.Close()
+		}
+
+		idA := strings.Repeat("a", IDLEN)
+		connA.fromCl <- []byte(idA)
+		idB0 := connsB[0].expectMsgAnyId(t, "ping")
+		connsB[1].expectMsgAnyId(t, "ping")
+
+		// the first device replies
+		connsB[0].fromCl <- []byte(idB0)
+		connsB[0].expectMsg(t, idB0, "pong")
+		connsB[1].expectMsgAnyId(t, `{"terminate":"cancel","error":"Answered on another device"}`)
+		connA.expectMsg(t, idA, "answered")
+	})
+
+	t.Run("Transactions are cancelled for everyone once they exceed their lifetime", func(t *testing.T) {
+
+		hub := NewHub()
+		lifetime := 100 * time.Millisecond
+
+		connA := newChanConn()
+		options := DefaultClientOptions()
+		options.MaxTransactionLifetime = lifetime
+		clientA := MakeClient(connA, options)
+		clientA.SetPublicKey(&pk0)
+		hub.AddClient(pk0, &clientA)
+		go clientA.Route(context.Background(), hub, func() Routine { return &chatRoutine{pkB: pk1} })
+		defer connA.Close()
+
+		connB := newChanConn()
+		clientB := MakeClient(connB)
+		clientB.SetPublicKey(&pk1)
+		hub.AddClient(pk1, &clientB)
+		go clientB.Route(context.Background(), hub, func() Routine { return &idleRoutine{} })
+		defer connB.Close()
+
+		idA := strings.Repeat("a", IDLEN)
+		connA.fromCl <- []byte(idA + "hello")
+		idB := connB.expectMsgAnyId(t, "said hello")
+
+		// keep the transaction busy for a while, but not for the whole lifetime
+		for i := 0; i < 3; i++ {
+			time.Sleep(lifetime / 10)
+			connB.fromCl <- []byte(idB + "hi")
+			connA.expectMsg(t, idA, "said hi")
+			connA.fromCl <- []byte(idA + "hi")
+			connB.expectMsg(t, idB, "said hi")
+		}
+
+		cancelMsg := `{"terminate":"cancel","error":"Transaction lifetime exceeded"}`
+		connA.expectMsg(t, idA, cancelMsg)
+		connB.expectMsg(t, idB, cancelMsg)
+
+		deadline := time.Now().Add(time.Second)
+		for clientA.TransactionCount() != 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if count := clientA.TransactionCount(); count != 0 {
+			t.Errorf("Expected the transaction to be deleted. %d left", count)
+		}
+	})
+
+	t.Run("Routines are told when their transaction has ended", func(t *testing.T) {
+
+		conn := newChanConn()
+		options := DefaultClientOptions()
+		options.MaxTransactionLifetime = 50 * time.Millisecond
+		client := MakeClient(conn, options)
+		ended := make(chan struct{})
+		go client.Route(context.Background(), NewHub(), func() Routine { return &endHandlerRoutine{ended: ended} })
+		defer conn.Close()
+
+		id := strings.Repeat("a", IDLEN)
+		conn.fromCl <- []byte(id)
+		conn.expectMsg(t, id, "ok")
+		select {
+		case <-ended:
+			t.Fatalf("Expected the routine not to be told the transaction ended while it is open")
+		default:
+		}
+
+		// cancelled without the routine's involvement
+		conn.expectMsg(t, id, `{"terminate":"cancel","error":"Transaction lifetime exceeded"}`)
+		select {
+		case <-ended:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the routine to be told the transaction ended")
+		}
+	})
+
+	t.Run("Routines are told about outputs to clients that aren't online", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn)
+		client.SetPublicKey(&pk0)
+		go client.Route(context.Background(), NewHub(), func() Routine { return &undeliverableRoutine{pkB: pk1} })
+		defer conn.Close()
+
+		id := strings.Repeat("a", IDLEN)
+		conn.fromCl <- []byte(id)
+		conn.expectMsg(t, id, "undeliverable to "+string(pk1))
+	})
+
+	t.Run("Outputs wait for a client that signs in within the peer lookup grace", func(t *testing.T) {
+
+		// the grace never runs out
+		hub := NewHub()
+		hub.SetClock(&fakeClock{})
+
+		connA := newChanConn()
+		clientA := MakeClient(connA)
+		clientA.SetPublicKey(&pk0)
+		go clientA.Route(context.Background(), hub, func() Routine { return &undeliverableRoutine{pkB: pk1} })
+		defer connA.Close()
+
+		idA := strings.Repeat("a", IDLEN)
+		connA.fromCl <- []byte(idA)
+		// wait for the transaction to be watching for B to sign in
+		for {
+			hub.lock.Lock()
+			waiting := len(hub.subscribers[pk1]) > 0
+			hub.lock.Unlock()
+			if waiting {
+				break
+			}
+			runtime.Gosched()
+		}
+
+		connB := newChanConn()
+		clientB := MakeClient(connB)
+		clientB.SetPublicKey(&pk1)
+		go clientB.Route(context.Background(), hub, func() Routine { return &idleRoutine{} })
+		defer connB.Close()
+		// B is routing by the time it has replied
+		idB := strings.Repeat("b", IDLEN)
+		connB.fromCl <- []byte(idB)
+		connB.expectMsg(t, idB, "ok")
+		hub.AddClient(pk1, &clientB)
+
+		connB.expectMsgAnyId(t, "ping")
+		connA.expectNoMsg(t)
+	})
+
+	t.Run("Terminating a peer in its first routine output cleans up its new socket", func(t *testing.T) {
+
+		hub := NewHub()
+
+		connA := newChanConn()
+		clientA := MakeClient(connA)
+		clientA.SetPublicKey(&pk0)
+		hub.AddClient(pk0, &clientA)
+		go clientA.Route(context.Background(), hub, func() Routine { return &terminatePeerRoutine{pkB: pk1} })
+		defer connA.Close()
+
+		connB := newChanConn()
+		clientB := MakeClient(connB)
+		clientB.SetPublicKey(&pk1)
+		hub.AddClient(pk1, &clientB)
+		go clientB.Route(context.Background(), hub, func() Routine { return &idleRoutine{} })
+		defer connB.Close()
+
+		idA := strings.Repeat("a", IDLEN)
+		connA.fromCl <- []byte(idA)
+		connB.expectMsgAnyId(t, "notice")
+		// B's first socket was closed, so this goes to a new socket instead of panicking
+		connB.expectMsgAnyId(t, "again")
+		connA.expectMsg(t, idA, "sent")
+		connB.expectNoMsg(t)
+
+		// B's sockets are deleted
+		socketCount := func() int {
+			defer clientB.modifyTransactionsLock.Unlock()
+			clientB.modifyTransactionsLock.Lock()
+			return len(clientB.transactionSockets)
+		}
+		deadline := time.After(time.Second)
+		for socketCount() != 0 {
+			select {
+			case <-deadline:
+				t.Fatalf("Expected B's transaction sockets to be deleted. %d left", socketCount())
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
+
+	t.Run("A device disconnecting does not end the transaction while another device can reply", func(t *testing.T) {
+
+		hub := NewHub()
+		routine := &relayRoutine{pkB: pk1, inputs: make(chan RoutineInput, 10)}
+
+		connA := newChanConn()
+		clientA := MakeClient(connA)
+		clientA.SetPublicKey(&pk0)
+		hub.AddClient(pk0, &clientA)
+		go clientA.Route(context.Background(), hub, func() Routine { return routine })
+		defer connA.Close()
+
+		connsB := []*chanConn{newChanConn(), newChanConn()}
+		for _, conn := range connsB {
+			clientB := MakeClient(conn)
+			clientB.SetPublicKey(&pk1)
+			hub.AddClient(pk1, &clientB)
+			go clientB.Route(context.Background(), hub, func() Routine { return &idleRoutine{} })
+			defer conn.Close()
+		}
+
+		idA := strings.Repeat("a", IDLEN)
+		connA.fromCl <- []byte(idA)
+		connsB[0].expectMsgAnyId(t, "ping")
+		idB1 := connsB[1].expectMsgAnyId(t, "ping")
+		<-routine.inputs // A's message
+
+		// the first device goes away without replying
+		connsB[0].Close()
+		connA.expectNoMsg(t)
+
+		// the second device can still reply
+		connsB[1].fromCl <- []byte(idB1)
+		connsB[1].expectMsg(t, idB1, "pong")
+		connA.expectMsg(t, idA, "answered")
+
+		// the routine never heard about the first device
+		input := <-routine.inputs
+		if input.MsgType != RoutineMsgType_UsrMsg {
+			t.Errorf("Expected the routine's next input to be the reply from the second device. Got %v", input)
+		}
+	})
+
+	t.Run("Resuming a transaction after reconnecting", func(t *testing.T) {
+
+		const grace = time.Second
+		// A is mid-chat with B when B drops. Returns a function to wait for an input from the routine.
+		setup := func(t *testing.T) (*Hub, *fakeClock, *chanConn, string, string, func(func(RoutineInput) bool)) {
+			hub := NewHub()
+			clock := &fakeClock{}
+			routine := &chatRoutine{pkB: pk1, inputs: make(chan RoutineInput, 10)}
+
+			connA := newChanConn()
+			clientA := MakeClient(connA, ClientOptions{Clock: clock})
+			clientA.SetPublicKey(&pk0)
+			hub.AddClient(pk0, &clientA)
+			go clientA.Route(context.Background(), hub, func() Routine { return routine })
+			t.Cleanup(func() { connA.Close() })
+
+			connB := newChanConn()
+			clientB := MakeClient(connB, ClientOptions{ResumeGrace: grace})
+			clientB.SetPublicKey(&pk1)
+			hub.AddClient(pk1, &clientB)
+			routeReturnedB := make(chan struct{})
+			go func() {
+				clientB.Route(context.Background(), hub, func() Routine { return &idleRoutine{} })
+				close(routeReturnedB)
+			}()
+
+			idA := strings.Repeat("a", IDLEN)
+			connA.fromCl <- []byte(idA + "hi")
+			idB := connB.expectMsgAnyId(t, "said hi")
+
+			connB.Close()
+			<-routeReturnedB
+			hub.DeleteClient(pk1, &clientB)
+			// B's socket is suspended as it is deleted, after Route returns
+			deadline := time.Now().Add(time.Second)
+			for {
+				if _, suspended := hub.suspendedTransaction(pk1, ([IDLEN]byte)([]byte(idB))); suspended {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected B's socket to be suspended")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			nextInput := func(match func(RoutineInput) bool) {
+				t.Helper()
+				for {
+					select {
+					case input := <-routine.inputs:
+						if match(input) {
+							return
+						}
+					case <-time.After(time.Second):
+						t.Fatalf("Expected the routine to get an input")
+					}
+				}
+			}
+			return hub, clock, connA, idA, idB, nextInput
+		}
+		// the grace period comes from the client that dropped. This one doesn't have one, so that its transactions end with the test.
+		reconnectB := func(t *testing.T, hub *Hub) *chanConn {
+			conn := newChanConn()
+			client := MakeClient(conn, ClientOptions{})
+			client.SetPublicKey(&pk1)
+			hub.AddClient(pk1, &client)
+			go client.Route(context.Background(), hub, func() Routine { return &idleRoutine{} })
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+		controlId := string(CONTROL_ID[:])
+		isClientCloseOfB := func(input RoutineInput) bool {
+			return input.MsgType == RoutineMsgType_ClientClose && *input.Pk == pk1
+		}
+
+		t.Run("Within the grace period it is resumed with the messages sent meanwhile", func(t *testing.T) {
+			hub, clock, connA, idA, idB, nextInput := setup(t)
+
+			connA.fromCl <- []byte(idA + "are you there?")
+			nextInput(func(input RoutineInput) bool { return input.Msg == "are you there?" })
+			clock.Advance(grace - time.Millisecond)
+
+			connB := reconnectB(t, hub)
+			connB.fromCl <- []byte(controlId + `{"resumeTransaction":"` + idB + `"}`)
+			connB.expectMsg(t, controlId, `{"resumed":"`+idB+`"}`)
+			connB.expectMsg(t, idB, "said are you there?")
+
+			connB.fromCl <- []byte(idB + "back now")
+			connA.expectMsg(t, idA, "said back now")
+			connA.fromCl <- []byte(idA + "welcome back")
+			connB.expectMsg(t, idB, "said welcome back")
+
+			// the grace period ending doesn't matter any more
+			clock.Advance(time.Second)
+			connA.fromCl <- []byte(idA + "still here")
+			nextInput(func(input RoutineInput) bool {
+				if isClientCloseOfB(input) {
+					t.Fatalf("Expected the routine not to be told that B disconnected")
+				}
+				return input.Msg == "still here"
+			})
+			connB.expectMsg(t, idB, "said still here")
+		})
+
+		t.Run("After the grace period the routine is told B has gone and it can't be resumed", func(t *testing.T) {
+			hub, clock, _, _, idB, nextInput := setup(t)
+
+			clock.Advance(grace)
+			nextInput(isClientCloseOfB)
+
+			connB := reconnectB(t, hub)
+			connB.fromCl <- []byte(controlId + `{"resumeTransaction":"` + idB + `"}`)
+			connB.expectMsg(t, controlId, `{"error":"transaction cannot be resumed"}`)
+		})
+
+		t.Run("Only the public key's own transactions can be resumed", func(t *testing.T) {
+			hub, clock, _, _, idB, nextInput := setup(t)
+
+			conn := newChanConn()
+			client := MakeClient(conn)
+			client.SetPublicKey(&pk0)
+			go client.Route(context.Background(), hub, func() Routine { return &idleRoutine{} })
+			defer conn.Close()
+			conn.fromCl <- []byte(controlId + `{"resumeTransaction":"` + idB + `"}`)
+			conn.expectMsg(t, controlId, `{"error":"transaction cannot be resumed"}`)
+
+			clock.Advance(grace)
+			nextInput(isClientCloseOfB)
+		})
+	})
+
+	t.Run("Routines are told about outputs to clients at their transaction limit", func(t *testing.T) {
+
+		hub := NewHub()
+
+		connB := newChanConn()
+		clientB := MakeClient(connB, ClientOptions{MaxTransactions: 1})
+		clientB.SetPublicKey(&pk1)
+		hub.AddClient(pk1, &clientB)
+		go clientB.Route(context.Background(), hub, func() Routine { return &idleRoutine{} })
+		defer connB.Close()
+		idB := strings.Repeat("b", IDLEN)
+		connB.fromCl <- []byte(idB)
+		// B is now busy
+		connB.expectMsg(t, idB, "ok")
+
+		connA := newChanConn()
+		clientA := MakeClient(connA)
+		clientA.SetPublicKey(&pk0)
+		hub.AddClient(pk0, &clientA)
+		go clientA.Route(context.Background(), hub, func() Routine { return &undeliverableRoutine{pkB: pk1} })
+		defer connA.Close()
+
+		idA := strings.Repeat("a", IDLEN)
+		connA.fromCl <- []byte(idA)
+		connA.expectMsg(t, idA, string(pk1)+" is busy")
+		connB.expectNoMsg(t)
+	})
+
+	t.Run("Server assigns transaction ids", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn, ClientOptions{ServerAssignedIds: true})
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &idleRoutine{}
+		})
+		defer conn.Close()
+
+		// the id the server picked for a transaction started on NEW_TRANSACTION_ID
+		newTid := string(NEW_TRANSACTION_ID[:])
+		assignedId := func() string {
+			t.Helper()
+			select {
+			case data := <-conn.toCl:
+				var reply struct {
+					TransactionId string `json:"transactionId"`
+				}
+				if !strings.HasPrefix(string(data), newTid) || json.Unmarshal(data[IDLEN:], &reply) != nil || len(reply.TransactionId) != IDLEN {
+					t.Fatalf("Expected the assigned id on %s, got %s", newTid, string(data))
+				}
+				return reply.TransactionId
+			case <-time.After(time.Second):
+				t.Fatalf("Expected the assigned id, got nothing")
+				return ""
+			}
+		}
 
-	t.Run("Correctly times-out routines (see comment)", func(t *testing.T) {
+		ids := map[string]bool{}
+		for i := 0; i < 3; i++ {
+			conn.fromCl <- []byte(newTid + "hi")
+			id := assignedId()
+			if ids[id] {
+				t.Errorf("Expected a new id, got %s again", id)
+			}
+			ids[id] = true
+			// the routine's reply comes on the assigned id
+			conn.expectMsg(t, id, "ok")
+		}
+		if count := client.TransactionCount(); count != 3 {
+			t.Errorf("Expected 3 open transactions. Got %d", count)
+		}
+
+		// messages on an assigned id go to its transaction
+		for id := range ids {
+			conn.fromCl <- []byte(id + "again")
+			conn.expectMsg(t, id, "ok")
+		}
+
+		// clients can't pick ids of their own
+		idA := strings.Repeat("a", IDLEN)
+		conn.fromCl <- []byte(idA)
+		conn.expectMsg(t, idA, `{"error":"transaction does not exist"}`)
+		if count := client.TransactionCount(); count != 3 {
+			t.Errorf("Expected 3 open transactions. Got %d", count)
+		}
+	})
+
+	t.Run("Server-assigned ids avoid ids in use", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn, ClientOptions{ServerAssignedIds: true, Framing: Framing_Envelope})
+		idA := [IDLEN]byte([]byte(strings.Repeat("a", IDLEN)))
+		idB := [IDLEN]byte([]byte(strings.Repeat("b", IDLEN)))
+		// picks A twice, then the reserved ids, before B
+		generated := [][IDLEN]byte{idA, idA, CONTROL_ID, NEW_TRANSACTION_ID, idB}
+		client.idGenerator = func() [IDLEN]byte {
+			id := generated[0]
+			generated = generated[1:]
+			return id
+		}
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &idleRoutine{}
+		})
+		defer conn.Close()
+
+		newTid := hex.EncodeToString(NEW_TRANSACTION_ID[:])
+		tidA := hex.EncodeToString(idA[:])
+		tidB := hex.EncodeToString(idB[:])
+		conn.fromCl <- []byte(`{"tid":"` + newTid + `","body":"hi"}`)
+		conn.expectMsg(t, "", `{"tid":"`+newTid+`","body":{"transactionId":"`+tidA+`"}}`)
+		conn.expectMsg(t, "", `{"tid":"`+tidA+`","body":"ok"}`)
+
+		conn.fromCl <- []byte(`{"tid":"` + newTid + `","body":"hi"}`)
+		conn.expectMsg(t, "", `{"tid":"`+newTid+`","body":{"transactionId":"`+tidB+`"}}`)
+		conn.expectMsg(t, "", `{"tid":"`+tidB+`","body":"ok"}`)
+	})
+
+	t.Run("Server-assigned ids are refused at the transaction limit", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn, ClientOptions{ServerAssignedIds: true, MaxTransactions: 1})
+		idA := [IDLEN]byte([]byte(strings.Repeat("a", IDLEN)))
+		client.idGenerator = func() [IDLEN]byte { return idA }
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &idleRoutine{}
+		})
+		defer conn.Close()
+
+		newTid := string(NEW_TRANSACTION_ID[:])
+		conn.fromCl <- []byte(newTid + "hi")
+		conn.expectMsg(t, newTid, `{"transactionId":"`+string(idA[:])+`"}`)
+		conn.expectMsg(t, string(idA[:]), "ok")
+
+		// the error comes on NEW_TRANSACTION_ID, like the id would have
+		conn.fromCl <- []byte(newTid + "hi")
+		conn.expectMsg(t, newTid, `{"error":"Max number of transactions reached"}`)
+	})
+
+	t.Run("Clients can use envelope framing", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn, ClientOptions{Framing: Framing_Envelope})
+		inputs := make(chan RoutineInput, 10)
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &recordingRoutine{inputs: inputs}
+		})
+		defer conn.Close()
+
+		tid := hex.EncodeToString([]byte(strings.Repeat("a", IDLEN)))
+		conn.fromCl <- []byte(`{"tid":"` + tid + `","body":{"initiate":"test"}}`)
+		conn.expectMsg(t, "", `{"tid":"`+tid+`","body":"ok"}`)
+		if input := <-inputs; input.Msg != `{"initiate":"test"}` {
+			t.Errorf("Expected the routine to get the body, got %s", input.Msg)
+		}
+
+		// control messages use hex ids too
+		controlTid := hex.EncodeToString(CONTROL_ID[:])
+		conn.fromCl <- []byte(`{"tid":"` + controlTid + `","body":{"closeTransaction":"` + tid + `"}}`)
+		if input := <-inputs; input.MsgType != RoutineMsgType_ClientClose {
+			t.Errorf("Expected the transaction to be closed, got %+v", input)
+		}
+
+		// not an envelope
+		conn.fromCl <- []byte(strings.Repeat("a", IDLEN) + `{"initiate":"test"}`)
+		conn.expectNoMsg(t)
+	})
+
+	t.Run("SetMaxTransactions changes the limit", func(t *testing.T) {
+
+		conn := newChanConn()
+		client := MakeClient(conn, ClientOptions{MaxTransactions: 1})
+		client.SetMaxTransactions(2)
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &idleRoutine{}
+		})
+		defer conn.Close()
+
+		for i := 0; i < 2; i++ {
+			id := strings.Repeat(strconv.Itoa(i), IDLEN)
+			conn.fromCl <- []byte(id)
+			conn.expectMsg(t, id, "ok")
+		}
+	})
 
-		// Send two messages with the same transaction id in quick succession.
-		// The master routine is mocked to timeout instantly and not explicity complete
-		// Expect one of the following situations:
-		// - 1 routine was initiated, a timeout {terminte, error} sent, message 2 was ignored and an {error} sent
-		// - 2 routines were initiated, both received 1 message, and 2 timeout {terminte, error} messages sent
+	t.Run("KeepTimeout leaves the running timeout armed", func(t *testing.T) {
+		conn := newChanConn()
+		client := MakeClient(conn)
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &keepTimeoutRoutine{}
+		})
+		defer conn.Close()
+
+		id := strings.Repeat("k", IDLEN)
+		conn.fromCl <- []byte(id)
+		conn.expectMsg(t, id, "armed")
+		conn.fromCl <- []byte(id + "again")
+		conn.expectMsg(t, id, "kept")
+		conn.expectMsg(t, id, "timed out")
+	})
+
+	t.Run("Routines are woken when they asked to be", func(t *testing.T) {
+
+		clock := &fakeClock{}
+		conn := newChanConn()
+		client := MakeClient(conn, ClientOptions{Clock: clock})
+		client.SetPublicKey(&pk0)
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &wakeRoutine{}
+		})
+		defer conn.Close()
+
+		id := strings.Repeat("w", IDLEN)
+		conn.fromCl <- []byte(id)
+		conn.expectMsg(t, id, "scheduled")
+		// outputs that don't ask for a wake leave the scheduled one running
+		conn.fromCl <- []byte(id + "again")
+		conn.expectMsg(t, id, "ok")
+
+		clock.Advance(49 * time.Millisecond)
+		conn.expectNoMsg(t)
+		clock.Advance(time.Millisecond)
+		conn.expectMsg(t, id, "woken")
+
+		// it only fires once
+		clock.Advance(time.Second)
+		conn.expectNoMsg(t)
+	})
+
+	t.Run("Routine timeouts are driven by the client's clock", func(t *testing.T) {
+
+		clock := &fakeClock{}
+		conn := newChanConn()
+		client := MakeClient(conn, ClientOptions{Clock: clock})
+		go client.Route(context.Background(), NewHub(), func() Routine {
+			return &keepTimeoutRoutine{}
+		})
+		defer conn.Close()
+
+		id := strings.Repeat("k", IDLEN)
+		conn.fromCl <- []byte(id)
+		conn.expectMsg(t, id, "armed")
+		// once "kept" arrives, the timer of "armed" has been started
+		conn.fromCl <- []byte(id + "again")
+		conn.expectMsg(t, id, "kept")
+
+		clock.Advance(49 * time.Millisecond)
+		conn.expectNoMsg(t)
+		clock.Advance(time.Millisecond)
+		conn.expectMsg(t, id, "timed out")
+	})
+
+	t.Run("Correctly times-out routines", func(t *testing.T) {
+
+		// Send two messages with the same transaction id.
+		// The master routine is mocked to timeout instantly and not explicity complete.
+		// Stepped synchronously, the first routine has timed out before the second message is read,
+		// so the second message starts a new routine.
 
 		mockConn := &mockConn{
 			outMsgs: make([][]byte, 0),
-			fromCl:  make(chan []byte),
+			fromCl:  make(chan []byte, 2),
 			done:    make(chan struct{}),
 		}
-		client := MakeClient(mockConn)
-		mockHub := NewHub()
+		client := MakeClient(mockConn, ClientOptions{Clock: &fakeClock{}})
 
 		var routineInstanceCount = 0
-		// use a mock routine that times out instantly, but doesn't explicity complete.
 		// for each message received by an instantTimeoutRoutine, it sends its routine number back as a string
-		go func() {
-			client.Route(mockHub, func() Routine {
-				routineInstanceCount += 1
-				return &instantTimeoutRoutine{
-					routineNumber: routineInstanceCount - 1,
-				}
-			})
-		}()
+		router := client.RouteSync(NewHub(), func() Routine {
+			routineInstanceCount += 1
+			return &instantTimeoutRoutine{
+				routineNumber: routineInstanceCount - 1,
+			}
+		})
 
 		idstr := strings.Repeat("0", IDLEN)
-
-		// initiate the routine
 		mockConn.fromCl <- []byte(idstr)
-
-		// wait a bit
-		<-time.After(10 * time.Millisecond)
-
-		// send another message to the routine
 		mockConn.fromCl <- []byte(idstr)
-
-		// wait for 10ms for the messages to come through (sorry, bad practice :( )
-		<-time.After(10 * time.Millisecond)
+		for i := 0; i < 2; i++ {
+			if !router.Step() {
+				t.Fatalf("Step %d: connection closed", i)
+			}
+		}
 
 		// close the websocket for reading
-		mockConn.done <- struct{}{}
+		close(mockConn.done)
+		if router.Step() {
+			t.Errorf("Expected Step to return false once the connection has closed")
+		}
 
-		// convert messages sent to the mock client to string
-		// and remove transaction id
+		// remove transaction ids
 		outMsgStrings := make([]string, 0)
 		for _, msg := range mockConn.outMsgs {
 			outMsgStrings = append(outMsgStrings, string(msg)[IDLEN:])
 		}
 
-		// parse and analyze results
+		if routineInstanceCount != 2 {
+			t.Errorf("Expected 2 routines to be created, got %d", routineInstanceCount)
+		}
+		expected := []string{"0", "terminate", "1", "terminate"}
+		if !slices.Equal(outMsgStrings, expected) {
+			t.Errorf("Expected messages %v, got %v", expected, outMsgStrings)
+		}
+	})
+}
 
-		errMsgSchema := func() *gojsonschema.Schema {
-			const errorSchemaString = `
-				{
-					"$schema": "https://json-schema.org/draft/2020-12/schema",
-					"type": "object",
-					"properties": {
-						"error": {
-							"type": "string" 
-						}
-					},
-					"required": ["error"],
-					"additionalProperties": false
-				}
-			`
-			schemaLoader := gojsonschema.NewStringLoader(errorSchemaString)
-			schema, _ := gojsonschema.NewSchema(schemaLoader)
-			return schema
-		}()
+func TestRouteSync(t *testing.T) {
 
-		errMsgCount := 0
-		for _, str := range outMsgStrings {
-			strLoader := gojsonschema.NewStringLoader(str)
-			result, err := errMsgSchema.Validate(strLoader)
-			if err == nil && result.Valid() {
-				errMsgCount += 1
-			}
-		}
-
-		// errTerminateMsgSchema := func() *gojsonschema.Schema {
-		// 	const errorSchemaString = `
-		// 		{
-		// 			"$schema": "https://json-schema.org/draft/2020-12/schema",
-		// 			"type": "object",
-		// 			"properties": {
-		// 				"terminate": {
-		// 					"const":"cancel"
-		// 				},
-		// 				"error": {
-		// 					"type": "string"
-		// 				}
-		// 			},
-		// 			"required": ["terminate"],
-		// 			"additionalProperties": false
-		// 		}
-		// 	`
-		// 	schemaLoader := gojsonschema.NewStringLoader(errorSchemaString)
-		// 	schema, _ := gojsonschema.NewSchema(schemaLoader)
-		// 	return schema
-		// }()
-
-		// errTerminateMsgCount := 0
-		// for _, str := range outMsgStrings {
-		// 	strLoader := gojsonschema.NewStringLoader(str)
-		// 	result, err := errTerminateMsgSchema.Validate(strLoader)
-		// 	if err == nil && result.Valid() {
-		// 		errTerminateMsgCount += 1
-		// 	}
-		// }
-
-		msgsSentToR0Count := countOccurrences(outMsgStrings, "0")
-		msgsSentToR1Count := countOccurrences(outMsgStrings, "1")
-		errTerminateMsgCount := countOccurrences(outMsgStrings, "terminate")
-
-		t.Logf("Messages: %v", outMsgStrings)
-
-		switch routineInstanceCount {
-		case 1:
-			t.Logf("1 routine case.")
-			if msgsSentToR0Count != 1 {
-				t.Errorf("Expected 1 message to be sent to routine. Got %d", msgsSentToR0Count)
-			}
-			if errTerminateMsgCount != 1 {
-				t.Errorf("Expected 1 error/terminate message to be sent to the user, to signify a timeout. Got %d", errTerminateMsgCount)
-			}
-			if errMsgCount != 1 {
-				t.Errorf("Expected 1 error message to be sent to the user, to signigy a message sent to a terminated transaction. Got %d", errMsgCount)
-			}
-		case 2:
-			t.Logf("2 routine case.")
-			if msgsSentToR0Count != 1 {
-				t.Errorf("Expected 1 message to be sent to routine 0. Got %d", msgsSentToR0Count)
-			}
-			if msgsSentToR1Count != 1 {
-				t.Errorf("Expected 1 message to be sent to routine 1. Got %d", msgsSentToR1Count)
-			}
-			if errTerminateMsgCount != 2 {
-				t.Errorf("Expected 2 error/terminate message to be sent to the user, to signify timeouts of the 2 routines. Got %d", errTerminateMsgCount)
-			}
-			if errMsgCount != 0 {
-				t.Errorf("Expected 0 error (non-terminate) messages to be sent to the client. Got %d", errMsgCount)
-			}
-		default:
-			t.Errorf("Expected 1 or 2 routines to be created, got %d", routineInstanceCount)
+	// read the messages written since the last call, without their transaction ids
+	newMsgs := func(conn *mockConn, read *int) []string {
+		msgs := make([]string, 0)
+		for _, msg := range conn.outMsgs[*read:] {
+			msgs = append(msgs, string(msg)[IDLEN:])
+		}
+		*read = len(conn.outMsgs)
+		return msgs
+	}
+
+	t.Run("Times out routines when the clock is advanced, without sleeping", func(t *testing.T) {
+
+		conn := &mockConn{
+			outMsgs: make([][]byte, 0),
+			fromCl:  make(chan []byte, 10),
+			done:    make(chan struct{}),
+		}
+		clock := &fakeClock{}
+		client := MakeClient(conn, ClientOptions{Clock: clock})
+		router := client.RouteSync(NewHub(), func() Routine {
+			return &keepTimeoutRoutine{}
+		})
+		read := 0
+
+		id := strings.Repeat("k", IDLEN)
+		conn.fromCl <- []byte(id)
+		router.Step()
+		if msgs := newMsgs(conn, &read); !slices.Equal(msgs, []string{"armed"}) {
+			t.Fatalf("Expected [armed], got %v", msgs)
+		}
+		conn.fromCl <- []byte(id + "again")
+		router.Step()
+		if msgs := newMsgs(conn, &read); !slices.Equal(msgs, []string{"kept"}) {
+			t.Fatalf("Expected [kept], got %v", msgs)
+		}
+
+		// nothing is ready until the timer fires, so Step would block reading the connection
+		clock.Advance(50 * time.Millisecond)
+		if !router.Step() {
+			t.Fatalf("Expected Step to handle the timeout")
+		}
+		if msgs := newMsgs(conn, &read); !slices.Equal(msgs, []string{"timed out"}) {
+			t.Fatalf("Expected [timed out], got %v", msgs)
+		}
+	})
+
+	t.Run("Times transaction lifetimes with the client's clock", func(t *testing.T) {
+
+		conn := &mockConn{
+			outMsgs: make([][]byte, 0),
+			fromCl:  make(chan []byte, 10),
+			done:    make(chan struct{}),
+		}
+		clock := &fakeClock{}
+		client := MakeClient(conn, ClientOptions{Clock: clock, MaxTransactionLifetime: time.Minute})
+		router := client.RouteSync(NewHub(), func() Routine {
+			return &idleRoutine{}
+		})
+		read := 0
+
+		id := strings.Repeat("l", IDLEN)
+		conn.fromCl <- []byte(id)
+		router.Step()
+		if msgs := newMsgs(conn, &read); !slices.Equal(msgs, []string{"ok"}) {
+			t.Fatalf("Expected [ok], got %v", msgs)
+		}
+
+		clock.Advance(time.Minute - time.Millisecond)
+		conn.fromCl <- []byte(id + "still here")
+		router.Step()
+		if msgs := newMsgs(conn, &read); !slices.Equal(msgs, []string{"ok"}) {
+			t.Fatalf("Expected [ok] before the lifetime is up, got %v", msgs)
+		}
+
+		clock.Advance(time.Millisecond)
+		if !router.Step() {
+			t.Fatalf("Expected Step to handle the lifetime running out")
+		}
+		expected := []string{`{"terminate":"cancel","error":"Transaction lifetime exceeded"}`}
+		if msgs := newMsgs(conn, &read); !slices.Equal(msgs, expected) {
+			t.Fatalf("Expected %v, got %v", expected, msgs)
+		}
+	})
+
+	t.Run("Ends the client's transactions by the time Step returns false", func(t *testing.T) {
+
+		conn := &mockConn{
+			outMsgs: make([][]byte, 0),
+			fromCl:  make(chan []byte, 10),
+			done:    make(chan struct{}),
+		}
+		client := MakeClient(conn, ClientOptions{Clock: &fakeClock{}})
+		routine := &endHandlerRoutine{ended: make(chan struct{})}
+		router := client.RouteSync(NewHub(), func() Routine {
+			return routine
+		})
+
+		conn.fromCl <- []byte(strings.Repeat("e", IDLEN))
+		router.Step()
+		if client.TransactionCount() != 1 {
+			t.Fatalf("Expected 1 open transaction, got %d", client.TransactionCount())
 		}
 
+		close(conn.done)
+		if router.Step() {
+			t.Fatalf("Expected Step to return false once the connection has closed")
+		}
+		select {
+		case <-routine.ended:
+		default:
+			t.Errorf("Expected the transaction to have ended")
+		}
+		if client.TransactionCount() != 0 {
+			t.Errorf("Expected no open transactions, got %d", client.TransactionCount())
+		}
 	})
+
+}
+
+func TestRouteContextCancellation(t *testing.T) {
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := NewHub()
+	routine := &relayRoutine{pkB: pk1, inputs: make(chan RoutineInput, 100)}
+
+	// A has a transaction with B open, and a transaction of its own.
+	// each client is added to the hub once Route has started, as comeOnline would, so peers can't open sockets on it before.
+	// Route is reading once it answers a message on the control id.
+	waitUntilRouting := func(conn *chanConn) {
+		controlId := string(CONTROL_ID[:])
+		conn.fromCl <- []byte(controlId + "{}")
+		conn.expectMsg(t, controlId, `{"error":"transaction id is reserved"}`)
+	}
+	connA := newChanConn()
+	clientA := MakeClient(connA)
+	clientA.SetPublicKey(&pk0)
+	routed := make(chan struct{}, 2)
+	go func() {
+		clientA.Route(ctx, hub, func() Routine { return routine })
+		routed <- struct{}{}
+	}()
+	waitUntilRouting(connA)
+	hub.AddClient(pk0, &clientA)
+
+	connB := newChanConn()
+	clientB := MakeClient(connB)
+	clientB.SetPublicKey(&pk1)
+	go func() {
+		clientB.Route(ctx, hub, func() Routine { return &idleRoutine{} })
+		routed <- struct{}{}
+	}()
+	waitUntilRouting(connB)
+	hub.AddClient(pk1, &clientB)
+
+	idA := strings.Repeat("a", IDLEN)
+	connA.fromCl <- []byte(idA)
+	idPing := connB.expectMsgAnyId(t, "ping")
+
+	idB := strings.Repeat("b", IDLEN)
+	connB.fromCl <- []byte(idB)
+	connB.expectMsg(t, idB, "ok")
+
+	// the connections are left open; only the context ends them.
+	cancel()
+
+	deadline := time.After(2 * time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-routed:
+		case <-deadline:
+			t.Fatalf("Expected Route to return after the context was cancelled")
+		}
+	}
+
+	for runtime.NumGoroutine() > before {
+		select {
+		case <-deadline:
+			t.Fatalf("Expected the client goroutines to return after the context was cancelled. %d goroutines before, %d after", before, runtime.NumGoroutine())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// neither socket of the shared transaction was held for resuming, so the routine was told both clients had closed
+	if _, suspended := hub.suspendedTransaction(pk0, [IDLEN]byte([]byte(idA))); suspended {
+		t.Errorf("Expected A's socket not to be suspended after the context was cancelled")
+	}
+	if _, suspended := hub.suspendedTransaction(pk1, [IDLEN]byte([]byte(idPing))); suspended {
+		t.Errorf("Expected B's socket not to be suspended after the context was cancelled")
+	}
+	closes := 0
+	for len(routine.inputs) > 0 {
+		if (<-routine.inputs).MsgType == RoutineMsgType_ClientClose {
+			closes++
+		}
+	}
+	if closes != 2 {
+		t.Errorf("Expected the routine to get 2 client closes, got %d", closes)
+	}
 }
 
 func TestSetPublicKey(t *testing.T) {
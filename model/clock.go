@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// Source of the current time, and of timers.
+// So that time can be mocked in tests.
+type Clock interface {
+	Now() time.Time
+	// sends the current time once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Clock that reads the system time.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,101 @@
+package model
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// how the transaction id and the message are put together in a websocket message
+type Framing int
+
+const ( // enum
+	// the IDLEN byte transaction id, followed straight away by the message. The default.
+	Framing_Prefix Framing = iota
+	// a JSON envelope, {"tid":"<transaction id in hex>","body":<message>}.
+	// The body is the message itself if it is a JSON object or array, and a JSON string holding it otherwise.
+	// Transaction ids in control messages, e.g. {"closeTransaction":"<transaction id>"}, are in hex as well.
+	Framing_Envelope
+)
+
+// most that an envelope adds to the size of the message inside it, not counting the escaping of a string body
+const envelopeOverhead = len(`{"tid":"","body":""}`) + 2*IDLEN
+
+var errFrameTooShort = errors.New("too short to contain a transaction id")
+var errInvalidEnvelope = errors.New(`not a {"tid":"<transaction id in hex>","body":<message>} envelope`)
+
+type envelope struct {
+	Tid  string          `json:"tid"`
+	Body json.RawMessage `json:"body"`
+}
+
+// the websocket message that sends msg on the transaction id
+func (f Framing) encode(id [IDLEN]byte, msg string) []byte {
+	if f != Framing_Envelope {
+		return append(id[:], []byte(msg)...)
+	}
+	body := json.RawMessage(msg)
+	if !isJSONContainer(msg) {
+		body, _ = json.Marshal(msg)
+	}
+	data, _ := json.Marshal(envelope{Tid: hex.EncodeToString(id[:]), Body: body})
+	return data
+}
+
+// split a websocket message from the client into the transaction id and the message
+func (f Framing) decode(data []byte) ([IDLEN]byte, []byte, error) {
+	if f != Framing_Envelope {
+		if len(data) < IDLEN {
+			return [IDLEN]byte{}, nil, errFrameTooShort
+		}
+		return ([IDLEN]byte)(data[:IDLEN]), data[IDLEN:], nil
+	}
+
+	var env envelope
+	err := json.Unmarshal(data, &env)
+	if err != nil || env.Body == nil {
+		return [IDLEN]byte{}, nil, errInvalidEnvelope
+	}
+	id, ok := f.parseId(env.Tid)
+	if !ok {
+		return [IDLEN]byte{}, nil, errInvalidEnvelope
+	}
+	var str string
+	if json.Unmarshal(env.Body, &str) == nil {
+		return id, []byte(str), nil
+	}
+	return id, env.Body, nil
+}
+
+// a transaction id as the client writes it in control messages. ok is false if it can't be one.
+func (f Framing) parseId(idStr string) (id [IDLEN]byte, ok bool) {
+	if f != Framing_Envelope {
+		if len(idStr) != IDLEN {
+			return id, false
+		}
+		return ([IDLEN]byte)([]byte(idStr)), true
+	}
+	decoded, err := hex.DecodeString(idStr)
+	if err != nil || len(decoded) != IDLEN {
+		return id, false
+	}
+	return ([IDLEN]byte)(decoded), true
+}
+
+// a transaction id as it is written in control messages to the client. The inverse of parseId.
+func (f Framing) formatId(id [IDLEN]byte) string {
+	if f != Framing_Envelope {
+		return string(id[:])
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// whether msg is a JSON object or array, so that it can be put in an envelope as it is
+func isJSONContainer(msg string) bool {
+	trimmed := bytes.TrimSpace([]byte(msg))
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return false
+	}
+	return json.Valid(trimmed)
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestFraming(t *testing.T) {
+
+	id := ([IDLEN]byte)([]byte("abcdefghijklmnop"))
+	hexId := hex.EncodeToString(id[:])
+
+	t.Run("Envelopes round trip", func(t *testing.T) {
+		tests := []struct {
+			description string
+			msg         string
+			encoded     string
+		}{
+			{"JSON object", `{"initiate":"comeOnline"}`, `{"tid":"` + hexId + `","body":{"initiate":"comeOnline"}}`},
+			{"JSON array", `[1,2]`, `{"tid":"` + hexId + `","body":[1,2]}`},
+			{"text", "ok", `{"tid":"` + hexId + `","body":"ok"}`},
+			{"JSON string", `"quoted"`, `{"tid":"` + hexId + `","body":"\"quoted\""}`},
+			{"number", "5", `{"tid":"` + hexId + `","body":"5"}`},
+			{"empty", "", `{"tid":"` + hexId + `","body":""}`},
+		}
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				encoded := Framing_Envelope.encode(id, tt.msg)
+				if string(encoded) != tt.encoded {
+					t.Errorf("Expected %s got %s", tt.encoded, encoded)
+				}
+				decodedId, body, err := Framing_Envelope.decode(encoded)
+				if err != nil {
+					t.Fatalf("Expected no error, got %s", err.Error())
+				}
+				if decodedId != id || string(body) != tt.msg {
+					t.Errorf("Expected %s %s got %s %s", id[:], tt.msg, decodedId[:], body)
+				}
+			})
+		}
+	})
+
+	t.Run("Prefixes round trip", func(t *testing.T) {
+		encoded := Framing_Prefix.encode(id, `{"a":1}`)
+		if string(encoded) != `abcdefghijklmnop{"a":1}` {
+			t.Errorf("Expected the id then the message, got %s", encoded)
+		}
+		decodedId, body, err := Framing_Prefix.decode(encoded)
+		if err != nil || decodedId != id || string(body) != `{"a":1}` {
+			t.Errorf("Expected %s {\"a\":1} got %s %s, %v", id[:], decodedId[:], body, err)
+		}
+	})
+
+	t.Run("Rejects malformed messages", func(t *testing.T) {
+		tests := []struct {
+			description string
+			framing     Framing
+			data        string
+		}{
+			{"prefix too short", Framing_Prefix, "short"},
+			{"envelope is not JSON", Framing_Envelope, `abcdefghijklmnop{"a":1}`},
+			{"envelope has no body", Framing_Envelope, `{"tid":"` + hexId + `"}`},
+			{"envelope has no tid", Framing_Envelope, `{"body":{}}`},
+			{"tid is not hex", Framing_Envelope, `{"tid":"` + strings.Repeat("z", 2*IDLEN) + `","body":{}}`},
+			{"tid is the wrong length", Framing_Envelope, `{"tid":"` + hexId[2:] + `","body":{}}`},
+		}
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				if _, _, err := tt.framing.decode([]byte(tt.data)); err == nil {
+					t.Errorf("Expected an error")
+				}
+			})
+		}
+	})
+
+	t.Run("Ids in control messages are hex in envelopes", func(t *testing.T) {
+		if parsed, ok := Framing_Envelope.parseId(hexId); !ok || parsed != id {
+			t.Errorf("Expected %s to parse as %s", hexId, id[:])
+		}
+		if _, ok := Framing_Envelope.parseId(string(id[:])); ok {
+			t.Errorf("Expected a raw id not to parse in an envelope")
+		}
+		if parsed, ok := Framing_Prefix.parseId(string(id[:])); !ok || parsed != id {
+			t.Errorf("Expected %s to parse", id[:])
+		}
+	})
+}
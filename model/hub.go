@@ -3,25 +3,175 @@ package model
 // threadsafe
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"slices"
 	"sync"
+	"time"
+)
+
+// maximum number of messages held for a public key while it is offline. The oldest are dropped first.
+const DEFAULT_OFFLINE_QUEUE_LENGTH = 20
+
+// how long a message is held for a public key while it is offline.
+const DEFAULT_OFFLINE_MESSAGE_TTL = 7 * 24 * time.Hour
+
+// how long a reconnection token can be redeemed for after it is issued.
+const DEFAULT_RECONNECT_TOKEN_TTL = 5 * time.Minute
+
+// maximum number of devices that can be signed in at once.
+const DEFAULT_MAX_CLIENTS = 100000
+
+// maximum number of devices that can be signed in with one public key at once.
+const DEFAULT_MAX_DEVICES_PER_KEY = 5
+
+// how long a client signing in has to reply at each step before comeOnline gives up.
+// shorter than other routines' timeouts, as a stalled sign in holds the client's comeOnline lock.
+const DEFAULT_AUTH_TIMEOUT = 10 * time.Second
+
+// how long an output for a public key with no devices signed in waits for one to sign in, e.g. because it is reconnecting.
+const DEFAULT_PEER_LOOKUP_GRACE = 300 * time.Millisecond
+
+// returned when a client can't be signed in because the hub already has its maximum number of devices.
+var ErrHubAtCapacity = errors.New("hub at capacity")
+
+// returned when a client can't be signed in because its public key already has its maximum number of devices.
+var ErrTooManyDevices = errors.New("too many devices signed in with this public key")
+
+// returned when deleting a device that isn't signed in with the key, e.g. because it has already been removed.
+var ErrClientNotFound = errors.New("client with public key does not exist")
+
+// how much detail routines put in the errors they send to clients about malformed messages
+type ErrorVerbosity string
+
+const ( // enum
+	// a generic "Malformed message". The details, which describe the schemas, are only logged. The default.
+	ErrorVerbosity_Production ErrorVerbosity = "production"
+	// the schema validation errors themselves, for developing clients.
+	ErrorVerbosity_Debug ErrorVerbosity = "debug"
+)
+
+// kind of key a client can sign in with
+type KeyAlgorithm string
+
+const ( // enum
+	KeyAlgorithm_Ed25519 KeyAlgorithm = "ed25519"
+	// ECDSA on the NIST P-256 curve with SHA-256, for platforms without Ed25519.
+	KeyAlgorithm_P256 KeyAlgorithm = "p256"
 )
 
 type Hub = genericHub[*Client]
 
+// what the hub needs from the clients it stores
+type hubClient interface {
+	comparable
+	// tell the client msg and end its connection from outside its Route loop.
+	Disconnect(reason DisconnectReason, msg string)
+	// number of transactions the client currently has open.
+	TransactionCount() int
+}
+
 // make hub generic for testing purposes
-type genericHub[C interface{}] struct {
-	clients map[PublicKey]C
-	lock    sync.Mutex
+type genericHub[C hubClient] struct {
+	// each public key can be signed in on several devices at once, in the order they signed in.
+	// a key with no devices is not in the map.
+	clients map[PublicKey][]C
+	// total number of devices in clients, and the most there can be. 0 for no limit.
+	deviceCount int
+	maxClients  int
+	// most devices that can be signed in with one key. 0 for no limit.
+	maxDevicesPerKey int
+	// channels to notify when a public key comes online or goes offline
+	subscribers map[PublicKey]map[chan PresenceEvent]struct{}
+	// set by Shutdown. no more clients can be added after this.
+	shuttingDown bool
+	// closed when the hub is shutting down and the last client has been deleted
+	drained       chan struct{}
+	drainedClosed bool
+	// where routines report events. Never nil.
+	metrics MetricsSink
+	// messages waiting for a public key to come online, oldest first
+	offlineQueues      map[PublicKey][]queuedOfflineMessage
+	offlineQueueLength int
+	offlineMessageTTL  time.Duration
+	// hashes of the unredeemed reconnection tokens of each public key, and when they were issued
+	reconnectTokens   map[PublicKey]map[[sha256.Size]byte]time.Time
+	reconnectTokenTTL time.Duration
+	// when each sender can next send a friend request to each recipient
+	friendRequestCooldowns map[friendRequestPair]time.Time
+	clock                  Clock
+	// keys that can't come online or be sent requests. Never nil, and has its own lock.
+	blocklist *Blocklist
+	// one-time pre-keys published for end-to-end encryption. Never nil, and has its own lock.
+	preKeys *PreKeyStore
+	// how much routines tell clients about their malformed messages
+	errorVerbosity ErrorVerbosity
+	// the kinds of key clients can sign in with
+	keyAlgorithms []KeyAlgorithm
+	// how long a client signing in has to reply at each step
+	authTimeout time.Duration
+	// how long routing an output to a public key with no devices waits for one to sign in
+	peerLookupGrace time.Duration
+	// transactions holding a socket for a public key that disconnected, until it resumes it or the grace period runs out
+	suspendedSockets map[suspendedSocketKey]*transaction
+	lock             sync.Mutex
+}
+
+// a message held by the hub until its recipient comes online.
+type OfflineMessage struct {
+	// sent to the recipient as-is.
+	Msg string
+}
+
+type queuedOfflineMessage struct {
+	msg        OfflineMessage
+	enqueuedAt time.Time
+}
+
+type friendRequestPair struct {
+	from PublicKey
+	to   PublicKey
+}
+
+// sent to subscribers when a client with a public key is added to or deleted from the hub.
+type PresenceEvent struct {
+	Pk     PublicKey
+	Online bool
 }
 
 func NewHub() *Hub {
 	return newGenericHub[*Client]()
 }
 
-func newGenericHub[C interface{}]() *genericHub[C] {
+func newGenericHub[C hubClient]() *genericHub[C] {
 	return &genericHub[C]{
-		clients: make(map[PublicKey]C),
+		clients:     make(map[PublicKey][]C),
+		subscribers: make(map[PublicKey]map[chan PresenceEvent]struct{}),
+		drained:     make(chan struct{}),
+		metrics:     noopMetrics{},
+		maxClients:  DEFAULT_MAX_CLIENTS,
+
+		maxDevicesPerKey: DEFAULT_MAX_DEVICES_PER_KEY,
+
+		offlineQueues:      make(map[PublicKey][]queuedOfflineMessage),
+		offlineQueueLength: DEFAULT_OFFLINE_QUEUE_LENGTH,
+		offlineMessageTTL:  DEFAULT_OFFLINE_MESSAGE_TTL,
+		reconnectTokens:    make(map[PublicKey]map[[sha256.Size]byte]time.Time),
+		reconnectTokenTTL:  DEFAULT_RECONNECT_TOKEN_TTL,
+
+		friendRequestCooldowns: make(map[friendRequestPair]time.Time),
+		clock:                  RealClock{},
+
+		blocklist:        NewBlocklist(),
+		preKeys:          NewPreKeyStore(DEFAULT_MAX_PRE_KEYS),
+		suspendedSockets: make(map[suspendedSocketKey]*transaction),
+		errorVerbosity:   ErrorVerbosity_Production,
+		keyAlgorithms:    []KeyAlgorithm{KeyAlgorithm_Ed25519},
+		authTimeout:      DEFAULT_AUTH_TIMEOUT,
+		peerLookupGrace:  DEFAULT_PEER_LOOKUP_GRACE,
 	}
 }
 
@@ -29,28 +179,549 @@ func (h *genericHub[C]) AddClient(pk PublicKey, client C) error {
 	defer h.lock.Unlock()
 	h.lock.Lock()
 
-	_, alreadyExists := h.clients[pk]
-	if alreadyExists {
-		return errors.New("client with public key already exists")
+	if h.shuttingDown {
+		return errors.New("server is shutting down")
+	}
+
+	devices := h.clients[pk]
+	if slices.Contains(devices, client) {
+		return errors.New("client has already been added with this public key")
+	}
+	if h.maxDevicesPerKey > 0 && len(devices) >= h.maxDevicesPerKey {
+		return ErrTooManyDevices
+	}
+	if h.atCapacityLocked() {
+		return ErrHubAtCapacity
 	}
 
-	h.clients[pk] = client
+	h.clients[pk] = append(devices, client)
+	h.deviceCount++
+	// only the first device brings the key online
+	if len(devices) == 0 {
+		h.notifySubscribers(PresenceEvent{Pk: pk, Online: true})
+	}
 	return nil
 }
 
+// Sign client in with the key in place of every device already signed in with it.
+// Returns the devices that were removed, which the caller should disconnect.
+// The key does not go offline in between, so subscribers are only notified if it wasn't online before.
+func (h *genericHub[C]) ReplaceClients(pk PublicKey, client C) ([]C, error) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	if h.shuttingDown {
+		return nil, errors.New("server is shutting down")
+	}
+
+	replaced := h.clients[pk]
+	if slices.Contains(replaced, client) {
+		return nil, errors.New("client has already been added with this public key")
+	}
+	// replacing a key's devices doesn't add to the total
+	if len(replaced) == 0 && h.atCapacityLocked() {
+		return nil, ErrHubAtCapacity
+	}
+
+	h.clients[pk] = []C{client}
+	h.deviceCount += 1 - len(replaced)
+	if len(replaced) == 0 {
+		h.notifySubscribers(PresenceEvent{Pk: pk, Online: true})
+	}
+	return replaced, nil
+}
+
+// the first device that signed in with the key, if any.
 func (h *genericHub[C]) GetClient(key PublicKey) (C, bool) {
-	cl, exists := h.clients[key]
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	var cl C
+	devices, exists := h.clients[key]
+	if exists {
+		cl = devices[0]
+	}
 	return cl, exists
 }
 
-func (h *genericHub[C]) DeleteClient(key PublicKey) error {
+// every device signed in with the key, in the order they signed in. Threadsafe.
+func (h *genericHub[C]) GetClients(key PublicKey) []C {
 	defer h.lock.Unlock()
 	h.lock.Lock()
+	return slices.Clone(h.clients[key])
+}
 
-	_, exists := h.clients[key]
-	if !exists {
-		return errors.New("client with public key does not exist")
+// the first device signed in with the key, waiting up to grace for one to sign in if there isn't one.
+// Blocks, so hot paths should use GetClient. Threadsafe.
+func (h *genericHub[C]) GetClientWithGrace(key PublicKey, grace time.Duration) (C, bool) {
+	var cl C
+	devices := h.GetClientsWithGrace(key, grace)
+	if len(devices) == 0 {
+		return cl, false
+	}
+	return devices[0], true
+}
+
+// every device signed in with the key. If there are none, waits up to grace for one to sign in,
+// so that a peer that is reconnecting isn't mistaken for one that has gone.
+// Returns straight away while the hub is shutting down. Blocks, so hot paths should use GetClients. Threadsafe.
+func (h *genericHub[C]) GetClientsWithGrace(key PublicKey, grace time.Duration) []C {
+	notify := make(chan PresenceEvent, 1)
+	devices, expired := func() ([]C, <-chan time.Time) {
+		defer h.lock.Unlock()
+		h.lock.Lock()
+		devices := slices.Clone(h.clients[key])
+		if len(devices) > 0 || grace <= 0 || h.shuttingDown {
+			return devices, nil
+		}
+		// subscribed with the lock held, so that a device signing in straight after can't be missed
+		h.subscribeLocked(key, notify)
+		return nil, h.clock.After(grace)
+	}()
+	if expired == nil {
+		return devices
+	}
+	defer h.Unsubscribe(key, notify)
+
+	for {
+		select {
+		case event := <-notify:
+			// events can be dropped, so look rather than trusting the event
+			if devices := h.GetClients(key); event.Online && len(devices) > 0 {
+				return devices
+			}
+		case <-expired:
+			return h.GetClients(key)
+		}
+	}
+}
+
+// Should be set before the hub is used. 0 means outputs for a public key with no devices are undeliverable straight away.
+func (h *genericHub[C]) SetPeerLookupGrace(grace time.Duration) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.peerLookupGrace = grace
+}
+
+// how long routing an output to a public key with no devices waits for one to sign in. Threadsafe.
+func (h *genericHub[C]) PeerLookupGrace() time.Duration {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	return h.peerLookupGrace
+}
+
+// remove one device signed in with the key. Returns ErrClientNotFound if it isn't signed in with it.
+func (h *genericHub[C]) DeleteClient(key PublicKey, client C) error {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	devices := h.clients[key]
+	i := slices.Index(devices, client)
+	if i == -1 {
+		return ErrClientNotFound
+	}
+	devices = slices.Delete(devices, i, i+1)
+	h.deviceCount--
+	if len(devices) > 0 {
+		h.clients[key] = devices
+		return nil
 	}
+
+	// last device has gone
 	delete(h.clients, key)
+	h.notifySubscribers(PresenceEvent{Pk: key, Online: false})
+	h.closeDrainedIfEmpty()
 	return nil
 }
+
+// number of devices signed in. Threadsafe.
+func (h *genericHub[C]) ClientCount() int {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	return h.deviceCount
+}
+
+// Should be set before the hub is used. 0 for no limit.
+func (h *genericHub[C]) SetMaxClients(maxClients int) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.maxClients = maxClients
+}
+
+// Should be set before the hub is used. 0 for no limit.
+// Doesn't apply to ReplaceClients, which leaves the key with one device.
+func (h *genericHub[C]) SetMaxDevicesPerKey(maxDevices int) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.maxDevicesPerKey = maxDevices
+}
+
+// whether another device would take the hub over its limit. Must hold h.lock.
+func (h *genericHub[C]) atCapacityLocked() bool {
+	return h.maxClients > 0 && h.deviceCount >= h.maxClients
+}
+
+// Page of the public keys that are online, sorted by key bytes so that pages are consistent between calls,
+// and the total number of keys online. Threadsafe.
+func (h *genericHub[C]) ListClients(offset int, limit int) ([]PublicKey, int) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	keys := make([]PublicKey, 0, len(h.clients))
+	for key := range h.clients {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	total := len(keys)
+	start := min(max(offset, 0), total)
+	end := min(start+max(limit, 0), total)
+	return keys[start:end], total
+}
+
+// Total of the transactions open by every client in the hub. Threadsafe.
+func (h *genericHub[C]) ActiveTransactionCount() int {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	count := 0
+	for _, devices := range h.clients {
+		for _, client := range devices {
+			count += client.TransactionCount()
+		}
+	}
+	return count
+}
+
+// Should be set before the hub is used.
+func (h *genericHub[C]) SetMetrics(metrics MetricsSink) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.metrics = metrics
+}
+
+// Threadsafe.
+func (h *genericHub[C]) Metrics() MetricsSink {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	return h.metrics
+}
+
+// Should be set before the hub is used.
+func (h *genericHub[C]) SetErrorVerbosity(verbosity ErrorVerbosity) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.errorVerbosity = verbosity
+}
+
+// Threadsafe.
+func (h *genericHub[C]) ErrorVerbosity() ErrorVerbosity {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	return h.errorVerbosity
+}
+
+// Should be set before the hub is used.
+func (h *genericHub[C]) SetKeyAlgorithms(algorithms []KeyAlgorithm) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.keyAlgorithms = slices.Clone(algorithms)
+}
+
+// the kinds of key clients can sign in with. Threadsafe.
+func (h *genericHub[C]) KeyAlgorithms() []KeyAlgorithm {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	return slices.Clone(h.keyAlgorithms)
+}
+
+// Should be set before the hub is used.
+func (h *genericHub[C]) SetAuthTimeout(timeout time.Duration) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.authTimeout = timeout
+}
+
+// how long a client signing in has to reply at each step. Threadsafe.
+func (h *genericHub[C]) AuthTimeout() time.Duration {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	return h.authTimeout
+}
+
+// the banned keys. Keys can be added and removed while the hub is in use.
+func (h *genericHub[C]) Blocklist() *Blocklist {
+	return h.blocklist
+}
+
+// the published pre-keys. Threadsafe.
+func (h *genericHub[C]) PreKeys() *PreKeyStore {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	return h.preKeys
+}
+
+// Should be set before the hub is used, e.g. to change the limit on pre-keys per public key.
+func (h *genericHub[C]) SetPreKeyStore(store *PreKeyStore) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.preKeys = store
+}
+
+// Should be set before the hub is used.
+func (h *genericHub[C]) SetOfflineQueueLimits(length int, ttl time.Duration) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.offlineQueueLength = length
+	h.offlineMessageTTL = ttl
+}
+
+// Should be set before the hub is used.
+func (h *genericHub[C]) SetClock(clock Clock) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.clock = clock
+}
+
+// Hold msg until pk comes online and DrainOffline is called. Threadsafe.
+func (h *genericHub[C]) EnqueueOffline(pk PublicKey, msg OfflineMessage) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	queue := h.unexpiredOfflineMessages(pk)
+	queue = append(queue, queuedOfflineMessage{msg: msg, enqueuedAt: h.clock.Now()})
+	if len(queue) > h.offlineQueueLength {
+		queue = queue[len(queue)-h.offlineQueueLength:]
+	}
+	h.offlineQueues[pk] = queue
+}
+
+// Remove and return the messages held for pk, oldest first, leaving out any that have expired. Threadsafe.
+func (h *genericHub[C]) DrainOffline(pk PublicKey) []OfflineMessage {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	queue := h.unexpiredOfflineMessages(pk)
+	delete(h.offlineQueues, pk)
+
+	msgs := make([]OfflineMessage, len(queue))
+	for i, queued := range queue {
+		msgs[i] = queued.msg
+	}
+	return msgs
+}
+
+// must hold h.lock.
+func (h *genericHub[C]) unexpiredOfflineMessages(pk PublicKey) []queuedOfflineMessage {
+	now := h.clock.Now()
+	return slices.DeleteFunc(h.offlineQueues[pk], func(queued queuedOfflineMessage) bool {
+		return now.Sub(queued.enqueuedAt) > h.offlineMessageTTL
+	})
+}
+
+// Should be set before the hub is used.
+func (h *genericHub[C]) SetReconnectTokenTTL(ttl time.Duration) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.reconnectTokenTTL = ttl
+}
+
+// Make a new single-use token that can be redeemed with RedeemReconnectToken to sign in as pk
+// without signing a challenge. Only a hash of it is kept. Threadsafe.
+func (h *genericHub[C]) IssueReconnectToken(pk PublicKey) (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", errors.New("internal server error generating a reconnection token")
+	}
+	token := base64.StdEncoding.EncodeToString(buf)
+
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	tokens := h.unexpiredReconnectTokens(pk)
+	if tokens == nil {
+		tokens = make(map[[sha256.Size]byte]time.Time)
+		h.reconnectTokens[pk] = tokens
+	}
+	tokens[sha256.Sum256([]byte(token))] = h.clock.Now()
+	return token, nil
+}
+
+// Whether token was issued for pk and has not expired. Either way it can't be redeemed again. Threadsafe.
+func (h *genericHub[C]) RedeemReconnectToken(pk PublicKey, token string) bool {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	tokens := h.unexpiredReconnectTokens(pk)
+	hash := sha256.Sum256([]byte(token))
+	_, ok := tokens[hash]
+	delete(tokens, hash)
+	if len(tokens) == 0 {
+		delete(h.reconnectTokens, pk)
+	}
+	return ok
+}
+
+// removes the expired tokens of pk and returns the rest, or nil if there are none.
+// must hold h.lock.
+func (h *genericHub[C]) unexpiredReconnectTokens(pk PublicKey) map[[sha256.Size]byte]time.Time {
+	tokens := h.reconnectTokens[pk]
+	now := h.clock.Now()
+	for hash, issuedAt := range tokens {
+		if now.Sub(issuedAt) > h.reconnectTokenTTL {
+			delete(tokens, hash)
+		}
+	}
+	if len(tokens) == 0 {
+		delete(h.reconnectTokens, pk)
+		return nil
+	}
+	return tokens
+}
+
+// Record that from is sending a friend request to to, unless it already has in the last cooldown.
+// Returns whether it can send it. Threadsafe.
+func (h *genericHub[C]) TryStartFriendRequest(from PublicKey, to PublicKey, cooldown time.Duration) bool {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	now := h.clock.Now()
+	// forget every cooldown that has ended, so the map only holds recent requests
+	for pair, until := range h.friendRequestCooldowns {
+		if !now.Before(until) {
+			delete(h.friendRequestCooldowns, pair)
+		}
+	}
+
+	pair := friendRequestPair{from: from, to: to}
+	if _, coolingDown := h.friendRequestCooldowns[pair]; coolingDown {
+		return false
+	}
+	h.friendRequestCooldowns[pair] = now.Add(cooldown)
+	return true
+}
+
+// Let from send another friend request to to straight away, e.g. because to has replied to the last one. Threadsafe.
+func (h *genericHub[C]) ClearFriendRequestCooldown(from PublicKey, to PublicKey) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	delete(h.friendRequestCooldowns, friendRequestPair{from: from, to: to})
+}
+
+// Record that t is holding the socket with id for pk, so that a client with pk can resume it. Threadsafe.
+func (h *genericHub[C]) addSuspendedSocket(pk PublicKey, id [IDLEN]byte, t *transaction) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.suspendedSockets[suspendedSocketKey{pk: pk, id: id}] = t
+}
+
+// the transaction holding the socket with id for pk, if there is one. Threadsafe.
+func (h *genericHub[C]) suspendedTransaction(pk PublicKey, id [IDLEN]byte) (*transaction, bool) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	t, exists := h.suspendedSockets[suspendedSocketKey{pk: pk, id: id}]
+	return t, exists
+}
+
+// The socket with id for pk has been resumed or has expired. Threadsafe.
+func (h *genericHub[C]) forgetSuspendedSocket(pk PublicKey, id [IDLEN]byte) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	delete(h.suspendedSockets, suspendedSocketKey{pk: pk, id: id})
+}
+
+// Stop accepting new clients, tell every client in the hub that the server is going away,
+// and wait for them all to be deleted from the hub.
+// Returns ctx.Err() if ctx expires before then.
+func (h *genericHub[C]) Shutdown(ctx context.Context) error {
+
+	clients := func() []C {
+		defer h.lock.Unlock()
+		h.lock.Lock()
+		h.shuttingDown = true
+		h.closeDrainedIfEmpty()
+
+		clients := make([]C, 0, len(h.clients))
+		for _, devices := range h.clients {
+			clients = append(clients, devices...)
+		}
+		return clients
+	}()
+
+	// disconnect without holding the lock, because the clients delete themselves from the hub as they leave.
+	for _, client := range clients {
+		client.Disconnect(DisconnectReason_ServerShutdown, `{"terminate":"serverShutdown"}`)
+	}
+
+	select {
+	case <-h.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// whether Shutdown has been called.
+func (h *genericHub[C]) IsShuttingDown() bool {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	return h.shuttingDown
+}
+
+// must hold h.lock.
+func (h *genericHub[C]) closeDrainedIfEmpty() {
+	if h.shuttingDown && len(h.clients) == 0 && !h.drainedClosed {
+		close(h.drained)
+		h.drainedClosed = true
+	}
+}
+
+// Receive a PresenceEvent on notify whenever a client with the public key comes online or goes offline.
+// Events are dropped if notify is full, so it should be buffered.
+func (h *genericHub[C]) Subscribe(pk PublicKey, notify chan PresenceEvent) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	h.subscribeLocked(pk, notify)
+}
+
+// must hold h.lock.
+func (h *genericHub[C]) subscribeLocked(pk PublicKey, notify chan PresenceEvent) {
+	_, exists := h.subscribers[pk]
+	if !exists {
+		h.subscribers[pk] = make(map[chan PresenceEvent]struct{})
+	}
+	h.subscribers[pk][notify] = struct{}{}
+}
+
+func (h *genericHub[C]) Unsubscribe(pk PublicKey, notify chan PresenceEvent) {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+
+	delete(h.subscribers[pk], notify)
+	if len(h.subscribers[pk]) == 0 {
+		delete(h.subscribers, pk)
+	}
+}
+
+// number of channels subscribed to presence events, counting one for each public key they are subscribed to.
+// For tests and debugging.
+func (h *genericHub[C]) SubscriberCount() int {
+	defer h.lock.Unlock()
+	h.lock.Lock()
+	count := 0
+	for _, notifies := range h.subscribers {
+		count += len(notifies)
+	}
+	return count
+}
+
+// must hold h.lock.
+// does not block - the hub should never wait on a subscriber.
+func (h *genericHub[C]) notifySubscribers(event PresenceEvent) {
+	for notify := range h.subscribers[event.Pk] {
+		select {
+		case notify <- event:
+		default:
+		}
+	}
+}
@@ -1,19 +1,89 @@
 package model
 
 import (
+	"context"
+	"errors"
+	"runtime"
+	"slices"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 // mock client type
 type ClientMockForHub struct {
 	publicKey *PublicKey
+	// messages passed to Disconnect
+	disconnectMsgs []string
+	// called by Disconnect, if set
+	onDisconnect func()
+	// returned by TransactionCount
+	transactionCount int
 }
 
 func (c *ClientMockForHub) GetPublicKey() *PublicKey {
 	return c.publicKey
 }
 
+func (c *ClientMockForHub) TransactionCount() int {
+	return c.transactionCount
+}
+
+func (c *ClientMockForHub) Disconnect(reason DisconnectReason, msg string) {
+	c.disconnectMsgs = append(c.disconnectMsgs, msg)
+	if c.onDisconnect != nil {
+		c.onDisconnect()
+	}
+}
+
+// clock that only moves forward when told to.
+type fakeClock struct {
+	now time.Time
+	// channels returned by After that haven't fired yet
+	timers []fakeTimer
+	lock   sync.Mutex
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	return c.now
+}
+
+// fires once Advance has moved the clock d past now.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer.c
+	}
+	c.timers = append(c.timers, timer)
+	return timer.c
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
+
 var pk0 = (PublicKey)("MCowBQYDK2VwAyEAUFRxKDllkUY843/zVOPE67zGqkGoMZd7dGKl2+9+pYQ=")
 
 // var privateKey0 = "MC4CAQAwBQYDK2VwBCIEILLK2qyMQi162qzsJ2pV5bS5tX/6XEgWtw62eUKOKLAF"
@@ -57,7 +127,7 @@ func TestHub(t *testing.T) {
 		}
 	})
 
-	t.Run("adding 2 clients with the same public key fails", func(t *testing.T) {
+	t.Run("adding the same client twice fails", func(t *testing.T) {
 		tests := []struct {
 			publicKey PublicKey
 		}{
@@ -69,15 +139,14 @@ func TestHub(t *testing.T) {
 
 				hub := newGenericHub[*ClientMockForHub]()
 
-				// add first client directly
+				// add client directly
 				client0 := &ClientMockForHub{publicKey: &tt.publicKey}
-				hub.clients[tt.publicKey] = client0
+				hub.clients[tt.publicKey] = []*ClientMockForHub{client0}
 
-				// use proper method to add second client
-				client1 := &ClientMockForHub{publicKey: &tt.publicKey}
-				err1 := hub.AddClient(tt.publicKey, client1)
+				// use proper method to add it again
+				err := hub.AddClient(tt.publicKey, client0)
 
-				if err1 == nil {
+				if err == nil {
 					t.Errorf("Expected adding the client to fail")
 				}
 
@@ -85,6 +154,59 @@ func TestHub(t *testing.T) {
 		}
 	})
 
+	t.Run("adding 2 devices with the same public key succeeds", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		notify := make(chan PresenceEvent, 4)
+		hub.Subscribe(pk0, notify)
+
+		device0 := &ClientMockForHub{publicKey: &pk0}
+		device1 := &ClientMockForHub{publicKey: &pk0}
+		for _, device := range []*ClientMockForHub{device0, device1} {
+			err := hub.AddClient(pk0, device)
+			if err != nil {
+				t.Errorf(err.Error())
+			}
+		}
+
+		devices := hub.GetClients(pk0)
+		if len(devices) != 2 || devices[0] != device0 || devices[1] != device1 {
+			t.Errorf("Expected both devices in sign-in order. Got %v", devices)
+		}
+		first, _ := hub.GetClient(pk0)
+		if first != device0 {
+			t.Errorf("Expected GetClient to return the first device. Got %v", first)
+		}
+
+		// deleting one device leaves the key online
+		hub.DeleteClient(pk0, device0)
+		devices = hub.GetClients(pk0)
+		if len(devices) != 1 || devices[0] != device1 {
+			t.Errorf("Expected only the second device to remain. Got %v", devices)
+		}
+		hub.DeleteClient(pk0, device1)
+		if _, exists := hub.GetClient(pk0); exists {
+			t.Errorf("Expected the key to be offline after the last device was deleted")
+		}
+
+		// one event when the first device signs in, and one when the last leaves
+		expected := []PresenceEvent{{Pk: pk0, Online: true}, {Pk: pk0, Online: false}}
+		for _, e := range expected {
+			select {
+			case got := <-notify:
+				if got != e {
+					t.Errorf("Expected %v got %v", e, got)
+				}
+			default:
+				t.Errorf("Expected %v, got no event", e)
+			}
+		}
+		select {
+		case got := <-notify:
+			t.Errorf("Expected no more events, got %v", got)
+		default:
+		}
+	})
+
 	// t.Run("Adding client with nil public key fails", func(t *testing.T) {
 
 	// 	hub := NewHub()
@@ -111,9 +233,9 @@ func TestHub(t *testing.T) {
 				client := &ClientMockForHub{publicKey: &tt.publicKey}
 
 				// add client directly
-				hub.clients[tt.publicKey] = client
+				hub.clients[tt.publicKey] = []*ClientMockForHub{client}
 
-				err := hub.DeleteClient(tt.publicKey)
+				err := hub.DeleteClient(tt.publicKey, client)
 
 				if err != nil {
 					t.Errorf(err.Error())
@@ -134,12 +256,490 @@ func TestHub(t *testing.T) {
 			t.Run(strconv.Itoa(i), func(t *testing.T) {
 				hub := NewHub()
 
-				err := hub.DeleteClient(tt.publicKey)
+				err := hub.DeleteClient(tt.publicKey, &Client{publicKey: &tt.publicKey})
 
-				if err == nil {
-					t.Errorf("Expected an error")
+				if !errors.Is(err, ErrClientNotFound) {
+					t.Errorf("Expected ErrClientNotFound, got %v", err)
+				}
+
+			})
+		}
+	})
+
+	t.Run("Replacing clients signs out every other device without the key going offline", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		old0 := &ClientMockForHub{publicKey: &pk0}
+		old1 := &ClientMockForHub{publicKey: &pk0}
+		hub.AddClient(pk0, old0)
+		hub.AddClient(pk0, old1)
+
+		notify := make(chan PresenceEvent, 2)
+		hub.Subscribe(pk0, notify)
+
+		newClient := &ClientMockForHub{publicKey: &pk0}
+		replaced, err := hub.ReplaceClients(pk0, newClient)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err.Error())
+		}
+
+		if !slices.Equal(replaced, []*ClientMockForHub{old0, old1}) {
+			t.Errorf("Expected both old devices to be replaced. Got %v", replaced)
+		}
+		if devices := hub.GetClients(pk0); !slices.Equal(devices, []*ClientMockForHub{newClient}) {
+			t.Errorf("Expected only the new device to be signed in. Got %v", devices)
+		}
+		select {
+		case got := <-notify:
+			t.Errorf("Expected no event, got %v", got)
+		default:
+		}
+
+		// the old devices have already gone
+		if err := hub.DeleteClient(pk0, old0); err == nil {
+			t.Errorf("Expected an error deleting a replaced device")
+		}
+	})
+
+	t.Run("Replacing clients of an offline key brings it online", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		notify := make(chan PresenceEvent, 2)
+		hub.Subscribe(pk0, notify)
+
+		replaced, err := hub.ReplaceClients(pk0, &ClientMockForHub{publicKey: &pk0})
+		if err != nil || len(replaced) != 0 {
+			t.Errorf("Expected nothing to be replaced. Got %v, %v", replaced, err)
+		}
+		select {
+		case got := <-notify:
+			if got != (PresenceEvent{Pk: pk0, Online: true}) {
+				t.Errorf("Expected an online event, got %v", got)
+			}
+		default:
+			t.Errorf("Expected an online event")
+		}
+	})
+
+	t.Run("Subscribers are notified when a client comes online and goes offline", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		notify := make(chan PresenceEvent, 2)
+		hub.Subscribe(pk0, notify)
+
+		client := &ClientMockForHub{publicKey: &pk0}
+		hub.AddClient(pk0, client)
+		hub.DeleteClient(pk0, client)
+
+		expected := []PresenceEvent{{Pk: pk0, Online: true}, {Pk: pk0, Online: false}}
+		for _, e := range expected {
+			select {
+			case got := <-notify:
+				if got != e {
+					t.Errorf("Expected %v got %v", e, got)
 				}
+			default:
+				t.Errorf("Expected %v, got no event", e)
+			}
+		}
+	})
+
+	t.Run("Subscribers are not notified about other clients or after unsubscribing", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		notify := make(chan PresenceEvent, 2)
+		hub.Subscribe(pk0, notify)
+
+		hub.AddClient(pk1, &ClientMockForHub{publicKey: &pk1})
+		hub.Unsubscribe(pk0, notify)
+		hub.AddClient(pk0, &ClientMockForHub{publicKey: &pk0})
+
+		select {
+		case got := <-notify:
+			t.Errorf("Expected no event, got %v", got)
+		default:
+		}
+	})
+
+	t.Run("Shutdown disconnects all clients and waits for them to leave", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		clients := []*ClientMockForHub{{publicKey: &pk0}, {publicKey: &pk1}}
+		for _, client := range clients {
+			hub.AddClient(*client.publicKey, client)
+			// like a real client, leave the hub after disconnecting
+			client.onDisconnect = func() {
+				go hub.DeleteClient(*client.publicKey, client)
+			}
+		}
 
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := hub.Shutdown(ctx)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err.Error())
+		}
+
+		for _, client := range clients {
+			if len(client.disconnectMsgs) != 1 || client.disconnectMsgs[0] != `{"terminate":"serverShutdown"}` {
+				t.Errorf("Expected a single serverShutdown message. Got %v", client.disconnectMsgs)
+			}
+		}
+	})
+
+	t.Run("Shutdown returns when the context expires if clients do not leave", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		hub.AddClient(pk0, &ClientMockForHub{publicKey: &pk0})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := hub.Shutdown(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("Shutdown with no clients returns immediately", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		err := hub.Shutdown(context.Background())
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err.Error())
+		}
+	})
+
+	t.Run("Clients cannot be added after shutdown", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		if hub.IsShuttingDown() {
+			t.Errorf("Expected the hub not to be shutting down before Shutdown")
+		}
+		hub.Shutdown(context.Background())
+		if !hub.IsShuttingDown() {
+			t.Errorf("Expected the hub to be shutting down after Shutdown")
+		}
+
+		err := hub.AddClient(pk0, &ClientMockForHub{publicKey: &pk0})
+		if err == nil {
+			t.Errorf("Expected an error")
+		}
+	})
+
+	t.Run("Counts clients and their transactions", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		hub.AddClient(pk0, &ClientMockForHub{publicKey: &pk0, transactionCount: 2})
+		hub.AddClient(pk1, &ClientMockForHub{publicKey: &pk1, transactionCount: 3})
+
+		if count := hub.ClientCount(); count != 2 {
+			t.Errorf("Expected 2 clients, got %d", count)
+		}
+		if count := hub.ActiveTransactionCount(); count != 5 {
+			t.Errorf("Expected 5 transactions, got %d", count)
+		}
+	})
+
+	t.Run("Clients cannot be added once the hub is at capacity", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		hub.SetMaxClients(2)
+
+		client0 := &ClientMockForHub{publicKey: &pk0}
+		if err := hub.AddClient(pk0, client0); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if err := hub.AddClient(pk0, &ClientMockForHub{publicKey: &pk0}); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		// a new key or another device
+		if err := hub.AddClient(pk1, &ClientMockForHub{publicKey: &pk1}); !errors.Is(err, ErrHubAtCapacity) {
+			t.Errorf("Expected ErrHubAtCapacity, got %v", err)
+		}
+		if _, err := hub.ReplaceClients(pk1, &ClientMockForHub{publicKey: &pk1}); !errors.Is(err, ErrHubAtCapacity) {
+			t.Errorf("Expected ErrHubAtCapacity replacing the devices of an offline key, got %v", err)
+		}
+		if devices := hub.GetClients(pk1); len(devices) != 0 {
+			t.Errorf("Expected the rejected key not to be added. Got %v", devices)
+		}
+
+		// replacing an online key's devices frees a slot rather than taking one
+		replacement := &ClientMockForHub{publicKey: &pk0}
+		if _, err := hub.ReplaceClients(pk0, replacement); err != nil {
+			t.Errorf("Expected replacing devices to succeed at capacity, got %v", err)
+		}
+		if count := hub.ClientCount(); count != 1 {
+			t.Errorf("Expected 1 client, got %d", count)
+		}
+		if err := hub.AddClient(pk1, &ClientMockForHub{publicKey: &pk1}); err != nil {
+			t.Errorf("Expected a client to be added below capacity, got %v", err)
+		}
+
+		// signing out frees a slot
+		hub.DeleteClient(pk0, replacement)
+		if err := hub.AddClient(pk0, client0); err != nil {
+			t.Errorf("Expected a client to be added after another left, got %v", err)
+		}
+	})
+
+	t.Run("A key cannot be signed in on more than the maximum number of devices", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		hub.SetMaxDevicesPerKey(3)
+
+		devices := []*ClientMockForHub{}
+		for i := 0; i < 3; i++ {
+			device := &ClientMockForHub{publicKey: &pk0}
+			if err := hub.AddClient(pk0, device); err != nil {
+				t.Fatalf("Expected device %d to be added, got %v", i, err)
+			}
+			devices = append(devices, device)
+		}
+
+		if err := hub.AddClient(pk0, &ClientMockForHub{publicKey: &pk0}); !errors.Is(err, ErrTooManyDevices) {
+			t.Errorf("Expected ErrTooManyDevices, got %v", err)
+		}
+		if count := hub.ClientCount(); count != 3 {
+			t.Errorf("Expected 3 clients, got %d", count)
+		}
+		// other keys have their own limit
+		if err := hub.AddClient(pk1, &ClientMockForHub{publicKey: &pk1}); err != nil {
+			t.Errorf("Expected a device of another key to be added, got %v", err)
+		}
+
+		// signing out frees a slot
+		hub.DeleteClient(pk0, devices[1])
+		if err := hub.AddClient(pk0, &ClientMockForHub{publicKey: &pk0}); err != nil {
+			t.Errorf("Expected a device to be added after another left, got %v", err)
+		}
+
+		// taking over the session leaves one device
+		if _, err := hub.ReplaceClients(pk0, &ClientMockForHub{publicKey: &pk0}); err != nil {
+			t.Errorf("Expected replacing devices to succeed at the limit, got %v", err)
+		}
+		if devices := hub.GetClients(pk0); len(devices) != 1 {
+			t.Errorf("Expected 1 device after the takeover, got %d", len(devices))
+		}
+	})
+
+	t.Run("Capacity is never exceeded by clients signing in at once", func(t *testing.T) {
+		const maxClients = 10
+		hub := newGenericHub[*ClientMockForHub]()
+		hub.SetMaxClients(maxClients)
+
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		added := 0
+		for i := 0; i < 5*maxClients; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pk := PublicKey(strconv.Itoa(i))
+				if hub.AddClient(pk, &ClientMockForHub{publicKey: &pk}) == nil {
+					lock.Lock()
+					added++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if added != maxClients || hub.ClientCount() != maxClients {
+			t.Errorf("Expected %d clients to be added, %d were and the hub has %d", maxClients, added, hub.ClientCount())
+		}
+	})
+
+	t.Run("Messages queued for an offline key are drained in order", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		hub.EnqueueOffline(pk0, OfflineMessage{Msg: "0"})
+		hub.EnqueueOffline(pk0, OfflineMessage{Msg: "1"})
+		hub.EnqueueOffline(pk1, OfflineMessage{Msg: "other key"})
+
+		msgs := hub.DrainOffline(pk0)
+		expected := []OfflineMessage{{Msg: "0"}, {Msg: "1"}}
+		if !slices.Equal(msgs, expected) {
+			t.Errorf("Expected %v got %v", expected, msgs)
+		}
+
+		// draining empties the queue
+		if msgs := hub.DrainOffline(pk0); len(msgs) != 0 {
+			t.Errorf("Expected no messages after draining, got %v", msgs)
+		}
+	})
+
+	t.Run("Queued messages expire after the TTL", func(t *testing.T) {
+		clock := &fakeClock{}
+		hub := newGenericHub[*ClientMockForHub]()
+		hub.SetClock(clock)
+		hub.SetOfflineQueueLimits(DEFAULT_OFFLINE_QUEUE_LENGTH, time.Hour)
+
+		hub.EnqueueOffline(pk0, OfflineMessage{Msg: "old"})
+		clock.Advance(30 * time.Minute)
+		hub.EnqueueOffline(pk0, OfflineMessage{Msg: "new"})
+		clock.Advance(31 * time.Minute)
+
+		msgs := hub.DrainOffline(pk0)
+		expected := []OfflineMessage{{Msg: "new"}}
+		if !slices.Equal(msgs, expected) {
+			t.Errorf("Expected %v got %v", expected, msgs)
+		}
+	})
+
+	t.Run("The oldest queued messages are dropped when the queue is full", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		hub.SetOfflineQueueLimits(2, DEFAULT_OFFLINE_MESSAGE_TTL)
+
+		for i := 0; i < 3; i++ {
+			hub.EnqueueOffline(pk0, OfflineMessage{Msg: strconv.Itoa(i)})
+		}
+
+		msgs := hub.DrainOffline(pk0)
+		expected := []OfflineMessage{{Msg: "1"}, {Msg: "2"}}
+		if !slices.Equal(msgs, expected) {
+			t.Errorf("Expected %v got %v", expected, msgs)
+		}
+	})
+
+	t.Run("Reconnection tokens can be redeemed once for their own key", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+		token0, _ := hub.IssueReconnectToken(pk0)
+		token1, _ := hub.IssueReconnectToken(pk0)
+		if token0 == token1 {
+			t.Errorf("Expected every token to be different")
+		}
+
+		if hub.RedeemReconnectToken(pk1, token0) {
+			t.Errorf("Expected a token not to be redeemable for another key")
+		}
+		if !hub.RedeemReconnectToken(pk0, token0) {
+			t.Errorf("Expected the token to be redeemable")
+		}
+		if hub.RedeemReconnectToken(pk0, token0) {
+			t.Errorf("Expected the token not to be redeemable twice")
+		}
+		// other devices' tokens are unaffected
+		if !hub.RedeemReconnectToken(pk0, token1) {
+			t.Errorf("Expected the second token to be redeemable")
+		}
+	})
+
+	t.Run("Reconnection tokens expire after the TTL", func(t *testing.T) {
+		clock := &fakeClock{}
+		hub := newGenericHub[*ClientMockForHub]()
+		hub.SetClock(clock)
+		hub.SetReconnectTokenTTL(time.Minute)
+
+		old, _ := hub.IssueReconnectToken(pk0)
+		clock.Advance(30 * time.Second)
+		recent, _ := hub.IssueReconnectToken(pk0)
+		clock.Advance(31 * time.Second)
+
+		if hub.RedeemReconnectToken(pk0, old) {
+			t.Errorf("Expected the expired token not to be redeemable")
+		}
+		if !hub.RedeemReconnectToken(pk0, recent) {
+			t.Errorf("Expected the unexpired token to be redeemable")
+		}
+	})
+
+	t.Run("Looking up a client with a grace period", func(t *testing.T) {
+
+		// start the lookup, and wait for it to be watching for the key to come online
+		lookUp := func(hub *genericHub[*ClientMockForHub], grace time.Duration) <-chan *ClientMockForHub {
+			found := make(chan *ClientMockForHub, 1)
+			go func() {
+				client, _ := hub.GetClientWithGrace(pk0, grace)
+				found <- client
+			}()
+			for {
+				hub.lock.Lock()
+				subscribed := len(hub.subscribers[pk0]) > 0
+				hub.lock.Unlock()
+				if subscribed {
+					return found
+				}
+				runtime.Gosched()
+			}
+		}
+
+		t.Run("Client present immediately", func(t *testing.T) {
+			hub := newGenericHub[*ClientMockForHub]()
+			client := &ClientMockForHub{publicKey: &pk0}
+			hub.AddClient(pk0, client)
+
+			// returns without waiting for the grace period
+			found, ok := hub.GetClientWithGrace(pk0, time.Hour)
+			if !ok || found != client {
+				t.Errorf("Expected the client to be found")
+			}
+		})
+
+		t.Run("Client appears within grace", func(t *testing.T) {
+			hub := newGenericHub[*ClientMockForHub]()
+			found := lookUp(hub, time.Hour)
+
+			client := &ClientMockForHub{publicKey: &pk0}
+			hub.AddClient(pk0, client)
+			if got := <-found; got != client {
+				t.Errorf("Expected the client that signed in to be found, got %v", got)
+			}
+			if len(hub.subscribers) != 0 {
+				t.Errorf("Expected the lookup to unsubscribe")
+			}
+		})
+
+		t.Run("Client never appears", func(t *testing.T) {
+			clock := &fakeClock{}
+			hub := newGenericHub[*ClientMockForHub]()
+			hub.SetClock(clock)
+			found := lookUp(hub, time.Second)
+
+			// another key coming online doesn't end the wait
+			hub.AddClient(pk1, &ClientMockForHub{publicKey: &pk1})
+			clock.Advance(time.Second)
+			if got := <-found; got != nil {
+				t.Errorf("Expected no client to be found, got %v", got)
+			}
+		})
+
+		t.Run("Doesn't wait while shutting down", func(t *testing.T) {
+			hub := newGenericHub[*ClientMockForHub]()
+			hub.Shutdown(context.Background())
+
+			if _, ok := hub.GetClientWithGrace(pk0, time.Hour); ok {
+				t.Errorf("Expected no client to be found")
+			}
+		})
+	})
+
+	t.Run("Lists online keys a page at a time", func(t *testing.T) {
+		hub := newGenericHub[*ClientMockForHub]()
+
+		keys, total := hub.ListClients(0, 10)
+		if len(keys) != 0 || total != 0 {
+			t.Errorf("Expected an empty hub to have no keys, got %v and total %d", keys, total)
+		}
+
+		// added out of order, and a key with two devices is listed once
+		for _, key := range []PublicKey{"c", "a", "e", "b", "d"} {
+			hub.AddClient(key, &ClientMockForHub{publicKey: &key})
+		}
+		hub.AddClient("a", &ClientMockForHub{})
+
+		tests := []struct {
+			description string
+			offset      int
+			limit       int
+			expected    []PublicKey
+		}{
+			{"single page", 0, 10, []PublicKey{"a", "b", "c", "d", "e"}},
+			{"first page", 0, 2, []PublicKey{"a", "b"}},
+			{"second page", 2, 2, []PublicKey{"c", "d"}},
+			{"last page", 4, 2, []PublicKey{"e"}},
+			{"past the end", 6, 2, []PublicKey{}},
+			{"negative offset", -1, 1, []PublicKey{"a"}},
+			{"zero limit", 0, 0, []PublicKey{}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				keys, total := hub.ListClients(tt.offset, tt.limit)
+				if !slices.Equal(keys, tt.expected) {
+					t.Errorf("Expected %v got %v", tt.expected, keys)
+				}
+				if total != 5 {
+					t.Errorf("Expected a total of 5, got %d", total)
+				}
 			})
 		}
 	})
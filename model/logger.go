@@ -0,0 +1,18 @@
+package model
+
+import "log/slog"
+
+// Levelled logger with key-value fields, e.g.
+// logger.Warn("Malformed message", "transactionId", id, "publicKey", pk)
+// *slog.Logger satisfies this.
+type Logger interface {
+	Debug(msg string, keyvals ...any)
+	Info(msg string, keyvals ...any)
+	Warn(msg string, keyvals ...any)
+	Error(msg string, keyvals ...any)
+}
+
+// logs using the standard library's default logger
+func DefaultLogger() Logger {
+	return slog.Default()
+}
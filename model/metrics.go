@@ -0,0 +1,183 @@
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+// names of the counters incremented by routines
+const (
+	METRIC_COME_ONLINE_COMPLETED = "harmony_come_online_completed_total"
+	METRIC_CONNECTION_HANDSHAKES = "harmony_connection_handshakes_total"
+	// connection requests where both peers confirmed that their connection opened
+	METRIC_CONNECTIONS_ESTABLISHED = "harmony_connections_established_total"
+)
+
+// names of the counters incremented with labels
+const (
+	// transaction sockets ended by routines, by routine and DoneReason
+	METRIC_TRANSACTIONS_ENDED = "harmony_transactions_ended_total"
+)
+
+// names of the histograms of durations observed by routines
+const (
+	// how long each Next call takes, by routine and the state it was called in
+	METRIC_ROUTINE_NEXT_SECONDS = "harmony_routine_next_seconds"
+	// how long establishConnectionToPeer spends in each state before moving on
+	METRIC_CONNECTION_STATE_SECONDS = "harmony_connection_state_seconds"
+	// how long establishConnectionToPeer takes from the first message until both peers have sent all their ICE candidates
+	METRIC_CONNECTION_HANDSHAKE_SECONDS = "harmony_connection_handshake_seconds"
+)
+
+// upper bounds of the histogram buckets, smallest first. Observations above the last only count towards +Inf.
+var HISTOGRAM_BUCKETS = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// tells apart the observations of a histogram, or the counts of a labelled counter. Empty fields are left out when reported.
+type MetricLabels struct {
+	Routine string
+	State   string
+	Reason  string
+}
+
+// receives counts of notable events, and how long things took.
+// implementations must be threadsafe, and shouldn't block for long, since they are called in the middle of routines.
+type MetricsSink interface {
+	IncCounter(name string)
+	IncLabelledCounter(name string, labels MetricLabels)
+	ObserveDuration(name string, labels MetricLabels, d time.Duration)
+}
+
+// MetricsSink that throws everything away.
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(name string) {}
+
+func (noopMetrics) IncLabelledCounter(name string, labels MetricLabels) {}
+
+func (noopMetrics) ObserveDuration(name string, labels MetricLabels, d time.Duration) {}
+
+// durations observed for one set of labels.
+type Histogram struct {
+	// number of observations at most HISTOGRAM_BUCKETS[i], for each i. Cumulative, like Prometheus buckets.
+	Buckets []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+type metricKey struct {
+	name   string
+	labels MetricLabels
+}
+
+// in-memory MetricsSink. Threadsafe.
+type Counters struct {
+	counts         map[string]uint64
+	labelledCounts map[metricKey]uint64
+	histograms     map[metricKey]*Histogram
+	lock           sync.Mutex
+}
+
+func NewCounters() *Counters {
+	return &Counters{
+		counts:         make(map[string]uint64),
+		labelledCounts: make(map[metricKey]uint64),
+		histograms:     make(map[metricKey]*Histogram),
+	}
+}
+
+func (c *Counters) IncCounter(name string) {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	c.counts[name] += 1
+}
+
+// 0 if the counter has never been incremented.
+func (c *Counters) Get(name string) uint64 {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	return c.counts[name]
+}
+
+func (c *Counters) IncLabelledCounter(name string, labels MetricLabels) {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	c.labelledCounts[metricKey{name, labels}] += 1
+}
+
+// 0 if the counter has never been incremented with these labels.
+func (c *Counters) GetLabelled(name string, labels MetricLabels) uint64 {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	return c.labelledCounts[metricKey{name, labels}]
+}
+
+// counts of the counter with this name, by labels.
+func (c *Counters) GetAllLabelled(name string) map[MetricLabels]uint64 {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	counts := make(map[MetricLabels]uint64)
+	for key, count := range c.labelledCounts {
+		if key.name == name {
+			counts[key.labels] = count
+		}
+	}
+	return counts
+}
+
+func (c *Counters) ObserveDuration(name string, labels MetricLabels, d time.Duration) {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	key := metricKey{name, labels}
+	h, ok := c.histograms[key]
+	if !ok {
+		h = &Histogram{Buckets: make([]uint64, len(HISTOGRAM_BUCKETS))}
+		c.histograms[key] = h
+	}
+	for i, bound := range HISTOGRAM_BUCKETS {
+		if d <= bound {
+			h.Buckets[i] += 1
+		}
+	}
+	h.Count += 1
+	h.Sum += d
+}
+
+// copy of the histogram with this name and labels. Count is 0 if nothing has been observed.
+func (c *Counters) GetHistogram(name string, labels MetricLabels) Histogram {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	h, ok := c.histograms[metricKey{name, labels}]
+	if !ok {
+		return Histogram{Buckets: make([]uint64, len(HISTOGRAM_BUCKETS))}
+	}
+	return h.clone()
+}
+
+// copies of every histogram with this name, by labels.
+func (c *Counters) GetHistograms(name string) map[MetricLabels]Histogram {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	histograms := make(map[MetricLabels]Histogram)
+	for key, h := range c.histograms {
+		if key.name == name {
+			histograms[key.labels] = h.clone()
+		}
+	}
+	return histograms
+}
+
+func (h *Histogram) clone() Histogram {
+	clone := *h
+	clone.Buckets = append([]uint64(nil), h.Buckets...)
+	return clone
+}
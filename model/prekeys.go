@@ -0,0 +1,70 @@
+package model
+
+import (
+	"errors"
+	"sync"
+)
+
+// maximum number of unclaimed pre-keys held for a public key.
+const DEFAULT_MAX_PRE_KEYS = 100
+
+// returned when publishing pre-keys would take a public key over the store's limit.
+var ErrTooManyPreKeys = errors.New("too many pre-keys")
+
+// One-time pre-keys published by public keys, for peers to start end-to-end encrypted sessions with them while they are offline.
+// Each pre-key is handed out once, oldest first. Threadsafe.
+type PreKeyStore struct {
+	// unclaimed pre-keys of each public key that has published any, oldest first.
+	// a key that has published pre-keys stays in the map once they have all been claimed.
+	preKeys map[PublicKey][]string
+	// most pre-keys held for one public key. 0 for no limit.
+	maxPerKey int
+	lock      sync.Mutex
+}
+
+func NewPreKeyStore(maxPerKey int) *PreKeyStore {
+	return &PreKeyStore{
+		preKeys:   make(map[PublicKey][]string),
+		maxPerKey: maxPerKey,
+	}
+}
+
+// Add preKeys to those held for key. Returns ErrTooManyPreKeys, adding none, if it would hold more than its limit.
+// Returns how many pre-keys are held for key.
+func (s *PreKeyStore) Publish(key PublicKey, preKeys []string) (int, error) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	held := s.preKeys[key]
+	if s.maxPerKey > 0 && len(held)+len(preKeys) > s.maxPerKey {
+		return len(held), ErrTooManyPreKeys
+	}
+	s.preKeys[key] = append(held, preKeys...)
+	return len(s.preKeys[key]), nil
+}
+
+// Remove and return the oldest pre-key held for key.
+// ok is false if there are none left, and published is false if key has never published any.
+func (s *PreKeyStore) Claim(key PublicKey) (preKey string, published bool, ok bool) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	held, published := s.preKeys[key]
+	if len(held) == 0 {
+		return "", published, false
+	}
+	s.preKeys[key] = held[1:]
+	return held[0], true, true
+}
+
+// number of pre-keys held for key.
+func (s *PreKeyStore) Count(key PublicKey) int {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+	return len(s.preKeys[key])
+}
+
+// most pre-keys held for one public key. 0 for no limit.
+func (s *PreKeyStore) MaxPerKey() int {
+	return s.maxPerKey
+}
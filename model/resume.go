@@ -0,0 +1,313 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// default time a client that drops has to reconnect and resume its transactions before its peers are told it has gone
+const DEFAULT_RESUME_GRACE = 10 * time.Second
+
+// a transaction socket of a client that has disconnected, held by the transaction for the client's resume grace period.
+// The routine isn't told that the client has gone unless the grace period runs out.
+// requires the transaction's pkToROChanLock
+type suspendedSocket struct {
+	id [IDLEN]byte
+	// when the client close is passed to the routine if the socket hasn't been resumed
+	expires time.Time
+	// the client close that was held back
+	clientClose       routineInputWrapper
+	initiatedByClient bool
+	// running timeout, presence subscription and wake of the socket, carried over when it is resumed
+	timeoutTimer   <-chan time.Time
+	presenceEvents chan PresenceEvent
+	wakeTimer      <-chan time.Time
+	// outputs the routine sent to the public key while it was suspended, in order
+	pending []RoutineOutput
+	// one of the pending outputs ends the socket, so the routine doesn't need the client close
+	done bool
+	// a client has resumed the socket, and is waiting for the transaction to hand over the pending outputs
+	resuming bool
+}
+
+// identifies a suspended socket in the hub
+type suspendedSocketKey struct {
+	pk PublicKey
+	id [IDLEN]byte
+}
+
+var errNotResumable = errors.New("transaction cannot be resumed")
+
+// Hold the socket in its transaction instead of telling the routine that the client has gone, if the client has disconnected and can come back for it.
+// Only the socket that receives the public key's outputs can be suspended. From now on they are held for it.
+// clientClose is passed to the routine if it isn't resumed in time. Returns whether the socket was suspended.
+// Sockets aren't suspended once the context passed to Route has been cancelled, since nothing should outlive Route then.
+func (c *Client) suspendTransactionSocket(ts *transactionSocket, clientClose routineInputWrapper) bool {
+	pk := c.GetPublicKey()
+	if c.resumeGrace <= 0 || pk == nil || c.hub == nil || c.hub.IsShuttingDown() || !c.isDisconnected() || c.routingContext().Err() != nil {
+		return false
+	}
+
+	t := ts.transaction
+	suspended := func() bool {
+		defer t.pkToROChanLock.Unlock()
+		t.pkToROChanLock.Lock()
+		// another device has claimed the public key, or the routine has finished with this socket
+		if t.pkToROChan[*pk] != ts.roChan {
+			return false
+		}
+		if _, exists := t.suspended[*pk]; exists {
+			return false
+		}
+		delete(t.pkToROChan, *pk)
+		t.suspended[*pk] = &suspendedSocket{
+			id:                ts.id,
+			expires:           t.clock.Now().Add(c.resumeGrace),
+			clientClose:       clientClose,
+			initiatedByClient: ts.initiatedByClient,
+			timeoutTimer:      ts.status.timeoutTimer,
+			presenceEvents:    ts.status.presenceEvents,
+			wakeTimer:         ts.status.wakeTimer,
+		}
+		return true
+	}()
+	if suspended {
+		c.hub.addSuspendedSocket(*pk, ts.id, t)
+		c.Logger().Debug("Transaction suspended until the client resumes it", c.logFields(ts.id, "resumeGrace", c.resumeGrace)...)
+	}
+	return suspended
+}
+
+func (c *Client) isDisconnected() bool {
+	defer c.modifyTransactionsLock.Unlock()
+	c.modifyTransactionsLock.Lock()
+	return c.disconnected
+}
+
+// the id in a control message from the client asking to resume one of its transactions after reconnecting, like {"resumeTransaction":"abcdefghijklmnop"}.
+// ok is false if body isn't one of these. The id might not be IDLEN long.
+func parseResumeTransaction(body []byte) (id string, ok bool) {
+	msg := struct {
+		ResumeTransaction *string `json:"resumeTransaction"`
+	}{}
+	err := json.Unmarshal(body, &msg)
+	if err != nil || msg.ResumeTransaction == nil {
+		return "", false
+	}
+	return *msg.ResumeTransaction, true
+}
+
+// Give the client back the transaction socket with this id, suspended when its public key last disconnected.
+// Replies {"resumed":"<id>"} on the control id if it worked, otherwise {"error":"transaction cannot be resumed"}.
+// Should only be called from the Route goroutine.
+func (c *Client) resumeTransactionSocket(hub *Hub, idStr string) {
+	fail := func(reason string) {
+		c.Logger().Debug("Resume refused: "+reason, "publicKey", c.logPk(), "resumeTransaction", idStr)
+		c.writeTransactionMessage(CONTROL_ID, `{"error":"transaction cannot be resumed"}`)
+	}
+
+	pk := c.GetPublicKey()
+	if pk == nil {
+		fail("public key not set")
+		return
+	}
+	id, ok := c.framing.parseId(idStr)
+	if !ok {
+		fail("no such transaction")
+		return
+	}
+	if _, exists := c.getTransactionSocket(id); exists {
+		fail("transaction id in use")
+		return
+	}
+	t, exists := hub.suspendedTransaction(*pk, id)
+	if !exists {
+		fail("no such transaction")
+		return
+	}
+	slot, exists := t.getSuspended(*pk, id)
+	if !exists {
+		fail("no such transaction")
+		return
+	}
+
+	ts := c.newTransactionSocket(t, id)
+	ts.initiatedByClient = slot.initiatedByClient
+	ts.resumed = true
+	ts.status.timeoutTimer = slot.timeoutTimer
+	ts.status.presenceEvents = slot.presenceEvents
+	ts.status.wakeTimer = slot.wakeTimer
+	err := c.addTransactionSocket(ts)
+	if err != nil {
+		// nowhere else has access to the channels
+		close(ts.clientMsgChan)
+		close(ts.clientCloseChan)
+		close(ts.roChan)
+		fail(err.Error())
+		return
+	}
+
+	c.Logger().Debug("Transaction resumed", c.logFields(id)...)
+	c.writeTransactionMessage(CONTROL_ID, `{"resumed":"`+idStr+`"}`)
+	// the transaction gives the socket the public key once it has sent the outputs it held.
+	// sent before the socket is routed, so that it reaches the transaction before anything else from the socket.
+	t.riChan <- routineInputWrapper{
+		args:         RoutineInput{Pk: pk},
+		senderRoChan: ts.roChan,
+		resume:       true,
+	}
+	c.startTransactionSocket(ts)
+}
+
+// the suspended socket of pk, if it has this id.
+func (t *transaction) getSuspended(pk PublicKey, id [IDLEN]byte) (suspendedSocket, bool) {
+	defer t.pkToROChanLock.Unlock()
+	t.pkToROChanLock.Lock()
+	slot, exists := t.suspended[pk]
+	if !exists || slot.id != id {
+		return suspendedSocket{}, false
+	}
+	return *slot, true
+}
+
+// Claim the suspended socket of pk with id for a socket that is resuming it.
+// Once claimed, it no longer expires. Must hold pkToROChanLock.
+func (t *transaction) claimSuspendedLocked(pk PublicKey, id [IDLEN]byte) error {
+	slot, exists := t.suspended[pk]
+	if !exists || slot.id != id || slot.resuming || !t.clock.Now().Before(slot.expires) {
+		return errNotResumable
+	}
+	slot.resuming = true
+	return nil
+}
+
+// Hand the outputs held for a suspended socket to the socket resuming it, then give it the public key.
+// Called by the RT goroutine for the input sent by resumeTransactionSocket.
+func (t *transaction) finishResume(hub *Hub, closedRoChans *map[chan RoutineOutput]struct{}, riw routineInputWrapper) {
+	pk := *riw.args.Pk
+	slot := func() *suspendedSocket {
+		defer t.pkToROChanLock.Unlock()
+		t.pkToROChanLock.Lock()
+		slot := t.suspended[pk]
+		delete(t.suspended, pk)
+		if slot != nil && !slot.done {
+			t.pkToROChan[pk] = riw.senderRoChan
+		}
+		return slot
+	}()
+	if slot == nil {
+		// dropped because the transaction was cancelled, which terminated this socket too
+		return
+	}
+	hub.forgetSuspendedSocket(pk, slot.id)
+	for _, ro := range slot.pending {
+		t.sendRoutineOutput(closedRoChans, []chan RoutineOutput{riw.senderRoChan}, ro)
+	}
+}
+
+// The transaction has been told about a suspended socket. It won't send anything more on its old roChan.
+// If the routine ended the socket before then, there is nothing to resume.
+func (t *transaction) socketSuspended(hub *Hub, closedRoChans *map[chan RoutineOutput]struct{}, riw routineInputWrapper) {
+	if _, isClosed := (*closedRoChans)[riw.senderRoChan]; isClosed {
+		t.forgetSuspended(hub, *riw.args.Pk, riw.senderRoChan)
+		return
+	}
+	(*closedRoChans)[riw.senderRoChan] = struct{}{}
+	close(riw.senderRoChan)
+}
+
+// Forget the suspended socket of pk, if it was suspended from the socket with roChan, without telling the routine.
+// For when the routine ended the socket as it was being suspended.
+func (t *transaction) forgetSuspended(hub *Hub, pk PublicKey, roChan chan RoutineOutput) {
+	slot := func() *suspendedSocket {
+		defer t.pkToROChanLock.Unlock()
+		t.pkToROChanLock.Lock()
+		slot, exists := t.suspended[pk]
+		if !exists || slot.clientClose.senderRoChan != roChan || slot.resuming {
+			return nil
+		}
+		delete(t.suspended, pk)
+		return slot
+	}()
+	if slot != nil {
+		hub.forgetSuspendedSocket(pk, slot.id)
+	}
+}
+
+// Hold ro for pk if it is suspended. Returns false if it isn't.
+func (t *transaction) holdForSuspended(pk PublicKey, ro RoutineOutput) bool {
+	defer t.pkToROChanLock.Unlock()
+	t.pkToROChanLock.Lock()
+	slot, exists := t.suspended[pk]
+	if !exists || slot.done {
+		return exists
+	}
+	slot.pending = append(slot.pending, ro)
+	slot.done = ro.Done
+	return true
+}
+
+// Pass the client closes of the suspended sockets whose grace period has run out to the routine.
+func (t *transaction) expireSuspended(hub *Hub, closedRoChans *map[chan RoutineOutput]struct{}) {
+	var expired []*suspendedSocket
+	func() {
+		defer t.pkToROChanLock.Unlock()
+		t.pkToROChanLock.Lock()
+		now := t.clock.Now()
+		for pk, slot := range t.suspended {
+			if !slot.resuming && !now.Before(slot.expires) {
+				expired = append(expired, slot)
+				delete(t.suspended, pk)
+			}
+		}
+	}()
+
+	for _, slot := range expired {
+		pk := *slot.clientClose.args.Pk
+		hub.forgetSuspendedSocket(pk, slot.id)
+		if slot.done {
+			continue
+		}
+		t.logger.Debug("Suspended transaction was not resumed in time", "publicKey", pk)
+		ros := t.routine.Next(slot.clientClose.args)
+		t.distributeRoutineOutputs(hub, closedRoChans, slot.clientClose, ros)
+	}
+}
+
+// Forget every suspended socket without telling the routine. For when the transaction is being cancelled.
+func (t *transaction) dropSuspended(hub *Hub) {
+	var dropped map[PublicKey]*suspendedSocket
+	func() {
+		defer t.pkToROChanLock.Unlock()
+		t.pkToROChanLock.Lock()
+		dropped = t.suspended
+		t.suspended = make(map[PublicKey]*suspendedSocket)
+	}()
+	for pk, slot := range dropped {
+		hub.forgetSuspendedSocket(pk, slot.id)
+	}
+}
+
+// fires when the next suspended socket expires. nil (never fires) if none can.
+func (t *transaction) nextExpiry() <-chan time.Time {
+	defer t.pkToROChanLock.Unlock()
+	t.pkToROChanLock.Lock()
+	var next time.Time
+	for _, slot := range t.suspended {
+		if !slot.resuming && (next.IsZero() || slot.expires.Before(next)) {
+			next = slot.expires
+		}
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return t.clock.After(next.Sub(t.clock.Now()))
+}
+
+// whether every socket has been deleted and none are suspended, so nothing can send to the transaction again.
+func (t *transaction) finished() bool {
+	defer t.pkToROChanLock.Unlock()
+	t.pkToROChanLock.Lock()
+	return t.transactionSocketCount == 0 && len(t.suspended) == 0
+}
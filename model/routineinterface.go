@@ -7,12 +7,86 @@ type Routine interface {
 	Next(args RoutineInput) []RoutineOutput
 }
 
+// Optionally implemented by routines that want to know when an output couldn't be delivered,
+// because no device with the public key has a socket in the transaction or can open one (e.g. a peer that has just disconnected).
+// Routines that don't implement it have these outputs dropped.
+type UndeliverableHandler interface {
+	// ro was returned by the Next call for args, but could not be sent to pk, for reason.
+	// The returned outputs are sent as if that Next call had returned them, so a nil Pk is the sender of args.
+	Undeliverable(args RoutineInput, pk PublicKey, ro RoutineOutput, reason UndeliverableReason) []RoutineOutput
+}
+
+// Optionally implemented by routines that hand their inputs to another routine, e.g. one picked by the first message.
+// Used to describe transactions for debugging. Routines that don't implement it are described by their type.
+type NamedRoutine interface {
+	// name of the routine handling inputs. "" if there isn't one yet.
+	// Only called between Next calls.
+	RoutineName() string
+}
+
+// Optionally implemented by routines that hold state outside the transaction, e.g. in a client, that must be released once it is over.
+// This includes transactions cancelled without the routine's involvement, such as when they exceed their lifetime.
+type EndHandler interface {
+	// called once, after the transaction's last socket has been closed. The routine isn't called again.
+	Ended()
+}
+
+type UndeliverableReason int
+
+const ( // enum
+	// no device with the public key is online, or they are all disconnecting
+	UndeliverableReason_Offline UndeliverableReason = iota
+	// the public key is online, but has as many transactions open as it is allowed on every device
+	UndeliverableReason_AtCapacity
+)
+
+// why a routine ended a client's transaction socket. For logs and metrics, clients aren't told it.
+type DoneReason int
+
+const ( // enum
+	// the routine didn't say. The zero value, so outputs that don't set it still compile.
+	DoneReason_Unspecified DoneReason = iota
+	// the routine finished what it was started for. Includes answers like a peer being offline or rejecting a request.
+	DoneReason_Completed
+	// the client or its peer cancelled the transaction.
+	DoneReason_Cancelled
+	// the client or its peer stopped replying.
+	DoneReason_Timeout
+	// a message was invalid, or wasn't allowed.
+	DoneReason_Error
+	// the client's peer disconnected.
+	DoneReason_PeerDisconnected
+)
+
+// label for the reason in logs and metrics
+func (r DoneReason) String() string {
+	switch r {
+	case DoneReason_Completed:
+		return "completed"
+	case DoneReason_Cancelled:
+		return "cancelled"
+	case DoneReason_Timeout:
+		return "timeout"
+	case DoneReason_Error:
+		return "error"
+	case DoneReason_PeerDisconnected:
+		return "peerDisconnected"
+	default:
+		return "unspecified"
+	}
+}
+
 type RoutineInput struct {
 	MsgType RoutineMsgType
 	// public key is nil if unset.
 	Pk *PublicKey
 	// can be ignored if MsgType is not RoutineMsgType_UsrMsg.
 	Msg string
+	// can be ignored if MsgType is not RoutineMsgType_PresenceEvent.
+	PresenceEvent PresenceEvent
+	// for RoutineMsgType_ClientClose, the JSON object the client registered with a {"lastWill":...} control message,
+	// if it closed because it disconnected rather than closing just this transaction. "" otherwise.
+	LastWill string
 }
 
 type RoutineMsgType int
@@ -21,21 +95,41 @@ const ( // enum
 	RoutineMsgType_UsrMsg RoutineMsgType = iota
 	RoutineMsgType_Timeout
 	RoutineMsgType_ClientClose
+	RoutineMsgType_PresenceEvent
+	// a wake the routine scheduled with RoutineOutput.WakeAfter. Pk is the client of the socket it was scheduled on.
+	RoutineMsgType_SelfWake
 )
 
 type RoutineOutput struct {
 	// Public key of the client to send messages to.
 	// Nil to reply to the client that sent the message.
 	Pk *PublicKey
-	// 0 or more messages to send to the client
+	// 0 or more messages to send to the client, in order.
+	// No other message on the client's connection is written between them.
 	Msgs []string
 	// whether the routine should no longer accept messages from the client.
 	// routine should NOT send any more messages after sending Done=true, or receiving a msg of msgType RoutineMsgType_ClientClose. This could result in a panic().
 	Done bool
+	// why the transaction socket ended. Only meaningful if Done is set.
+	DoneReason DoneReason
 	// if no message is received within the timeout then the routine gets a .Next() with message type RoutineMsgType_Timeout
 	// and can deal with it however it wants (e.g. by returning a RoutineOutput with done=true)
 	TimeoutDuration time.Duration
 	TimeoutEnabled  bool
+	// if set (and TimeoutEnabled isn't), the client's current timeout keeps running instead of being cleared.
+	// for messages that shouldn't count as progress, e.g. forwarding something to a peer mid-transaction.
+	KeepTimeout bool
+	// if set, the client is disconnected if a message can't be written, rather than once several writes in a row have failed.
+	// on a RecoverableConn each message is written again with backoff first.
+	// for messages a peer would otherwise wait for forever, e.g. terminate messages or a forwarded answer. See ClientOptions.CriticalWriteRetries.
+	Critical bool
+	// if set, every event received on this channel is passed to the routine as a .Next() with message type RoutineMsgType_PresenceEvent.
+	// stays set for the rest of the transaction socket once set. Use with (*Hub).Subscribe.
+	PresenceEvents chan PresenceEvent
+	// if positive, the routine gets a .Next() with message type RoutineMsgType_SelfWake from this socket once this has elapsed,
+	// whether or not the client sends anything. For grace periods and retries, which shouldn't depend on the client's timeout.
+	// replaces a wake already scheduled on the socket, which otherwise stays scheduled until it fires. Nothing is sent once the socket is done.
+	WakeAfter time.Duration
 }
 
 // you don't need to use this - you can just create the struct directly
@@ -0,0 +1,150 @@
+package model
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// roChan buffer size of the sockets of a client routed by a SyncRouter.
+// A routine can't send a socket more outputs than this between steps.
+const SYNC_RO_BUFFER_SIZE = 64
+
+// Routes a client on the goroutine that calls Step, instead of on goroutines of its own. For tests only.
+// With a fake Clock, what the client is sent depends only on the messages it sends and when the clock is advanced,
+// so tests can check it without sleeping.
+//
+// Transactions the client starts are stepped here, along with all of its sockets.
+// Peers routed by Route work as usual, but transactions started by other SyncRouters' clients only move when those are stepped.
+// The client has no idle timeout or resume grace, and Route must not be called as well.
+type SyncRouter struct {
+	client      *Client
+	hub         *Hub
+	makeRoutine func() Routine
+	// transactions started by the client that haven't finished
+	transactions []*transaction
+	// sockets of the client that haven't closed. Added to by the transactions of peers' SyncRouters, so requires socketsLock.
+	sockets     []*transactionSocket
+	socketsLock sync.Mutex
+	// set once the connection has closed
+	closed bool
+}
+
+// Route the client with a SyncRouter instead of Route. Nothing happens until Step is called.
+func (c *Client) RouteSync(hub *Hub, makeRoutine func() Routine) *SyncRouter {
+	c.idleTimeout = 0
+	c.resumeGrace = 0
+	c.syncRouter = &SyncRouter{
+		client:      c,
+		hub:         hub,
+		makeRoutine: makeRoutine,
+	}
+	c.startRouting(context.Background(), hub)
+	return c.syncRouter
+}
+
+// Handle everything that is ready: routine outputs, client messages, timeouts that have fired, and whatever they cause in turn.
+// If nothing was ready, read one message from the connection, blocking until there is one, and handle it the same way.
+// Returns false once the connection has closed, after the client has been torn down as Route would have.
+func (s *SyncRouter) Step() bool {
+	if s.closed {
+		return false
+	}
+	if s.settle() {
+		return true
+	}
+
+	c := s.client
+	_, msgBytes, err := c.conn.ReadMessage()
+	if !c.readOk(connRead{msgBytes: msgBytes, err: err}) {
+		s.close()
+		return false
+	}
+	c.handleRead(s.hub, s.makeRoutine, msgBytes)
+	s.settle()
+	return true
+}
+
+// step every transaction and socket until none of them have anything left to do.
+// Returns whether anything was done.
+func (s *SyncRouter) settle() bool {
+	didAnything := false
+	for {
+		s.client.closeDanglingChannels()
+
+		handled := false
+		for i := 0; i < len(s.transactions); {
+			// once it has finished, the next transaction takes its place
+			stepped, _ := s.stepTransactionAt(i)
+			if !stepped {
+				i++
+			}
+			handled = handled || stepped
+		}
+		for _, ts := range s.openSockets() {
+			for !ts.allClosed() && s.client.stepTransactionSocket(ts) {
+				handled = true
+			}
+		}
+		s.dropClosedSockets()
+
+		if !handled {
+			return didAnything
+		}
+		didAnything = true
+	}
+}
+
+// the client has disconnected: tell its transactions, and handle everything that causes.
+func (s *SyncRouter) close() {
+	s.closed = true
+	c := s.client
+	c.close()
+	s.settle()
+	// every socket has been deleted by now, so their channels can be closed, which lets them be dropped.
+	c.closeDanglingChannels()
+	s.settle()
+}
+
+func (s *SyncRouter) addTransaction(t *transaction) {
+	s.transactions = append(s.transactions, t)
+	t.startLifetime()
+}
+
+// handle one input of t if it is one of the client's transactions.
+func (s *SyncRouter) stepTransaction(t *transaction) {
+	for i := range s.transactions {
+		if s.transactions[i] == t {
+			s.stepTransactionAt(i)
+			return
+		}
+	}
+}
+
+// handle one input of the i'th transaction, forgetting it if it has finished.
+func (s *SyncRouter) stepTransactionAt(i int) (handled bool, ended bool) {
+	handled, ended = s.transactions[i].stepSync(s.hub)
+	if ended {
+		s.transactions = slices.Delete(s.transactions, i, i+1)
+	}
+	return handled, ended
+}
+
+func (s *SyncRouter) addSocket(ts *transactionSocket) {
+	defer s.socketsLock.Unlock()
+	s.socketsLock.Lock()
+	s.sockets = append(s.sockets, ts)
+}
+
+// a copy of the sockets, since stepping them can add more.
+func (s *SyncRouter) openSockets() []*transactionSocket {
+	defer s.socketsLock.Unlock()
+	s.socketsLock.Lock()
+	return append([]*transactionSocket(nil), s.sockets...)
+}
+
+func (s *SyncRouter) dropClosedSockets() {
+	defer s.socketsLock.Unlock()
+	s.socketsLock.Lock()
+	s.sockets = slices.DeleteFunc(s.sockets, (*transactionSocket).allClosed)
+}
@@ -1,18 +1,24 @@
 package model
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
 	"time"
-
-	"golang.org/x/exp/rand"
 )
 
 const IDLEN = 16
 
 type transactionStatus struct {
-	done         bool
-	timeoutTimer <-chan time.Time
+	done           bool
+	timeoutTimer   <-chan time.Time
+	presenceEvents chan PresenceEvent
+	// fires when the routine asked to be woken. nil if it hasn't, or once it has fired.
+	wakeTimer <-chan time.Time
 }
 
 // each client interacting with a given transaction has one of these
@@ -25,14 +31,35 @@ type transactionSocket struct {
 	roChan chan RoutineOutput
 	// transaction (socket) id
 	id [IDLEN]byte
+	// whether the client opened this socket, rather than a routine on behalf of a peer.
+	// only these count towards the client's transaction limit, but a client at its limit can't be sent new sockets by peers either.
+	initiatedByClient bool
+	// whether the client asked the server to pick the socket's id. The id is picked when the socket is added to the client.
+	assignId bool
+
+	// when the socket was added to its client. Read from the client's clock.
+	openedAt time.Time
+
+	// whether the socket resumes one that was suspended when its client disconnected.
+	// it gets the public key's outputs once the transaction has sent it the ones it held.
+	resumed bool
 
 	transaction *transaction
 	status      transactionStatus
 }
 
+// true once roChan, clientMsgChan and clientCloseChan have all been closed, and the socket has nothing left to route.
+func (ts *transactionSocket) allClosed() bool {
+	return ts.roChan == nil && ts.clientMsgChan == nil && ts.clientCloseChan == nil
+}
+
 type routineInputWrapper struct {
 	args         RoutineInput
 	senderRoChan chan RoutineOutput
+	// the client close of a socket that has been suspended. Not passed to the routine.
+	suspended bool
+	// sent by a socket that has resumed a suspended one. Not passed to the routine.
+	resume bool
 }
 
 // instance of a routine
@@ -41,98 +68,418 @@ type transaction struct {
 	pkToROChan map[PublicKey](chan RoutineOutput)
 	// also requires pkToROChanLock
 	transactionSocketCount int
-	pkToROChanLock         sync.Mutex
+	// roChan of every socket that has been added to the transaction, including those that have since been deleted.
+	// also requires pkToROChanLock
+	roChans []chan RoutineOutput
+	// sockets of public keys that have disconnected, held until they are resumed or their grace period runs out.
+	// also requires pkToROChanLock
+	suspended      map[PublicKey]*suspendedSocket
+	pkToROChanLock sync.Mutex
 
 	routine Routine
+	// describes routine. Updated after each Next call, since only the route goroutine can call the routine.
+	// also requires pkToROChanLock
+	routineName string
 
 	// wrappers around inputs for the .Next() method of the routine
 	riChan chan routineInputWrapper
+
+	// when a routine output is sent to a public key that is signed in on several devices, every device gets a transaction socket.
+	// these are the roChans of those sockets until one of the devices replies. That device then gets the pkToROChan entry and the rest are terminated.
+	// only accessed by the RT goroutine.
+	unclaimedROChans map[PublicKey][]chan RoutineOutput
+
+	// logger of the client that created the transaction
+	logger Logger
+	// how long the transaction can last, however active it is. 0 means no limit.
+	maxLifetime time.Duration
+	// clock of the client that created the transaction. times the grace periods of suspended sockets.
+	clock Clock
+
+	// only accessed by the RT goroutine, or the SyncRouter stepping the transaction.
+	// set of closed roChans, so that messages from their owners are ignored.
+	closedRoChans map[chan RoutineOutput]struct{}
+	// fires once the transaction has lasted maxLifetime. nil (never fires) if there is no limit, or once it has fired.
+	lifetime <-chan time.Time
+	// fires when the next suspended socket expires. nil if none are suspended.
+	graceExpiry <-chan time.Time
 }
 
 func (t *transaction) route(hub *Hub) {
 
+	defer t.ended()
+	t.startLifetime()
+
+	// this doesn't watch a context: the transaction can be shared by sockets of several clients, each with their own.
+	// once every socket has been deleted, because its client disconnected or its context was cancelled, riChan is closed.
+	// if sockets are suspended when the last one is deleted, riChan stays open and this returns once the last one expires.
+
+	// breaks out when the riChan is closed
+	// this occurs when the last client
+	for {
+		select {
+		case riw, ok := <-t.riChan:
+			if !ok {
+				return
+			}
+			t.handleInput(hub, riw)
+		case <-t.lifetime:
+			if t.lifetimeExceeded(hub) {
+				return
+			}
+		case <-t.graceExpiry:
+			if t.graceExpired(hub) {
+				return
+			}
+		}
+	}
+
+}
+
+// start timing the transaction's lifetime with its clock, if it has a limit.
+func (t *transaction) startLifetime() {
+	if t.maxLifetime <= 0 {
+		return
+	}
+	t.lifetime = t.clock.After(t.maxLifetime)
+}
+
+// handle one input or timer that is ready, without blocking. Used by a SyncRouter instead of route.
+// handled is false if nothing was ready. ended is true once the transaction has finished, after which it must not be stepped again.
+func (t *transaction) stepSync(hub *Hub) (handled bool, ended bool) {
+	select {
+	case riw, ok := <-t.riChan:
+		if !ok {
+			t.ended()
+			return true, true
+		}
+		t.handleInput(hub, riw)
+		return true, false
+	default:
+	}
+
+	finished := false
+	select {
+	case <-t.lifetime:
+		finished = t.lifetimeExceeded(hub)
+	case <-t.graceExpiry:
+		finished = t.graceExpired(hub)
+	default:
+		return false, false
+	}
+	if finished {
+		t.ended()
+	}
+	return true, finished
+}
+
+// tell the routine, if it wants to know, that the transaction is over.
+func (t *transaction) ended() {
+	if handler, ok := t.routine.(EndHandler); ok {
+		handler.Ended()
+	}
+}
+
+// every socket is cancelled, so the routine won't be called again.
+// Returns true if the transaction has finished.
+func (t *transaction) lifetimeExceeded(hub *Hub) bool {
+	t.lifetime = nil
+	t.logger.Warn("Transaction lifetime exceeded", "maxLifetime", t.maxLifetime)
+	t.dropSuspended(hub)
+	t.graceExpiry = nil
+	t.cancelAll(&t.closedRoChans, `{"terminate":"cancel","error":"Transaction lifetime exceeded"}`)
+	return t.finished()
+}
+
+// the grace period of the next suspended socket has run out.
+// Returns true if the transaction has finished.
+func (t *transaction) graceExpired(hub *Hub) bool {
+	t.expireSuspended(hub, &t.closedRoChans)
+	t.graceExpiry = t.nextExpiry()
+	return t.finished()
+}
+
+// pass an input from a socket to the routine, and send its outputs to the sockets.
+func (t *transaction) handleInput(hub *Hub, riw routineInputWrapper) {
+
 	// within this function and subfunctions is the only place where roChans can be closed.
 	// this ensures that the routine always explicity ends a client socket (by sending Done=true in a RoutineOutput), or that the routine is aware when the client disconnects.
 	// Therefore the routine can be programmed to never send messages to clients with closed roChans.
 
-	// set of closed roChans, so we can ignore any messages from the owner of these.
-	closedRoChans := make(map[chan RoutineOutput]struct{})
+	if riw.suspended {
+		t.socketSuspended(hub, &t.closedRoChans, riw)
+		t.graceExpiry = t.nextExpiry()
+		return
+	}
 
-	// breaks out when the riChan is closed
-	// this occurs when the last client
-	for riw := range t.riChan {
+	// ignore messages from clients with closed routine output channels
+	// (the transaction with this client has been terminated)
+	_, isClosed := t.closedRoChans[riw.senderRoChan]
+	if isClosed {
+		return
+	}
 
-		// ignore messages from clients with closed routine output channels
-		// (the transaction with this client has been terminated)
-		_, isClosed := closedRoChans[riw.senderRoChan]
-		if isClosed {
-			continue
+	if riw.resume {
+		t.finishResume(hub, &t.closedRoChans, riw)
+		t.graceExpiry = t.nextExpiry()
+		return
+	}
+
+	if t.claimDevice(riw, &t.closedRoChans) {
+		return
+	}
+
+	ros := t.routine.Next(riw.args)
+	t.setRoutineName(routineNameOf(t.routine))
+	t.distributeRoutineOutputs(hub, &t.closedRoChans, riw, ros)
+
+	if riw.args.MsgType == RoutineMsgType_ClientClose {
+		t.closedRoChans[riw.senderRoChan] = struct{}{}
+		close(riw.senderRoChan)
+	}
+}
+
+// name of the routine for debugging: the one it hands its inputs to if it is a NamedRoutine, otherwise its type.
+// Must not be called at the same time as the routine's Next.
+func routineNameOf(routine Routine) string {
+	if named, ok := routine.(NamedRoutine); ok {
+		if name := named.RoutineName(); name != "" {
+			return name
 		}
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", routine), "*")
+}
+
+// Threadsafe.
+func (t *transaction) setRoutineName(name string) {
+	defer t.pkToROChanLock.Unlock()
+	t.pkToROChanLock.Lock()
+	t.routineName = name
+}
+
+// terminate every socket of the transaction that is still open with msg, without the routine's involvement.
+func (t *transaction) cancelAll(closedRoChans *map[chan RoutineOutput]struct{}, msg string) {
 
-		ros := t.routine.Next(riw.args)
-		t.distributeRoutineOutputs(hub, &closedRoChans, riw.senderRoChan, ros)
+	var roChans []chan RoutineOutput
+	func() {
+		defer t.pkToROChanLock.Unlock()
+		t.pkToROChanLock.Lock()
+		roChans = slices.Clone(t.roChans)
+		clear(t.pkToROChan)
+	}()
+	clear(t.unclaimedROChans)
 
-		if riw.args.MsgType == RoutineMsgType_ClientClose {
-			closedRoChans[riw.senderRoChan] = struct{}{}
-			close(riw.senderRoChan)
+	for _, roChan := range roChans {
+		if _, isClosed := (*closedRoChans)[roChan]; isClosed {
+			continue
+		}
+		roChan <- RoutineOutput{
+			Msgs:       []string{msg},
+			Done:       true,
+			DoneReason: DoneReason_Cancelled,
 		}
+		(*closedRoChans)[roChan] = struct{}{}
+		close(roChan)
+	}
+}
+
+// Called for every input before it reaches the routine.
+// If the input is from one of several unclaimed devices, that device claims the transaction for its public key, and the other devices' sockets are terminated.
+// Returns true if the input should not be passed to the routine.
+func (t *transaction) claimDevice(riw routineInputWrapper, closedRoChans *map[chan RoutineOutput]struct{}) bool {
+
+	if riw.args.Pk == nil {
+		return false
+	}
+	pk := *riw.args.Pk
+	roChans, unclaimed := t.unclaimedROChans[pk]
+	if !unclaimed || !slices.Contains(roChans, riw.senderRoChan) {
+		return false
+	}
 
+	// a device disconnecting is only the routine's business if it was the last one
+	if riw.args.MsgType == RoutineMsgType_ClientClose && len(roChans) > 1 {
+		t.unclaimedROChans[pk] = slices.DeleteFunc(roChans, func(roChan chan RoutineOutput) bool {
+			return roChan == riw.senderRoChan
+		})
+		(*closedRoChans)[riw.senderRoChan] = struct{}{}
+		close(riw.senderRoChan)
+		return true
 	}
 
+	delete(t.unclaimedROChans, pk)
+	func() {
+		defer t.pkToROChanLock.Unlock()
+		t.pkToROChanLock.Lock()
+		t.pkToROChan[pk] = riw.senderRoChan
+	}()
+
+	reason := `{"terminate":"cancel","error":"Answered on another device"}`
+	if riw.args.MsgType == RoutineMsgType_Timeout {
+		reason = `{"terminate":"cancel","error":"Timeout"}`
+	}
+	for _, roChan := range roChans {
+		if roChan == riw.senderRoChan {
+			continue
+		}
+		roChan <- RoutineOutput{
+			Msgs:       []string{reason},
+			Done:       true,
+			DoneReason: DoneReason_Cancelled,
+		}
+		(*closedRoChans)[roChan] = struct{}{}
+		close(roChan)
+	}
+
+	return false
 }
 
 // send routine outputs to correct clients.
-func (t *transaction) distributeRoutineOutputs(hub *Hub, closedRoChans *map[chan RoutineOutput]struct{}, senderRoChan chan RoutineOutput, ros []RoutineOutput) {
+// riw is the input that the routine returned ros for.
+func (t *transaction) distributeRoutineOutputs(hub *Hub, closedRoChans *map[chan RoutineOutput]struct{}, riw routineInputWrapper, ros []RoutineOutput) {
 
+	senderRoChan := riw.senderRoChan
 	for _, routineOutput := range ros {
 
+		if routineOutput.Done {
+			t.recordDone(hub, routineOutput)
+		}
+
 		if routineOutput.Pk == nil {
+			// the sender was suspended and its grace period has run out, so it is gone
+			if _, isClosed := (*closedRoChans)[senderRoChan]; isClosed {
+				continue
+			}
 			senderRoChan <- routineOutput
 			if routineOutput.Done {
 				(*closedRoChans)[senderRoChan] = struct{}{}
 				close(senderRoChan)
 			}
 		} else {
-			// find the rochan corresponding to pk
-			roChan, exists := t.pkToROChan[*routineOutput.Pk]
+			pk := *routineOutput.Pk
+
+			// find the rochan(s) corresponding to pk
+			roChan, exists := func() (chan RoutineOutput, bool) {
+				defer t.pkToROChanLock.Unlock()
+				t.pkToROChanLock.Lock()
+				roChan, exists := t.pkToROChan[pk]
+				return roChan, exists
+			}()
 			if exists {
-				roChan <- routineOutput
+				t.sendRoutineOutput(closedRoChans, []chan RoutineOutput{roChan}, routineOutput)
+				continue
+			}
+
+			roChans, unclaimed := t.unclaimedROChans[pk]
+			if unclaimed {
+				// none of the devices have replied yet
+				t.sendRoutineOutput(closedRoChans, roChans, routineOutput)
 				if routineOutput.Done {
-					(*closedRoChans)[roChan] = struct{}{}
-					close(roChan)
+					delete(t.unclaimedROChans, pk)
 				}
-			} else {
-				peerClient, exists := hub.GetClient(*routineOutput.Pk)
-				if !exists {
-					fmt.Printf("client does not exist")
-					continue
-				}
-				// create a new transaction socket if it does not exist
+				continue
+			}
+
+			if t.holdForSuspended(pk, routineOutput) {
+				continue
+			}
+
+			// a peer that is reconnecting gets the output once it has signed back in
+			peerClients := hub.GetClientsWithGrace(pk, hub.PeerLookupGrace())
+			if len(peerClients) == 0 {
+				t.logger.Warn("Routine output sent to a client that is not online", "publicKey", pk)
+				t.undeliverable(hub, closedRoChans, riw, pk, routineOutput, UndeliverableReason_Offline)
+				continue
+			}
+			// create a new transaction socket on every device
+			roChans = make([]chan RoutineOutput, 0, len(peerClients))
+			atCapacity := false
+			for _, peerClient := range peerClients {
 				tSocket := peerClient.newTransactionSocket(t, newId())
 				err := peerClient.addTransactionSocket(tSocket)
 				if err == nil {
-					go peerClient.routeTransactionSocket(tSocket)
-					tSocket.roChan <- routineOutput
-					if routineOutput.Done {
-						(*closedRoChans)[tSocket.roChan] = struct{}{}
-						close(tSocket.roChan)
-					}
+					peerClient.startTransactionSocket(tSocket)
+					roChans = append(roChans, tSocket.roChan)
+				} else if errors.Is(err, errMaxTransactions) {
+					atCapacity = true
+				}
+			}
+			if len(roChans) > 1 {
+				// addTransactionSocket gave pk to the last device. wait to see which one replies instead.
+				func() {
+					defer t.pkToROChanLock.Unlock()
+					t.pkToROChanLock.Lock()
+					delete(t.pkToROChan, pk)
+				}()
+				if !routineOutput.Done {
+					t.unclaimedROChans[pk] = roChans
 				}
 			}
+			if len(roChans) == 0 {
+				// every device is disconnecting or busy
+				reason := UndeliverableReason_Offline
+				if atCapacity {
+					reason = UndeliverableReason_AtCapacity
+				}
+				t.undeliverable(hub, closedRoChans, riw, pk, routineOutput, reason)
+				continue
+			}
+			t.sendRoutineOutput(closedRoChans, roChans, routineOutput)
 
 		}
 	}
 }
 
-// genreate a random transaction id
+// log and count the routine ending a socket with ro. Only called by the route goroutine.
+func (t *transaction) recordDone(hub *Hub, ro RoutineOutput) {
+	routine := routineNameOf(t.routine)
+	reason := ro.DoneReason.String()
+	t.logger.Debug("Transaction socket terminated", "routine", routine, "reason", reason)
+	hub.Metrics().IncLabelledCounter(METRIC_TRANSACTIONS_ENDED, MetricLabels{Routine: routine, Reason: reason})
+}
+
+// tell the routine, if it wants to know, that routineOutput couldn't be sent to pk.
+func (t *transaction) undeliverable(hub *Hub, closedRoChans *map[chan RoutineOutput]struct{}, riw routineInputWrapper, pk PublicKey, routineOutput RoutineOutput, reason UndeliverableReason) {
+	handler, ok := t.routine.(UndeliverableHandler)
+	if !ok {
+		return
+	}
+	ros := handler.Undeliverable(riw.args, pk, routineOutput, reason)
+	t.distributeRoutineOutputs(hub, closedRoChans, riw, ros)
+}
+
+// send a routine output to the roChans of a peer, closing them if it is the last one.
+func (t *transaction) sendRoutineOutput(closedRoChans *map[chan RoutineOutput]struct{}, roChans []chan RoutineOutput, routineOutput RoutineOutput) {
+	for _, roChan := range roChans {
+		roChan <- routineOutput
+		if routineOutput.Done {
+			(*closedRoChans)[roChan] = struct{}{}
+			close(roChan)
+			// deleteTransactionSocket also removes the pkToROChan entry, but it runs later on another goroutine.
+			// remove it now so that another output to the same key can't be sent on the closed roChan.
+			func() {
+				defer t.pkToROChanLock.Unlock()
+				t.pkToROChanLock.Lock()
+				if t.pkToROChan[*routineOutput.Pk] == roChan {
+					delete(t.pkToROChan, *routineOutput.Pk)
+				}
+			}()
+		}
+	}
+}
+
+// generate a random transaction id.
+// ids are sent at the start of websocket text messages, so they have to be valid UTF-8:
+// the id is IDLEN*3/4 bytes from crypto/rand, encoded as URL-safe base64 (IDLEN characters, no padding).
 func newId() [IDLEN]byte {
-	const charset = "abcdefghijklmnopqrstuvwxyz"
-	var seededRand *rand.Rand = rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+	buf := make([]byte, base64.RawURLEncoding.DecodedLen(IDLEN))
+	_, err := rand.Read(buf)
+	if err != nil {
+		// nothing sensible can be done if the OS can't supply randomness
+		panic("crypto/rand failed: " + err.Error())
+	}
 
 	var id [IDLEN]byte
-	for i := range id {
-		id[i] = charset[seededRand.Intn(len(charset))]
-	}
+	base64.RawURLEncoding.Encode(id[:], buf)
 	return id
-
 }
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestNewId(t *testing.T) {
+
+	const n = 10000
+
+	ids := make(map[[IDLEN]byte]struct{}, n)
+	// how many times each byte value appears across all the decoded ids
+	var byteCounts [256]int
+
+	for i := 0; i < n; i++ {
+		id := newId()
+
+		if _, seen := ids[id]; seen {
+			t.Fatalf("Generated id %s twice in %d ids", id[:], i+1)
+		}
+		ids[id] = struct{}{}
+
+		if id == CONTROL_ID {
+			t.Errorf("Generated the control id")
+		}
+
+		// must be text that can be sent in a websocket text message
+		decoded, err := base64.RawURLEncoding.DecodeString(string(id[:]))
+		if err != nil {
+			t.Fatalf("Expected id %s to be URL-safe base64: %v", id[:], err)
+		}
+		for _, b := range decoded {
+			byteCounts[b]++
+		}
+	}
+
+	// ~470 of each is expected, so any byte value missing means the ids aren't drawn from the full range
+	for b, count := range byteCounts {
+		if count == 0 {
+			t.Errorf("Byte value %d never appeared in %d ids", b, n)
+		}
+	}
+}
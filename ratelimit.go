@@ -0,0 +1,119 @@
+package main
+
+import (
+	"harmony/backend/model"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// connections per second each IP address can open once its burst is used up
+const defaultWsRate = 2.0
+
+// connections an IP address can open at once
+const defaultWsBurst = 20
+
+// how often buckets of IP addresses that have stopped connecting are deleted
+const rateLimiterGCInterval = time.Minute
+
+// Token bucket rate limiter keyed by IP address. Threadsafe.
+type ipRateLimiter struct {
+	// tokens added per second. 0 disables the limiter.
+	rate float64
+	// size of each bucket
+	burst   float64
+	clock   model.Clock
+	buckets map[string]*tokenBucket
+	lock    sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	// when tokens was last brought up to date
+	updatedAt time.Time
+}
+
+func newIPRateLimiter(rate float64, burst int, clock model.Clock) *ipRateLimiter {
+	return &ipRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clock:   clock,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take a token from the bucket of ip, if there is one.
+func (l *ipRateLimiter) Allow(ip string) bool {
+	if l.rate == 0 {
+		return true
+	}
+	defer l.lock.Unlock()
+	l.lock.Lock()
+
+	now := l.clock.Now()
+	bucket, exists := l.buckets[ip]
+	if !exists {
+		bucket = &tokenBucket{tokens: l.burst, updatedAt: now}
+		l.buckets[ip] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*l.rate)
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// delete the buckets that have refilled, which behave the same as no bucket.
+func (l *ipRateLimiter) collectGarbage() {
+	defer l.lock.Unlock()
+	l.lock.Lock()
+
+	now := l.clock.Now()
+	for ip, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// call collectGarbage every interval, forever.
+func (l *ipRateLimiter) collectGarbageEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.collectGarbage()
+	}
+}
+
+// Address of the client that made the request.
+// If trustedProxyHeader is set the first address in that header is used, so it must be set by a proxy in front of the server
+// that overwrites whatever the client sent. Otherwise it is the address the connection came from.
+func clientIP(c *gin.Context, trustedProxyHeader string) string {
+	if trustedProxyHeader != "" {
+		forwarded, _, _ := strings.Cut(c.GetHeader(trustedProxyHeader), ",")
+		forwarded = strings.TrimSpace(forwarded)
+		if forwarded != "" {
+			return forwarded
+		}
+	}
+	return c.RemoteIP()
+}
+
+// middleware that rejects requests with 429 once the client's IP address has run out of tokens.
+func makeRateLimit(limiter *ipRateLimiter, trustedProxyHeader string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := clientIP(c, trustedProxyHeader)
+		if !limiter.Allow(ip) {
+			logger.Debug("Rate limited websocket upgrade", "ip", ip)
+			c.AbortWithStatus(http.StatusTooManyRequests)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// clock that only moves forward when told to.
+type fakeClockForLimiter struct {
+	now time.Time
+}
+
+func (c *fakeClockForLimiter) Now() time.Time {
+	return c.now
+}
+
+// the limiter never waits, so this never fires.
+func (c *fakeClockForLimiter) After(d time.Duration) <-chan time.Time {
+	return nil
+}
+
+func (c *fakeClockForLimiter) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestIPRateLimiter(t *testing.T) {
+
+	t.Run("Allows a burst then refills at the rate", func(t *testing.T) {
+		clock := &fakeClockForLimiter{}
+		limiter := newIPRateLimiter(2, 3, clock)
+
+		for i := 0; i < 3; i++ {
+			if !limiter.Allow("1.1.1.1") {
+				t.Errorf("Expected request %d of the burst to be allowed", i)
+			}
+		}
+		if limiter.Allow("1.1.1.1") {
+			t.Errorf("Expected the request after the burst to be rejected")
+		}
+		// other addresses have their own bucket
+		if !limiter.Allow("2.2.2.2") {
+			t.Errorf("Expected another address to be allowed")
+		}
+
+		clock.Advance(500 * time.Millisecond)
+		if !limiter.Allow("1.1.1.1") {
+			t.Errorf("Expected a request to be allowed after a token was added")
+		}
+		if limiter.Allow("1.1.1.1") {
+			t.Errorf("Expected only one token to have been added")
+		}
+	})
+
+	t.Run("A rate of 0 allows everything", func(t *testing.T) {
+		limiter := newIPRateLimiter(0, 1, &fakeClockForLimiter{})
+		for i := 0; i < 100; i++ {
+			if !limiter.Allow("1.1.1.1") {
+				t.Fatalf("Expected every request to be allowed")
+			}
+		}
+	})
+
+	t.Run("Garbage collection only deletes refilled buckets", func(t *testing.T) {
+		clock := &fakeClockForLimiter{}
+		limiter := newIPRateLimiter(1, 2, clock)
+
+		limiter.Allow("idle")
+		limiter.Allow("idle")
+		clock.Advance(time.Second)
+		limiter.Allow("busy")
+		limiter.Allow("busy")
+		clock.Advance(time.Second)
+		limiter.collectGarbage()
+
+		if _, exists := limiter.buckets["idle"]; exists {
+			t.Errorf("Expected the refilled bucket to be deleted")
+		}
+		if _, exists := limiter.buckets["busy"]; !exists {
+			t.Errorf("Expected the partly empty bucket to be kept")
+		}
+		// deleting a bucket doesn't hand out extra tokens
+		limiter.Allow("busy")
+		if limiter.Allow("busy") {
+			t.Errorf("Expected the kept bucket to still be limited")
+		}
+	})
+}
+
+func TestRateLimitUpgrades(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	// websocket server behind the rate limiter
+	newServer := func(limiter *ipRateLimiter, trustedProxyHeader string) (*httptest.Server, string) {
+		upgrader := websocket.Upgrader{}
+		router := gin.New()
+		router.GET("/ws", makeRateLimit(limiter, trustedProxyHeader), func(c *gin.Context) {
+			conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+			if err == nil {
+				conn.Close()
+			}
+		})
+		server := httptest.NewServer(router)
+		return server, "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	}
+
+	dial := func(t *testing.T, url string, header http.Header) int {
+		conn, resp, _ := websocket.DefaultDialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("Expected a response")
+		}
+		return resp.StatusCode
+	}
+
+	t.Run("Rapid upgrades from one IP are rejected with 429 after the burst", func(t *testing.T) {
+		const burst = 5
+		server, url := newServer(newIPRateLimiter(0.001, burst, &fakeClockForLimiter{}), "")
+		defer server.Close()
+
+		for i := 0; i < 50; i++ {
+			expected := http.StatusSwitchingProtocols
+			if i >= burst {
+				expected = http.StatusTooManyRequests
+			}
+			if status := dial(t, url, nil); status != expected {
+				t.Errorf("Upgrade %d: expected status %d got %d", i, expected, status)
+			}
+		}
+	})
+
+	t.Run("Clients behind a trusted proxy are limited separately", func(t *testing.T) {
+		server, url := newServer(newIPRateLimiter(0.001, 1, &fakeClockForLimiter{}), "X-Forwarded-For")
+		defer server.Close()
+
+		tests := []struct {
+			forwardedFor string
+			expected     int
+		}{
+			{"203.0.113.1", http.StatusSwitchingProtocols},
+			{"203.0.113.2, 10.0.0.1", http.StatusSwitchingProtocols},
+			{"203.0.113.1, 10.0.0.2", http.StatusTooManyRequests},
+			{"203.0.113.2", http.StatusTooManyRequests},
+			// no header falls back to the proxy's own address
+			{"", http.StatusSwitchingProtocols},
+			{"", http.StatusTooManyRequests},
+		}
+
+		for _, tt := range tests {
+			header := http.Header{}
+			if tt.forwardedFor != "" {
+				header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if status := dial(t, url, header); status != tt.expected {
+				t.Errorf("X-Forwarded-For %q: expected status %d got %d", tt.forwardedFor, tt.expected, status)
+			}
+		}
+	})
+
+	t.Run("The header is ignored unless it is trusted", func(t *testing.T) {
+		server, url := newServer(newIPRateLimiter(0.001, 1, &fakeClockForLimiter{}), "")
+		defer server.Close()
+
+		dial(t, url, http.Header{"X-Forwarded-For": {"203.0.113.1"}})
+		if status := dial(t, url, http.Header{"X-Forwarded-For": {"203.0.113.2"}}); status != http.StatusTooManyRequests {
+			t.Errorf("Expected status %d got %d", http.StatusTooManyRequests, status)
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package routines
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"harmony/backend/model"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// maximum number of keys a status can be broadcast to at once
+const defaultMaxBroadcastKeys = 100
+
+// maximum length in bytes of the (compacted) status object
+const defaultMaxStatusLength = 1024
+
+// Sends a status update (e.g. "away", a new display name) to every online key in a list supplied by the client.
+// The server doesn't store friend lists, so the client decides who receives it.
+type BroadcastStatus struct {
+	client *model.Client
+	hub    *model.Hub
+	pkA    *model.PublicKey
+	config bsConfig
+}
+
+// tunable parameters of BroadcastStatus
+type bsConfig struct {
+	maxKeys         int
+	maxStatusLength int
+}
+
+func defaultBSConfig() bsConfig {
+	return bsConfig{
+		maxKeys:         defaultMaxBroadcastKeys,
+		maxStatusLength: defaultMaxStatusLength,
+	}
+}
+
+func newBroadcastStatus(client *model.Client, hub *model.Hub) model.Routine {
+	return newBroadcastStatusDependencyInj(client, hub, defaultBSConfig())
+}
+
+func newBroadcastStatusDependencyInj(client *model.Client, hub *model.Hub, config bsConfig) model.Routine {
+	return &BroadcastStatus{
+		client: client,
+		hub:    hub,
+		config: config,
+	}
+}
+
+func (r *BroadcastStatus) Next(args model.RoutineInput) []model.RoutineOutput {
+	// only 1 step, don't need to worry about state.
+	r.pkA = args.Pk
+	if r.pkA == nil {
+		return bsError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
+	}
+
+	// validate msg
+	result, err := validateJSON(bsSchema, args.Msg)
+	if err != nil {
+		return bsError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return bsError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Initiate string          `json:"initiate"`
+		Keys     []string        `json:"keys"`
+		Status   json.RawMessage `json:"status"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	if len(usrMsg.Keys) > r.config.maxKeys {
+		return bsError(nil, ERROR_LIMIT_EXCEEDED, fmt.Sprintf("Too many keys, the maximum is %d", r.config.maxKeys))
+	}
+	status := bytes.Buffer{}
+	json.Compact(&status, usrMsg.Status)
+	if status.Len() > r.config.maxStatusLength {
+		return bsError(nil, ERROR_LIMIT_EXCEEDED, fmt.Sprintf("Status is longer than %d bytes", r.config.maxStatusLength))
+	}
+	keys := make([]model.PublicKey, 0, len(usrMsg.Keys))
+	for _, keyStr := range usrMsg.Keys {
+		key, err := parsePublicKey(keyStr)
+		if err != nil {
+			return bsError(nil, ERROR_MALFORMED, err.Error())
+		}
+		if sameKey(*key, *r.pkA) {
+			return bsError(nil, ERROR_SELF_NOT_ALLOWED, "Broadcasting to yourself is not allowed")
+		}
+		keys = append(keys, *key)
+	}
+
+	update := struct {
+		StatusUpdate struct {
+			From   string          `json:"from"`
+			Status json.RawMessage `json:"status"`
+		} `json:"statusUpdate"`
+		Terminate string `json:"terminate"`
+	}{}
+	update.StatusUpdate.From = publicKeyToString(*r.pkA)
+	update.StatusUpdate.Status = status.Bytes()
+	update.Terminate = "done"
+	updateStr, _ := json.Marshal(update)
+
+	// send the update to the keys that are online
+	deliveries := make(map[string]string)
+	ros := []model.RoutineOutput{}
+	for _, key := range keys {
+		if _, online := r.hub.GetClient(key); online {
+			deliveries[publicKeyToString(key)] = "delivered"
+			ros = append(ros, model.RoutineOutput{
+				Pk:         &key,
+				Msgs:       []string{string(updateStr)},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+			})
+		} else {
+			deliveries[publicKeyToString(key)] = "offline"
+		}
+	}
+
+	msgToA, _ := json.Marshal(struct {
+		Deliveries map[string]string `json:"deliveries"`
+		Terminate  string            `json:"terminate"`
+	}{deliveries, "done"})
+	return append(ros, model.RoutineOutput{
+		Pk:         r.pkA,
+		Msgs:       []string{string(msgToA)},
+		Done:       true,
+		DoneReason: model.DoneReason_Completed,
+	})
+}
+
+var bsSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"broadcastStatus"
+			},
+			"keys": {
+				"type": "array",
+				"items": {
+					"type":"string",
+					"pattern": "` + publicKeyPattern + `"
+				},
+				"minItems": 1,
+				"uniqueItems": true
+			},
+			"status": {
+				"type": "object"
+			}
+		},
+		"required": ["initiate", "keys", "status"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// wrapper for error routine output
+func bsError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
+	return []model.RoutineOutput{
+		{
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
+		},
+	}
+}
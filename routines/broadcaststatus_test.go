@@ -0,0 +1,165 @@
+package routines
+
+import (
+	"harmony/backend/model"
+	"strings"
+	"testing"
+)
+
+func TestBroadcastStatus(t *testing.T) {
+
+	// A and B online, C offline
+	newBroadcast := func(config bsConfig) model.Routine {
+		clientA := &model.Client{}
+		clientA.SetPublicKey(&publicKey0)
+		clientB := &model.Client{}
+		clientB.SetPublicKey(&publicKey1)
+		hub := model.NewHub()
+		hub.AddClient(publicKey0, clientA)
+		hub.AddClient(publicKey1, clientB)
+		return newBroadcastStatusDependencyInj(clientA, hub, config)
+	}
+
+	t.Run("Valid inputs", func(t *testing.T) {
+
+		t.Run("Online and offline targets", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "A broadcasts a status to B (online) and C (offline)",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg: `{
+							"initiate": "broadcastStatus",
+							"keys": ["` + (string)(publicKey1) + `", "` + (string)(publicKey2) + `"],
+							"status": {"presence": "away", "displayName": "A"}
+						}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey1,
+								Msgs: []string{`{"const":{"statusUpdate":{"from":"` + (string)(publicKey0) + `","status":{"presence":"away","displayName":"A"}},"terminate":"done"}}`},
+								Done: true,
+							},
+						},
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{`{"const":{"deliveries":{"` + (string)(publicKey1) + `":"delivered","` + (string)(publicKey2) + `":"offline"},"terminate":"done"}}`},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+			testRunner(t, newBroadcast(defaultBSConfig()), test)
+		})
+
+		t.Run("All targets offline", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "A broadcasts a status to C, who is offline",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg:     `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey2) + `"],"status":{}}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{`{"const":{"deliveries":{"` + (string)(publicKey2) + `":"offline"},"terminate":"done"}}`},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+			testRunner(t, newBroadcast(defaultBSConfig()), test)
+		})
+
+		t.Run("Status at the size limit", func(t *testing.T) {
+			status := `{"s":"` + strings.Repeat("a", 8) + `"}` // 16 bytes
+			test := []Step{
+				{
+					description: "A broadcasts a status of exactly the maximum length",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg:     `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey1) + `"],"status":` + status + `}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey1,
+								Msgs: []string{`{"const":{"statusUpdate":{"from":"` + (string)(publicKey0) + `","status":` + status + `},"terminate":"done"}}`},
+								Done: true,
+							},
+						},
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{`{"const":{"deliveries":{"` + (string)(publicKey1) + `":"delivered"},"terminate":"done"}}`},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+			testRunner(t, newBroadcast(bsConfig{maxKeys: 1, maxStatusLength: 16}), test)
+		})
+	})
+
+	t.Run("Invalid inputs", func(t *testing.T) {
+		tests := []struct {
+			description string
+			pk          *model.PublicKey
+			msg         string
+			code        string
+			error       string
+		}{
+			{"No public key", nil, `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey1) + `"],"status":{}}`, ERROR_NOT_AUTHENTICATED, "You have not provided a public key"},
+			{"Broadcast to self", &publicKey0, `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey0) + `"],"status":{}}`, ERROR_SELF_NOT_ALLOWED, "Broadcasting to yourself is not allowed"},
+			{"Broadcast to self encoded differently", &publicKey0, `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey0OtherEncoding) + `"],"status":{}}`, ERROR_SELF_NOT_ALLOWED, "Broadcasting to yourself is not allowed"},
+			{"Too many keys", &publicKey0, `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey1) + `","` + (string)(publicKey2) + `"],"status":{}}`, ERROR_LIMIT_EXCEEDED, "Too many keys, the maximum is 1"},
+			{"Status too long", &publicKey0, `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey1) + `"],"status":{"s":"` + strings.Repeat("a", 9) + `"}}`, ERROR_LIMIT_EXCEEDED, "Status is longer than 16 bytes"},
+			{"No keys", &publicKey0, `{"initiate":"broadcastStatus","keys":[],"status":{}}`, ERROR_MALFORMED, ""},
+			{"Duplicate keys", &publicKey0, `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey1) + `","` + (string)(publicKey1) + `"],"status":{}}`, ERROR_MALFORMED, ""},
+			{"Invalid key", &publicKey0, `{"initiate":"broadcastStatus","keys":["` + invalidPublicKeyNIST + `"],"status":{}}`, ERROR_MALFORMED, ""},
+			{"Missing status", &publicKey0, `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey1) + `"]}`, ERROR_MALFORMED, ""},
+			{"Status is not an object", &publicKey0, `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey1) + `"],"status":"away"}`, ERROR_MALFORMED, ""},
+			{"Extra property", &publicKey0, `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey1) + `"],"status":{},"extra":1}`, ERROR_MALFORMED, ""},
+			{"Invalid JSON", &publicKey0, `)`, ERROR_MALFORMED, ""},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				expectedError := errorCodeSchemaString(tt.code)
+				if tt.error != "" {
+					expectedError = errorCodeSchemaString(tt.code, tt.error)
+				}
+				test := []Step{
+					{
+						description: tt.description,
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      tt.pk,
+							Msg:     tt.msg,
+						},
+						outputs: []ExpectedOutput{
+							{
+								ro: model.RoutineOutput{
+									Pk:   tt.pk,
+									Msgs: []string{expectedError},
+									Done: true,
+								},
+							},
+						},
+					},
+				}
+				testRunner(t, newBroadcast(bsConfig{maxKeys: 1, maxStatusLength: 16}), test)
+			})
+		}
+	})
+}
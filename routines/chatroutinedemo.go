@@ -2,7 +2,6 @@ package routines
 
 import (
 	"encoding/json"
-	"fmt"
 	"harmony/backend/model"
 	"time"
 )
@@ -23,8 +22,9 @@ func (r *ChatRoutineDemo) Next(args model.RoutineInput) []model.RoutineOutput {
 	switch args.MsgType {
 	case model.RoutineMsgType_Timeout:
 		return []model.RoutineOutput{{
-			Msgs: []string{`Timed out waiting for a response - you no longer have access to this transaction. Start a new one if you want to send additional messages`},
-			Done: true,
+			Msgs:       []string{`Timed out waiting for a response - you no longer have access to this transaction. Start a new one if you want to send additional messages`},
+			Done:       true,
+			DoneReason: model.DoneReason_Timeout,
 		}}
 	case model.RoutineMsgType_UsrMsg:
 
@@ -34,8 +34,14 @@ func (r *ChatRoutineDemo) Next(args model.RoutineInput) []model.RoutineOutput {
 		}{}
 
 		json.Unmarshal([]byte(args.Msg), &usrMsg)
-		peerPkBytes, _ := parsePublicKey(usrMsg.PublicKey)
-		peerPk := (*model.PublicKey)(peerPkBytes)
+		peerPk, err := parsePublicKey(usrMsg.PublicKey)
+		if err != nil {
+			return []model.RoutineOutput{{
+				Msgs:            []string{err.Error()},
+				TimeoutEnabled:  true,
+				TimeoutDuration: 60 * time.Second,
+			}}
+		}
 
 		// the first message that they send sets their own public key and doesn't actually send any message
 		// kinda hacky, but this is a demo so who cares
@@ -47,6 +53,7 @@ func (r *ChatRoutineDemo) Next(args model.RoutineInput) []model.RoutineOutput {
 				Pk:              nil, // client sending the message
 				Msgs:            []string{"Your public key has been set."},
 				Done:            true, // yeet the transaction out of the windnow
+				DoneReason:      model.DoneReason_Completed,
 				TimeoutEnabled:  true,
 				TimeoutDuration: 60 * time.Second,
 			}}
@@ -69,7 +76,7 @@ func (r *ChatRoutineDemo) Next(args model.RoutineInput) []model.RoutineOutput {
 		}
 
 	case model.RoutineMsgType_ClientClose:
-		fmt.Printf("Client has disconnected\n")
+		r.client.Logger().Info("Client has disconnected")
 		return []model.RoutineOutput{}
 
 	default:
@@ -0,0 +1,108 @@
+package routines
+
+import (
+	"encoding/json"
+	"harmony/backend/model"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Tells the client whether a peer is online, without notifying the peer.
+type CheckPeerOnline struct {
+	client *model.Client
+	hub    *model.Hub
+	pkA    *model.PublicKey
+	pkB    *model.PublicKey
+}
+
+func newCheckPeerOnline(client *model.Client, hub *model.Hub) model.Routine {
+	return &CheckPeerOnline{client: client, hub: hub}
+}
+
+func (r *CheckPeerOnline) Next(args model.RoutineInput) []model.RoutineOutput {
+	// only 1 step, don't need to worry about state.
+	r.pkA = args.Pk
+	if r.pkA == nil {
+		return cpoError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
+	}
+
+	// validate msg
+	result, err := validateJSON(cpoSchema, args.Msg)
+	if err != nil {
+		return cpoError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return cpoError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Initiate string `json:"initiate"`
+		Key      string `json:"key"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	r.pkB, err = parsePublicKey(usrMsg.Key)
+	if err != nil {
+		return cpoError(nil, ERROR_MALFORMED, err.Error())
+	}
+
+	// check pkB is different from pkA
+	if sameKey(*r.pkA, *r.pkB) {
+		return cpoError(nil, ERROR_SELF_NOT_ALLOWED, "Checking whether you are online yourself is not allowed")
+	}
+
+	_, peerOnline := r.hub.GetClient(*r.pkB)
+
+	if peerOnline {
+		return []model.RoutineOutput{
+			{
+				Pk:         r.pkA,
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Msgs:       []string{`{"peerStatus":"online","terminate":"done"}`},
+			},
+		}
+	} else {
+		return []model.RoutineOutput{
+			{
+				Pk:         r.pkA,
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Msgs:       []string{`{"peerStatus":"offline","terminate":"done"}`},
+			},
+		}
+	}
+}
+
+var cpoSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"checkPeerOnline"
+			},
+			"key": {
+				"type":"string",
+				"pattern": "` + publicKeyPattern + `"
+			}
+		},
+		"required": ["initiate", "key"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// wrapper for error routine output
+func cpoError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
+	return []model.RoutineOutput{
+		{
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
+		},
+	}
+}
@@ -0,0 +1,223 @@
+package routines
+
+import (
+	"harmony/backend/model"
+	"testing"
+)
+
+func TestCheckPeerOnline(t *testing.T) {
+
+	t.Run("Valid inputs", func(t *testing.T) {
+
+		t.Run("Peer is online", func(t *testing.T) {
+			test := []Step{
+				cpoStepOnline,
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(*clientA.GetPublicKey(), clientA)
+			hub.AddClient(*clientB.GetPublicKey(), clientB)
+			cpo := newCheckPeerOnline(clientA, hub)
+
+			testRunner(t, cpo, test)
+		})
+
+		t.Run("Peer is offline", func(t *testing.T) {
+			test := []Step{
+				cpoStepOffline,
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			hub.AddClient(*clientA.GetPublicKey(), clientA)
+			cpo := newCheckPeerOnline(clientA, hub)
+
+			testRunner(t, cpo, test)
+		})
+	})
+
+	t.Run("Invalid inputs", func(t *testing.T) {
+		t.Run("User has not provided their public key", func(t *testing.T) {
+
+			test := []Step{
+				{
+					description: "A checks whether B is online without having provided their public key",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      nil,
+						Msg:     cpoStepOnline.input.Msg,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   nil,
+								Msgs: []string{errorSchemaString("You have not provided a public key")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			clientA := &model.Client{}
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+			cpo := newCheckPeerOnline(clientA, hub)
+
+			testRunner(t, cpo, test)
+		})
+
+		t.Run("User checks themself", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "User checks whether they are online themself",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg: `{
+							"initiate": "checkPeerOnline",
+							"key": "` + (string)(publicKey0) + `"
+						}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{errorSchemaString("Checking whether you are online yourself is not allowed")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			hub.AddClient(*clientA.GetPublicKey(), clientA)
+
+			cpo := newCheckPeerOnline(clientA, hub)
+
+			testRunner(t, cpo, test)
+		})
+
+		tests := []Step{
+			{
+				description: "No key",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "checkPeerOnline"}`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Key in wrong format",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "checkPeerOnline", "key":"4"}`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Key is not Ed25519",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "checkPeerOnline", "key":"` + invalidPublicKeyNIST + `"}`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Invalid JSON",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `)`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Extra properties",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "checkPeerOnline", "key":"` + (string)(publicKey1) + `", "extraProperty!":{}}`,
+				},
+				outputs: outputPkAError,
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.description, func(t *testing.T) {
+				clientA := &model.Client{}
+				clientA.SetPublicKey(&publicKey0)
+				clientB := &model.Client{}
+				clientB.SetPublicKey(&publicKey1)
+				hub := model.NewHub()
+				hub.AddClient(*clientA.GetPublicKey(), clientA)
+				hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+				cpo := newCheckPeerOnline(clientA, hub)
+
+				testRunner(t, cpo, []Step{test})
+			})
+		}
+	})
+}
+
+// only A receives a RoutineOutput, B is never contacted.
+var cpoStepOnline = Step{
+	description: "Check whether an online peer is online",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg: `{
+			"initiate": "checkPeerOnline",
+			"key": "` + (string)(publicKey1) + `"
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{frejSchemaOnlineToA},
+				Done: true,
+			},
+		},
+	},
+}
+
+var cpoStepOffline = Step{
+	description: "Check whether an offline peer is online",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg: `{
+			"initiate": "checkPeerOnline",
+			"key": "` + (string)(publicKey1) + `"
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{frejSchemaOfflineToA},
+				Done: true,
+			},
+		},
+	},
+}
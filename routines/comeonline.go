@@ -1,29 +1,36 @@
 package routines
 
 import (
-	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"harmony/backend/model"
 	"time"
+	"unicode/utf8"
 
 	"github.com/xeipuuv/gojsonschema"
 )
 
-const timeout = 30 * time.Second
+// how long the client has to sign the random message once it has been sent
+const defaultChallengeTTL = 20 * time.Second
 
-type ComeOnline struct {
-	client     *model.Client
-	hub        *model.Hub
-	step       comeOnlineStep
-	randMsgGen RandomMessageGenerator
+// longest message accepted at any step, in bytes. Valid messages are far shorter.
+const defaultComeOnlineMaxMessageLength = 1024
 
-	signThis         string
-	publicKey        *model.PublicKey
-	ed25519PublicKey *ed25519.PublicKey
+type ComeOnline struct {
+	client *model.Client
+	hub    *model.Hub
+	step   comeOnlineStep
+	config comeOnlineConfig
+
+	signThis          string
+	challengeIssuedAt time.Time
+	publicKey         *model.PublicKey
+	key               clientKey
+	// sign out the key's other devices once signed in
+	takeover bool
 
 	holdsComeOnlineLock bool
 }
@@ -54,17 +61,54 @@ const ( // enum
 	comeOnlineStep_recvSignature
 )
 
+// label for the step in metrics
+func (s comeOnlineStep) metricLabel() string {
+	switch s {
+	case comeOnlineStep_hello:
+		return "hello"
+	case comeOnlineStep_recvPublicKey:
+		return "recvPublicKey"
+	case comeOnlineStep_recvSignature:
+		return "recvSignature"
+	default:
+		return "unknown"
+	}
+}
+
+// dependencies and tunable parameters of ComeOnline
+type comeOnlineConfig struct {
+	randMsgGen   RandomMessageGenerator
+	clock        model.Clock
+	challengeTTL time.Duration
+	// how long the client has to reply at each step. Rearmed by every reply, so a client that stalls part way through
+	// signing in is torn down well before other routines would time out.
+	authTimeout      time.Duration
+	maxMessageLength int
+}
+
+func defaultComeOnlineConfig() comeOnlineConfig {
+	return comeOnlineConfig{
+		randMsgGen:       RandomMessageGeneratorImpl{},
+		clock:            model.RealClock{},
+		challengeTTL:     defaultChallengeTTL,
+		authTimeout:      model.DEFAULT_AUTH_TIMEOUT,
+		maxMessageLength: defaultComeOnlineMaxMessageLength,
+	}
+}
+
 // constructor
 func newComeOnline(client *model.Client, hub *model.Hub) model.Routine {
-	return newComeOnlineDependencyInj(client, hub, RandomMessageGeneratorImpl{})
+	config := defaultComeOnlineConfig()
+	config.authTimeout = hub.AuthTimeout()
+	return newComeOnlineDependencyInj(client, hub, config)
 }
 
-func newComeOnlineDependencyInj(client *model.Client, hub *model.Hub, randMsgGen RandomMessageGenerator) model.Routine {
+func newComeOnlineDependencyInj(client *model.Client, hub *model.Hub, config comeOnlineConfig) model.Routine {
 	return &ComeOnline{
-		client:     client,
-		hub:        hub,
-		randMsgGen: randMsgGen,
-		step:       comeOnlineStep_hello,
+		client: client,
+		hub:    hub,
+		config: config,
+		step:   comeOnlineStep_hello,
 	}
 }
 
@@ -74,7 +118,7 @@ func (c *ComeOnline) Next(args model.RoutineInput) []model.RoutineOutput {
 	if !c.holdsComeOnlineLock {
 		succeed := c.client.ComeOnlineLock.TryLock()
 		if !succeed {
-			return makeCOOutput(true, MakeJSONError("Another comeOnline routine is in progress"))
+			return c.coError(ERROR_BUSY, "Another comeOnline routine is in progress")
 		}
 		c.holdsComeOnlineLock = true
 	}
@@ -89,6 +133,10 @@ func (c *ComeOnline) Next(args model.RoutineInput) []model.RoutineOutput {
 	return nextResult
 }
 
+func (c *ComeOnline) metricState() string {
+	return c.step.metricLabel()
+}
+
 /**Called by Next() only if the lock is obtained.*/
 func (c *ComeOnline) safeNext(args model.RoutineInput) []model.RoutineOutput {
 
@@ -96,14 +144,23 @@ func (c *ComeOnline) safeNext(args model.RoutineInput) []model.RoutineOutput {
 	case model.RoutineMsgType_ClientClose:
 		return []model.RoutineOutput{}
 	case model.RoutineMsgType_Timeout:
-		return makeCOOutput(true, MakeJSONError("timeout"))
+		return c.coError(ERROR_TIMEOUT, "Authentication timed out")
 	case model.RoutineMsgType_UsrMsg:
+		// cheap checks so that spam never reaches the schema validator
+		if len(args.Msg) > c.config.maxMessageLength {
+			return c.coError(ERROR_LIMIT_EXCEEDED, fmt.Sprintf("Message is longer than %d bytes", c.config.maxMessageLength))
+		}
+		if !utf8.ValidString(args.Msg) {
+			return c.coError(ERROR_MALFORMED, "Message is not valid UTF-8")
+		}
 		if isClientCancelMsg(args.Msg) {
-			return makeCOOutput(true)
+			ros := c.makeCOOutput(true)
+			ros[0].DoneReason = model.DoneReason_Cancelled
+			return ros
 		}
 		switch c.step {
 		case comeOnlineStep_hello:
-			return c.hello()
+			return c.hello(args.Msg)
 		case comeOnlineStep_recvPublicKey:
 			return c.recvPublicKey(args.Msg)
 		case comeOnlineStep_recvSignature:
@@ -115,36 +172,134 @@ func (c *ComeOnline) safeNext(args model.RoutineInput) []model.RoutineOutput {
 
 }
 
-// send version number
-func (c *ComeOnline) hello() []model.RoutineOutput {
+var helloSchema = func() *gojsonschema.Schema {
+	schemaLoader := gojsonschema.NewStringLoader(`
+	{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const": "comeOnline"
+			},
+			"minVersion": {
+				"type": "string",
+				"pattern": "` + versionPattern + `"
+			},
+			"maxVersion": {
+				"type": "string",
+				"pattern": "` + versionPattern + `"
+			},
+			"takeover": {
+				"type": "boolean"
+			}
+		},
+		"required": ["initiate"],
+		"additionalProperties": false
+	}
+	`)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// agree a protocol version and send it
+func (c *ComeOnline) hello(msg string) []model.RoutineOutput {
 
 	if c.client.GetPublicKey() != nil {
-		return makeCOOutput(true, MakeJSONError("Public key already set"))
+		return c.coError(ERROR_ALREADY_ONLINE, "Public key already set")
+	}
+
+	// validate msg
+	result, err := validateJSON(helloSchema, msg)
+	if err != nil {
+		return c.coError(ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return c.coError(ERROR_MALFORMED, jsonErrorMessage(c.hub, c.client, result))
 	}
+
+	// clients that don't give a range get the newest version
+	usrMsg := struct {
+		MinVersion string `json:"minVersion"`
+		MaxVersion string `json:"maxVersion"`
+		Takeover   bool   `json:"takeover"`
+	}{
+		MinVersion: "0.0",
+		MaxVersion: VERSION,
+	}
+	json.Unmarshal([]byte(msg), &usrMsg)
+
+	version, ok := negotiateVersion(usrMsg.MinVersion, usrMsg.MaxVersion)
+	if !ok {
+		return c.coError(ERROR_UNSUPPORTED_VERSION, "Unsupported protocol version")
+	}
+	c.client.SetProtocolVersion(version)
+	c.takeover = usrMsg.Takeover
+
 	// set next step
 	c.step = comeOnlineStep_recvPublicKey
 	// msgs to return to user
-	return makeCOOutput(false, `{"version":"`+VERSION+`"}`)
+	return c.makeCOOutput(false, `{"version":"`+version+`"}`)
+}
+
+// "major.minor". Escaped for embedding in a json schema.
+const versionPattern = `^[0-9]+\\.[0-9]+$`
+
+type protocolVersion struct {
+	major int
+	minor int
+}
+
+// s must match versionPattern.
+func parseProtocolVersion(s string) protocolVersion {
+	var v protocolVersion
+	fmt.Sscanf(s, "%d.%d", &v.major, &v.minor)
+	return v
+}
+
+func (v protocolVersion) less(other protocolVersion) bool {
+	return v.major < other.major || (v.major == other.major && v.minor < other.minor)
+}
+
+func (v protocolVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// newest version in both the client's range and the server's range, if there is one.
+func negotiateVersion(clientMin string, clientMax string) (string, bool) {
+	lo := parseProtocolVersion(MIN_SUPPORTED_VERSION)
+	if v := parseProtocolVersion(clientMin); lo.less(v) {
+		lo = v
+	}
+	hi := parseProtocolVersion(VERSION)
+	if v := parseProtocolVersion(clientMax); v.less(hi) {
+		hi = v
+	}
+	if hi.less(lo) {
+		return "", false
+	}
+	return hi.String(), true
 }
 
 func (c *ComeOnline) recvPublicKey(msg string) []model.RoutineOutput {
-	key, keyBytes, err := parseUserKeyMessage(msg)
+	key, decoded, err := parseUserKeyMessage(c.hub, c.client, msg)
 	if err != nil {
-		return makeCOOutput(true, MakeJSONError(err.Error()))
+		return c.coError(ERROR_MALFORMED, err.Error())
 	}
-	_, clientWithKeyAlreadyExists := c.hub.GetClient(*key)
-	if clientWithKeyAlreadyExists {
-		return makeCOOutput(true, MakeJSONError("Another client already signed in with this public key"))
+
+	// banned keys aren't even challenged, so they never get as far as the hub
+	if c.hub.Blocklist().Contains(*key) {
+		return c.coError(ERROR_BANNED, "Key is banned")
 	}
 
 	c.publicKey = key
-	c.ed25519PublicKey = keyBytes
+	c.key = decoded
 
 	// generate a random message for the client to sign with their private key
-	c.signThis, err = c.randMsgGen.GetMessage()
+	c.signThis, err = c.config.randMsgGen.GetMessage()
 	if err != nil {
-		makeCOOutput(true, MakeJSONError(err.Error()))
+		return c.coError(ERROR_INTERNAL, err.Error())
 	}
+	c.challengeIssuedAt = c.config.clock.Now()
 	signThisMsgData := struct {
 		SignThis string `json:"signThis"`
 	}{}
@@ -154,33 +309,111 @@ func (c *ComeOnline) recvPublicKey(msg string) []model.RoutineOutput {
 	// set next step
 	c.step = comeOnlineStep_recvSignature
 
-	return makeCOOutput(false, (string)(signThisMsgStr))
+	return c.makeCOOutput(false, (string)(signThisMsgStr))
 }
 
 func (c *ComeOnline) recvSignature(msg string) []model.RoutineOutput {
 
 	// parse signature to byte array
-	sig, err := parseUserSignatureMessage(msg)
+	sig, err := parseUserSignatureMessage(c.hub, c.client, msg)
 	if err != nil {
-		return makeCOOutput(true, MakeJSONError(err.Error()))
+		return c.coError(ERROR_MALFORMED, err.Error())
+	}
+
+	// reject signatures of challenges that were issued too long ago
+	if c.config.clock.Now().Sub(c.challengeIssuedAt) > c.config.challengeTTL {
+		return c.coError(ERROR_CHALLENGE_EXPIRED, "Challenge expired")
 	}
 
 	// verify signature
-	valid := ed25519.Verify(*c.ed25519PublicKey, []byte(c.signThis), sig)
+	valid := c.key.verify([]byte(c.signThis), sig)
 	if !valid {
-		return makeCOOutput(true, MakeJSONError("Invalid signature"))
+		return c.coError(ERROR_INVALID_SIGNATURE, "Invalid signature")
 	}
 
 	// add to hub
-	err = c.hub.AddClient(*c.publicKey, c.client)
-	if err != nil {
-		return makeCOOutput(true, MakeJSONError(err.Error()))
+	if c.takeover {
+		replaced, err := c.hub.ReplaceClients(*c.publicKey, c.client)
+		if err != nil {
+			return c.addClientError(err)
+		}
+		for _, stale := range replaced {
+			stale.Disconnect(model.DisconnectReason_SessionTakenOver, `{"terminate":"sessionTakenOver"}`)
+		}
+	} else {
+		err = c.hub.AddClient(*c.publicKey, c.client)
+		if err != nil {
+			return c.addClientError(err)
+		}
 	}
 
 	// set client pk
 	c.client.SetPublicKey(c.publicKey)
+	c.hub.Metrics().IncCounter(model.METRIC_COME_ONLINE_COMPLETED)
+
+	ros := c.makeCOOutput(true, welcomeMessages(c.hub, c.client, *c.publicKey)...)
+	ros[0].DoneReason = model.DoneReason_Completed
+	return ros
+}
+
+// the client couldn't be added to the hub, so it stays offline.
+func (c *ComeOnline) addClientError(err error) []model.RoutineOutput {
+	if errors.Is(err, model.ErrHubAtCapacity) {
+		return c.coError(ERROR_AT_CAPACITY, "Server at capacity")
+	}
+	if errors.Is(err, model.ErrTooManyDevices) {
+		return c.coError(ERROR_TOO_MANY_DEVICES, "Too many devices signed in with this key")
+	}
+	return c.coError(ERROR_INTERNAL, err.Error())
+}
 
-	return makeCOOutput(true, `{"welcome":"welcome","terminate":"done"}`)
+// what the server lets a client do, sent in its welcome so that it can adapt.
+type capabilities struct {
+	// 0 means no limit
+	MaxTransactions int `json:"maxTransactions"`
+	MaxMessageSize  int `json:"maxMessageSize"`
+	// the routines the client can initiate
+	Routines []string `json:"routines"`
+	// whether peers that can't connect directly can relay data through the server
+	Relay bool `json:"relay"`
+}
+
+// the capabilities of client, from its limits and the registered routines.
+func clientCapabilities(client *model.Client) capabilities {
+	_, relay := registeredRoutines["relayData"]
+	return capabilities{
+		MaxTransactions: client.MaxTransactions(),
+		MaxMessageSize:  client.MaxMessageSize(),
+		Routines:        sortedRoutineNames(registeredRoutines),
+		Relay:           relay,
+	}
+}
+
+// messages for client, which has just been added to the hub with pk:
+// anything that was sent while it was offline, then the welcome with its capabilities and a token to reconnect with.
+func welcomeMessages(hub *model.Hub, client *model.Client, pk model.PublicKey) []string {
+	msgs := []string{}
+	for _, offlineMsg := range hub.DrainOffline(pk) {
+		msgs = append(msgs, offlineMsg.Msg)
+	}
+
+	welcome := struct {
+		Welcome        string       `json:"welcome"`
+		Capabilities   capabilities `json:"capabilities"`
+		ReconnectToken string       `json:"reconnectToken,omitempty"`
+		Terminate      string       `json:"terminate"`
+	}{
+		Welcome:      "welcome",
+		Capabilities: clientCapabilities(client),
+		Terminate:    "done",
+	}
+	// the client can still come online again the slow way without a token
+	token, err := hub.IssueReconnectToken(pk)
+	if err == nil {
+		welcome.ReconnectToken = token
+	}
+	welcomeStr, _ := json.Marshal(welcome)
+	return append(msgs, string(welcomeStr))
 }
 
 var userKeyMessageSchema = func() *gojsonschema.Schema {
@@ -192,6 +425,9 @@ var userKeyMessageSchema = func() *gojsonschema.Schema {
 			"publicKey": {
 				"type":"string",
 				"pattern": "` + publicKeyPattern + `"
+			},
+			"alg": {
+				"enum": ["` + string(model.KeyAlgorithm_Ed25519) + `", "` + string(model.KeyAlgorithm_P256) + `"]
 			}
 		},
 		"required": ["publicKey"],
@@ -202,52 +438,39 @@ var userKeyMessageSchema = func() *gojsonschema.Schema {
 	return schema
 }()
 
-// convert the raw json to a public key
-func parseUserKeyMessage(keyMessageString string) (*model.PublicKey, *ed25519.PublicKey, error) {
+// convert the raw json to a public key of one of the kinds the hub allows.
+// the kind is worked out from the key. If the client says what it is with "alg" as well, the two must match.
+func parseUserKeyMessage(hub *model.Hub, client *model.Client, keyMessageString string) (*model.PublicKey, clientKey, error) {
 	// verify json
-	messageLoader := gojsonschema.NewStringLoader(keyMessageString)
-	result, err := userKeyMessageSchema.Validate(messageLoader)
+	result, err := validateJSON(userKeyMessageSchema, keyMessageString)
 	if err != nil {
-		return nil, nil, err
+		return nil, clientKey{}, err
 	}
 	if !result.Valid() {
-		return nil, nil, errors.New(formatJSONError(result))
+		return nil, clientKey{}, errors.New(jsonErrorMessage(hub, client, result))
 	}
 
 	// parse json
 	keyMessage := struct {
-		PublicKey string `json:"publicKey"`
+		PublicKey string             `json:"publicKey"`
+		Alg       model.KeyAlgorithm `json:"alg"`
 	}{}
 	err = json.Unmarshal([]byte(keyMessageString), &keyMessage)
 	if err != nil {
-		return nil, nil, err
+		return nil, clientKey{}, err
 	}
 
 	// convert key to model.publicKey
 	keyString := keyMessage.PublicKey
-	key, err := parsePublicKey(keyString)
+	keyDecoded, err := parseClientKey(keyString, hub.KeyAlgorithms())
 	if err != nil {
-		return nil, nil, errors.New("unable to parse public key")
+		return nil, clientKey{}, err
 	}
-
-	// decode base64
-	keyDER, err := base64.StdEncoding.DecodeString(keyString)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// parse DER
-	keyDecoded, err := x509.ParsePKIXPublicKey(keyDER)
-	if err != nil {
-		return nil, nil, errors.New("public key is not ed25519")
+	if keyMessage.Alg != "" && keyMessage.Alg != keyDecoded.algorithm {
+		return nil, clientKey{}, errors.New("public key is not " + string(keyMessage.Alg))
 	}
 
-	// assert ed25519 and return
-	if keyDecoded, ok := keyDecoded.(ed25519.PublicKey); ok {
-		return (*model.PublicKey)(key), &keyDecoded, nil
-	} else {
-		return nil, nil, errors.New("public key is not ed25519")
-	}
+	return (*model.PublicKey)(&keyString), keyDecoded, nil
 
 }
 
@@ -270,16 +493,15 @@ var userSignatureMessageSchema = func() *gojsonschema.Schema {
 	return schema
 }()
 
-func parseUserSignatureMessage(signatureMessageString string) ([]byte, error) {
+func parseUserSignatureMessage(hub *model.Hub, client *model.Client, signatureMessageString string) ([]byte, error) {
 
 	// validate against json schema
-	messageLoader := gojsonschema.NewStringLoader(signatureMessageString)
-	result, err := userSignatureMessageSchema.Validate(messageLoader)
+	result, err := validateJSON(userSignatureMessageSchema, signatureMessageString)
 	if err != nil {
 		return nil, err
 	}
 	if !result.Valid() {
-		return nil, errors.New(formatJSONError(result))
+		return nil, errors.New(jsonErrorMessage(hub, client, result))
 	}
 
 	// parse msg
@@ -302,9 +524,16 @@ func parseUserSignatureMessage(signatureMessageString string) ([]byte, error) {
 }
 
 // make ComeOnline output
-func makeCOOutput(done bool, msgs ...string) []model.RoutineOutput {
+func (c *ComeOnline) makeCOOutput(done bool, msgs ...string) []model.RoutineOutput {
 	ro := model.MakeRoutineOutput(done, msgs...)
 	ro.TimeoutEnabled = true
-	ro.TimeoutDuration = timeout
+	ro.TimeoutDuration = c.config.authTimeout
 	return []model.RoutineOutput{ro}
 }
+
+// make a ComeOnline output that ends the transaction with an error.
+func (c *ComeOnline) coError(code string, msg string) []model.RoutineOutput {
+	ros := c.makeCOOutput(true, MakeJSONErrorWithCode(code, msg))
+	ros[0].DoneReason = doneReasonForCode(code)
+	return ros
+}
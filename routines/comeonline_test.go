@@ -1,9 +1,22 @@
 package routines
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"harmony/backend/model"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 const comeOnlineVersionResponseSchema = `{
@@ -40,9 +53,21 @@ const comeOnlineWelcomeResponseSchema = `{
   "type": "object",
   "properties": {
     "welcome": {"const": "welcome"},
+    "capabilities": {
+      "type": "object",
+      "properties": {
+        "maxTransactions": {"type": "integer", "minimum": 0},
+        "maxMessageSize": {"type": "integer", "minimum": 0},
+        "routines": {"type": "array", "items": {"type": "string"}},
+        "relay": {"type": "boolean"}
+      },
+      "required": ["maxTransactions", "maxMessageSize", "routines", "relay"],
+      "additionalProperties": false
+    },
+    "reconnectToken": {"type": "string", "minLength": 1},
     "terminate": {"const": "done"}
   },
-  "required": ["welcome", "terminate"],
+  "required": ["welcome", "capabilities", "reconnectToken", "terminate"],
   "additionalProperties": false
 }`
 
@@ -74,12 +99,18 @@ func TestComeOnline(t *testing.T) {
 				// mocks
 				mockClient := &model.Client{}
 				mockHub := model.NewHub()
+				metrics := model.NewCounters()
+				mockHub.SetMetrics(metrics)
 				mockRndMsgGen := fixedMessageGenerator{tt.msgToSign}
 
-				co := newComeOnlineDependencyInj(mockClient, mockHub, mockRndMsgGen)
+				co := newComeOnlineDependencyInj(mockClient, mockHub, coConfigWithMsgGen(mockRndMsgGen))
 
 				testRunner(t, co, tt.steps)
 
+				if count := metrics.Get(model.METRIC_COME_ONLINE_COMPLETED); count != 1 {
+					t.Errorf("Expected comeOnline completions to be counted once. Got %d", count)
+				}
+
 				// check that the key has been updated as expected
 				if mockClient.GetPublicKey() == nil {
 					t.Errorf("Expected public key of client not to be nil")
@@ -98,6 +129,173 @@ func TestComeOnline(t *testing.T) {
 		}
 	})
 
+	t.Run("Next calls are timed for each step", func(t *testing.T) {
+
+		mockClient := &model.Client{}
+		mockHub := model.NewHub()
+		metrics := model.NewCounters()
+		mockHub.SetMetrics(metrics)
+		rc := RoutineConstructors{
+			"comeOnline": func(c *model.Client, h *model.Hub) model.Routine {
+				return newComeOnlineDependencyInj(c, h, coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+			},
+		}
+		master := newMasterRoutineDependencyInj(rc, mockClient, mockHub)
+
+		testRunner(t, master, []Step{
+			coStepInitiate,
+			coStepValidPk(publicKey0, testMessage),
+			coStepValidSignature(testPk0Signature),
+		})
+
+		for _, step := range []comeOnlineStep{comeOnlineStep_hello, comeOnlineStep_recvPublicKey, comeOnlineStep_recvSignature} {
+			labels := model.MetricLabels{Routine: "comeOnline", State: step.metricLabel()}
+			histogram := metrics.GetHistogram(model.METRIC_ROUTINE_NEXT_SECONDS, labels)
+			if histogram.Count != 1 {
+				t.Errorf("Expected step %s to be timed once. Got %d", labels.State, histogram.Count)
+			}
+			if last := histogram.Buckets[len(histogram.Buckets)-1]; last != histogram.Count {
+				t.Errorf("Expected step %s to take less than the largest bucket. %d of %d did", labels.State, last, histogram.Count)
+			}
+		}
+	})
+
+	t.Run("delivers messages queued while offline before welcoming", func(t *testing.T) {
+
+		clock := &fakeClock{}
+		mockClient := &model.Client{}
+		mockHub := model.NewHub()
+		mockHub.SetClock(clock)
+		mockHub.SetOfflineQueueLimits(model.DEFAULT_OFFLINE_QUEUE_LENGTH, time.Hour)
+
+		mockHub.EnqueueOffline(publicKey0, model.OfflineMessage{Msg: `{"queued":"expired"}`})
+		clock.Advance(time.Hour)
+		mockHub.EnqueueOffline(publicKey0, model.OfflineMessage{Msg: `{"queued":0}`})
+		mockHub.EnqueueOffline(publicKey0, model.OfflineMessage{Msg: `{"queued":1}`})
+		mockHub.EnqueueOffline(publicKey1, model.OfflineMessage{Msg: `{"queued":"for someone else"}`})
+		clock.Advance(time.Minute)
+
+		co := newComeOnlineDependencyInj(mockClient, mockHub, coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+
+		welcomeStep := coStepValidSignature(testPk0Signature)
+		welcomeStep.outputs[0].ro.Msgs = []string{
+			`{"const":{"queued":0}}`,
+			`{"const":{"queued":1}}`,
+			comeOnlineWelcomeResponseSchema,
+		}
+
+		testRunner(t, co, []Step{
+			coStepInitiate,
+			coStepValidPk(publicKey0, testMessage),
+			welcomeStep,
+		})
+
+		if msgs := mockHub.DrainOffline(publicKey0); len(msgs) != 0 {
+			t.Errorf("Expected the queue to be empty after coming online, got %v", msgs)
+		}
+	})
+
+	t.Run("Welcome carries the client's capabilities", func(t *testing.T) {
+
+		mockClient := model.MakeClient(nil, model.ClientOptions{MaxTransactions: 7, MaxMessageSize: 1234})
+		mockHub := model.NewHub()
+		co := newComeOnlineDependencyInj(&mockClient, mockHub, coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+
+		routines, _ := json.Marshal(sortedRoutineNames(registeredRoutines))
+		welcomeStep := coStepValidSignature(testPk0Signature)
+		welcomeStep.outputs[0].ro.Msgs = []string{`{
+			"type": "object",
+			"properties": {
+				"welcome": {"const": "welcome"},
+				"capabilities": {"const": {
+					"maxTransactions": 7,
+					"maxMessageSize": 1234,
+					"routines": ` + string(routines) + `,
+					"relay": true
+				}},
+				"reconnectToken": {"type": "string", "minLength": 1},
+				"terminate": {"const": "done"}
+			},
+			"required": ["welcome", "capabilities", "reconnectToken", "terminate"],
+			"additionalProperties": false
+		}`}
+
+		testRunner(t, co, []Step{
+			coStepInitiate,
+			coStepValidPk(publicKey0, testMessage),
+			welcomeStep,
+		})
+	})
+
+	t.Run("Negotiates the protocol version", func(t *testing.T) {
+
+		tests := []struct {
+			description     string
+			msg             string
+			expectedVersion string // "" if the routine should terminate
+		}{
+			{"Legacy message with no version fields", `{"initiate":"comeOnline"}`, VERSION},
+			{"Client range contains the server's", `{"initiate":"comeOnline","minVersion":"0.1","maxVersion":"9.9"}`, VERSION},
+			{"Client range ends at the server's", `{"initiate":"comeOnline","minVersion":"0.1","maxVersion":"` + VERSION + `"}`, VERSION},
+			{"Only a minimum", `{"initiate":"comeOnline","minVersion":"` + MIN_SUPPORTED_VERSION + `"}`, VERSION},
+			{"Client range is newer than the server's", `{"initiate":"comeOnline","minVersion":"9.0","maxVersion":"9.9"}`, ""},
+			{"Client range is older than the server's", `{"initiate":"comeOnline","minVersion":"0.1","maxVersion":"0.9"}`, ""},
+			{"Malformed version", `{"initiate":"comeOnline","maxVersion":"1"}`, ""},
+			{"Version is not a string", `{"initiate":"comeOnline","maxVersion":1.0}`, ""},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+
+				step := Step{
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Msg:     tt.msg,
+					},
+				}
+				if tt.expectedVersion != "" {
+					step.outputs = []ExpectedOutput{{ro: model.RoutineOutput{
+						Msgs: []string{`{"const":{"version":"` + tt.expectedVersion + `"}}`},
+					}}}
+				} else {
+					step.outputs = []ExpectedOutput{{ro: model.RoutineOutput{
+						Msgs: []string{errorSchemaString()},
+						Done: true,
+					}}}
+				}
+
+				mockClient := &model.Client{}
+				co := newComeOnlineDependencyInj(mockClient, model.NewHub(), coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+
+				// finish the routine if it is still going so the test runner doesn't complain
+				steps := []Step{step}
+				if tt.expectedVersion != "" {
+					steps = append(steps, coStepClientCancel)
+				}
+				testRunner(t, co, steps)
+
+				if got := mockClient.GetProtocolVersion(); got != tt.expectedVersion {
+					t.Errorf("Expected the client's protocol version to be %q, got %q", tt.expectedVersion, got)
+				}
+			})
+		}
+
+		t.Run("Unsupported ranges terminate with an explanation", func(t *testing.T) {
+			co := newComeOnlineDependencyInj(&model.Client{}, model.NewHub(), coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+			testRunner(t, co, []Step{{
+				description: "Client only supports newer versions than the server",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Msg:     `{"initiate":"comeOnline","minVersion":"9.0"}`,
+				},
+				outputs: []ExpectedOutput{{ro: model.RoutineOutput{
+					Msgs: []string{errorCodeSchemaString(ERROR_UNSUPPORTED_VERSION, "Unsupported protocol version")},
+					Done: true,
+				}}},
+			}})
+		})
+	})
+
 	t.Run("cancels transaction on bad public key message", func(t *testing.T) {
 
 		tests := []struct {
@@ -141,33 +339,262 @@ func TestComeOnline(t *testing.T) {
 		}
 	})
 
-	t.Run("cancels transaction if public key is already signed in", func(t *testing.T) {
+	t.Run("Key algorithms", func(t *testing.T) {
+
+		// a P-256 key, and its signatures of testMessage in both encodings
+		p256Private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p256DER, _ := x509.MarshalPKIXPublicKey(&p256Private.PublicKey)
+		p256Key := (model.PublicKey)(base64.StdEncoding.EncodeToString(p256DER))
+		hash := sha256.Sum256([]byte(testMessage))
+		p256ASN1Sig, _ := ecdsa.SignASN1(rand.Reader, p256Private, hash[:])
+		r, s, _ := ecdsa.Sign(rand.Reader, p256Private, hash[:])
+		p256RawSig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+		bothAlgorithms := []model.KeyAlgorithm{model.KeyAlgorithm_Ed25519, model.KeyAlgorithm_P256}
+
+		tests := []struct {
+			description string
+			algorithms  []model.KeyAlgorithm
+			key         model.PublicKey
+			steps       []Step
+		}{
+			{
+				description: "Ed25519 with a matching alg",
+				key:         publicKey0,
+				steps: []Step{
+					coStepInitiate,
+					coStepValidPkMsg(`{"publicKey":"`+string(publicKey0)+`","alg":"ed25519"}`, testMessage),
+					coStepValidSignature(testPk0Signature),
+				},
+			},
+			{
+				description: "P-256 is rejected by default",
+				steps: []Step{
+					coStepInitiate,
+					coStepBadPublicKey(`{"publicKey":"`+string(p256Key)+`"}`, "public key is not ed25519"),
+				},
+			},
+			{
+				description: "P-256 with an ASN.1 signature once allowed",
+				algorithms:  bothAlgorithms,
+				key:         p256Key,
+				steps: []Step{
+					coStepInitiate,
+					coStepValidPkMsg(`{"publicKey":"`+string(p256Key)+`","alg":"p256"}`, testMessage),
+					coStepValidSignature(base64.StdEncoding.EncodeToString(p256ASN1Sig)),
+				},
+			},
+			{
+				description: "P-256 with a raw signature once allowed",
+				algorithms:  bothAlgorithms,
+				key:         p256Key,
+				steps: []Step{
+					coStepInitiate,
+					coStepValidPk(p256Key, testMessage),
+					coStepValidSignature(base64.StdEncoding.EncodeToString(p256RawSig)),
+				},
+			},
+			{
+				description: "P-256 with an Ed25519 signature",
+				algorithms:  bothAlgorithms,
+				steps: []Step{
+					coStepInitiate,
+					coStepValidPk(p256Key, testMessage),
+					coStepInvalidSignature(`{"signature":"`+testPk0Signature+`"}`, "Invalid signature"),
+				},
+			},
+			{
+				description: "alg that doesn't match the key",
+				algorithms:  bothAlgorithms,
+				steps: []Step{
+					coStepInitiate,
+					coStepBadPublicKey(`{"publicKey":"`+string(publicKey0)+`","alg":"p256"}`, "public key is not p256"),
+				},
+			},
+			{
+				description: "Unknown alg",
+				steps: []Step{
+					coStepInitiate,
+					coStepBadPublicKey(`{"publicKey":"` + string(publicKey0) + `","alg":"rsa"}`),
+				},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				client := &model.Client{}
+				hub := model.NewHub()
+				if tt.algorithms != nil {
+					hub.SetKeyAlgorithms(tt.algorithms)
+				}
+				co := newComeOnlineDependencyInj(client, hub, coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+
+				testRunner(t, co, tt.steps)
+
+				if tt.key == "" {
+					if client.GetPublicKey() != nil {
+						t.Errorf("Expected public key of client to be nil")
+					}
+					return
+				}
+				if client.GetPublicKey() == nil || *client.GetPublicKey() != tt.key {
+					t.Errorf("Expected the client to be signed in with %s. Got %v", tt.key, client.GetPublicKey())
+				}
+				if _, exists := hub.GetClient(tt.key); !exists {
+					t.Errorf("Expected client to be added to the hub")
+				}
+			})
+		}
+	})
+
+	t.Run("Rejects banned keys before challenging them", func(t *testing.T) {
 
 		steps := []Step{
+			coStepInitiate,
 			{
+				description: "User provides a banned public key, and server cancels without a challenge",
 				input: model.RoutineInput{
 					MsgType: model.RoutineMsgType_UsrMsg,
-					Msg:     `{"initiate": "comeOnline"}`,
+					Msg:     `{"publicKey": "` + (string)(publicKey0) + `"}`,
 				},
 				outputs: []ExpectedOutput{
 					{
 						ro: model.RoutineOutput{
-							Msgs: []string{comeOnlineVersionResponseSchema},
+							Msgs: []string{errorCodeSchemaString(ERROR_BANNED, "Key is banned")},
+							Done: true,
 						},
 					},
 				},
 			},
+		}
+
+		hub := model.NewHub()
+		hub.Blocklist().Add(publicKey0)
+		client := &model.Client{}
+		co := newComeOnline(client, hub)
+
+		testRunner(t, co, steps)
+
+		if _, online := hub.GetClient(publicKey0); online || client.GetPublicKey() != nil {
+			t.Errorf("Expected the banned key not to be signed in")
+		}
+
+		// can come online again once the ban is lifted
+		hub.Blocklist().Remove(publicKey0)
+		co = newComeOnlineDependencyInj(client, hub, coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+		testRunner(t, co, []Step{
+			coStepInitiate,
+			coStepValidPk(publicKey0, testMessage),
+			coStepValidSignature(testPk0Signature),
+		})
+	})
+
+	t.Run("signs in a second device with a public key that is already signed in", func(t *testing.T) {
+
+		steps := []Step{
+			coStepInitiate,
+			coStepValidPk(publicKey0, testMessage),
+			coStepValidSignature(testPk0Signature),
+		}
+
+		// mock hub with the first device already signed in
+		hub := model.NewHub()
+
+		client0 := &model.Client{}
+		key := publicKey0
+		client0.SetPublicKey(&key)
+		hub.AddClient(key, client0)
+
+		// second device signing in with the same key
+		client1 := &model.Client{}
+
+		co := newComeOnlineDependencyInj(client1, hub, coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+
+		testRunner(t, co, steps)
+
+		// both devices are in the hub
+		devices := hub.GetClients(key)
+		if len(devices) != 2 || devices[0] != client0 || devices[1] != client1 {
+			t.Errorf("Expected both devices to be signed in. Got %v", devices)
+		}
+
+	})
+
+	t.Run("Rejects sign-ins once the server is at capacity", func(t *testing.T) {
+
+		for _, takeover := range []bool{false, true} {
+			t.Run("takeover="+strconv.FormatBool(takeover), func(t *testing.T) {
+
+				initiate := coStepInitiate
+				if takeover {
+					initiate.input.Msg = `{"initiate":"comeOnline","takeover":true}`
+				}
+				steps := []Step{
+					initiate,
+					coStepValidPk(publicKey0, testMessage),
+					{
+						description: "Client sends a valid signature, but the hub is full",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Msg:     `{"signature":"` + testPk0Signature + `"}`,
+						},
+						outputs: []ExpectedOutput{
+							{
+								ro: model.RoutineOutput{
+									Msgs: []string{errorCodeSchemaString(ERROR_AT_CAPACITY, "Server at capacity")},
+									Done: true,
+								},
+							},
+						},
+					},
+				}
+
+				// another key fills the hub
+				hub := model.NewHub()
+				hub.SetMaxClients(1)
+				other := &model.Client{}
+				other.SetPublicKey(&publicKey1)
+				if err := hub.AddClient(publicKey1, other); err != nil {
+					t.Fatalf("Expected the first client to be added. Got %v", err)
+				}
+
+				client := &model.Client{}
+				co := newComeOnlineDependencyInj(client, hub, coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+
+				testRunner(t, co, steps)
+
+				// no partial sign-in
+				if client.GetPublicKey() != nil {
+					t.Errorf("Expected public key of client to be nil")
+				}
+				if devices := hub.GetClients(publicKey0); len(devices) != 0 {
+					t.Errorf("Expected the client not to be added to the hub. Got %v", devices)
+				}
+				if count := hub.ClientCount(); count != 1 {
+					t.Errorf("Expected 1 client in the hub, got %d", count)
+				}
+			})
+		}
+	})
+
+	t.Run("Rejects sign-ins once the key has too many devices", func(t *testing.T) {
+
+		steps := []Step{
+			coStepInitiate,
+			coStepValidPk(publicKey0, testMessage),
 			{
+				description: "Client sends a valid signature, but the key already has its maximum number of devices",
 				input: model.RoutineInput{
 					MsgType: model.RoutineMsgType_UsrMsg,
-					Msg: `{
-						"publicKey": "` + (string)(publicKey0) + `"
-					}`,
+					Msg:     `{"signature":"` + testPk0Signature + `"}`,
 				},
 				outputs: []ExpectedOutput{
 					{
 						ro: model.RoutineOutput{
-							Msgs: []string{errorSchemaString()},
+							Msgs: []string{errorCodeSchemaString(ERROR_TOO_MANY_DEVICES, "Too many devices signed in with this key")},
 							Done: true,
 						},
 					},
@@ -175,34 +602,98 @@ func TestComeOnline(t *testing.T) {
 			},
 		}
 
-		// mock hub with the client already signed in
-
 		hub := model.NewHub()
+		hub.SetMaxDevicesPerKey(1)
+		other := &model.Client{}
+		other.SetPublicKey(&publicKey0)
+		if err := hub.AddClient(publicKey0, other); err != nil {
+			t.Fatalf("Expected the first device to be added. Got %v", err)
+		}
 
-		client0 := &model.Client{}
+		client := &model.Client{}
+		co := newComeOnlineDependencyInj(client, hub, coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+
+		testRunner(t, co, steps)
+
+		if client.GetPublicKey() != nil {
+			t.Errorf("Expected public key of client to be nil")
+		}
+		if devices := hub.GetClients(publicKey0); len(devices) != 1 || devices[0] != other {
+			t.Errorf("Expected only the first device to be signed in. Got %v", devices)
+		}
+	})
+
+	t.Run("takes over the session of devices already signed in with the public key", func(t *testing.T) {
+
+		steps := []Step{
+			{
+				description: "User initiates the routine asking to take over, and server replies with protocol version.",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Msg:     `{"initiate": "comeOnline", "takeover": true}`,
+				},
+				outputs: coStepInitiate.outputs,
+			},
+			coStepValidPk(publicKey0, testMessage),
+			coStepValidSignature(testPk0Signature),
+		}
+
+		hub := model.NewHub()
 		key := publicKey0
-		client0.SetPublicKey(&key)
-		hub.AddClient(key, client0)
 
-		// client that tries to use a public key that is already signed in
-		client1 := &model.Client{}
+		// stale device already signed in
+		staleConn := &recordingConn{}
+		staleClient := model.MakeClient(staleConn)
+		staleClient.SetPublicKey(&key)
+		hub.AddClient(key, &staleClient)
 
-		co := newComeOnline(client1, hub)
+		newClient := &model.Client{}
+		co := newComeOnlineDependencyInj(newClient, hub, coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
 
 		testRunner(t, co, steps)
 
-		// client id was not updated
-		if client1.GetPublicKey() != nil {
-			t.Errorf("Public key expected nil got %v", client1.GetPublicKey())
+		// only the new device is in the hub
+		devices := hub.GetClients(key)
+		if len(devices) != 1 || devices[0] != newClient {
+			t.Errorf("Expected only the new device to be signed in. Got %v", devices)
+		}
+
+		// the stale device is told why and disconnected
+		expected := string(model.CONTROL_ID[:]) + `{"terminate":"sessionTakenOver"}`
+		if len(staleConn.written) != 1 || staleConn.written[0] != expected {
+			t.Errorf("Expected the stale device to be sent %q. Got %q", expected, staleConn.written)
 		}
+		if !staleConn.closed {
+			t.Errorf("Expected the stale device's connection to be closed")
+		}
+	})
 
-		// hub still returns original client
-		expected := client0
-		got, _ := hub.GetClient(key)
-		if expected != got {
-			t.Errorf("Expected client not to be updated. Expected %v got %v", expected, got)
+	t.Run("does not disconnect other devices without takeover", func(t *testing.T) {
+
+		steps := []Step{
+			coStepInitiate,
+			coStepValidPk(publicKey0, testMessage),
+			coStepValidSignature(testPk0Signature),
 		}
 
+		hub := model.NewHub()
+		key := publicKey0
+
+		otherConn := &recordingConn{}
+		otherClient := model.MakeClient(otherConn)
+		otherClient.SetPublicKey(&key)
+		hub.AddClient(key, &otherClient)
+
+		co := newComeOnlineDependencyInj(&model.Client{}, hub, coConfigWithMsgGen(fixedMessageGenerator{testMessage}))
+
+		testRunner(t, co, steps)
+
+		if len(otherConn.written) != 0 || otherConn.closed {
+			t.Errorf("Expected the other device to be left alone. Got messages %q, closed=%v", otherConn.written, otherConn.closed)
+		}
+		if devices := hub.GetClients(key); len(devices) != 2 {
+			t.Errorf("Expected both devices to be signed in. Got %v", devices)
+		}
 	})
 
 	t.Run("Cancels if another comeOnline is in progress", func(t *testing.T) {
@@ -229,7 +720,7 @@ func TestComeOnline(t *testing.T) {
 					{
 						ro: model.RoutineOutput{
 							Done: true,
-							Msgs: []string{errorSchemaString("Another comeOnline routine is in progress")},
+							Msgs: []string{errorCodeSchemaString(ERROR_BUSY, "Another comeOnline routine is in progress")},
 						},
 					},
 				},
@@ -242,7 +733,7 @@ func TestComeOnline(t *testing.T) {
 				client := &model.Client{}
 				hub := model.NewHub()
 				mockRndMsgGen := fixedMessageGenerator{testMessage}
-				co0 := newComeOnlineDependencyInj(client, hub, mockRndMsgGen)
+				co0 := newComeOnlineDependencyInj(client, hub, coConfigWithMsgGen(mockRndMsgGen))
 
 				// manually run the first test - after this point it is not complete
 				for _, step := range test {
@@ -250,7 +741,7 @@ func TestComeOnline(t *testing.T) {
 				}
 
 				// start another comeOnline
-				co1 := newComeOnlineDependencyInj(client, hub, mockRndMsgGen)
+				co1 := newComeOnlineDependencyInj(client, hub, coConfigWithMsgGen(mockRndMsgGen))
 				testRunner(t, co1, co1Test) // expect it to fail
 			})
 		}
@@ -281,7 +772,7 @@ func TestComeOnline(t *testing.T) {
 				client := &model.Client{}
 				hub := model.NewHub()
 				mockRndMsgGen := fixedMessageGenerator{testMessage}
-				co0 := newComeOnlineDependencyInj(client, hub, mockRndMsgGen)
+				co0 := newComeOnlineDependencyInj(client, hub, coConfigWithMsgGen(mockRndMsgGen))
 
 				// manually run the first test - it has completed at this point.
 				for _, step := range test {
@@ -289,7 +780,7 @@ func TestComeOnline(t *testing.T) {
 				}
 
 				// start another comeOnline
-				co1 := newComeOnlineDependencyInj(client, hub, mockRndMsgGen)
+				co1 := newComeOnlineDependencyInj(client, hub, coConfigWithMsgGen(mockRndMsgGen))
 				testRunner(t, co1, co1Test) // expect it not to fail
 			})
 		}
@@ -413,6 +904,80 @@ func TestComeOnline(t *testing.T) {
 
 	})
 
+	t.Run("Uses the configured timeout", func(t *testing.T) {
+		tests := []struct {
+			description string
+			config      comeOnlineConfig
+			expected    time.Duration
+		}{
+			{"default", defaultComeOnlineConfig(), 10 * time.Second},
+			{"override", func() comeOnlineConfig {
+				config := defaultComeOnlineConfig()
+				config.authTimeout = time.Millisecond
+				return config
+			}(), time.Millisecond},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				initiate := coStepInitiate
+				initiate.outputs = []ExpectedOutput{
+					{
+						verifyTimeouts: true,
+						ro: model.RoutineOutput{
+							Msgs:            []string{comeOnlineVersionResponseSchema},
+							TimeoutEnabled:  true,
+							TimeoutDuration: tt.expected,
+						},
+					},
+				}
+
+				co := newComeOnlineDependencyInj(&model.Client{}, model.NewHub(), tt.config)
+				testRunner(t, co, []Step{initiate, coStepTimeout})
+			})
+		}
+	})
+
+	t.Run("A stalled sign in is torn down on the auth timeout", func(t *testing.T) {
+		const authTimeout = 3 * time.Second
+
+		// every reply rearms the shorter timeout, not just the first
+		withAuthTimeout := func(step Step) Step {
+			step.outputs = slices.Clone(step.outputs)
+			step.outputs[0].verifyTimeouts = true
+			step.outputs[0].ro.TimeoutEnabled = true
+			step.outputs[0].ro.TimeoutDuration = authTimeout
+			return step
+		}
+
+		tests := map[string][]Step{
+			"before sending a public key": {
+				withAuthTimeout(coStepInitiate),
+				withAuthTimeout(coStepTimeout),
+			},
+			"after sending a public key": {
+				withAuthTimeout(coStepInitiate),
+				withAuthTimeout(coStepValidPk(publicKey0)),
+				withAuthTimeout(coStepTimeout),
+			},
+		}
+
+		for name, test := range tests {
+			t.Run(name, func(t *testing.T) {
+				client := &model.Client{}
+				hub := model.NewHub()
+				hub.SetAuthTimeout(authTimeout)
+				co := newComeOnline(client, hub)
+				testRunner(t, co, test)
+
+				// the lock is released, so the client can try again
+				if !client.ComeOnlineLock.TryLock() {
+					t.Errorf("Expected the comeOnline lock to be released")
+				}
+			})
+		}
+	})
+
 	t.Run("Rejects incorrect/invalid signatures signatures", func(t *testing.T) {
 
 		tests := []struct {
@@ -454,7 +1019,7 @@ func TestComeOnline(t *testing.T) {
 					mockClient := &model.Client{}
 					mockHub := model.NewHub()
 					mockRndMsgGen := fixedMessageGenerator{test.msgToSign}
-					co := newComeOnlineDependencyInj(mockClient, mockHub, mockRndMsgGen)
+					co := newComeOnlineDependencyInj(mockClient, mockHub, coConfigWithMsgGen(mockRndMsgGen))
 
 					testRunner(t, co, append(test.prefaceSteps, testCase), testRunnerConfig{errorsOnLastStepOnly: true})
 
@@ -475,6 +1040,158 @@ func TestComeOnline(t *testing.T) {
 
 	})
 
+	t.Run("Cancels if the random message cannot be generated", func(t *testing.T) {
+
+		steps := []Step{
+			coStepInitiate,
+			{
+				description: "User provides a valid public key, but the server fails to generate a message to sign",
+				input:       coStepValidPk(publicKey0).input,
+				outputs: []ExpectedOutput{
+					{
+						ro: model.RoutineOutput{
+							Msgs: []string{errorCodeSchemaString(ERROR_INTERNAL, "internal server error generating a random string")},
+							Done: true,
+						},
+					},
+				},
+			},
+		}
+
+		mockClient := &model.Client{}
+		mockHub := model.NewHub()
+		mockRndMsgGen := failingMessageGenerator{}
+		co := newComeOnlineDependencyInj(mockClient, mockHub, coConfigWithMsgGen(mockRndMsgGen))
+
+		testRunner(t, co, steps)
+
+		// check that the routine did not advance to the signature step
+		if step := co.(*ComeOnline).step; step == comeOnlineStep_recvSignature {
+			t.Errorf("Expected routine not to advance to the signature step")
+		}
+		if mockClient.GetPublicKey() != nil {
+			t.Errorf("Expected public key of client to be nil")
+		}
+	})
+
+	t.Run("Rejects oversized or non UTF-8 messages before parsing them", func(t *testing.T) {
+
+		badMessages := []struct {
+			description string
+			msg         string
+			error       string
+			code        string
+		}{
+			{"1MB message", `{"signature":"` + strings.Repeat("A", 1<<20) + `"}`, "Message is longer than 1024 bytes", ERROR_LIMIT_EXCEEDED},
+			{"invalid UTF-8", "{\"initiate\":\"comeOnline\xff\"}", "Message is not valid UTF-8", ERROR_MALFORMED},
+			{"truncated multi-byte character", "{\"key\":\"\xe2\x82\"}", "Message is not valid UTF-8", ERROR_MALFORMED},
+		}
+		prefaces := []struct {
+			description string
+			steps       []Step
+		}{
+			{"hello", []Step{}},
+			{"public key", []Step{coStepInitiate}},
+			{"signature", []Step{coStepInitiate, coStepValidPk(publicKey0)}},
+		}
+
+		for _, preface := range prefaces {
+			for _, bad := range badMessages {
+				t.Run(preface.description+"-"+bad.description, func(t *testing.T) {
+					step := Step{
+						description: bad.description,
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Msg:     bad.msg,
+						},
+						outputs: []ExpectedOutput{
+							{
+								ro: model.RoutineOutput{
+									Msgs: []string{errorCodeSchemaString(bad.code, bad.error)},
+									Done: true,
+								},
+							},
+						},
+					}
+					mockClient := &model.Client{}
+					co := newComeOnline(mockClient, model.NewHub())
+					testRunner(t, co, append(preface.steps, step))
+
+					if mockClient.GetPublicKey() != nil {
+						t.Errorf("Expected public key of client to be nil")
+					}
+				})
+			}
+		}
+
+		t.Run("Uses the configured length", func(t *testing.T) {
+			config := defaultComeOnlineConfig()
+			config.maxMessageLength = 10
+			step := coStepInitiate
+			step.outputs = []ExpectedOutput{
+				{
+					ro: model.RoutineOutput{
+						Msgs: []string{errorCodeSchemaString(ERROR_LIMIT_EXCEEDED, "Message is longer than 10 bytes")},
+						Done: true,
+					},
+				},
+			}
+			co := newComeOnlineDependencyInj(&model.Client{}, model.NewHub(), config)
+			testRunner(t, co, []Step{step})
+		})
+	})
+
+	t.Run("Rejects signatures of expired challenges", func(t *testing.T) {
+
+		const ttl = 5 * time.Second
+
+		tests := []struct {
+			description string
+			elapsed     time.Duration
+			lastStep    Step
+			expectAdded bool
+		}{
+			{
+				description: "Signature within TTL is accepted",
+				elapsed:     ttl - time.Second,
+				lastStep:    coStepValidSignature(testPk0Signature),
+				expectAdded: true,
+			},
+			{
+				description: "Signature after TTL is rejected",
+				elapsed:     ttl + time.Second,
+				lastStep:    coStepInvalidSignature(`{"signature":"`+testPk0Signature+`"}`, "Challenge expired"),
+				expectAdded: false,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+
+				mockClient := &model.Client{}
+				mockHub := model.NewHub()
+				clock := &fakeClock{}
+				config := coConfigWithMsgGen(fixedMessageGenerator{testMessage})
+				config.clock = clock
+				config.challengeTTL = ttl
+				co := newComeOnlineDependencyInj(mockClient, mockHub, config)
+
+				// get the challenge
+				co.Next(coStepInitiate.input)
+				co.Next(coStepValidPk(publicKey0).input)
+
+				clock.Advance(tt.elapsed)
+
+				testRunner(t, co, []Step{tt.lastStep})
+
+				_, added := mockHub.GetClient(publicKey0)
+				if added != tt.expectAdded {
+					t.Errorf("Client added to hub: expected %v got %v", tt.expectAdded, added)
+				}
+			})
+		}
+	})
+
 	t.Run("Random string generator", func(t *testing.T) {
 		t.Run("Return value is not hard-coded", func(t *testing.T) {
 			gen := RandomMessageGeneratorImpl{}
@@ -524,6 +1241,13 @@ var coStepValidPk = func(pk model.PublicKey, msgToSign ...string) Step {
 	}
 }
 
+// like coStepValidPk, with the whole key message.
+var coStepValidPkMsg = func(msg string, msgToSign ...string) Step {
+	step := coStepValidPk("", msgToSign...)
+	step.input.Msg = msg
+	return step
+}
+
 var coStepValidSignature = func(signature string) Step {
 	return Step{
 		description: "User replies with the correct signature for the message, and server welcomes the user.",
@@ -576,7 +1300,7 @@ var coStepTimeout = Step{
 		{
 			ro: model.RoutineOutput{
 				Done: true,
-				Msgs: []string{errorSchemaString("timeout")},
+				Msgs: []string{errorCodeSchemaString(ERROR_TIMEOUT, "Authentication timed out")},
 			},
 		},
 	},
@@ -623,6 +1347,48 @@ const testMessage = "This is a test message used to verify the public key. Usual
 // testMessage signed with publicKey0
 const testPk0Signature = "jIX/9ZHy6UuGZzywconx5rSV77yGugYg2M40ROilWS/zo3qnlau2Zn2p045ZYvKDH98LrMm8vJOmdmWBCkY0Bg=="
 
+// model.Conn that records what is written to it and never receives anything.
+type recordingConn struct {
+	written []string
+	closed  bool
+}
+
+func (c *recordingConn) ReadMessage() (int, []byte, error) {
+	return 0, nil, errors.New("connection closed")
+}
+func (c *recordingConn) WriteMessage(messageType int, data []byte) error {
+	c.written = append(c.written, string(data))
+	return nil
+}
+func (c *recordingConn) Close() error {
+	c.closed = true
+	return nil
+}
+func (c *recordingConn) SetReadLimit(limit int64) {}
+func (c *recordingConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (c *recordingConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+func (c *recordingConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return nil
+}
+
+// recordingConn that receives the messages sent on fromCl, blocking until there is one.
+type scriptedConn struct {
+	recordingConn
+	fromCl chan []byte
+}
+
+func (c *scriptedConn) ReadMessage() (int, []byte, error) {
+	msg, ok := <-c.fromCl
+	if !ok {
+		return 0, nil, errors.New("connection closed")
+	}
+	return websocket.TextMessage, msg, nil
+}
+
 // non-random message generator for mocking.
 type fixedMessageGenerator struct {
 	msg string
@@ -631,3 +1397,17 @@ type fixedMessageGenerator struct {
 func (g fixedMessageGenerator) GetMessage() (string, error) {
 	return g.msg, nil
 }
+
+// message generator that always fails, for mocking.
+type failingMessageGenerator struct{}
+
+func (g failingMessageGenerator) GetMessage() (string, error) {
+	return "", errors.New("internal server error generating a random string")
+}
+
+// default ComeOnline config, but with a mocked message generator.
+func coConfigWithMsgGen(randMsgGen RandomMessageGenerator) comeOnlineConfig {
+	config := defaultComeOnlineConfig()
+	config.randMsgGen = randMsgGen
+	return config
+}
@@ -3,7 +3,9 @@ package routines
 
 import (
 	"harmony/backend/model"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/xeipuuv/gojsonschema"
 )
@@ -13,10 +15,25 @@ var publicKey0 = (model.PublicKey)("MCowBQYDK2VwAyEAUFRxKDllkUY843/zVOPE67zGqkGo
 // var privateKey0 = "MC4CAQAwBQYDK2VwBCIEILLK2qyMQi162qzsJ2pV5bS5tX/6XEgWtw62eUKOKLAF"
 //                    MC4CAQAwBQYDK2VwBCIEILLK2qyMQi162qzsJ2pV5cS5tX/6XEgWtw62eUKOKLAF
 
+// publicKey0 with the unused bits before the padding set. Decodes to the same key.
+var publicKey0OtherEncoding = (model.PublicKey)("MCowBQYDK2VwAyEAUFRxKDllkUY843/zVOPE67zGqkGoMZd7dGKl2+9+pYR=")
+
 var publicKey1 = (model.PublicKey)("MCowBQYDK2VwAyEA1x5dCGTiFyoAGPP8XTzv58tZQHx5RB5E+5xFX5xwMFQ=")
 
 // var privateKey1 = "MC4CAQAwBQYDK2VwBCIEIP192NwPoJrEi4IxNZRpYd5E9yoDQypY+3VNSuxSvFtn"
 
+var publicKey2 = (model.PublicKey)("MCowBQYDK2VwAyEAEJt93gG+WKNcbe6MXgY43d3EQwxCnK5y+nzm/gNfX3o=")
+
+// keys that match publicKeyPattern but are not valid Ed25519 keys
+const (
+	// uses NIST192p curve instead of Ed25519
+	invalidPublicKeyNIST = "MEkwEwYHKoZIzj0CAQYIKoZIzj0DAQEDMgAEoGveud25v3hQMWyISkUboxNF/0dXLnTn1G4kmdmb44NMstp5bvxdXDrRg4F0l+ZK"
+	// publicKey0 with the end chopped off
+	invalidPublicKeyTruncated = "MCowBQYDK2VwAyEAUFRxKDllkUY843/zVOPE67zG"
+	// character modified in the DER header
+	invalidPublicKeyCorruptedHeader = "MCoxBQYDK2VwAyEA6pf9wPoa7Y6zeuwENUOifdDYN9kmYrd4jWIa3032spU="
+)
+
 type ExpectedOutput struct {
 	// json schemas instead of actual messages in the ro.
 	ro             model.RoutineOutput
@@ -27,6 +44,8 @@ type Step struct {
 	description string
 	input       model.RoutineInput
 	outputs     []ExpectedOutput
+	// optional. Runs before the input is sent, e.g. to advance a fake clock.
+	before func()
 }
 
 func pkToStr(pk *model.PublicKey) string {
@@ -92,6 +111,9 @@ func testRunner(t *testing.T, r model.Routine, steps []Step, configs ...testRunn
 
 		tLogf("Step %d: %s", stepNum, step.description)
 
+		if step.before != nil {
+			step.before()
+		}
 		ros := r.Next(step.input)
 
 		// replace all nil public keys with the key of the step initiator
@@ -191,6 +213,9 @@ func testRunner(t *testing.T, r model.Routine, steps []Step, configs ...testRunn
 						tErrorf("RoutineOutput to pk %s in step %d should have had a timeout of duration %v. Got %v", pkToStr(ro.Pk), stepNum, expectedOutput.ro.TimeoutDuration, ro)
 					}
 				}
+				if ro.KeepTimeout != expectedOutput.ro.KeepTimeout {
+					tErrorf("RoutineOutput to pk %s in step %d should have had KeepTimeout=%v. Got %v", pkToStr(ro.Pk), stepNum, expectedOutput.ro.KeepTimeout, ro)
+				}
 			}
 
 			// compare messages against schema
@@ -252,12 +277,24 @@ func countOccurrences[K comparable](slice []K, el K) int {
 // error messages to send to the client should look like this.
 
 func errorSchemaString(msg ...string) string {
+	return errorCodeSchemaString("", msg...)
+}
+
+// like errorSchemaString, but also requires the error code to be code.
+// An empty code accepts any code.
+func errorCodeSchemaString(code string, msg ...string) string {
 	var errorSchemaFragment string
 	if len(msg) > 0 {
 		errorSchemaFragment = `"const":"` + msg[0] + `"`
 	} else {
 		errorSchemaFragment = `"type":"string"`
 	}
+	codeSchemaFragment := `"type":"string"`
+	required := `["terminate"]`
+	if code != "" {
+		codeSchemaFragment = `"const":"` + code + `"`
+		required = `["terminate", "code"]`
+	}
 	return `{
 		"$schema": "https://json-schema.org/draft/2020-12/schema",
 		"type": "object",
@@ -265,11 +302,14 @@ func errorSchemaString(msg ...string) string {
 			"terminate": {
 				"const":"cancel"
 			},
+			"code": {
+				` + codeSchemaFragment + `
+			},
 			"error": {
 				` + errorSchemaFragment + `
 			}
 		},
-		"required": ["terminate"],
+		"required": ` + required + `,
 		"additionalProperties": false
 	}`
 }
@@ -281,3 +321,50 @@ type EmptyRoutine struct{}
 func (r *EmptyRoutine) Next(args model.RoutineInput) []model.RoutineOutput {
 	return []model.RoutineOutput{model.MakeRoutineOutput(false)}
 }
+
+// clock that only moves forward when told to.
+type fakeClock struct {
+	now time.Time
+	// channels returned by After that haven't fired yet
+	timers []fakeTimer
+	lock   sync.Mutex
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	return c.now
+}
+
+// fires once Advance has moved the clock d past now.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer.c
+	}
+	c.timers = append(c.timers, timer)
+	return timer.c
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
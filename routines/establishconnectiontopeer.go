@@ -3,6 +3,9 @@ package routines
 import (
 	"encoding/json"
 	"harmony/backend/model"
+	"net/netip"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/xeipuuv/gojsonschema"
@@ -12,11 +15,77 @@ type ECTPState int
 
 const ectpTimeoutDuration = 20 * time.Second
 
+// default maximum number of (non-empty) ICE candidates that each peer can send
+const defaultMaxIceCandidates = 20
+
+// maximum lengths in bytes of the string fields of an ICE candidate
+const (
+	maxIceCandidateLength = 1024
+	maxIceSdpMidLength    = 256
+	maxIceUfragLength     = 256
+)
+
+// default number of typing indicators each peer can send per typingWindow. The rest are dropped.
+const (
+	defaultMaxTypingIndicators = 10
+	defaultTypingWindow        = 10 * time.Second
+)
+
+// maximum length of the optional display name A can send B with a request, in characters
+const ectpMaxDisplayNameLength = 64
+
+// maximum length in bytes of an SDP offer or answer, and of the message containing it
+const defaultMaxSdpLength = 64 * 1024
+
+// by default each trickled ICE candidate is forwarded as soon as it arrives.
+const defaultIceBatchWindow = 0
+
+// default number of times the peers can renegotiate (send a new offer) once ICE candidates are being exchanged.
+const defaultMaxRenegotiations = 3
+
+// default number of times the peers can restart ICE once ICE candidates are being exchanged.
+const defaultMaxIceRestarts = 3
+
 const (
 	ectp_entry ECTPState = iota
 	ectp_bAcceptOrReject
+	ectp_bSdpOffer
 	ectp_aSdpAnswer
 	ectp_iceCandidates
+	// a peer has sent a new offer during the ICE phase, and is waiting for the other peer's answer.
+	ectp_renegotiationAnswer
+	// both peers have sent all their ICE candidates, and A asked for them to confirm that the connection opened.
+	ectp_connectionConfirmation
+)
+
+// label for the state in metrics
+func (s ECTPState) metricLabel() string {
+	switch s {
+	case ectp_entry:
+		return "entry"
+	case ectp_bAcceptOrReject:
+		return "bAcceptOrReject"
+	case ectp_bSdpOffer:
+		return "bSdpOffer"
+	case ectp_aSdpAnswer:
+		return "aSdpAnswer"
+	case ectp_iceCandidates:
+		return "iceCandidates"
+	case ectp_renegotiationAnswer:
+		return "renegotiationAnswer"
+	case ectp_connectionConfirmation:
+		return "connectionConfirmation"
+	default:
+		return "unknown"
+	}
+}
+
+// how the peers exchange ICE candidates, chosen by A in the first message.
+// in trickle mode each candidate is forwarded on its own, ending with an empty candidate.
+// in bundle mode each peer sends all of its candidates at once in a single message.
+const (
+	iceModeTrickle = "trickle"
+	iceModeBundle  = "bundle"
 )
 
 type EstablishConnectionToPeer struct {
@@ -24,32 +93,154 @@ type EstablishConnectionToPeer struct {
 	pkB                         *model.PublicKey
 	pkAHasSentEmptyICECandidate bool
 	pkBHasSentEmptyICECandidate bool
-	hub                         *model.Hub
-	state                       ECTPState
+	pkAIceCount                 int
+	pkBIceCount                 int
+	iceMode                     string
+	pkATyping                   typingLimiter
+	pkBTyping                   typingLimiter
+	renegotiations              int
+	iceRestarts                 int
+	// the peer that sent the offer of the current renegotiation.
+	renegotiator *model.PublicKey
+	// chosen by A in the first message. Whether the transaction waits for both peers to send {"connectionEstablished":true}
+	// once they have finished sending ICE candidates.
+	confirmConnection bool
+	pkAConfirmed      bool
+	pkBConfirmed      bool
+	// trickled ICE candidates each peer has sent in its current batch window, not forwarded yet.
+	pkAIceBatch []iceCandidate
+	pkBIceBatch []iceCandidate
+	// set while handling a candidate that was added to the sender's batch.
+	iceBatched bool
+	hub        *model.Hub
+	state      ECTPState
+	config     ectpConfig
+	// when the routine was created, and when it entered its current state. Read from config.clock.
+	startedAt      time.Time
+	stateEnteredAt time.Time
+	// set once a message couldn't be delivered to a peer. The transaction is over, and any later inputs are ignored.
+	peerGone bool
+	// A's client, which only lets it have one connection request to B in progress at a time.
+	client *model.Client
+	// whether this routine's request to B is recorded in client, and has to be ended once A's socket is.
+	requestStarted bool
+}
+
+// tunable parameters of EstablishConnectionToPeer
+type ectpConfig struct {
+	maxSdpLength int
+	// per peer. Raise it for networks that gather many candidates, lower it to limit abuse.
+	maxIceCandidates int
+	// reject ICE candidates with private or link-local addresses, so the server can't be used to probe internal networks.
+	rejectPrivateCandidates bool
+	// per peer, per typingWindow.
+	maxTypingIndicators int
+	typingWindow        time.Duration
+	// shared by both peers. Stops a pair of clients from renegotiating forever.
+	maxRenegotiations int
+	// shared by both peers. Stops a pair of clients from restarting ICE forever.
+	maxIceRestarts int
+	// in trickle mode, candidates a peer sends within this long of the first are forwarded together in one message.
+	// 0 forwards each candidate straight away.
+	iceBatchWindow time.Duration
+	clock          model.Clock
+}
+
+// counts the typing indicators a peer has sent in the current window.
+type typingLimiter struct {
+	windowStart time.Time
+	count       int
+}
+
+func defaultECTPConfig() ectpConfig {
+	return ectpConfig{
+		maxSdpLength:        defaultMaxSdpLength,
+		maxIceCandidates:    defaultMaxIceCandidates,
+		maxTypingIndicators: defaultMaxTypingIndicators,
+		typingWindow:        defaultTypingWindow,
+		maxRenegotiations:   defaultMaxRenegotiations,
+		maxIceRestarts:      defaultMaxIceRestarts,
+		iceBatchWindow:      defaultIceBatchWindow,
+		clock:               model.RealClock{},
+	}
 }
 
 func newEstablishConnectionToPeer(client *model.Client, hub *model.Hub) model.Routine {
+	return newEstablishConnectionToPeerDependencyInj(client, hub, defaultECTPConfig())
+}
+
+func newEstablishConnectionToPeerDependencyInj(client *model.Client, hub *model.Hub, config ectpConfig) model.Routine {
+	now := config.clock.Now()
 	return &EstablishConnectionToPeer{
-		hub:   hub,
-		state: ectp_entry,
+		client:         client,
+		hub:            hub,
+		state:          ectp_entry,
+		iceMode:        iceModeTrickle,
+		config:         config,
+		startedAt:      now,
+		stateEnteredAt: now,
 	}
 }
 
+func (r *EstablishConnectionToPeer) metricState() string {
+	return r.state.metricLabel()
+}
+
+// move to state, recording how long was spent in the one before.
+// Moving to the same state (e.g. a second renegotiation) still counts as a transition.
+func (r *EstablishConnectionToPeer) setState(state ECTPState) {
+	r.observeStateDuration()
+	r.state = state
+}
+
+// record how long the routine has been in its current state, and start timing it again.
+func (r *EstablishConnectionToPeer) observeStateDuration() {
+	now := r.config.clock.Now()
+	labels := model.MetricLabels{Routine: "sendConnectionRequest", State: r.state.metricLabel()}
+	r.hub.Metrics().ObserveDuration(model.METRIC_CONNECTION_STATE_SECONDS, labels, now.Sub(r.stateEnteredAt))
+	r.stateEnteredAt = now
+}
+
 func (r *EstablishConnectionToPeer) Next(args model.RoutineInput) []model.RoutineOutput {
+	ros := r.next(args)
+	r.endRequestIfADone(args, ros)
+	return ros
+}
+
+// Next, without ending A's connection request.
+func (r *EstablishConnectionToPeer) next(args model.RoutineInput) []model.RoutineOutput {
+
+	if r.peerGone {
+		// the other peer's client close, or a message it sent before disconnecting
+		return []model.RoutineOutput{}
+	}
+
+	r.iceBatched = false
 
 	switch args.MsgType {
 	case model.RoutineMsgType_Timeout:
+		// the sender's batch window is over, rather than the transaction timing out
+		if r.pkB != nil && len(*r.iceBatch(args.Pk)) > 0 {
+			return r.flushIceBatches(args.Pk, []model.RoutineOutput{
+				{
+					Pk:              nil, // sender
+					TimeoutEnabled:  true,
+					TimeoutDuration: ectpTimeoutDuration,
+				},
+			})
+		}
+
 		// note: assumption I am making here: if the pkA is set that means that pkA is online, same for pkB
 		// these are never explicitly unset, however in the correct operation pkA and pkB's transaction sockets are closed at the same time
 		// therefore it is not possible to receieve a timeout or a client close when only 1 of A and B has been terminated
-		ros := ectpError(nil, "Timeout")
+		ros := ectpError(nil, ERROR_TIMEOUT, "Timeout")
 
 		if r.pkA != nil && r.pkB != nil {
 			switch *args.Pk {
 			case *r.pkA:
-				ros = append(ros, ectpError(r.pkB, "Peer timed out")...)
+				ros = append(ros, ectpError(r.pkB, ERROR_PEER_TIMEOUT, "Peer timed out")...)
 			case *r.pkB:
-				ros = append(ros, ectpError(r.pkA, "Peer timed out")...)
+				ros = append(ros, ectpError(r.pkA, ERROR_PEER_TIMEOUT, "Peer timed out")...)
 			}
 		}
 		return ros
@@ -59,41 +250,123 @@ func (r *EstablishConnectionToPeer) Next(args model.RoutineInput) []model.Routin
 		if r.pkA != nil && r.pkB != nil {
 			switch *args.Pk {
 			case *r.pkA:
-				return ectpError(r.pkB, "Peer disconnected")
+				return peerDisconnected(r.pkB, args.LastWill)
 			case *r.pkB:
-				return ectpError(r.pkA, "Peer disconnected")
+				return peerDisconnected(r.pkA, args.LastWill)
 			}
 		}
 		return []model.RoutineOutput{}
 
 	case model.RoutineMsgType_UsrMsg:
-
-		if isClientCancelMsg(args.Msg) {
-			return r.cancel(args)
-		}
-		switch r.state {
-		case ectp_entry:
-			return r.entry(args)
-		case ectp_bAcceptOrReject:
-			return r.bAcceptOrReject(args)
-		case ectp_aSdpAnswer:
-			return r.aSdpAnswer(args)
-		case ectp_iceCandidates:
-			return r.iceCandidates(args)
-		default:
-			panic("unrecognized state?")
-		}
+		// echo the request id, if there is one, on everything sent in response
+		// batched candidates are added after the request id, as they belong to earlier messages
+		return r.flushIceBatches(args.Pk, withRequestId(r.usrMsg(args), parseRequestId(args.Msg)))
 	default:
 		panic("unrecognized message type")
 	}
 
 }
 
+// a message to a peer couldn't be delivered because it has disconnected, but its client close hasn't arrived yet,
+// or because it is busy with as many transactions as it is allowed.
+// end the sender's transaction now, instead of leaving it waiting for a reply until it times out.
+func (r *EstablishConnectionToPeer) Undeliverable(args model.RoutineInput, pk model.PublicKey, ro model.RoutineOutput, reason model.UndeliverableReason) []model.RoutineOutput {
+	ros := r.undeliverable(args, ro, reason)
+	r.endRequestIfADone(args, ros)
+	return ros
+}
+
+// Implements model.EndHandler, for transactions that end without A's socket being ended by the routine, e.g. when they exceed their lifetime.
+func (r *EstablishConnectionToPeer) Ended() {
+	r.endRequest()
+}
+
+// A can send B another connection request once its socket has been ended, by ros or by A disconnecting.
+func (r *EstablishConnectionToPeer) endRequestIfADone(args model.RoutineInput, ros []model.RoutineOutput) {
+	if !r.requestStarted {
+		return
+	}
+	aDone := args.MsgType == model.RoutineMsgType_ClientClose && args.Pk != nil && *args.Pk == *r.pkA
+	for _, ro := range ros {
+		pk := ro.Pk
+		if pk == nil {
+			pk = args.Pk // sender
+		}
+		aDone = aDone || (ro.Done && pk != nil && *pk == *r.pkA)
+	}
+	if aDone {
+		r.endRequest()
+	}
+}
+
+// only ends the request once, so that a later request from A to B isn't ended with it.
+func (r *EstablishConnectionToPeer) endRequest() {
+	if r.requestStarted {
+		r.client.EndConnectionRequest(*r.pkB)
+		r.requestStarted = false
+	}
+}
+
+// Undeliverable, without ending A's connection request.
+func (r *EstablishConnectionToPeer) undeliverable(args model.RoutineInput, ro model.RoutineOutput, reason model.UndeliverableReason) []model.RoutineOutput {
+	// if ro ended the peer's transaction, the sender's has ended (or is about to) too.
+	if ro.Done || r.peerGone {
+		return []model.RoutineOutput{}
+	}
+	r.peerGone = true
+	// B couldn't be sent the request. Answer for it, like it had rejected it.
+	if reason == model.UndeliverableReason_AtCapacity && r.state == ectp_bAcceptOrReject {
+		return []model.RoutineOutput{
+			{
+				Pk:         nil,
+				Msgs:       []string{`{"peerStatus":"online","forwarded":{"type":"busy"},"terminate":"done"}`},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+			},
+		}
+	}
+	return ectpError(nil, ERROR_PEER_DISCONNECTED, "Peer disconnected")
+}
+
+// message from a client, without the request id handling.
+func (r *EstablishConnectionToPeer) usrMsg(args model.RoutineInput) []model.RoutineOutput {
+
+	if isClientCancelMsg(args.Msg) {
+		return r.cancel(args)
+	}
+	// keepalives are only meaningful once there is a timeout to extend
+	if r.state != ectp_entry && isKeepaliveMsg(args.Msg) {
+		return keepaliveOutput(ectpTimeoutDuration)
+	}
+	if r.state != ectp_entry {
+		if typing, ok := parseTypingMsg(args.Msg); ok {
+			return r.typing(args, typing)
+		}
+	}
+	switch r.state {
+	case ectp_entry:
+		return r.entry(args)
+	case ectp_bAcceptOrReject:
+		return r.bAcceptOrReject(args)
+	case ectp_bSdpOffer:
+		return r.bSdpOffer(args)
+	case ectp_aSdpAnswer, ectp_renegotiationAnswer:
+		return r.aSdpAnswer(args)
+	case ectp_iceCandidates:
+		return r.iceCandidates(args)
+	case ectp_connectionConfirmation:
+		return r.connectionConfirmation(args)
+	default:
+		panic("unrecognized state?")
+	}
+}
+
 // client sends a {"terminate":"cancel"} message.
 func (r *EstablishConnectionToPeer) cancel(args model.RoutineInput) []model.RoutineOutput {
 	if r.state == ectp_entry {
 		return []model.RoutineOutput{{
-			Done: true,
+			Done:       true,
+			DoneReason: model.DoneReason_Cancelled,
 		}}
 	} else {
 		var peer = r.pkA
@@ -102,9 +375,10 @@ func (r *EstablishConnectionToPeer) cancel(args model.RoutineInput) []model.Rout
 		}
 		return []model.RoutineOutput{
 			{
-				Done: true,
+				Done:       true,
+				DoneReason: model.DoneReason_Cancelled,
 			},
-			ectpError(peer, "Peer cancelled the transaction")[0],
+			peerCancelledOutput(peer, parseCancelReason(args.Msg)),
 		}
 	}
 }
@@ -114,12 +388,24 @@ var ectpEntrySchema = func() *gojsonschema.Schema {
 		"$schema": "https://json-schema.org/draft/2020-12/schema",
 		"type": "object",
 		"properties": {
+			"rid": ` + requestIdSchema + `,
 			"initiate": {
 				"const":"sendConnectionRequest"
 			},
 			"key": {
 				"type":"string",
 				"pattern": "` + publicKeyPattern + `"
+			},
+			"iceMode": {
+				"enum": ["` + iceModeTrickle + `", "` + iceModeBundle + `"]
+			},
+			"displayName": {
+				"type":"string",
+				"minLength": 1,
+				"maxLength": ` + strconv.Itoa(ectpMaxDisplayNameLength) + `
+			},
+			"confirmConnection": {
+				"type":"boolean"
 			}
 		},
 		"required": ["initiate", "key"],
@@ -134,41 +420,85 @@ func (r *EstablishConnectionToPeer) entry(args model.RoutineInput) []model.Routi
 
 	// store public key of first peer
 	if args.Pk == nil {
-		return ectpError(nil, "You have not provided a public key")
+		return ectpError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
 	}
 	r.pkA = args.Pk
 
 	// validate msg
-	usrMsgLoader := gojsonschema.NewStringLoader(args.Msg)
-	result, err := ectpEntrySchema.Validate(usrMsgLoader)
+	result, err := validateJSON(ectpEntrySchema, args.Msg)
 	if err != nil {
-		return ectpError(nil, err.Error())
+		return ectpError(nil, ERROR_MALFORMED, err.Error())
 	}
 	if !result.Valid() {
-		return ectpError(nil, formatJSONError(result))
+		return ectpError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
 	}
 
 	// parse first message
 	usrMsg := struct {
-		Initiate string `json:"initiate"`
-		Key      string `json:"key"`
+		Initiate          string `json:"initiate"`
+		Key               string `json:"key"`
+		IceMode           string `json:"iceMode"`
+		DisplayName       string `json:"displayName"`
+		ConfirmConnection bool   `json:"confirmConnection"`
 	}{}
 	json.Unmarshal([]byte(args.Msg), &usrMsg)
-	r.pkB, _ = parsePublicKey(usrMsg.Key)
+	if usrMsg.IceMode != "" {
+		r.iceMode = usrMsg.IceMode
+	}
+	r.confirmConnection = usrMsg.ConfirmConnection
+	// the pattern only checks for base64. Reject keys that can't belong to anyone before looking them up in the hub.
+	r.pkB, err = parsePublicKey(usrMsg.Key)
+	if err != nil {
+		return ectpError(nil, ERROR_MALFORMED, "Invalid public key")
+	}
 
 	// check pkB is different from pkA
-	if *(r.pkA) == *(r.pkB) {
-		return ectpError(nil, "Connecting to yourself is not allowed")
+	if sameKey(*r.pkA, *r.pkB) {
+		return ectpError(nil, ERROR_SELF_NOT_ALLOWED, "Connecting to yourself is not allowed")
+	}
+
+	if r.hub.Blocklist().Contains(*r.pkB) {
+		return ectpError(nil, ERROR_BANNED, "Peer is banned")
 	}
 
 	_, peerOnline := r.hub.GetClient(*r.pkB)
 
 	if peerOnline {
-		r.state = ectp_bAcceptOrReject
+		// B would be asked twice
+		if !r.client.TryStartConnectionRequest(*r.pkB) {
+			return ectpError(nil, ERROR_BUSY, "Connection to this peer already in progress")
+		}
+		r.requestStarted = true
+		r.setState(ectp_bAcceptOrReject)
+		dataToB := struct {
+			Initiate string `json:"initiate"`
+			Key      string `json:"key"`
+			IceMode  string `json:"iceMode,omitempty"`
+			// chosen by A, so only for B to show. Marshalled rather than pasted in, since it could contain anything.
+			DisplayName string `json:"displayName,omitempty"`
+			// B has to confirm the connection as well
+			ConfirmConnection bool `json:"confirmConnection,omitempty"`
+		}{
+			Initiate:          "receiveConnectionRequest",
+			Key:               publicKeyToString(*r.pkA),
+			DisplayName:       usrMsg.DisplayName,
+			ConfirmConnection: r.confirmConnection,
+		}
+		// B only needs to be told about the ICE mode if it isn't the default
+		if r.iceMode == iceModeBundle {
+			dataToB.IceMode = iceModeBundle
+		}
+		msgToB, _ := json.Marshal(dataToB)
 		return []model.RoutineOutput{
+			// let A show that B is being asked. A keeps waiting without a timeout of its own, B's timeout covers both.
+			// sent first, so that A isn't sent anything after "Peer disconnected" if B can't be reached.
+			{
+				Pk:   r.pkA,
+				Msgs: []string{`{"peerStatus":"online","ringing":true}`},
+			},
 			{
 				Pk:              r.pkB,
-				Msgs:            []string{`{"initiate":"receiveConnectionRequest","key":"` + publicKeyToString(*r.pkA) + `"}`},
+				Msgs:            []string{string(msgToB)},
 				TimeoutEnabled:  true,
 				TimeoutDuration: ectpTimeoutDuration,
 			},
@@ -176,20 +506,25 @@ func (r *EstablishConnectionToPeer) entry(args model.RoutineInput) []model.Routi
 	} else {
 		return []model.RoutineOutput{
 			{
-				Pk:   r.pkA,
-				Msgs: []string{`{"peerStatus":"offline","forwarded":null,"terminate":"done"}`},
-				Done: true,
+				Pk:         r.pkA,
+				Msgs:       []string{`{"peerStatus":"offline","forwarded":null,"terminate":"done"}`},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
 			},
 		}
 	}
 
 }
 
+// every RTCSdpType. The schemas accept any of them so that a payload whose type doesn't match the message gets a clear error.
+const sdpTypes = `["offer", "pranswer", "answer", "rollback"]`
+
 var bAcceptOrRejectSchema = func() *gojsonschema.Schema {
 	errorSchemaString := `{
 		"$schema": "https://json-schema.org/draft/2020-12/schema",
 		"type": "object",
 		"properties": {
+			"rid": ` + requestIdSchema + `,
 			"forward": {
 				"oneOf": [
 					{
@@ -200,7 +535,7 @@ var bAcceptOrRejectSchema = func() *gojsonschema.Schema {
 							"payload": {
 								"properties": {
 									"type": {
-										"const": "offer"
+										"enum": ` + sdpTypes + `
 									},
 									"sdp": {
 										"type": "string"
@@ -217,6 +552,18 @@ var bAcceptOrRejectSchema = func() *gojsonschema.Schema {
 						"properties": {
 							"type": {
 								"const": "reject"
+							},
+							"reason": {
+								"enum": ["busy", "declined", "unavailable"]
+							}
+						},
+						"required": ["type"],
+						"additionalProperties": false
+					},
+					{
+						"properties": {
+							"type": {
+								"const": "accept"
 							}
 						},
 						"required": ["type"],
@@ -237,40 +584,78 @@ func (r *EstablishConnectionToPeer) bAcceptOrReject(args model.RoutineInput) []m
 
 	// check response is from B
 	if *args.Pk == *r.pkA {
-		return append(ectpError(r.pkA, "Message sent out or order"), ectpError(r.pkB, "Peer sent a malformed message")...)
+		return append(ectpError(r.pkA, ERROR_OUT_OF_ORDER, "Message sent out or order"), ectpError(r.pkB, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// cheap check before parsing
+	if len(args.Msg) > r.config.maxSdpLength {
+		return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "SDP payload too large"), ectpError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 
 	// validate msg
-	usrMsgLoader := gojsonschema.NewStringLoader(args.Msg)
-	result, err := bAcceptOrRejectSchema.Validate(usrMsgLoader)
+	result, err := validateJSON(bAcceptOrRejectSchema, args.Msg)
 	if err != nil {
-		return append(ectpError(nil, err.Error()), ectpError(r.pkA, "Peer sent a malformed message")...)
+		return append(ectpError(nil, ERROR_MALFORMED, err.Error()), ectpError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 	if !result.Valid() {
-		return append(ectpError(nil, formatJSONError(result)), ectpError(r.pkA, "Peer sent a malformed message")...)
+		return append(ectpError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result)), ectpError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 
 	usrMsg := struct {
 		Forward struct {
-			Type string `json:"type"`
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
 		} `json:"forward"`
 	}{}
 	json.Unmarshal([]byte(args.Msg), &usrMsg)
 
 	switch usrMsg.Forward.Type {
 	case "reject":
+		// the reason is optional, and left out of the message to A if B didn't give one
+		dataToA := struct {
+			PeerStatus string `json:"peerStatus"`
+			Forwarded  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason,omitempty"`
+			} `json:"forwarded"`
+			Terminate string `json:"terminate"`
+		}{
+			PeerStatus: "online",
+			Terminate:  "done",
+		}
+		dataToA.Forwarded.Type = "reject"
+		dataToA.Forwarded.Reason = usrMsg.Forward.Reason
+		msgToA, _ := json.Marshal(dataToA)
+
 		return []model.RoutineOutput{
 			{
-				Pk:   r.pkA,
-				Msgs: []string{`{"peerStatus":"online","forwarded":{"type":"reject"},"terminate":"done"}`},
-				Done: true,
+				Pk:         r.pkA,
+				Msgs:       []string{string(msgToA)},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
 			},
 			{
 				Pk: r.pkB,
 				Msgs: []string{`{
 					"terminate": "done"
 				}`},
-				Done: true,
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+			},
+		}
+
+	case "accept":
+		// B will send the offer in a separate message
+		r.setState(ectp_bSdpOffer)
+		return []model.RoutineOutput{
+			{
+				Pk:   r.pkA,
+				Msgs: []string{`{"peerStatus":"online","forwarded":{"type":"accept"}}`},
+			},
+			{
+				Pk:              r.pkB,
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpTimeoutDuration,
 			},
 		}
 
@@ -286,6 +671,12 @@ func (r *EstablishConnectionToPeer) bAcceptOrReject(args model.RoutineInput) []m
 			} `json:"forward"`
 		}{}
 		json.Unmarshal([]byte(args.Msg), &usrMsgWithPayload)
+		if len(usrMsgWithPayload.Forward.Payload.Sdp) > r.config.maxSdpLength {
+			return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "SDP payload too large"), ectpError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+		}
+		if usrMsgWithPayload.Forward.Payload.Type != "offer" {
+			return append(ectpError(nil, ERROR_MALFORMED, "Malformed offer"), ectpError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+		}
 
 		// create message to B
 		// marshal it instead of creating the json string directly so that the SDPs get sanitized
@@ -306,7 +697,7 @@ func (r *EstablishConnectionToPeer) bAcceptOrReject(args model.RoutineInput) []m
 
 		msgToA, _ := json.Marshal(dataToB)
 
-		r.state = ectp_aSdpAnswer
+		r.setState(ectp_aSdpAnswer)
 		return []model.RoutineOutput{
 			{
 				Pk:              r.pkA,
@@ -322,20 +713,21 @@ func (r *EstablishConnectionToPeer) bAcceptOrReject(args model.RoutineInput) []m
 
 }
 
-var aSdpAnswerSchema = func() *gojsonschema.Schema {
+var bSdpOfferSchema = func() *gojsonschema.Schema {
 	errorSchemaString := `{
 		"$schema": "https://json-schema.org/draft/2020-12/schema",
 		"type": "object",
 		"properties": {
+			"rid": ` + requestIdSchema + `,
 			"forward": {
 				"properties": {
 					"type": {
-						"const": "answer"
+						"const": "offer"
 					},
 					"payload": {
 						"properties": {
 							"type": {
-								"const": "answer"
+								"enum": ` + sdpTypes + `
 							},
 							"sdp": {
 								"type": "string"
@@ -357,21 +749,26 @@ var aSdpAnswerSchema = func() *gojsonschema.Schema {
 	return schema
 }()
 
-func (r *EstablishConnectionToPeer) aSdpAnswer(args model.RoutineInput) []model.RoutineOutput {
+// B has accepted without an offer and now sends it separately
+func (r *EstablishConnectionToPeer) bSdpOffer(args model.RoutineInput) []model.RoutineOutput {
 
-	// reject any message from B
-	if *args.Pk == *r.pkB {
-		return append(ectpError(r.pkB, "Message sent out or order"), ectpError(r.pkA, "Peer sent a malformed message")...)
+	// check message is from B
+	if *args.Pk == *r.pkA {
+		return append(ectpError(r.pkA, ERROR_OUT_OF_ORDER, "Message sent out or order"), ectpError(r.pkB, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// cheap check before parsing
+	if len(args.Msg) > r.config.maxSdpLength {
+		return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "SDP payload too large"), ectpError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 
 	// validate msg
-	usrMsgLoader := gojsonschema.NewStringLoader(args.Msg)
-	result, err := aSdpAnswerSchema.Validate(usrMsgLoader)
+	result, err := validateJSON(bSdpOfferSchema, args.Msg)
 	if err != nil {
-		return append(ectpError(nil, err.Error()), ectpError(r.pkB, "Peer sent a malformed message")...)
+		return append(ectpError(nil, ERROR_MALFORMED, err.Error()), ectpError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 	if !result.Valid() {
-		return append(ectpError(nil, formatJSONError(result)), ectpError(r.pkB, "Peer sent a malformed message")...)
+		return append(ectpError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result)), ectpError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 
 	// parse msg
@@ -385,9 +782,15 @@ func (r *EstablishConnectionToPeer) aSdpAnswer(args model.RoutineInput) []model.
 		} `json:"forward"`
 	}{}
 	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	if len(usrMsg.Forward.Payload.Sdp) > r.config.maxSdpLength {
+		return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "SDP payload too large"), ectpError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if usrMsg.Forward.Payload.Type != "offer" {
+		return append(ectpError(nil, ERROR_MALFORMED, "Malformed offer"), ectpError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
 
-	// remarshal it for B
-	dataToB := struct {
+	// remarshal it for A
+	dataToA := struct {
 		Forwarded struct {
 			Type    string `json:"type"`
 			Payload struct {
@@ -396,48 +799,43 @@ func (r *EstablishConnectionToPeer) aSdpAnswer(args model.RoutineInput) []model.
 			} `json:"payload"`
 		} `json:"forwarded"`
 	}{}
-	dataToB.Forwarded.Type = "answer"
-	dataToB.Forwarded.Payload.Type = "answer"
-	dataToB.Forwarded.Payload.Sdp = usrMsg.Forward.Payload.Sdp
-	msgToB, _ := json.Marshal(dataToB)
+	dataToA.Forwarded.Type = "offer"
+	dataToA.Forwarded.Payload.Type = "offer"
+	dataToA.Forwarded.Payload.Sdp = usrMsg.Forward.Payload.Sdp
+	msgToA, _ := json.Marshal(dataToA)
 
-	r.state = ectp_iceCandidates
+	r.setState(ectp_aSdpAnswer)
 	return []model.RoutineOutput{
 		{
-			Pk:              r.pkB,
-			Msgs:            []string{string(msgToB)},
+			Pk:              r.pkA,
+			Msgs:            []string{string(msgToA)},
 			TimeoutEnabled:  true,
 			TimeoutDuration: ectpTimeoutDuration,
 		},
 	}
 }
 
-var iceCandidatesSchema = func() *gojsonschema.Schema {
+var aSdpAnswerSchema = func() *gojsonschema.Schema {
 	errorSchemaString := `{
 		"$schema": "https://json-schema.org/draft/2020-12/schema",
 		"type": "object",
 		"properties": {
+			"rid": ` + requestIdSchema + `,
 			"forward": {
 				"properties": {
 					"type": {
-						"const": "ICECandidate"
+						"const": "answer"
 					},
 					"payload": {
 						"properties": {
-							"candidate": {
-								"type": "string"
-							},
-							"sdpMLineIndex": {
-								"type": "integer"
-							},
-							"sdpMid": {
-								"type": "string"
+							"type": {
+								"enum": ` + sdpTypes + `
 							},
-							"usernameFragment": {
+							"sdp": {
 								"type": "string"
 							}
 						},
-						"required": ["candidate","sdpMLineIndex"],
+						"required": ["type","sdp"],
 						"additionalProperties": false
 					}
 				},
@@ -453,36 +851,31 @@ var iceCandidatesSchema = func() *gojsonschema.Schema {
 	return schema
 }()
 
-func (r *EstablishConnectionToPeer) iceCandidates(args model.RoutineInput) []model.RoutineOutput {
+// A answers B's offer, or during a renegotiation the other peer answers the renegotiator's offer.
+func (r *EstablishConnectionToPeer) aSdpAnswer(args model.RoutineInput) []model.RoutineOutput {
 
-	// set to true if both clients have finished sending ICE candidates.
-	terminate := false
+	answerer, offerer := r.pkA, r.pkB
+	if r.state == ectp_renegotiationAnswer && *r.renegotiator == *r.pkA {
+		answerer, offerer = r.pkB, r.pkA
+	}
 
-	// check who is sending the ice candidate
-	// reject messages sent by a client who has already sent an empty ICE candidate (indicating that they had finished sending messages)
-	var toPk *model.PublicKey
-	if *args.Pk == *r.pkA {
-		toPk = r.pkB
-		if r.pkAHasSentEmptyICECandidate {
-			return append(ectpError(nil, "Another ICE candidate sent after final ICE candidate"), ectpError(toPk, "Peer sent a malformed message")...)
-		}
-	} else if *args.Pk == *r.pkB {
-		toPk = r.pkA
-		if r.pkBHasSentEmptyICECandidate {
-			return append(ectpError(nil, "Another ICE candidate sent after final ICE candidate"), ectpError(toPk, "Peer sent a malformed message")...)
-		}
-	} else {
-		panic("received ice candidate from unknown client")
+	// reject any message from the offerer
+	if *args.Pk == *offerer {
+		return append(ectpError(offerer, ERROR_OUT_OF_ORDER, "Message sent out or order"), ectpError(answerer, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// cheap check before parsing
+	if len(args.Msg) > r.config.maxSdpLength {
+		return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "SDP payload too large"), ectpError(offerer, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 
 	// validate msg
-	usrMsgLoader := gojsonschema.NewStringLoader(args.Msg)
-	result, err := iceCandidatesSchema.Validate(usrMsgLoader)
+	result, err := validateJSON(aSdpAnswerSchema, args.Msg)
 	if err != nil {
-		return append(ectpError(nil, err.Error()), ectpError(toPk, "Peer sent a malformed message")...)
+		return append(ectpError(nil, ERROR_MALFORMED, err.Error()), ectpError(offerer, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 	if !result.Valid() {
-		return append(ectpError(nil, formatJSONError(result)), ectpError(toPk, "Peer sent a malformed message")...)
+		return append(ectpError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result)), ectpError(offerer, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 
 	// parse msg
@@ -490,83 +883,908 @@ func (r *EstablishConnectionToPeer) iceCandidates(args model.RoutineInput) []mod
 		Forward struct {
 			Type    string `json:"type"`
 			Payload struct {
-				Candidate        string `json:"candidate"`
-				SdpMLineIndex    int    `json:"sdpMLineIndex"`
-				SdpMid           string `json:"sdpMid,omitempty"`
-				UsernameFragment string `json:"usernameFragment,omitempty"`
+				Type string `json:"type"`
+				Sdp  string `json:"sdp"`
 			} `json:"payload"`
 		} `json:"forward"`
 	}{}
 	json.Unmarshal([]byte(args.Msg), &usrMsg)
-
-	// check for end of ice candidates (empty candidate field)
-	if usrMsg.Forward.Payload.Candidate == "" {
-		switch *args.Pk {
-		case *r.pkA:
-			r.pkAHasSentEmptyICECandidate = true
-			if r.pkBHasSentEmptyICECandidate {
-				terminate = true
-			}
-		case *r.pkB:
-			r.pkBHasSentEmptyICECandidate = true
-			if r.pkAHasSentEmptyICECandidate {
-				terminate = true
-			}
-		}
+	if len(usrMsg.Forward.Payload.Sdp) > r.config.maxSdpLength {
+		return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "SDP payload too large"), ectpError(offerer, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if usrMsg.Forward.Payload.Type != "answer" {
+		return append(ectpError(nil, ERROR_MALFORMED, "Malformed answer"), ectpError(offerer, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 
-	// remarshal
-	forwardedData := struct {
+	// remarshal it for the offerer
+	dataToOfferer := struct {
 		Forwarded struct {
 			Type    string `json:"type"`
 			Payload struct {
-				Candidate        string `json:"candidate"`
-				SdpMLineIndex    int    `json:"sdpMLineIndex"`
-				SdpMid           string `json:"sdpMid,omitempty"`
-				UsernameFragment string `json:"usernameFragment,omitempty"`
+				Type string `json:"type"`
+				Sdp  string `json:"sdp"`
 			} `json:"payload"`
 		} `json:"forwarded"`
 	}{}
-	forwardedData.Forwarded.Type = usrMsg.Forward.Type
-	forwardedData.Forwarded.Payload.Candidate = usrMsg.Forward.Payload.Candidate
-	forwardedData.Forwarded.Payload.SdpMLineIndex = usrMsg.Forward.Payload.SdpMLineIndex
-	forwardedData.Forwarded.Payload.SdpMid = usrMsg.Forward.Payload.SdpMid
-	forwardedData.Forwarded.Payload.UsernameFragment = usrMsg.Forward.Payload.UsernameFragment
+	dataToOfferer.Forwarded.Type = "answer"
+	dataToOfferer.Forwarded.Payload.Type = "answer"
+	dataToOfferer.Forwarded.Payload.Sdp = usrMsg.Forward.Payload.Sdp
+	msgToOfferer, _ := json.Marshal(dataToOfferer)
 
-	forwardedStr, _ := json.Marshal(forwardedData)
+	if r.state == ectp_renegotiationAnswer {
+		// the new session may need new candidates, so both peers send their last candidate again
+		r.pkAHasSentEmptyICECandidate = false
+		r.pkBHasSentEmptyICECandidate = false
+	}
+	r.setState(ectp_iceCandidates)
+	return []model.RoutineOutput{
+		{
+			Pk:              offerer,
+			Msgs:            []string{string(msgToOfferer)},
+			TimeoutEnabled:  true,
+			TimeoutDuration: ectpTimeoutDuration,
+			// the offerer can't do anything without it
+			Critical: true,
+		},
+	}
+}
 
-	if terminate {
-		return []model.RoutineOutput{
-			{
-				Pk:   toPk,
-				Msgs: []string{string(forwardedStr), terminateDoneJSONMsg()},
-				Done: true,
-			},
-			{
-				Pk:   nil, // sender
-				Msgs: []string{terminateDoneJSONMsg()},
-				Done: true,
-			},
+// properties of a single ICE candidate (RTCIceCandidateInit)
+const iceCandidateProperties = `{
+	"candidate": {
+		"type": "string"
+	},
+	"sdpMLineIndex": {
+		"type": "integer"
+	},
+	"sdpMid": {
+		"type": "string"
+	},
+	"usernameFragment": {
+		"type": "string"
+	}
+}`
+
+var iceCandidatesSchema = func() *gojsonschema.Schema {
+	errorSchemaString := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"rid": ` + requestIdSchema + `,
+			"forward": {
+				"properties": {
+					"type": {
+						"const": "ICECandidate"
+					},
+					"payload": {
+						"properties": ` + iceCandidateProperties + `,
+						"required": ["candidate","sdpMLineIndex"],
+						"additionalProperties": false
+					}
+				},
+				"required": ["type","payload"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["forward"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(errorSchemaString)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// a bundle holds all of a peer's candidates, so there is no empty end-of-candidates marker in it.
+var iceCandidateBundleSchema = func() *gojsonschema.Schema {
+	errorSchemaString := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"rid": ` + requestIdSchema + `,
+			"forward": {
+				"properties": {
+					"type": {
+						"const": "ICECandidates"
+					},
+					"candidates": {
+						"type": "array",
+						"items": {
+							"properties": ` + iceCandidateProperties + `,
+							"required": ["candidate","sdpMLineIndex"],
+							"additionalProperties": false
+						}
+					}
+				},
+				"required": ["type","candidates"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["forward"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(errorSchemaString)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+type iceCandidate struct {
+	Candidate        string `json:"candidate"`
+	SdpMLineIndex    int    `json:"sdpMLineIndex"`
+	SdpMid           string `json:"sdpMid,omitempty"`
+	UsernameFragment string `json:"usernameFragment,omitempty"`
+}
+
+// bound the fields before forwarding them
+func (c iceCandidate) valid() bool {
+	return len(c.Candidate) <= maxIceCandidateLength &&
+		len(c.SdpMid) <= maxIceSdpMidLength &&
+		len(c.UsernameFragment) <= maxIceUfragLength &&
+		c.SdpMLineIndex >= 0
+}
+
+// true if the candidate's address, or the related address it was derived from, is in a private or link-local range.
+// the candidate string looks like "candidate:842163049 1 udp 1677729535 203.0.113.7 3478 typ srflx raddr 10.0.0.1 rport 50000".
+// hostnames (e.g. mDNS .local names) aren't IP addresses, so they don't count.
+func (c iceCandidate) hasPrivateAddress() bool {
+	fields := strings.Fields(c.Candidate)
+	addrs := []string{}
+	if len(fields) > 4 {
+		addrs = append(addrs, fields[4])
+	}
+	// after the port, the rest of the fields are name value pairs
+	for i := 6; i+1 < len(fields); i += 2 {
+		if fields[i] == "raddr" {
+			addrs = append(addrs, fields[i+1])
 		}
-	} else {
-		return []model.RoutineOutput{
-			{
-				Pk:              toPk,
-				Msgs:            []string{string(forwardedStr)},
-				TimeoutEnabled:  true,
-				TimeoutDuration: ectpTimeoutDuration,
-			},
+	}
+	for _, addrStr := range addrs {
+		addr, err := netip.ParseAddr(addrStr)
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+		if addr.IsPrivate() || addr.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the server's policy lets c be forwarded.
+func (r *EstablishConnectionToPeer) candidatePermitted(c iceCandidate) bool {
+	return !r.config.rejectPrivateCandidates || !c.hasPrivateAddress()
+}
+
+func (r *EstablishConnectionToPeer) iceCandidates(args model.RoutineInput) []model.RoutineOutput {
+
+	// check who is sending the ice candidate
+	var toPk *model.PublicKey
+	var finished bool
+	if *args.Pk == *r.pkA {
+		toPk = r.pkB
+		finished = r.pkAHasSentEmptyICECandidate
+	} else if *args.Pk == *r.pkB {
+		toPk = r.pkA
+		finished = r.pkBHasSentEmptyICECandidate
+	} else {
+		panic("received ice candidate from unknown client")
+	}
+
+	msgType := struct {
+		Forward struct {
+			Type string `json:"type"`
+		} `json:"forward"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &msgType)
+
+	// a client that has finished sending ICE candidates can confirm its connection before the other has finished
+	if r.confirmConnection && isConnectionEstablishedMsg(args.Msg) {
+		return r.connectionEstablished(args, toPk, finished)
+	}
+
+	// a client that has finished sending ICE candidates can still renegotiate, or restart ICE
+	if msgType.Forward.Type == "renegotiate" {
+		return r.renegotiate(args, toPk)
+	}
+	if msgType.Forward.Type == "restartICE" {
+		return r.restartIce(args, toPk)
+	}
+
+	// a client resending its final ICE candidate, e.g. over a flaky network, has nothing new to say
+	if finished && r.isRepeatedFinalIceCandidate(args.Msg) {
+		return []model.RoutineOutput{}
+	}
+
+	// reject messages sent by a client who has already sent an empty ICE candidate (indicating that they had finished sending messages)
+	if finished {
+		return append(ectpError(nil, ERROR_OUT_OF_ORDER, "Another ICE candidate sent after final ICE candidate"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// reject the other mode's message before validating against this mode's schema, so that the error says why
+	if r.iceMode == iceModeBundle && msgType.Forward.Type == "ICECandidate" {
+		return append(ectpError(nil, ERROR_MALFORMED, "ICE candidates must be sent as a bundle in bundle mode"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if r.iceMode == iceModeTrickle && msgType.Forward.Type == "ICECandidates" {
+		return append(ectpError(nil, ERROR_MALFORMED, "ICE candidate bundles are only accepted in bundle mode"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	if r.iceMode == iceModeBundle {
+		return r.iceCandidateBundle(args, toPk)
+	}
+	return r.iceCandidateTrickle(args, toPk)
+}
+
+// one ICE candidate, forwarded as soon as it is received.
+func (r *EstablishConnectionToPeer) iceCandidateTrickle(args model.RoutineInput, toPk *model.PublicKey) []model.RoutineOutput {
+
+	// validate msg
+	result, err := validateJSON(iceCandidatesSchema, args.Msg)
+	if err != nil {
+		return append(ectpError(nil, ERROR_MALFORMED, err.Error()), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if !result.Valid() {
+		return append(ectpError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result)), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Forward struct {
+			Type    string       `json:"type"`
+			Payload iceCandidate `json:"payload"`
+		} `json:"forward"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+
+	if !usrMsg.Forward.Payload.valid() {
+		return append(ectpError(nil, ERROR_MALFORMED, "Malformed ICE candidate"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if !r.candidatePermitted(usrMsg.Forward.Payload) {
+		return append(ectpError(nil, ERROR_NOT_PERMITTED, "Candidate not permitted"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a candidate that is not permitted")...)
+	}
+
+	// count ice candidates, and reject once a peer has sent too many.
+	// the final empty candidate does not count towards the limit.
+	if usrMsg.Forward.Payload.Candidate != "" {
+		if !r.countIceCandidates(args.Pk, 1) {
+			return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "You have sent too many ICE candidates"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer is sending too many ICE candidates")...)
+		}
+	}
+
+	// remarshal
+	forwardedData := struct {
+		Forwarded struct {
+			Type    string       `json:"type"`
+			Payload iceCandidate `json:"payload"`
+		} `json:"forwarded"`
+	}{}
+	forwardedData.Forwarded.Type = usrMsg.Forward.Type
+	forwardedData.Forwarded.Payload = usrMsg.Forward.Payload
+
+	forwardedStr, _ := json.Marshal(forwardedData)
+
+	// check for end of ice candidates (empty candidate field)
+	if usrMsg.Forward.Payload.Candidate == "" {
+		return r.finishIceCandidates(args.Pk, toPk, string(forwardedStr))
+	}
+
+	if r.config.iceBatchWindow > 0 {
+		batch := r.iceBatch(args.Pk)
+		*batch = append(*batch, usrMsg.Forward.Payload)
+		r.iceBatched = true
+		if len(*batch) > 1 {
+			// the window is already running
+			return []model.RoutineOutput{}
+		}
+		// the sender's timeout ends the window
+		return []model.RoutineOutput{
+			{
+				Pk:              nil, // sender
+				TimeoutEnabled:  true,
+				TimeoutDuration: r.config.iceBatchWindow,
+			},
+		}
+	}
+	return []model.RoutineOutput{
+		{
+			Pk:              toPk,
+			Msgs:            []string{string(forwardedStr)},
+			TimeoutEnabled:  true,
+			TimeoutDuration: ectpTimeoutDuration,
+		},
+	}
+}
+
+// all of a peer's ICE candidates at once. This is also that peer's last message.
+func (r *EstablishConnectionToPeer) iceCandidateBundle(args model.RoutineInput, toPk *model.PublicKey) []model.RoutineOutput {
+
+	// validate msg
+	result, err := validateJSON(iceCandidateBundleSchema, args.Msg)
+	if err != nil {
+		return append(ectpError(nil, ERROR_MALFORMED, err.Error()), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if !result.Valid() {
+		return append(ectpError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result)), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Forward struct {
+			Type       string         `json:"type"`
+			Candidates []iceCandidate `json:"candidates"`
+		} `json:"forward"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+
+	for _, candidate := range usrMsg.Forward.Candidates {
+		if candidate.Candidate == "" || !candidate.valid() {
+			return append(ectpError(nil, ERROR_MALFORMED, "Malformed ICE candidate"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+		}
+		if !r.candidatePermitted(candidate) {
+			return append(ectpError(nil, ERROR_NOT_PERMITTED, "Candidate not permitted"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a candidate that is not permitted")...)
+		}
+	}
+	if !r.countIceCandidates(args.Pk, len(usrMsg.Forward.Candidates)) {
+		return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "You have sent too many ICE candidates"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer is sending too many ICE candidates")...)
+	}
+
+	// remarshal
+	forwardedData := struct {
+		Forwarded struct {
+			Type       string         `json:"type"`
+			Candidates []iceCandidate `json:"candidates"`
+		} `json:"forwarded"`
+	}{}
+	forwardedData.Forwarded.Type = usrMsg.Forward.Type
+	forwardedData.Forwarded.Candidates = usrMsg.Forward.Candidates
+
+	forwardedStr, _ := json.Marshal(forwardedData)
+
+	return r.finishIceCandidates(args.Pk, toPk, string(forwardedStr))
+}
+
+var renegotiateSchema = func() *gojsonschema.Schema {
+	errorSchemaString := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"rid": ` + requestIdSchema + `,
+			"forward": {
+				"properties": {
+					"type": {
+						"const": "renegotiate"
+					},
+					"payload": {
+						"properties": {
+							"type": {
+								"enum": ` + sdpTypes + `
+							},
+							"sdp": {
+								"type": "string"
+							}
+						},
+						"required": ["type","sdp"],
+						"additionalProperties": false
+					}
+				},
+				"required": ["type","payload"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["forward"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(errorSchemaString)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// a peer sends a new offer during the ICE phase, e.g. to add video to an audio call.
+// it is forwarded to the other peer, who has to answer it before either of them can send more ICE candidates.
+func (r *EstablishConnectionToPeer) renegotiate(args model.RoutineInput, toPk *model.PublicKey) []model.RoutineOutput {
+
+	if r.renegotiations >= r.config.maxRenegotiations {
+		return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "You have renegotiated too many times"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer is renegotiating too many times")...)
+	}
+
+	// cheap check before parsing
+	if len(args.Msg) > r.config.maxSdpLength {
+		return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "SDP payload too large"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// validate msg
+	result, err := validateJSON(renegotiateSchema, args.Msg)
+	if err != nil {
+		return append(ectpError(nil, ERROR_MALFORMED, err.Error()), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if !result.Valid() {
+		return append(ectpError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result)), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Forward struct {
+			Type    string `json:"type"`
+			Payload struct {
+				Type string `json:"type"`
+				Sdp  string `json:"sdp"`
+			} `json:"payload"`
+		} `json:"forward"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	if len(usrMsg.Forward.Payload.Sdp) > r.config.maxSdpLength {
+		return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "SDP payload too large"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if usrMsg.Forward.Payload.Type != "offer" {
+		return append(ectpError(nil, ERROR_MALFORMED, "Malformed offer"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// remarshal it for the other peer
+	dataToPeer := struct {
+		Forwarded struct {
+			Type    string `json:"type"`
+			Payload struct {
+				Type string `json:"type"`
+				Sdp  string `json:"sdp"`
+			} `json:"payload"`
+		} `json:"forwarded"`
+	}{}
+	dataToPeer.Forwarded.Type = "renegotiate"
+	dataToPeer.Forwarded.Payload.Type = "offer"
+	dataToPeer.Forwarded.Payload.Sdp = usrMsg.Forward.Payload.Sdp
+	msgToPeer, _ := json.Marshal(dataToPeer)
+
+	r.renegotiations++
+	r.renegotiator = args.Pk
+	r.setState(ectp_renegotiationAnswer)
+	return []model.RoutineOutput{
+		{
+			Pk:              toPk,
+			Msgs:            []string{string(msgToPeer)},
+			TimeoutEnabled:  true,
+			TimeoutDuration: ectpTimeoutDuration,
+		},
+	}
+}
+
+var restartIceSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"rid": ` + requestIdSchema + `,
+			"forward": {
+				"properties": {
+					"type": {
+						"const": "restartICE"
+					}
+				},
+				"required": ["type"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["forward"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// a peer restarts ICE, e.g. because its connection has degraded. It gathers candidates with a new ufrag and pwd,
+// without renegotiating. The other peer is told to do the same, and both send a fresh round of candidates,
+// which count towards a fresh limit.
+func (r *EstablishConnectionToPeer) restartIce(args model.RoutineInput, toPk *model.PublicKey) []model.RoutineOutput {
+
+	if r.iceRestarts >= r.config.maxIceRestarts {
+		return append(ectpError(nil, ERROR_LIMIT_EXCEEDED, "You have restarted ICE too many times"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer is restarting ICE too many times")...)
+	}
+
+	// validate msg
+	result, err := validateJSON(restartIceSchema, args.Msg)
+	if err != nil {
+		return append(ectpError(nil, ERROR_MALFORMED, err.Error()), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if !result.Valid() {
+		return append(ectpError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result)), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	r.iceRestarts++
+	r.pkAHasSentEmptyICECandidate = false
+	r.pkBHasSentEmptyICECandidate = false
+	r.pkAIceCount = 0
+	r.pkBIceCount = 0
+
+	ros := []model.RoutineOutput{
+		{
+			Pk:              toPk,
+			Msgs:            []string{`{"forwarded":{"type":"restartICE"}}`},
+			TimeoutEnabled:  true,
+			TimeoutDuration: ectpTimeoutDuration,
+		},
+	}
+	// batched candidates are for the old session, so they are dropped rather than forwarded.
+	// the peer's window ends with the timeout above, but the sender's would still end with its own.
+	if len(*r.iceBatch(args.Pk)) > 0 {
+		ros = append(ros, model.RoutineOutput{
+			Pk:              nil, // sender
+			TimeoutEnabled:  true,
+			TimeoutDuration: ectpTimeoutDuration,
+		})
+	}
+	r.pkAIceBatch = nil
+	r.pkBIceBatch = nil
+	return ros
+}
+
+var typingSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"rid": ` + requestIdSchema + `,
+			"typing": {
+				"type": "boolean"
+			}
+		},
+		"required": ["typing"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// ok is false if msg isn't a {"typing":true|false} message.
+func parseTypingMsg(msg string) (typing bool, ok bool) {
+	result, err := validateJSON(typingSchema, msg)
+	if err != nil || !result.Valid() {
+		return false, false
+	}
+	typingMsg := struct {
+		Typing bool `json:"typing"`
+	}{}
+	json.Unmarshal([]byte(msg), &typingMsg)
+	return typingMsg.Typing, true
+}
+
+// a peer is (or has stopped) typing. Relayed to the other peer as {"peerTyping":true|false},
+// without changing the state or anyone's timeout.
+// ignored until B has accepted, and once the sender has used up its allowance for the current window.
+func (r *EstablishConnectionToPeer) typing(args model.RoutineInput, typing bool) []model.RoutineOutput {
+	if r.state == ectp_bAcceptOrReject {
+		return []model.RoutineOutput{}
+	}
+
+	toPk := r.pkB
+	limiter := &r.pkATyping
+	if *args.Pk == *r.pkB {
+		toPk = r.pkA
+		limiter = &r.pkBTyping
+	}
+
+	now := r.config.clock.Now()
+	if now.Sub(limiter.windowStart) >= r.config.typingWindow {
+		limiter.windowStart = now
+		limiter.count = 0
+	}
+	if limiter.count >= r.config.maxTypingIndicators {
+		return []model.RoutineOutput{}
+	}
+	limiter.count++
+
+	peerTyping, _ := json.Marshal(struct {
+		PeerTyping bool `json:"peerTyping"`
+	}{typing})
+	return []model.RoutineOutput{
+		{
+			Pk:          toPk,
+			Msgs:        []string{string(peerTyping)},
+			KeepTimeout: true,
+		},
+	}
+}
+
+// whether msg is a valid empty (final) ICE candidate. Only a trickled candidate can be final.
+// Only called for a client that has sent its final candidate, so that it can send it again.
+func (r *EstablishConnectionToPeer) isRepeatedFinalIceCandidate(msg string) bool {
+	if r.iceMode != iceModeTrickle {
+		return false
+	}
+	result, err := validateJSON(iceCandidatesSchema, msg)
+	if err != nil || !result.Valid() {
+		return false
+	}
+	usrMsg := struct {
+		Forward struct {
+			Payload iceCandidate `json:"payload"`
+		} `json:"forward"`
+	}{}
+	json.Unmarshal([]byte(msg), &usrMsg)
+	return usrMsg.Forward.Payload.Candidate == "" && usrMsg.Forward.Payload.valid()
+}
+
+// adds n to the number of candidates pk has sent. Returns false if that is over the limit.
+func (r *EstablishConnectionToPeer) countIceCandidates(pk *model.PublicKey, n int) bool {
+	iceCount := &r.pkAIceCount
+	if *pk == *r.pkB {
+		iceCount = &r.pkBIceCount
+	}
+	*iceCount += n
+	return *iceCount <= r.config.maxIceCandidates
+}
+
+// forwards the last ICE candidate message from fromPk, and terminates both transactions if the other peer has finished as well.
+func (r *EstablishConnectionToPeer) finishIceCandidates(fromPk *model.PublicKey, toPk *model.PublicKey, forwardedStr string) []model.RoutineOutput {
+
+	// set to true if both clients have finished sending ICE candidates.
+	terminate := false
+	switch *fromPk {
+	case *r.pkA:
+		r.pkAHasSentEmptyICECandidate = true
+		terminate = r.pkBHasSentEmptyICECandidate
+	case *r.pkB:
+		r.pkBHasSentEmptyICECandidate = true
+		terminate = r.pkAHasSentEmptyICECandidate
+	}
+
+	// any candidates still waiting in the sender's batch come before its last one
+	msgs := []string{forwardedStr}
+	if batchMsg, ok := r.takeIceBatch(fromPk); ok {
+		msgs = []string{batchMsg, forwardedStr}
+	}
+
+	if terminate {
+		r.hub.Metrics().IncCounter(model.METRIC_CONNECTION_HANDSHAKES)
+		if r.confirmConnection {
+			r.setState(ectp_connectionConfirmation)
+		} else {
+			// the ICE phase is over too
+			r.observeStateDuration()
+		}
+		r.hub.Metrics().ObserveDuration(model.METRIC_CONNECTION_HANDSHAKE_SECONDS, model.MetricLabels{Routine: "sendConnectionRequest"}, r.config.clock.Now().Sub(r.startedAt))
+	}
+
+	// the sender can't have confirmed its connection yet, so the transaction waits for it to
+	if terminate && !r.confirmConnection {
+		return []model.RoutineOutput{
+			{
+				Pk:         toPk,
+				Msgs:       append(msgs, terminateDoneJSONMsg()),
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Critical:   true,
+			},
+			{
+				Pk:         nil, // sender
+				Msgs:       []string{terminateDoneJSONMsg()},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Critical:   true,
+			},
+		}
+	}
+	return []model.RoutineOutput{
+		{
+			Pk:              toPk,
+			Msgs:            msgs,
+			TimeoutEnabled:  true,
+			TimeoutDuration: ectpTimeoutDuration,
+		},
+	}
+}
+
+var connectionEstablishedSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"rid": ` + requestIdSchema + `,
+			"connectionEstablished": {
+				"const": true
+			}
+		},
+		"required": ["connectionEstablished"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// whether msg is a {"connectionEstablished":true} message.
+func isConnectionEstablishedMsg(msg string) bool {
+	result, err := validateJSON(connectionEstablishedSchema, msg)
+	return err == nil && result.Valid()
+}
+
+// both peers have finished sending ICE candidates, and the only thing left is for them to confirm their connection.
+func (r *EstablishConnectionToPeer) connectionConfirmation(args model.RoutineInput) []model.RoutineOutput {
+	toPk := r.pkB
+	if *args.Pk == *r.pkB {
+		toPk = r.pkA
+	}
+	// both have finished sending ICE candidates, so this can only be a resend
+	if r.isRepeatedFinalIceCandidate(args.Msg) {
+		return []model.RoutineOutput{}
+	}
+	if !isConnectionEstablishedMsg(args.Msg) {
+		return append(ectpError(nil, ERROR_OUT_OF_ORDER, "Expected connection confirmation"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	return r.connectionEstablished(args, toPk, true)
+}
+
+// a peer confirms that its connection to the other opened. Relayed to the other peer as {"peerConnectionEstablished":true}.
+// both transactions are terminated once both peers have confirmed.
+// finished is whether the sender has sent all its ICE candidates, as it can't be connected before then.
+func (r *EstablishConnectionToPeer) connectionEstablished(args model.RoutineInput, toPk *model.PublicKey, finished bool) []model.RoutineOutput {
+	if !finished {
+		return append(ectpError(nil, ERROR_OUT_OF_ORDER, "Connection confirmed before final ICE candidate"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	confirmed := &r.pkAConfirmed
+	if *args.Pk == *r.pkB {
+		confirmed = &r.pkBConfirmed
+	}
+	if *confirmed {
+		return append(ectpError(nil, ERROR_OUT_OF_ORDER, "Connection already confirmed"), ectpError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	*confirmed = true
+
+	relay := `{"peerConnectionEstablished":true}`
+	if r.pkAConfirmed && r.pkBConfirmed {
+		r.hub.Metrics().IncCounter(model.METRIC_CONNECTIONS_ESTABLISHED)
+		r.observeStateDuration()
+		return []model.RoutineOutput{
+			{
+				Pk:         toPk,
+				Msgs:       []string{relay, terminateDoneJSONMsg()},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Critical:   true,
+			},
+			{
+				Pk:         nil, // sender
+				Msgs:       []string{terminateDoneJSONMsg()},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Critical:   true,
+			},
+		}
+	}
+	return []model.RoutineOutput{
+		{
+			Pk:              toPk,
+			Msgs:            []string{relay},
+			TimeoutEnabled:  true,
+			TimeoutDuration: ectpTimeoutDuration,
+		},
+	}
+}
+
+// the candidates pk has sent in its current batch window.
+func (r *EstablishConnectionToPeer) iceBatch(pk *model.PublicKey) *[]iceCandidate {
+	if *pk == *r.pkB {
+		return &r.pkBIceBatch
+	}
+	return &r.pkAIceBatch
+}
+
+// empties pk's batch, returning the message that forwards it. ok is false if the batch was empty.
+// a batch of one is forwarded like any other candidate.
+func (r *EstablishConnectionToPeer) takeIceBatch(pk *model.PublicKey) (msg string, ok bool) {
+	batch := r.iceBatch(pk)
+	candidates := *batch
+	*batch = nil
+
+	var forwarded []byte
+	switch len(candidates) {
+	case 0:
+		return "", false
+	case 1:
+		forwardedData := struct {
+			Forwarded struct {
+				Type    string       `json:"type"`
+				Payload iceCandidate `json:"payload"`
+			} `json:"forwarded"`
+		}{}
+		forwardedData.Forwarded.Type = "ICECandidate"
+		forwardedData.Forwarded.Payload = candidates[0]
+		forwarded, _ = json.Marshal(forwardedData)
+	default:
+		forwardedData := struct {
+			Forwarded struct {
+				Type    string         `json:"type"`
+				Payload []iceCandidate `json:"payload"`
+			} `json:"forwarded"`
+		}{}
+		forwardedData.Forwarded.Type = "ICECandidateBatch"
+		forwardedData.Forwarded.Payload = candidates
+		forwarded, _ = json.Marshal(forwardedData)
+	}
+	return string(forwarded), true
+}
+
+// forwards the batched candidates that can't wait any longer along with ros, the reply to a message from sender:
+// the sender's, unless the message was another candidate for its batch, and the peer's if ros restarts its timeout,
+// which would otherwise have ended the peer's window.
+// ros that end the transaction are returned as they are.
+func (r *EstablishConnectionToPeer) flushIceBatches(sender *model.PublicKey, ros []model.RoutineOutput) []model.RoutineOutput {
+	if r.config.iceBatchWindow == 0 || r.pkB == nil {
+		return ros
+	}
+	for _, ro := range ros {
+		if ro.Done {
+			return ros
+		}
+	}
+
+	peer := r.pkA
+	if *sender == *r.pkA {
+		peer = r.pkB
+	}
+	flushSender := !r.iceBatched
+	flushPeer := outputIndex(ros, sender, peer) != -1
+
+	if flushSender {
+		if msg, ok := r.takeIceBatch(sender); ok {
+			ros = r.sendIceBatch(ros, sender, peer, msg)
+		}
+	}
+	if flushPeer {
+		if msg, ok := r.takeIceBatch(peer); ok {
+			ros = r.sendIceBatch(ros, sender, sender, msg)
+		}
+	}
+	return ros
+}
+
+// sends msg to pk before anything else ros sends it.
+func (r *EstablishConnectionToPeer) sendIceBatch(ros []model.RoutineOutput, sender *model.PublicKey, pk *model.PublicKey, msg string) []model.RoutineOutput {
+	if i := outputIndex(ros, sender, pk); i != -1 {
+		ros[i].Msgs = append([]string{msg}, ros[i].Msgs...)
+		return ros
+	}
+
+	ro := model.RoutineOutput{
+		Pk:   pk,
+		Msgs: []string{msg},
+	}
+	if *pk == *sender {
+		ro.Pk = nil
+	}
+	if len(*r.iceBatch(pk)) > 0 {
+		// pk's own window is still running
+		ro.KeepTimeout = true
+	} else {
+		ro.TimeoutEnabled = true
+		ro.TimeoutDuration = ectpTimeoutDuration
+	}
+	return append(ros, ro)
+}
+
+// index of the output in ros (the reply to a message from sender) that goes to pk, or -1 if there isn't one.
+func outputIndex(ros []model.RoutineOutput, sender *model.PublicKey, pk *model.PublicKey) int {
+	for i, ro := range ros {
+		to := ro.Pk
+		if to == nil {
+			to = sender
+		}
+		if *to == *pk {
+			return i
 		}
 	}
+	return -1
 }
 
 // wrapper for error routine output
-func ectpError(pk *model.PublicKey, msgs ...string) []model.RoutineOutput {
+func ectpError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
 	return []model.RoutineOutput{
 		{
-			Pk:   pk,
-			Done: true,
-			Msgs: []string{MakeJSONError(msgs...)},
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
+			Critical:   true,
 		},
 	}
 }
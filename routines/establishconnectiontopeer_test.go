@@ -2,7 +2,10 @@ package routines
 
 import (
 	"harmony/backend/model"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -45,6 +48,50 @@ func TestEstablishConnectionToPeer(t *testing.T) {
 			testRunner(t, ectp, test)
 		})
 
+		t.Run("friend rejects with a reason", func(t *testing.T) {
+			for _, reason := range []string{"busy", "declined", "unavailable"} {
+				t.Run(reason, func(t *testing.T) {
+					test := []Step{
+						ectpStepInitiateOnline,
+						ectpStepRejectWithReason(reason),
+					}
+
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
+
+					testRunner(t, ectp, test)
+				})
+			}
+		})
+
+		t.Run("B cancels with a reason", func(t *testing.T) {
+			for _, tt := range cancelWithReasonCases {
+				t.Run(tt.cancelMsg, func(t *testing.T) {
+					test := []Step{
+						ectpStepInitiateOnline,
+						stepPkBCancelWithReason(tt.cancelMsg, tt.expectedReason),
+					}
+
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
+
+					testRunner(t, ectp, test)
+				})
+			}
+		})
+
 		t.Run("clients connect", func(t *testing.T) {
 
 			tests := [][]Step{
@@ -67,6 +114,15 @@ func TestEstablishConnectionToPeer(t *testing.T) {
 					ectpStepIceAToB,   // ice candidate sent after the other client has finished
 					ectpStepFinalIceATerminate,
 				},
+				{
+					ectpStepInitiateOnline,
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					ectpStepFinalIceA,
+					ectpStepRepeatedFinalIceA, // resent, e.g. over a flaky network
+					ectpStepIceBtoA,
+					ectpStepFinalIceBTerminate,
+				},
 			}
 
 			for i, test := range tests {
@@ -76,356 +132,2612 @@ func TestEstablishConnectionToPeer(t *testing.T) {
 					clientB := &model.Client{}
 					clientB.SetPublicKey(&publicKey1)
 					hub := model.NewHub()
+					metrics := model.NewCounters()
+					hub.SetMetrics(metrics)
 					hub.AddClient(publicKey0, clientA)
 					hub.AddClient(publicKey1, clientB)
 					ectp := newEstablishConnectionToPeer(clientA, hub)
 
 					testRunner(t, ectp, test)
+
+					if count := metrics.Get(model.METRIC_CONNECTION_HANDSHAKES); count != 1 {
+						t.Errorf("Expected the handshake to be counted once. Got %d", count)
+					}
+					if count := metrics.GetHistogram(model.METRIC_CONNECTION_HANDSHAKE_SECONDS, model.MetricLabels{Routine: "sendConnectionRequest"}).Count; count != 1 {
+						t.Errorf("Expected the handshake to be timed once. Got %d", count)
+					}
+					for _, state := range []ECTPState{ectp_entry, ectp_bAcceptOrReject, ectp_aSdpAnswer, ectp_iceCandidates} {
+						labels := model.MetricLabels{Routine: "sendConnectionRequest", State: state.metricLabel()}
+						if count := metrics.GetHistogram(model.METRIC_CONNECTION_STATE_SECONDS, labels).Count; count != 1 {
+							t.Errorf("Expected the time in state %s to be recorded once. Got %d", labels.State, count)
+						}
+					}
 				})
 
 			}
 
 		})
-	})
+		t.Run("clients connect after accepting without an offer", func(t *testing.T) {
+			test := []Step{
+				ectpStepInitiateOnline,
+				ectpStepAccept,
+				ectpStepOffer,
+				ectpStepAnswer,
+				ectpStepIceAToB,
+				ectpStepIceBtoA,
+				ectpStepFinalIceA,
+				ectpStepFinalIceBTerminate,
+			}
 
-	t.Run("Invalid inputs", func(t *testing.T) {
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeer(clientA, hub)
 
-		t.Run("User has not provided their public key", func(t *testing.T) {
+			testRunner(t, ectp, test)
+		})
 
-			test := []Step{
+		t.Run("clients connect in bundle mode", func(t *testing.T) {
+			tests := [][]Step{
 				{
-					description: "A sends a request without having provided their public key",
-					input: model.RoutineInput{
-						MsgType: model.RoutineMsgType_UsrMsg,
-						Pk:      nil,
-						Msg: `{
-							"initiate": "sendConnectionRequest",
-							"key": "` + (string)(publicKey1) + `"
-						}`,
-					},
-					outputs: []ExpectedOutput{
-						{
-							ro: model.RoutineOutput{
-								Pk:   nil,
-								Msgs: []string{errorSchemaString("You have not provided a public key")},
-								Done: true,
-							},
-						},
-					},
+					ectpStepInitiateOnlineBundle,
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					ectpStepBundleAToB,
+					ectpStepBundleBToATerminate,
+				},
+				{
+					ectpStepInitiateOnlineBundle,
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					ectpStepEmptyBundleBToA, // a peer may have no candidates at all
+					ectpStepBundleAToBTerminate,
 				},
 			}
 
-			client := &model.Client{}
-			hub := model.NewHub()
-			ectp := newEstablishConnectionToPeer(client, hub)
+			for i, test := range tests {
+				t.Run(strconv.Itoa(i), func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					metrics := model.NewCounters()
+					hub.SetMetrics(metrics)
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
 
-			testRunner(t, ectp, test)
+					testRunner(t, ectp, test)
+
+					if count := metrics.Get(model.METRIC_CONNECTION_HANDSHAKES); count != 1 {
+						t.Errorf("Expected the handshake to be counted once. Got %d", count)
+					}
+				})
+			}
 		})
 
-		t.Run("User tries to connect to themself", func(t *testing.T) {
+		t.Run("clients connect in explicit trickle mode", func(t *testing.T) {
+			initiate := ectpStepInitiateOnline
+			initiate.input.Msg = `{"initiate":"sendConnectionRequest","key":"` + (string)(publicKey1) + `","iceMode":"trickle"}`
 			test := []Step{
-				{
-					description: "A sends a connection request to A",
-					input: model.RoutineInput{
-						MsgType: model.RoutineMsgType_UsrMsg,
-						Pk:      &publicKey0,
-						Msg: `{
-							"initiate": "sendConnectionRequest",
-							"key": "` + (string)(publicKey0) + `"
-						}`,
-					},
-					outputs: []ExpectedOutput{
-						{
-							ro: model.RoutineOutput{
-								Pk:   &publicKey0,
-								Msgs: []string{errorSchemaString("Connecting to yourself is not allowed")},
-								Done: true,
-							},
-						},
-					},
-				},
+				initiate,
+				ectpStepAcceptAndOffer,
+				ectpStepAnswer,
+				ectpStepIceAToB,
+				ectpStepFinalIceA,
+				ectpStepFinalIceBTerminate,
 			}
 
-			client := &model.Client{}
-			client.SetPublicKey(&publicKey0)
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
 			hub := model.NewHub()
-			hub.AddClient(publicKey0, client)
-			ectp := newEstablishConnectionToPeer(client, hub)
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeer(clientA, hub)
 
 			testRunner(t, ectp, test)
 		})
 
-		t.Run("Friend is offline", func(t *testing.T) {
+		t.Run("display name is forwarded to B", func(t *testing.T) {
+			withName := ectpStepInitiateOnline
+			withName.input.Msg = `{"initiate":"sendConnectionRequest","key":"` + (string)(publicKey1) + `","displayName":"Alice \"A\" <script>"}`
+			withName.outputs = slices.Clone(withName.outputs)
+			withName.outputs[0].ro.Msgs = []string{ectpSchemaInitiateToBWithName(`Alice \"A\" <script>`)}
+
+			tests := map[string]Step{
+				"with a display name":    withName,
+				"without a display name": ectpStepInitiateOnline,
+			}
+
+			for name, initiate := range tests {
+				t.Run(name, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
+
+					testRunner(t, ectp, []Step{
+						initiate,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepFinalIceA,
+						ectpStepFinalIceBTerminate,
+					})
+				})
+			}
+		})
+
+		t.Run("clients confirm the connection", func(t *testing.T) {
 			tests := [][]Step{
 				{
-					{
-						description: "No key",
-						input: model.RoutineInput{
-							MsgType: model.RoutineMsgType_UsrMsg,
-							Pk:      &publicKey0,
-							Msg:     `{"initiate": "sendConnectionRequest"}`,
-						},
-						outputs: outputPkAError,
-					},
+					ectpStepInitiateOnlineConfirm,
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					ectpStepIceAToB,
+					ectpStepFinalIceA,
+					ectpStepFinalIceB, // doesn't terminate, as neither has confirmed
+					ectpStepConfirmA,
+					ectpStepConfirmBTerminate,
 				},
 				{
-					{
-						description: "Key in wrong format",
-						input: model.RoutineInput{
-							MsgType: model.RoutineMsgType_UsrMsg,
-							Pk:      &publicKey0,
-							Msg:     `{"initiate": "sendConnectionRequest", "key":"4"}`,
-						},
-						outputs: outputPkAError,
-					},
+					ectpStepInitiateOnlineConfirm,
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					ectpStepFinalIceA,
+					ectpStepConfirmA, // before B has finished
+					ectpStepIceBtoA,
+					ectpStepFinalIceB,
+					ectpStepConfirmBTerminate,
 				},
 				{
-					{
-						description: "Invalid JSON",
-						input: model.RoutineInput{
-							MsgType: model.RoutineMsgType_UsrMsg,
-							Pk:      &publicKey0,
-							Msg:     `)`,
-						},
-						outputs: outputPkAError,
-					},
+					ectpStepInitiateOnlineConfirm,
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					ectpStepFinalIceB,
+					ectpStepFinalIceA,
+					ectpStepConfirmB,
+					ectpStepWithRid(ectpStepConfirmATerminate, "1"),
 				},
 				{
-					{
-						description: "Extra properties",
-						input: model.RoutineInput{
-							MsgType: model.RoutineMsgType_UsrMsg,
-							Pk:      &publicKey0,
-							Msg:     `{"initiate": "sendConnectionRequest", "key":"` + (string)(publicKey1) + `", "extraProperty!":{}}`,
-						},
-						outputs: outputPkAError,
-					},
+					ectpStepInitiateOnlineConfirm,
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					ectpStepFinalIceA,
+					ectpStepFinalIceB,
+					ectpStepRepeatedFinalIceA, // resent once both have finished
+					ectpStepConfirmA,
+					ectpStepConfirmBTerminate,
 				},
 			}
 
 			for i, test := range tests {
 				t.Run(strconv.Itoa(i), func(t *testing.T) {
-					client := &model.Client{}
-					client.SetPublicKey(&publicKey0)
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
 					hub := model.NewHub()
-					ectp := newEstablishConnectionToPeer(client, hub)
+					metrics := model.NewCounters()
+					hub.SetMetrics(metrics)
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
 
 					testRunner(t, ectp, test)
+
+					// the handshake is still counted when signalling finishes
+					if count := metrics.Get(model.METRIC_CONNECTION_HANDSHAKES); count != 1 {
+						t.Errorf("Expected the handshake to be counted once. Got %d", count)
+					}
+					if count := metrics.Get(model.METRIC_CONNECTIONS_ESTABLISHED); count != 1 {
+						t.Errorf("Expected the connection to be counted once. Got %d", count)
+					}
+					labels := model.MetricLabels{Routine: "sendConnectionRequest", State: ectp_connectionConfirmation.metricLabel()}
+					if count := metrics.GetHistogram(model.METRIC_CONNECTION_STATE_SECONDS, labels).Count; count != 1 {
+						t.Errorf("Expected the time spent confirming to be recorded once. Got %d", count)
+					}
 				})
 			}
 		})
-		t.Run("Friend is online", func(t *testing.T) {
 
-			tests := []struct {
-				description  string
-				prefaceSteps []Step
-				cases        []Step
-			}{
+		t.Run("unconfirmed connections aren't counted as established", func(t *testing.T) {
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			metrics := model.NewCounters()
+			hub.SetMetrics(metrics)
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeer(clientA, hub)
+
+			testRunner(t, ectp, []Step{
+				ectpStepInitiateOnlineConfirm,
+				ectpStepAcceptAndOffer,
+				ectpStepAnswer,
+				ectpStepFinalIceA,
+				ectpStepFinalIceB,
+				ectpStepConfirmA,
+				stepPkBTimeout,
+			})
+
+			if count := metrics.Get(model.METRIC_CONNECTIONS_ESTABLISHED); count != 0 {
+				t.Errorf("Expected no connections to be counted. Got %d", count)
+			}
+		})
+
+		t.Run("clients renegotiate during ICE", func(t *testing.T) {
+
+			tests := [][]Step{
 				{
-					description: "A initiates; server has send msg to B",
-					prefaceSteps: []Step{
-						ectpStepInitiateOnline,
-					},
-					cases: []Step{
-						stepPkADisconnect,
-						stepPkBDisconnect,
-						stepPkBTimeout,
-						stepPkACancel,
-						stepPkBCancel,
-						{
-							description: "B sends bad input",
-							input: model.RoutineInput{
-								MsgType: model.RoutineMsgType_UsrMsg,
-								Pk:      &publicKey1,
-								Msg:     "lol",
+					ectpStepInitiateOnline,
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					ectpStepIceAToB,
+					ectpStepRenegotiateB,
+					ectpStepRenegotiationAnswerA,
+					ectpStepIceBtoA,
+					ectpStepFinalIceA,
+					ectpStepFinalIceBTerminate,
+				},
+				{
+					ectpStepInitiateOnline,
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					ectpStepFinalIceA,
+					ectpStepRenegotiateB,
+					ectpStepRenegotiationAnswerA,
+					ectpStepIceAToB, // A has to finish sending ICE candidates again
+					ectpStepFinalIceA,
+					ectpStepFinalIceBTerminate,
+				},
+			}
+
+			for i, test := range tests {
+				t.Run(strconv.Itoa(i), func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
+
+					testRunner(t, ectp, test)
+				})
+			}
+		})
+
+		t.Run("Peers restart ICE mid-exchange", func(t *testing.T) {
+
+			// a fresh round of candidates can't be sent unless the counters are reset
+			config := defaultECTPConfig()
+			config.maxIceCandidates = 1
+
+			test := []Step{
+				ectpStepInitiateOnline,
+				ectpStepAcceptAndOffer,
+				ectpStepAnswer,
+				ectpStepIceAToB,
+				ectpStepFinalIceB,
+				ectpStepRestartIceA,
+				ectpStepIceAToB,
+				ectpStepIceBtoA, // B has to finish sending ICE candidates again
+				ectpStepFinalIceA,
+				ectpStepFinalIceBTerminate,
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeerDependencyInj(clientA, hub, config)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("Restarting ICE drops batched candidates", func(t *testing.T) {
+
+			config := defaultECTPConfig()
+			config.iceBatchWindow = 100 * time.Millisecond
+
+			test := []Step{
+				ectpStepInitiateOnline,
+				ectpStepAcceptAndOffer,
+				ectpStepAnswer,
+				{
+					description: "A sends an ICE candidate, server holds it and starts A's batch window",
+					input:       ectpStepIceAToB.input,
+					outputs: []ExpectedOutput{
+						{
+							verifyTimeouts: true,
+							ro: model.RoutineOutput{
+								Pk:              &publicKey0,
+								TimeoutEnabled:  true,
+								TimeoutDuration: config.iceBatchWindow,
 							},
-							outputs: outputPkBErrorToBoth,
 						},
-						{
-							description: "A sends a message out of order",
-							input:       ectpStepAnswer.input,
-							outputs:     outputPkAErrorToBoth,
+					},
+				},
+				{
+					description: "A restarts ICE, server tells B and ends A's window without forwarding the batch",
+					input:       ectpStepRestartIceA.input,
+					outputs: append(ectpStepRestartIceA.outputs, ExpectedOutput{
+						verifyTimeouts: true,
+						ro: model.RoutineOutput{
+							Pk:              &publicKey0,
+							TimeoutEnabled:  true,
+							TimeoutDuration: ectpExpectedTimeoutDuration,
+						},
+					}),
+				},
+				// with no batch left, A's next timeout ends the transaction
+				stepPkATimeout,
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeerDependencyInj(clientA, hub, config)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("ICE candidates are batched", func(t *testing.T) {
+
+			const window = 100 * time.Millisecond
+
+			startBatchA := Step{
+				description: "A sends an ICE candidate, server holds it and starts A's batch window",
+				input:       ectpStepIceAToB.input,
+				outputs: []ExpectedOutput{
+					{
+						verifyTimeouts: true,
+						ro: model.RoutineOutput{
+							Pk:              &publicKey0,
+							TimeoutEnabled:  true,
+							TimeoutDuration: window,
 						},
 					},
 				},
+			}
+			addToBatchA := Step{
+				description: "A sends another ICE candidate within the window, server holds it",
+				input:       ectpStepIceBtoA.input,
+			}
+			addToBatchA.input.Pk = &publicKey0
+
+			tests := []struct {
+				description string
+				steps       []Step
+			}{
 				{
-					description: "B has sent sdp offer to A",
-					prefaceSteps: []Step{
+					description: "Batch is forwarded when the window ends",
+					steps: []Step{
 						ectpStepInitiateOnline,
 						ectpStepAcceptAndOffer,
-					},
-					cases: []Step{
-						stepPkADisconnect,
-						stepPkBDisconnect,
-						stepPkATimeout,
-						stepPkACancel,
-						stepPkBCancel,
+						ectpStepAnswer,
+						startBatchA,
+						addToBatchA,
+						addToBatchA,
 						{
-							description: "A sends bad input",
+							description: "A's window ends, server forwards the batch to B",
 							input: model.RoutineInput{
-								MsgType: model.RoutineMsgType_UsrMsg,
+								MsgType: model.RoutineMsgType_Timeout,
 								Pk:      &publicKey0,
-								Msg:     "xd",
 							},
-							outputs: outputPkAErrorToBoth,
-						},
-						{
-							description: "B sends a message out of order",
-							input:       ectpStepIceBtoA.input,
-							outputs:     outputPkBErrorToBoth,
+							outputs: []ExpectedOutput{
+								{
+									verifyTimeouts: true,
+									ro: model.RoutineOutput{
+										Pk:              &publicKey0,
+										TimeoutEnabled:  true,
+										TimeoutDuration: ectpExpectedTimeoutDuration,
+									},
+								},
+								{
+									verifyTimeouts: true,
+									ro: model.RoutineOutput{
+										Pk:              &publicKey1,
+										Msgs:            []string{ectpSchemaIceCandidateBatch(ICECandidate0, ICECandidate1, ICECandidate1)},
+										TimeoutEnabled:  true,
+										TimeoutDuration: ectpExpectedTimeoutDuration,
+									},
+								},
+							},
 						},
+						ectpStepFinalIceA,
+						ectpStepFinalIceBTerminate,
 					},
 				},
 				{
-					description: "Both have exchanged SDPs, now are exchanging ICE candidates",
-					prefaceSteps: []Step{
+					description: "A batch of one is forwarded as a single candidate",
+					steps: []Step{
 						ectpStepInitiateOnline,
 						ectpStepAcceptAndOffer,
 						ectpStepAnswer,
-					},
-					cases: []Step{
-						stepPkADisconnect,
-						stepPkBDisconnect,
-						stepPkATimeout,
-						stepPkBTimeout,
-						stepPkACancel,
-						stepPkBCancel,
+						startBatchA,
 						{
-							description: "A sends bad input",
+							description: "A's window ends, server forwards the candidate to B",
 							input: model.RoutineInput{
-								MsgType: model.RoutineMsgType_UsrMsg,
+								MsgType: model.RoutineMsgType_Timeout,
 								Pk:      &publicKey0,
-								Msg:     "lol",
 							},
-							outputs: outputPkAErrorToBoth,
-						},
-						{
-							description: "B sends bad input",
-							input: model.RoutineInput{
-								MsgType: model.RoutineMsgType_UsrMsg,
-								Pk:      &publicKey1,
-								Msg:     "lol",
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk: &publicKey0,
+									},
+								},
+								ectpStepIceAToB.outputs[0],
 							},
-							outputs: outputPkBErrorToBoth,
 						},
+						ectpStepFinalIceA,
+						ectpStepFinalIceBTerminate,
 					},
 				},
 				{
-					description: "A has finished sending ICE candidates (but not B)",
-					prefaceSteps: []Step{
+					description: "Final candidate flushes the batch",
+					steps: []Step{
 						ectpStepInitiateOnline,
 						ectpStepAcceptAndOffer,
 						ectpStepAnswer,
-						ectpStepIceAToB,
-						ectpStepIceBtoA,
-						ectpStepFinalIceA,
-					},
-					cases: []Step{
-						stepPkADisconnect,
-						stepPkBDisconnect,
-						stepPkBTimeout,
-						stepPkACancel,
-						stepPkBCancel,
+						startBatchA,
+						addToBatchA,
 						{
-							description: "A sends another ice candidate after the final once",
-							input:       ectpStepIceAToB.input,
-							outputs:     outputPkAErrorToBoth,
+							description: "A sends its final candidate, server forwards the batch and then the final candidate to B",
+							input:       ectpStepFinalIceA.input,
+							outputs: []ExpectedOutput{
+								{
+									verifyTimeouts: true,
+									ro: model.RoutineOutput{
+										Pk:              &publicKey1,
+										Msgs:            []string{ectpSchemaIceCandidateBatch(ICECandidate0, ICECandidate1), ectpSchemaIceCandidate(ICECandidateDone)},
+										TimeoutEnabled:  true,
+										TimeoutDuration: ectpExpectedTimeoutDuration,
+									},
+								},
+							},
 						},
+						ectpStepFinalIceBTerminate,
 					},
 				},
 				{
-					description: "B has finished sending ICE candidates (but not A)",
-					prefaceSteps: []Step{
+					description: "Final candidate flushes the batch and terminates",
+					steps: []Step{
 						ectpStepInitiateOnline,
 						ectpStepAcceptAndOffer,
 						ectpStepAnswer,
-						ectpStepIceAToB,
-						ectpStepIceBtoA,
 						ectpStepFinalIceB,
+						startBatchA,
+						addToBatchA,
+						{
+							description: "A sends its final candidate, server forwards the batch and the final candidate to B and terminates both",
+							input:       ectpStepFinalIceA.input,
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey1,
+										Msgs: []string{ectpSchemaIceCandidateBatch(ICECandidate0, ICECandidate1), ectpSchemaIceCandidate(ICECandidateDone), schemaBareTerminate},
+										Done: true,
+									},
+								},
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey0,
+										Msgs: []string{schemaBareTerminate},
+										Done: true,
+									},
+								},
+							},
+						},
 					},
-					cases: []Step{
-						stepPkADisconnect,
-						stepPkBDisconnect,
-						stepPkATimeout,
-						stepPkACancel,
-						stepPkBCancel,
+				},
+				{
+					description: "Batch is flushed before the sender's timeout is restarted",
+					steps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						startBatchA,
 						{
-							description: "B sends another message candidate after the final once",
-							input:       ectpStepIceBtoA.input,
-							outputs:     outputPkBErrorToBoth,
+							description: "B sends its final candidate, server forwards it to A and A's batch to B",
+							input:       ectpStepFinalIceB.input,
+							outputs: []ExpectedOutput{
+								ectpStepFinalIceB.outputs[0],
+								{
+									verifyTimeouts: true,
+									ro: model.RoutineOutput{
+										Pk:              &publicKey1,
+										Msgs:            []string{ectpSchemaIceCandidate(ICECandidate0)},
+										TimeoutEnabled:  true,
+										TimeoutDuration: ectpExpectedTimeoutDuration,
+									},
+								},
+							},
 						},
+						ectpStepFinalIceATerminate,
 					},
 				},
 			}
 
 			for _, test := range tests {
+				t.Run(test.description, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					config := defaultECTPConfig()
+					config.iceBatchWindow = window
+					ectp := newEstablishConnectionToPeerDependencyInj(clientA, hub, config)
 
-				for j, testCase := range test.cases {
-
-					t.Run(test.description+"-"+strconv.Itoa(j), func(t *testing.T) {
+					testRunner(t, ectp, test.steps)
+				})
+			}
+		})
 
-						clientA := &model.Client{}
-						clientA.SetPublicKey(&publicKey0)
-						clientB := &model.Client{}
-						clientB.SetPublicKey(&publicKey1)
-						hub := model.NewHub()
-						hub.AddClient(publicKey0, clientA)
-						hub.AddClient(publicKey1, clientB)
-						ectp := newEstablishConnectionToPeer(clientA, hub)
+		t.Run("request ids are echoed", func(t *testing.T) {
+			test := []Step{
+				ectpStepWithRid(ectpStepInitiateOnline, "1"),
+				ectpStepWithRid(ectpStepAcceptAndOffer, "2"),
+				ectpStepAnswer, // without a request id
+				ectpStepWithRid(ectpStepIceAToB, "4"),
+				ectpStepWithRid(ectpStepFinalIceA, "a message id"),
+				ectpStepWithRid(ectpStepFinalIceBTerminate, "6"),
+			}
 
-						testRunner(t, ectp, append(test.prefaceSteps, testCase), testRunnerConfig{errorsOnLastStepOnly: true})
-					})
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeer(clientA, hub)
 
-				}
-			}
+			testRunner(t, ectp, test)
 		})
-	})
 
-}
+		t.Run("request id is echoed when offline", func(t *testing.T) {
+			client := &model.Client{}
+			client.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			ectp := newEstablishConnectionToPeer(client, hub)
 
-const ectpSchemaOfflineToA = `{
-	"$schema": "https://json-schema.org/draft/2020-12/schema",
-	"type": "object",
-	"properties": {
-		"peerStatus": {
-			"const":"offline"
-		},
-		"forwarded": {
-			"const": null 
-		},
-		"terminate": {
-			"const":"done"
-		}
-	},
-	"required": ["peerStatus", "forwarded", "terminate"],
-	"additionalProperties": false
-}`
+			testRunner(t, ectp, []Step{ectpStepWithRid(ectpStepInitiateOffline, "1")})
+		})
 
-var ectpSchemaInitiateToB = `{
-	"$schema": "https://json-schema.org/draft/2020-12/schema",
-	"type": "object",
-	"properties": {
-		"initiate": {
-			"const":"receiveConnectionRequest"
-		},
-		"key": {
-			"type":"string",
-			"pattern": "` + publicKeyPattern + `"
-		}
-	},
-	"required": ["initiate", "key"],
-	"additionalProperties": false
-}`
+		t.Run("keepalives extend the timeout without advancing state", func(t *testing.T) {
 
-const schemaBareTerminate = `{
-	"$schema": "https://json-schema.org/draft/2020-12/schema",
-	"type": "object",
-	"properties": {
-		"terminate": {
-			"const":"done"
-		}
-	},
-	"required": ["terminate"],
+			tests := [][]Step{
+				{
+					ectpStepInitiateOnline,
+					stepPkBKeepalive, // B is still deciding
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					ectpStepIceAToB,
+					stepPkAKeepalive, // mid-ICE
+					stepPkBKeepalive,
+					ectpStepIceBtoA,
+					ectpStepFinalIceA,
+					stepPkBKeepalive, // after the peer has finished
+					ectpStepFinalIceBTerminate,
+				},
+				{
+					ectpStepInitiateOnline,
+					ectpStepAcceptAndOffer,
+					stepPkAKeepalive,
+					stepPkAKeepalive,
+					ectpStepAnswer,
+					ectpStepIceAToB,
+					ectpStepFinalIceA,
+					ectpStepFinalIceBTerminate,
+				},
+			}
+
+			for i, test := range tests {
+				t.Run(strconv.Itoa(i), func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
+
+					testRunner(t, ectp, test)
+				})
+			}
+		})
+
+		t.Run("typing indicators are relayed without advancing state", func(t *testing.T) {
+			test := []Step{
+				ectpStepInitiateOnline,
+				ectpStepTypingIgnored(&publicKey0, true), // B hasn't accepted yet
+				ectpStepTypingIgnored(&publicKey1, true),
+				ectpStepAcceptAndOffer,
+				ectpStepTyping(&publicKey0, &publicKey1, true),
+				ectpStepTyping(&publicKey1, &publicKey0, true),
+				ectpStepAnswer,
+				ectpStepTyping(&publicKey0, &publicKey1, false),
+				ectpStepIceAToB,
+				ectpStepIceBtoA,
+				ectpStepFinalIceA,
+				ectpStepTyping(&publicKey1, &publicKey0, false), // after the peer has finished
+				ectpStepFinalIceBTerminate,
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeer(clientA, hub)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("typing indicators are rate limited", func(t *testing.T) {
+			clock := &fakeClock{}
+			config := defaultECTPConfig()
+			config.maxTypingIndicators = 2
+			config.typingWindow = 10 * time.Second
+			config.clock = clock
+
+			nextWindow := ectpStepTyping(&publicKey0, &publicKey1, true)
+			nextWindow.before = func() { clock.Advance(config.typingWindow) }
+
+			test := []Step{
+				ectpStepInitiateOnline,
+				ectpStepAcceptAndOffer,
+				ectpStepTyping(&publicKey0, &publicKey1, true),
+				ectpStepTyping(&publicKey0, &publicKey1, false),
+				ectpStepTypingIgnored(&publicKey0, true),       // over the limit
+				ectpStepTyping(&publicKey1, &publicKey0, true), // B has its own allowance
+				ectpStepTypingIgnored(&publicKey0, false),
+				nextWindow,
+				ectpStepAnswer,
+				ectpStepIceAToB,
+				ectpStepFinalIceA,
+				ectpStepFinalIceBTerminate,
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeerDependencyInj(clientA, hub, config)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("A is terminated when B disconnects mid-ICE", func(t *testing.T) {
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := &unreachablePeerRoutine{
+				EstablishConnectionToPeer: newEstablishConnectionToPeer(clientA, hub).(*EstablishConnectionToPeer),
+			}
+
+			iceAfterDisconnect := ectpStepIceAToB
+			iceAfterDisconnect.description = "B has disconnected, but its client close hasn't arrived. A sends an ICE candidate and is terminated"
+			iceAfterDisconnect.before = func() { ectp.unreachable = &publicKey1 }
+			iceAfterDisconnect.outputs = []ExpectedOutput{
+				{
+					ro: model.RoutineOutput{
+						Pk:   &publicKey0,
+						Msgs: []string{errorCodeSchemaString(ERROR_PEER_DISCONNECTED, "Peer disconnected")},
+						Done: true,
+					},
+				},
+			}
+
+			test := []Step{
+				ectpStepInitiateOnline,
+				ectpStepAcceptAndOffer,
+				ectpStepAnswer,
+				ectpStepIceAToB,
+				iceAfterDisconnect,
+				{
+					description: "B's client close arrives, and A isn't told again",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_ClientClose,
+						Pk:      &publicKey1,
+					},
+					outputs: []ExpectedOutput{},
+				},
+			}
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("A is told B is busy when B is at its transaction limit", func(t *testing.T) {
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := &unreachablePeerRoutine{
+				EstablishConnectionToPeer: newEstablishConnectionToPeer(clientA, hub).(*EstablishConnectionToPeer),
+				unreachable:               &publicKey1,
+				reason:                    model.UndeliverableReason_AtCapacity,
+			}
+
+			// A is sent two outputs, which testRunner doesn't allow
+			ros := ectp.Next(ectpStepInitiateOnline.input)
+			expected := []model.RoutineOutput{
+				{Pk: &publicKey0, Msgs: []string{`{"peerStatus":"online","ringing":true}`}},
+				{Pk: nil, Msgs: []string{`{"peerStatus":"online","forwarded":{"type":"busy"},"terminate":"done"}`}, Done: true, DoneReason: model.DoneReason_Completed},
+			}
+			if !reflect.DeepEqual(ros, expected) {
+				t.Errorf("Expected A to be told B is busy instead of timing out. Expected %+v got %+v", expected, ros)
+			}
+		})
+
+		t.Run("B's last will is passed to A when B disconnects mid-ICE", func(t *testing.T) {
+			tests := []struct {
+				description string
+				lastWill    string
+				outputs     []ExpectedOutput
+			}{
+				{"without a last will", "", outputPkBDisconnectedToA},
+				{"with a last will", `{"reason":"networkLost"}`, []ExpectedOutput{
+					{
+						ro: model.RoutineOutput{
+							Pk:   &publicKey0,
+							Msgs: []string{`{"const":{"terminate":"cancel","code":"PEER_DISCONNECTED","error":"Peer disconnected","lastWill":{"reason":"networkLost"}}}`},
+							Done: true,
+						},
+					},
+				}},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.description, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
+
+					test := []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepIceAToB,
+						ectpStepIceBtoA,
+						{
+							description: "B disconnects",
+							input: model.RoutineInput{
+								MsgType:  model.RoutineMsgType_ClientClose,
+								Pk:       &publicKey1,
+								LastWill: tt.lastWill,
+							},
+							outputs: tt.outputs,
+						},
+					}
+
+					testRunner(t, ectp, test)
+				})
+			}
+		})
+
+		t.Run("A can only have one connection request to B in progress", func(t *testing.T) {
+
+			stepDuplicate := Step{
+				description: "A sends B a second request while the first is in progress",
+				input:       ectpStepInitiateOnline.input,
+				outputs: []ExpectedOutput{
+					{
+						ro: model.RoutineOutput{
+							Pk:   &publicKey0,
+							Msgs: []string{errorCodeSchemaString(ERROR_BUSY, "Connection to this peer already in progress")},
+							Done: true,
+						},
+					},
+				},
+			}
+
+			// end ends the first request, after which A can send another
+			tests := []struct {
+				description string
+				end         func(first model.Routine)
+			}{
+				{"B rejects", func(first model.Routine) { first.Next(ectpStepReject.input) }},
+				{"A cancels", func(first model.Routine) { first.Next(stepPkACancel.input) }},
+				{"A disconnects", func(first model.Routine) { first.Next(stepPkADisconnect.input) }},
+				{"B times out", func(first model.Routine) { first.Next(stepPkBTimeout.input) }},
+				{"The transaction ends without the routine", func(first model.Routine) { first.(model.EndHandler).Ended() }},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.description, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					clientC := &model.Client{}
+					clientC.SetPublicKey(&publicKey2)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					hub.AddClient(publicKey2, clientC)
+
+					first := newEstablishConnectionToPeer(clientA, hub)
+					first.Next(ectpStepInitiateOnline.input)
+
+					testRunner(t, newEstablishConnectionToPeer(clientA, hub), []Step{stepDuplicate})
+
+					// requests to other peers aren't affected
+					toC := model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg:     `{"initiate":"sendConnectionRequest","key":"` + (string)(publicKey2) + `"}`,
+					}
+					if ros := newEstablishConnectionToPeer(clientA, hub).Next(toC); len(ros) != 2 || ros[0].Done {
+						t.Errorf("Expected the request to C to be sent. Got %+v", ros)
+					}
+
+					tt.end(first)
+					// ending it again doesn't end a newer request
+					first.(model.EndHandler).Ended()
+
+					testRunner(t, newEstablishConnectionToPeer(clientA, hub), []Step{ectpStepInitiateOnline, ectpStepReject})
+					second := newEstablishConnectionToPeer(clientA, hub)
+					second.Next(ectpStepInitiateOnline.input)
+					first.(model.EndHandler).Ended()
+					testRunner(t, newEstablishConnectionToPeer(clientA, hub), []Step{stepDuplicate})
+				})
+			}
+		})
+	})
+
+	t.Run("Invalid inputs", func(t *testing.T) {
+
+		t.Run("Typing as the first message", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "A sends a typing indicator instead of initiating",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg:     `{"typing":true}`,
+					},
+					outputs: outputPkAError,
+				},
+			}
+
+			client := &model.Client{}
+			client.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			ectp := newEstablishConnectionToPeer(client, hub)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("Keepalive as the first message", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "A sends a keepalive instead of initiating",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg:     `{"keepalive":true}`,
+					},
+					outputs: outputPkAError,
+				},
+			}
+
+			client := &model.Client{}
+			client.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			ectp := newEstablishConnectionToPeer(client, hub)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("User has not provided their public key", func(t *testing.T) {
+
+			test := []Step{
+				{
+					description: "A sends a request without having provided their public key",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      nil,
+						Msg: `{
+							"initiate": "sendConnectionRequest",
+							"key": "` + (string)(publicKey1) + `"
+						}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   nil,
+								Msgs: []string{errorCodeSchemaString(ERROR_NOT_AUTHENTICATED, "You have not provided a public key")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			client := &model.Client{}
+			hub := model.NewHub()
+			ectp := newEstablishConnectionToPeer(client, hub)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("User tries to connect to themself", func(t *testing.T) {
+			// a different encoding of their own key is still them
+			for _, key := range []model.PublicKey{publicKey0, publicKey0OtherEncoding} {
+				t.Run((string)(key), func(t *testing.T) {
+					test := []Step{
+						{
+							description: "A sends a connection request to A",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg: `{
+									"initiate": "sendConnectionRequest",
+									"key": "` + (string)(key) + `"
+								}`,
+							},
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey0,
+										Msgs: []string{errorCodeSchemaString(ERROR_SELF_NOT_ALLOWED, "Connecting to yourself is not allowed")},
+										Done: true,
+									},
+								},
+							},
+						},
+					}
+
+					client := &model.Client{}
+					client.SetPublicKey(&publicKey0)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, client)
+					ectp := newEstablishConnectionToPeer(client, hub)
+
+					testRunner(t, ectp, test)
+				})
+			}
+		})
+
+		t.Run("User tries to connect to a banned key", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "A sends a connection request to B, who is banned",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg: `{
+							"initiate": "sendConnectionRequest",
+							"key": "` + (string)(publicKey1) + `"
+						}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{errorCodeSchemaString(ERROR_BANNED, "Peer is banned")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			// still online, e.g. banned after signing in
+			hub.AddClient(publicKey1, clientB)
+			hub.Blocklist().Add(publicKey1)
+			ectp := newEstablishConnectionToPeer(clientA, hub)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("Friend is offline", func(t *testing.T) {
+			tests := [][]Step{
+				{
+					{
+						description: "No key",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendConnectionRequest"}`,
+						},
+						outputs: outputPkAError,
+					},
+				},
+				{
+					{
+						description: "Key in wrong format",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendConnectionRequest", "key":"4"}`,
+						},
+						outputs: outputPkAError,
+					},
+				},
+				{
+					{
+						description: "Key is not Ed25519 (NIST curve)",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendConnectionRequest", "key":"` + invalidPublicKeyNIST + `"}`,
+						},
+						outputs: ectpOutputInvalidKey,
+					},
+				},
+				{
+					{
+						description: "Key is not Ed25519 (truncated)",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendConnectionRequest", "key":"` + invalidPublicKeyTruncated + `"}`,
+						},
+						outputs: ectpOutputInvalidKey,
+					},
+				},
+				{
+					{
+						description: "Key is not Ed25519 (corrupted DER header)",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendConnectionRequest", "key":"` + invalidPublicKeyCorruptedHeader + `"}`,
+						},
+						outputs: ectpOutputInvalidKey,
+					},
+				},
+				{
+					{
+						description: "Key is base64 but not DER",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendConnectionRequest", "key":"AAAA"}`,
+						},
+						outputs: ectpOutputInvalidKey,
+					},
+				},
+				{
+					{
+						description: "Invalid JSON",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `)`,
+						},
+						outputs: outputPkAError,
+					},
+				},
+				{
+					{
+						description: "Display name too long",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendConnectionRequest", "key":"` + (string)(publicKey1) + `", "displayName":"` + strings.Repeat("a", ectpMaxDisplayNameLength+1) + `"}`,
+						},
+						outputs: outputPkAError,
+					},
+				},
+				{
+					{
+						description: "Display name is not a string",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendConnectionRequest", "key":"` + (string)(publicKey1) + `", "displayName":{"admin":true}}`,
+						},
+						outputs: outputPkAError,
+					},
+				},
+				{
+					{
+						description: "Connection confirmation is not a boolean",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendConnectionRequest", "key":"` + (string)(publicKey1) + `", "confirmConnection":"yes"}`,
+						},
+						outputs: outputPkAError,
+					},
+				},
+				{
+					{
+						description: "Extra properties",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendConnectionRequest", "key":"` + (string)(publicKey1) + `", "extraProperty!":{}}`,
+						},
+						outputs: outputPkAError,
+					},
+				},
+			}
+
+			for i, test := range tests {
+				t.Run(strconv.Itoa(i), func(t *testing.T) {
+					client := &model.Client{}
+					client.SetPublicKey(&publicKey0)
+					hub := model.NewHub()
+					ectp := newEstablishConnectionToPeer(client, hub)
+
+					testRunner(t, ectp, test)
+				})
+			}
+		})
+		t.Run("Invalid key is rejected before the hub lookup", func(t *testing.T) {
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			// the hub doesn't check keys, so a client can be found under a key that isn't Ed25519
+			invalidKey := (model.PublicKey)(invalidPublicKeyNIST)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&invalidKey)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(invalidKey, clientB)
+			ectp := newEstablishConnectionToPeer(clientA, hub)
+
+			testRunner(t, ectp, []Step{
+				{
+					description: "A sends a request to a key that is in the hub but not valid",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg:     `{"initiate": "sendConnectionRequest", "key":"` + invalidPublicKeyNIST + `"}`,
+					},
+					outputs: ectpOutputInvalidKey,
+				},
+			})
+		})
+
+		t.Run("Friend is online", func(t *testing.T) {
+
+			tests := []struct {
+				description  string
+				prefaceSteps []Step
+				cases        []Step
+			}{
+				{
+					description: "A initiates; server has send msg to B",
+					prefaceSteps: []Step{
+						ectpStepInitiateOnline,
+					},
+					cases: []Step{
+						stepPkADisconnect,
+						stepPkBDisconnect,
+						stepPkBTimeout,
+						stepPkACancel,
+						stepPkBCancel,
+						{
+							description: "B sends bad input",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey1,
+								Msg:     "lol",
+							},
+							outputs: outputPkBErrorToBoth,
+						},
+						{
+							description: "B rejects with an invalid reason",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey1,
+								Msg:     `{"forward":{"type":"reject","reason":"bored"}}`,
+							},
+							outputs: outputPkBErrorToBoth,
+						},
+						{
+							description: "B sends a reason with an offer",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey1,
+								Msg:     `{"forward":{"type":"acceptAndOffer","reason":"busy","payload":{"type":"offer","sdp":"` + sdpOffer + `"}}}`,
+							},
+							outputs: outputPkBErrorToBoth,
+						},
+						{
+							description: "A sends a message out of order",
+							input:       ectpStepAnswer.input,
+							outputs:     outputPkAErrorToBoth,
+						},
+					},
+				},
+				{
+					description: "B has accepted without an offer",
+					prefaceSteps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAccept,
+					},
+					cases: []Step{
+						stepPkADisconnect,
+						stepPkBDisconnect,
+						stepPkATimeout,
+						stepPkBTimeout,
+						stepPkACancel,
+						stepPkBCancel,
+						{
+							description: "B sends bad input",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey1,
+								Msg:     "lol",
+							},
+							outputs: outputPkBErrorToBoth,
+						},
+						{
+							description: "B accepts again with an offer",
+							input:       ectpStepAcceptAndOffer.input,
+							outputs:     outputPkBErrorToBoth,
+						},
+						{
+							description: "A sends a message out of order",
+							input:       ectpStepAnswer.input,
+							outputs:     outputPkAErrorToBoth,
+						},
+					},
+				},
+				{
+					description: "B has sent sdp offer to A",
+					prefaceSteps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+					},
+					cases: []Step{
+						stepPkADisconnect,
+						stepPkBDisconnect,
+						stepPkATimeout,
+						stepPkACancel,
+						stepPkBCancel,
+						{
+							description: "A sends bad input",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg:     "xd",
+							},
+							outputs: outputPkAErrorToBoth,
+						},
+						{
+							description: "B sends a message out of order",
+							input:       ectpStepIceBtoA.input,
+							outputs:     outputPkBErrorToBoth,
+						},
+					},
+				},
+				{
+					description: "Both have exchanged SDPs, now are exchanging ICE candidates",
+					prefaceSteps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+					},
+					cases: []Step{
+						stepPkADisconnect,
+						stepPkBDisconnect,
+						stepPkATimeout,
+						stepPkBTimeout,
+						stepPkACancel,
+						stepPkBCancel,
+						{
+							description: "A sends bad input",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg:     "lol",
+							},
+							outputs: outputPkAErrorToBoth,
+						},
+						{
+							description: "B sends bad input",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey1,
+								Msg:     "lol",
+							},
+							outputs: outputPkBErrorToBoth,
+						},
+					},
+				},
+				{
+					description: "A has finished sending ICE candidates (but not B)",
+					prefaceSteps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepIceAToB,
+						ectpStepIceBtoA,
+						ectpStepFinalIceA,
+					},
+					cases: []Step{
+						stepPkADisconnect,
+						stepPkBDisconnect,
+						stepPkBTimeout,
+						stepPkACancel,
+						stepPkBCancel,
+						{
+							description: "A sends another ice candidate after the final once",
+							input:       ectpStepIceAToB.input,
+							outputs:     outputPkAErrorToBoth,
+						},
+					},
+				},
+				{
+					description: "B has finished sending ICE candidates (but not A)",
+					prefaceSteps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepIceAToB,
+						ectpStepIceBtoA,
+						ectpStepFinalIceB,
+					},
+					cases: []Step{
+						stepPkADisconnect,
+						stepPkBDisconnect,
+						stepPkATimeout,
+						stepPkACancel,
+						stepPkBCancel,
+						{
+							description: "B sends another message candidate after the final once",
+							input:       ectpStepIceBtoA.input,
+							outputs:     outputPkBErrorToBoth,
+						},
+					},
+				},
+				{
+					description: "A confirms the connection without having asked for confirmation",
+					prefaceSteps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepFinalIceA,
+					},
+					cases: []Step{
+						{
+							description: "A confirms the connection",
+							input:       ectpStepConfirmA.input,
+							outputs:     outputPkAErrorToBoth,
+						},
+					},
+				},
+				{
+					description: "A has asked for confirmation, and neither has finished sending ICE candidates",
+					prefaceSteps: []Step{
+						ectpStepInitiateOnlineConfirm,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepIceAToB,
+					},
+					cases: []Step{
+						{
+							description: "A confirms the connection before its final ICE candidate",
+							input:       ectpStepConfirmA.input,
+							outputs:     outputPkAErrorToBoth,
+						},
+					},
+				},
+				{
+					description: "A has finished sending ICE candidates and confirmed the connection (but not B)",
+					prefaceSteps: []Step{
+						ectpStepInitiateOnlineConfirm,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepFinalIceA,
+						ectpStepConfirmA,
+					},
+					cases: []Step{
+						stepPkADisconnect,
+						stepPkBDisconnect,
+						stepPkBTimeout,
+						stepPkBCancel,
+						{
+							description: "A confirms the connection again",
+							input:       ectpStepConfirmA.input,
+							outputs:     outputPkAErrorToBoth,
+						},
+						{
+							description: "B confirms the connection before its final ICE candidate",
+							input:       ectpStepConfirmB.input,
+							outputs:     outputPkBErrorToBoth,
+						},
+					},
+				},
+				{
+					description: "Both have finished sending ICE candidates, and are confirming the connection",
+					prefaceSteps: []Step{
+						ectpStepInitiateOnlineConfirm,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepFinalIceA,
+						ectpStepFinalIceB,
+					},
+					cases: []Step{
+						stepPkADisconnect,
+						stepPkBDisconnect,
+						stepPkATimeout,
+						stepPkBTimeout,
+						stepPkACancel,
+						stepPkBCancel,
+						{
+							description: "A sends another ice candidate instead",
+							input:       ectpStepIceAToB.input,
+							outputs:     outputPkAErrorToBoth,
+						},
+						{
+							description: "B says the connection didn't open",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey1,
+								Msg:     `{"connectionEstablished":false}`,
+							},
+							outputs: outputPkBErrorToBoth,
+						},
+					},
+				},
+			}
+
+			for _, test := range tests {
+
+				for j, testCase := range test.cases {
+
+					t.Run(test.description+"-"+strconv.Itoa(j), func(t *testing.T) {
+
+						clientA := &model.Client{}
+						clientA.SetPublicKey(&publicKey0)
+						clientB := &model.Client{}
+						clientB.SetPublicKey(&publicKey1)
+						hub := model.NewHub()
+						hub.AddClient(publicKey0, clientA)
+						hub.AddClient(publicKey1, clientB)
+						ectp := newEstablishConnectionToPeer(clientA, hub)
+
+						testRunner(t, ectp, append(test.prefaceSteps, testCase), testRunnerConfig{errorsOnLastStepOnly: true})
+					})
+
+				}
+			}
+		})
+
+		t.Run("Peer sends an oversized SDP", func(t *testing.T) {
+
+			oversizedSdp := strings.Repeat("a", defaultMaxSdpLength+1)
+
+			sdpTooLargeOutputs := func(sender *model.PublicKey, peer *model.PublicKey) []ExpectedOutput {
+				return []ExpectedOutput{
+					{
+						ro: model.RoutineOutput{
+							Pk:   sender,
+							Msgs: []string{errorCodeSchemaString(ERROR_LIMIT_EXCEEDED, "SDP payload too large")},
+							Done: true,
+						},
+					},
+					{
+						ro: model.RoutineOutput{
+							Pk:   peer,
+							Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a malformed message")},
+							Done: true,
+						},
+					},
+				}
+			}
+
+			tests := []struct {
+				description string
+				config      ectpConfig
+				steps       []Step
+			}{
+				{
+					description: "B sends an oversized offer",
+					config:      defaultECTPConfig(),
+					steps: []Step{
+						ectpStepInitiateOnline,
+						{
+							description: "B sends an offer that is too large",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey1,
+								Msg:     `{"forward":{"type":"acceptAndOffer","payload":{"type":"offer","sdp":"` + oversizedSdp + `"}}}`,
+							},
+							outputs: sdpTooLargeOutputs(&publicKey1, &publicKey0),
+						},
+					},
+				},
+				{
+					description: "B sends an oversized offer after accepting",
+					config:      defaultECTPConfig(),
+					steps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAccept,
+						{
+							description: "B sends a separate offer that is too large",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey1,
+								Msg:     `{"forward":{"type":"offer","payload":{"type":"offer","sdp":"` + oversizedSdp + `"}}}`,
+							},
+							outputs: sdpTooLargeOutputs(&publicKey1, &publicKey0),
+						},
+					},
+				},
+				{
+					description: "A sends an oversized answer",
+					config:      defaultECTPConfig(),
+					steps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						{
+							description: "A sends an answer that is too large",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg:     `{"forward":{"type":"answer","payload":{"type":"answer","sdp":"` + oversizedSdp + `"}}}`,
+							},
+							outputs: sdpTooLargeOutputs(&publicKey0, &publicKey1),
+						},
+					},
+				},
+				{
+					description: "Limit is configurable",
+					config:      ectpConfig{maxSdpLength: len(sdpOffer) - 1, maxIceCandidates: defaultMaxIceCandidates, clock: model.RealClock{}},
+					steps: []Step{
+						ectpStepInitiateOnline,
+						{
+							description: "B sends an offer that is over the configured limit",
+							input:       ectpStepAcceptAndOffer.input,
+							outputs:     sdpTooLargeOutputs(&publicKey1, &publicKey0),
+						},
+					},
+				},
+			}
+
+			for _, test := range tests {
+				t.Run(test.description, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeerDependencyInj(clientA, hub, test.config)
+
+					testRunner(t, ectp, test.steps)
+				})
+			}
+		})
+
+		t.Run("Peer sends an SDP of the wrong type", func(t *testing.T) {
+
+			mismatchedOutputs := func(sender *model.PublicKey, peer *model.PublicKey, expectedError string) []ExpectedOutput {
+				return []ExpectedOutput{
+					{
+						ro: model.RoutineOutput{
+							Pk:   sender,
+							Msgs: []string{errorCodeSchemaString(ERROR_MALFORMED, expectedError)},
+							Done: true,
+						},
+					},
+					{
+						ro: model.RoutineOutput{
+							Pk:   peer,
+							Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a malformed message")},
+							Done: true,
+						},
+					},
+				}
+			}
+
+			tests := []struct {
+				description  string
+				prefaceSteps []Step
+				sender       *model.PublicKey
+				peer         *model.PublicKey
+				msgs         []string
+				error        string
+			}{
+				{
+					description:  "B accepts with an answer instead of an offer",
+					prefaceSteps: []Step{ectpStepInitiateOnline},
+					sender:       &publicKey1,
+					peer:         &publicKey0,
+					msgs: []string{
+						`{"forward":{"type":"acceptAndOffer","payload":{"type":"answer","sdp":"` + sdpOffer + `"}}}`,
+						`{"forward":{"type":"acceptAndOffer","payload":{"type":"rollback","sdp":""}}}`,
+					},
+					error: "Malformed offer",
+				},
+				{
+					description:  "B sends an answer as its offer after accepting",
+					prefaceSteps: []Step{ectpStepInitiateOnline, ectpStepAccept},
+					sender:       &publicKey1,
+					peer:         &publicKey0,
+					msgs: []string{
+						`{"forward":{"type":"offer","payload":{"type":"answer","sdp":"` + sdpOffer + `"}}}`,
+						`{"forward":{"type":"offer","payload":{"type":"pranswer","sdp":"` + sdpOffer + `"}}}`,
+					},
+					error: "Malformed offer",
+				},
+				{
+					description:  "A sends an offer as its answer",
+					prefaceSteps: []Step{ectpStepInitiateOnline, ectpStepAcceptAndOffer},
+					sender:       &publicKey0,
+					peer:         &publicKey1,
+					msgs: []string{
+						`{"forward":{"type":"answer","payload":{"type":"offer","sdp":"` + sdpAnswer + `"}}}`,
+						`{"forward":{"type":"answer","payload":{"type":"pranswer","sdp":"` + sdpAnswer + `"}}}`,
+					},
+					error: "Malformed answer",
+				},
+			}
+
+			for _, test := range tests {
+				for j, msg := range test.msgs {
+					t.Run(test.description+"-"+strconv.Itoa(j), func(t *testing.T) {
+						clientA := &model.Client{}
+						clientA.SetPublicKey(&publicKey0)
+						clientB := &model.Client{}
+						clientB.SetPublicKey(&publicKey1)
+						hub := model.NewHub()
+						hub.AddClient(publicKey0, clientA)
+						hub.AddClient(publicKey1, clientB)
+						ectp := newEstablishConnectionToPeer(clientA, hub)
+
+						testRunner(t, ectp, append(test.prefaceSteps, Step{
+							description: "sends " + msg,
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      test.sender,
+								Msg:     msg,
+							},
+							outputs: mismatchedOutputs(test.sender, test.peer, test.error),
+						}))
+					})
+				}
+			}
+		})
+
+		t.Run("Peer sends too many ICE candidates", func(t *testing.T) {
+
+			prefaceSteps := []Step{
+				ectpStepInitiateOnline,
+				ectpStepAcceptAndOffer,
+				ectpStepAnswer,
+			}
+			for i := 0; i < defaultMaxIceCandidates; i++ {
+				prefaceSteps = append(prefaceSteps, ectpStepIceAToB)
+			}
+			// so that the appends below don't share a backing array
+			prefaceSteps = slices.Clip(prefaceSteps)
+
+			tests := []struct {
+				description string
+				steps       []Step
+			}{
+				{
+					description: "Candidate after the limit is rejected",
+					steps: append(prefaceSteps, Step{
+						description: "A sends one ICE candidate too many",
+						input:       ectpStepIceAToB.input,
+						outputs: []ExpectedOutput{
+							{
+								ro: model.RoutineOutput{
+									Pk:   &publicKey0,
+									Msgs: []string{errorCodeSchemaString(ERROR_LIMIT_EXCEEDED, "You have sent too many ICE candidates")},
+									Done: true,
+								},
+							},
+							{
+								ro: model.RoutineOutput{
+									Pk:   &publicKey1,
+									Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer is sending too many ICE candidates")},
+									Done: true,
+								},
+							},
+						},
+					}),
+				},
+				{
+					description: "Final empty candidate does not count towards the limit",
+					steps: append(prefaceSteps,
+						ectpStepIceBtoA,
+						ectpStepFinalIceA,
+						ectpStepFinalIceBTerminate,
+					),
+				},
+			}
+
+			for _, test := range tests {
+				t.Run(test.description, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
+
+					testRunner(t, ectp, test.steps)
+				})
+			}
+		})
+
+		t.Run("ICE candidate limit is configurable", func(t *testing.T) {
+
+			tooManyOutputs := []ExpectedOutput{
+				{
+					ro: model.RoutineOutput{
+						Pk:   &publicKey0,
+						Msgs: []string{errorCodeSchemaString(ERROR_LIMIT_EXCEEDED, "You have sent too many ICE candidates")},
+						Done: true,
+					},
+				},
+				{
+					ro: model.RoutineOutput{
+						Pk:   &publicKey1,
+						Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer is sending too many ICE candidates")},
+						Done: true,
+					},
+				},
+			}
+
+			tests := []struct {
+				description string
+				steps       []Step
+			}{
+				{
+					description: "Candidates up to the limit are forwarded",
+					steps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepIceAToB,
+						ectpStepIceAToB,
+						ectpStepFinalIceA,
+						ectpStepFinalIceBTerminate,
+					},
+				},
+				{
+					description: "Candidate after the limit is rejected",
+					steps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepIceAToB,
+						ectpStepIceAToB,
+						{
+							description: "A sends a third ICE candidate",
+							input:       ectpStepIceAToB.input,
+							outputs:     tooManyOutputs,
+						},
+					},
+				},
+				{
+					description: "Bundle at the limit is forwarded",
+					steps: []Step{
+						ectpStepInitiateOnlineBundle,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepBundleAToB,
+						ectpStepBundleBToATerminate,
+					},
+				},
+				{
+					description: "Bundle over the limit is rejected",
+					steps: []Step{
+						ectpStepInitiateOnlineBundle,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						{
+							description: "A sends a bundle of three ICE candidates",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg:     `{"forward":{"type":"ICECandidates","candidates":[` + ICECandidate0 + `,` + ICECandidate1 + `,` + ICECandidate1 + `]}}`,
+							},
+							outputs: tooManyOutputs,
+						},
+					},
+				},
+			}
+
+			for _, test := range tests {
+				t.Run(test.description, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeerDependencyInj(clientA, hub, ectpConfig{maxSdpLength: defaultMaxSdpLength, maxIceCandidates: 2, clock: model.RealClock{}})
+
+					testRunner(t, ectp, test.steps)
+				})
+			}
+		})
+
+		t.Run("Private candidates and the candidate policy", func(t *testing.T) {
+
+			candidate := func(candidate string) string {
+				return `{"candidate":"` + candidate + `","sdpMLineIndex":0}`
+			}
+			privateHost := candidate("candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host")
+			privateRelated := candidate("candidate:2 1 udp 1686052607 203.0.113.7 54321 typ srflx raddr 10.0.0.1 rport 54321")
+			linkLocal := candidate("candidate:3 1 udp 2122260223 169.254.3.4 54321 typ host")
+			privateIPv6 := candidate("candidate:4 1 udp 2122262783 fd12:3456:789a::1 54321 typ host")
+			public := candidate("candidate:5 1 udp 1686052607 203.0.113.7 54321 typ srflx raddr 0.0.0.0 rport 0")
+			mdns := candidate("candidate:6 1 udp 2122260223 0a1b2c3d-4e5f.local 54321 typ host")
+
+			iceAToB := func(payload string) model.RoutineInput {
+				return model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"forward":{"type":"ICECandidate","payload":` + payload + `}}`,
+				}
+			}
+			forwarded := func(payload string) Step {
+				return Step{
+					description: "A sends " + payload + ", server forwards it to B",
+					input:       iceAToB(payload),
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey1,
+								Msgs: []string{ectpSchemaIceCandidate(payload)},
+							},
+						},
+					},
+				}
+			}
+			notPermittedOutputs := []ExpectedOutput{
+				{
+					ro: model.RoutineOutput{
+						Pk:   &publicKey0,
+						Msgs: []string{errorCodeSchemaString(ERROR_NOT_PERMITTED, "Candidate not permitted")},
+						Done: true,
+					},
+				},
+				{
+					ro: model.RoutineOutput{
+						Pk:   &publicKey1,
+						Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a candidate that is not permitted")},
+						Done: true,
+					},
+				},
+			}
+			rejected := func(payload string) Step {
+				return Step{
+					description: "A sends " + payload + ", server rejects it",
+					input:       iceAToB(payload),
+					outputs:     notPermittedOutputs,
+				}
+			}
+			connected := []Step{ectpStepInitiateOnline, ectpStepAcceptAndOffer, ectpStepAnswer}
+			finish := []Step{ectpStepFinalIceA, ectpStepFinalIceBTerminate}
+
+			strict := defaultECTPConfig()
+			strict.rejectPrivateCandidates = true
+
+			tests := []struct {
+				description string
+				config      ectpConfig
+				steps       []Step
+			}{
+				{"Private address is forwarded by default", defaultECTPConfig(), slices.Concat(connected, []Step{forwarded(privateHost), forwarded(linkLocal)}, finish)},
+				{"Private address is rejected", strict, slices.Concat(connected, []Step{rejected(privateHost)})},
+				{"Private related address is rejected", strict, slices.Concat(connected, []Step{rejected(privateRelated)})},
+				{"Link-local address is rejected", strict, slices.Concat(connected, []Step{rejected(linkLocal)})},
+				{"Private IPv6 address is rejected", strict, slices.Concat(connected, []Step{rejected(privateIPv6)})},
+				{"Public address and hostname are forwarded", strict, slices.Concat(connected, []Step{forwarded(public), forwarded(mdns)}, finish)},
+				{"Bundle with a private address is rejected", strict, []Step{
+					ectpStepInitiateOnlineBundle,
+					ectpStepAcceptAndOffer,
+					ectpStepAnswer,
+					{
+						description: "A sends a bundle with a public and a private candidate",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"forward":{"type":"ICECandidates","candidates":[` + public + `,` + privateHost + `]}}`,
+						},
+						outputs: notPermittedOutputs,
+					},
+				}},
+			}
+
+			for _, test := range tests {
+				t.Run(test.description, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeerDependencyInj(clientA, hub, test.config)
+
+					testRunner(t, ectp, test.steps)
+				})
+			}
+		})
+
+		t.Run("Peers renegotiate too many times", func(t *testing.T) {
+
+			config := defaultECTPConfig()
+			config.maxRenegotiations = 1
+
+			test := []Step{
+				ectpStepInitiateOnline,
+				ectpStepAcceptAndOffer,
+				ectpStepAnswer,
+				ectpStepRenegotiateB,
+				ectpStepRenegotiationAnswerA,
+				{
+					description: "B renegotiates again",
+					input:       ectpStepRenegotiateB.input,
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey1,
+								Msgs: []string{errorCodeSchemaString(ERROR_LIMIT_EXCEEDED, "You have renegotiated too many times")},
+								Done: true,
+							},
+						},
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer is renegotiating too many times")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeerDependencyInj(clientA, hub, config)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("Peers restart ICE too many times", func(t *testing.T) {
+
+			config := defaultECTPConfig()
+			config.maxIceRestarts = 1
+
+			test := []Step{
+				ectpStepInitiateOnline,
+				ectpStepAcceptAndOffer,
+				ectpStepAnswer,
+				ectpStepRestartIceA,
+				{
+					description: "B restarts ICE as well",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey1,
+						Msg:     `{"forward":{"type":"restartICE"}}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey1,
+								Msgs: []string{errorCodeSchemaString(ERROR_LIMIT_EXCEEDED, "You have restarted ICE too many times")},
+								Done: true,
+							},
+						},
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer is restarting ICE too many times")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeerDependencyInj(clientA, hub, config)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("Renegotiation offer is answered by the renegotiator", func(t *testing.T) {
+
+			test := []Step{
+				ectpStepInitiateOnline,
+				ectpStepAcceptAndOffer,
+				ectpStepAnswer,
+				ectpStepRenegotiateB,
+				{
+					description: "B answers its own offer",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey1,
+						Msg:     ectpStepRenegotiationAnswerA.input.Msg,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey1,
+								Msgs: []string{errorCodeSchemaString(ERROR_OUT_OF_ORDER, "Message sent out or order")},
+								Done: true,
+							},
+						},
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a malformed message")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeer(clientA, hub)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("Malformed request id", func(t *testing.T) {
+
+			tests := []struct {
+				description string
+				rid         string
+			}{
+				{"Number", `1`},
+				{"Empty", `""`},
+				{"Too long", `"` + strings.Repeat("a", 65) + `"`},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.description, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
+
+					testRunner(t, ectp, []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						{
+							description: "A sends an ICE candidate with a malformed request id",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg:     `{"rid":` + tt.rid + `,"forward":{"type":"ICECandidate","payload":` + ICECandidate0 + `}}`,
+							},
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey0,
+										Msgs: []string{errorCodeSchemaString(ERROR_MALFORMED)},
+										Done: true,
+									},
+								},
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey1,
+										Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a malformed message")},
+										Done: true,
+									},
+								},
+							},
+						},
+					})
+				})
+			}
+		})
+
+		t.Run("Peer sends a malformed ICE candidate", func(t *testing.T) {
+
+			malformedIceOutputs := []ExpectedOutput{
+				{
+					ro: model.RoutineOutput{
+						Pk:   &publicKey0,
+						Msgs: []string{errorCodeSchemaString(ERROR_MALFORMED, "Malformed ICE candidate")},
+						Done: true,
+					},
+				},
+				{
+					ro: model.RoutineOutput{
+						Pk:   &publicKey1,
+						Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a malformed message")},
+						Done: true,
+					},
+				},
+			}
+
+			tests := []struct {
+				description string
+				payload     string
+			}{
+				{"Over-long candidate", `{"candidate":"` + strings.Repeat("a", maxIceCandidateLength+1) + `","sdpMLineIndex":0}`},
+				{"Over-long sdpMid", `{"candidate":"c","sdpMLineIndex":0,"sdpMid":"` + strings.Repeat("a", maxIceSdpMidLength+1) + `"}`},
+				{"Over-long usernameFragment", `{"candidate":"c","sdpMLineIndex":0,"usernameFragment":"` + strings.Repeat("a", maxIceUfragLength+1) + `"}`},
+				{"Negative sdpMLineIndex", `{"candidate":"c","sdpMLineIndex":-1}`},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.description, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
+
+					testRunner(t, ectp, []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						{
+							description: "A sends a malformed ICE candidate",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg:     `{"forward":{"type":"ICECandidate","payload":` + tt.payload + `}}`,
+							},
+							outputs: malformedIceOutputs,
+						},
+					})
+				})
+			}
+		})
+
+		t.Run("Peer sends an ICE candidate after its final one", func(t *testing.T) {
+			test := []Step{
+				ectpStepInitiateOnline,
+				ectpStepAcceptAndOffer,
+				ectpStepAnswer,
+				ectpStepFinalIceA,
+				ectpStepRepeatedFinalIceA,
+				{
+					description: "A sends a candidate after its final one",
+					input:       ectpStepIceAToB.input,
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{errorCodeSchemaString(ERROR_OUT_OF_ORDER, "Another ICE candidate sent after final ICE candidate")},
+								Done: true,
+							},
+						},
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey1,
+								Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a malformed message")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			ectp := newEstablishConnectionToPeer(clientA, hub)
+
+			testRunner(t, ectp, test)
+		})
+
+		t.Run("Peer mixes ICE modes", func(t *testing.T) {
+
+			mixedOutputs := func(from *model.PublicKey, to *model.PublicKey, msg string) []ExpectedOutput {
+				return []ExpectedOutput{
+					{
+						ro: model.RoutineOutput{
+							Pk:   from,
+							Msgs: []string{errorCodeSchemaString(ERROR_MALFORMED, msg)},
+							Done: true,
+						},
+					},
+					{
+						ro: model.RoutineOutput{
+							Pk:   to,
+							Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a malformed message")},
+							Done: true,
+						},
+					},
+				}
+			}
+
+			tests := []struct {
+				description string
+				steps       []Step
+			}{
+				{
+					description: "Single candidate in bundle mode",
+					steps: []Step{
+						ectpStepInitiateOnlineBundle,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						{
+							description: "A sends a single ICE candidate",
+							input:       ectpStepIceAToB.input,
+							outputs:     mixedOutputs(&publicKey0, &publicKey1, "ICE candidates must be sent as a bundle in bundle mode"),
+						},
+					},
+				},
+				{
+					description: "Single candidate after the peer sent a bundle",
+					steps: []Step{
+						ectpStepInitiateOnlineBundle,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepBundleAToB,
+						{
+							description: "B switches to sending single ICE candidates",
+							input:       ectpStepIceBtoA.input,
+							outputs:     mixedOutputs(&publicKey1, &publicKey0, "ICE candidates must be sent as a bundle in bundle mode"),
+						},
+					},
+				},
+				{
+					description: "Bundle in trickle mode",
+					steps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						{
+							description: "A sends a bundle",
+							input:       ectpStepBundleAToB.input,
+							outputs:     mixedOutputs(&publicKey0, &publicKey1, "ICE candidate bundles are only accepted in bundle mode"),
+						},
+					},
+				},
+				{
+					description: "Bundle after trickling candidates",
+					steps: []Step{
+						ectpStepInitiateOnline,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepIceAToB,
+						ectpStepIceBtoA,
+						{
+							description: "B switches to sending a bundle",
+							input:       ectpStepEmptyBundleBToA.input,
+							outputs:     mixedOutputs(&publicKey1, &publicKey0, "ICE candidate bundles are only accepted in bundle mode"),
+						},
+					},
+				},
+				{
+					description: "Second bundle",
+					steps: []Step{
+						ectpStepInitiateOnlineBundle,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						ectpStepBundleAToB,
+						{
+							description: "A sends another bundle",
+							input:       ectpStepBundleAToB.input,
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey0,
+										Msgs: []string{errorCodeSchemaString(ERROR_OUT_OF_ORDER, "Another ICE candidate sent after final ICE candidate")},
+										Done: true,
+									},
+								},
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey1,
+										Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a malformed message")},
+										Done: true,
+									},
+								},
+							},
+						},
+					},
+				},
+				{
+					description: "Empty candidate in a bundle",
+					steps: []Step{
+						ectpStepInitiateOnlineBundle,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						{
+							description: "A sends a bundle ending with an empty candidate",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg:     `{"forward":{"type":"ICECandidates","candidates":[` + ICECandidate0 + `,` + ICECandidateDone + `]}}`,
+							},
+							outputs: mixedOutputs(&publicKey0, &publicKey1, "Malformed ICE candidate"),
+						},
+					},
+				},
+				{
+					description: "Too many candidates in a bundle",
+					steps: []Step{
+						ectpStepInitiateOnlineBundle,
+						ectpStepAcceptAndOffer,
+						ectpStepAnswer,
+						{
+							description: "A sends a bundle over the limit",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg:     `{"forward":{"type":"ICECandidates","candidates":[` + strings.Repeat(ICECandidate1+",", defaultMaxIceCandidates) + ICECandidate1 + `]}}`,
+							},
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey0,
+										Msgs: []string{errorCodeSchemaString(ERROR_LIMIT_EXCEEDED, "You have sent too many ICE candidates")},
+										Done: true,
+									},
+								},
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey1,
+										Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer is sending too many ICE candidates")},
+										Done: true,
+									},
+								},
+							},
+						},
+					},
+				},
+				{
+					description: "Unknown ICE mode",
+					steps: []Step{
+						{
+							description: "A asks for an unknown ICE mode",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg:     `{"initiate":"sendConnectionRequest","key":"` + (string)(publicKey1) + `","iceMode":"vanilla"}`,
+							},
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey0,
+										Msgs: []string{errorCodeSchemaString(ERROR_MALFORMED)},
+										Done: true,
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+
+			for _, test := range tests {
+				t.Run(test.description, func(t *testing.T) {
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					ectp := newEstablishConnectionToPeer(clientA, hub)
+
+					testRunner(t, ectp, test.steps)
+				})
+			}
+		})
+	})
+
+}
+
+const ectpSchemaOfflineToA = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"peerStatus": {
+			"const":"offline"
+		},
+		"forwarded": {
+			"const": null 
+		},
+		"terminate": {
+			"const":"done"
+		}
+	},
+	"required": ["peerStatus", "forwarded", "terminate"],
+	"additionalProperties": false
+}`
+
+const ectpSchemaRingingToA = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"peerStatus": {
+			"const":"online"
+		},
+		"ringing": {
+			"const": true
+		}
+	},
+	"required": ["peerStatus", "ringing"],
+	"additionalProperties": false
+}`
+
+var ectpSchemaInitiateToB = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"initiate": {
+			"const":"receiveConnectionRequest"
+		},
+		"key": {
+			"type":"string",
+			"pattern": "` + publicKeyPattern + `"
+		}
+	},
+	"required": ["initiate", "key"],
+	"additionalProperties": false
+}`
+
+// `name` should be escaped for json.
+func ectpSchemaInitiateToBWithName(name string) string {
+	return `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"initiate": {
+			"const":"receiveConnectionRequest"
+		},
+		"key": {
+			"type":"string",
+			"pattern": "` + publicKeyPattern + `"
+		},
+		"displayName": {
+			"const": "` + name + `"
+		}
+	},
+	"required": ["initiate", "key", "displayName"],
+	"additionalProperties": false
+}`
+}
+
+var ectpSchemaInitiateToBConfirm = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"initiate": {
+			"const":"receiveConnectionRequest"
+		},
+		"key": {
+			"type":"string",
+			"pattern": "` + publicKeyPattern + `"
+		},
+		"confirmConnection": {
+			"const": true
+		}
+	},
+	"required": ["initiate", "key", "confirmConnection"],
+	"additionalProperties": false
+}`
+
+var ectpSchemaPeerConnectionEstablished = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"peerConnectionEstablished": {
+			"const": true
+		}
+	},
+	"required": ["peerConnectionEstablished"],
+	"additionalProperties": false
+}`
+
+var ectpSchemaInitiateToBBundle = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"initiate": {
+			"const":"receiveConnectionRequest"
+		},
+		"key": {
+			"type":"string",
+			"pattern": "` + publicKeyPattern + `"
+		},
+		"iceMode": {
+			"const":"bundle"
+		}
+	},
+	"required": ["initiate", "key", "iceMode"],
+	"additionalProperties": false
+}`
+
+const schemaBareTerminate = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"terminate": {
+			"const":"done"
+		}
+	},
+	"required": ["terminate"],
 	"additionalProperties": false
 }
 `
@@ -454,124 +2766,560 @@ const ectpSchemaRejectToA = `{
 	"additionalProperties": false
 }`
 
-func ectpSchemaAcceptAndOfferToA(sdp string) string {
+func ectpSchemaRejectWithReasonToA(reason string) string {
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"peerStatus": {
+				"const":"online"
+			},
+			"forwarded": {
+				"properties": {
+					"type": {
+						"const":"reject"
+					},
+					"reason": {
+						"const":"` + reason + `"
+					}
+				},
+				"required": ["type", "reason"],
+				"additionalProperties": false
+			},
+			"terminate": {
+				"const":"done"
+			}
+		},
+		"required": ["peerStatus", "forwarded", "terminate"],
+		"additionalProperties": false
+	}`
+}
+
+func ectpSchemaAcceptAndOfferToA(sdp string) string {
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"peerStatus": {
+				"const":"online"
+			},
+			"forwarded": {
+				"properties": {
+					"type": {
+						"const":"acceptAndOffer"
+					},
+					"payload": {
+						"properties": {
+							"type": {
+								"const":"offer" 
+							},
+							"sdp": {
+								"const":"` + sdp + `"
+							}
+						},
+						"required": ["type", "sdp"],
+						"additionalProperties": false  
+					}
+				},
+				"required": ["type", "payload"],
+				"additionalProperties": false  
+			}
+		},
+		"required": ["peerStatus", "forwarded"],
+		"additionalProperties": false
+	}`
+}
+
+const ectpSchemaAcceptToA = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"peerStatus": {
+			"const":"online"
+		},
+		"forwarded": {
+			"properties": {
+				"type": {
+					"const":"accept"
+				}
+			},
+			"required": ["type"],
+			"additionalProperties": false
+		}
+	},
+	"required": ["peerStatus", "forwarded"],
+	"additionalProperties": false
+}`
+
+func ectpSchemaOfferToA(sdp string) string {
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"forwarded": {
+				"properties": {
+					"type": {
+						"const":"offer"
+					},
+					"payload": {
+						"properties": {
+							"type": {
+								"const":"offer"
+							},
+							"sdp": {
+								"const":"` + sdp + `"
+							}
+						},
+						"required": ["type", "sdp"],
+						"additionalProperties": false
+					}
+				},
+				"required": ["type", "payload"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["forwarded"],
+		"additionalProperties": false
+	}`
+}
+
+func ectpSchemaAnswerToB(sdp string) string {
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"forwarded": {
+				"properties": {
+					"type": {
+						"const":"answer"
+					},
+					"payload": {
+						"properties": {
+							"type": {
+								"const":"answer" 
+							},
+							"sdp": {
+								"const":"` + sdp + `"
+							}
+						},
+						"required": ["type", "sdp"],
+						"additionalProperties": false  
+					}
+				},
+				"required": ["type", "payload"],
+				"additionalProperties": false  
+			}
+		},
+		"required": ["forwarded"],
+		"additionalProperties": false
+	}`
+}
+
+func ectpSchemaRenegotiateOffer(sdp string) string {
 	return `{
 		"$schema": "https://json-schema.org/draft/2020-12/schema",
 		"type": "object",
 		"properties": {
-			"peerStatus": {
-				"const":"online"
-			},
 			"forwarded": {
 				"properties": {
 					"type": {
-						"const":"acceptAndOffer"
+						"const":"renegotiate"
 					},
 					"payload": {
 						"properties": {
 							"type": {
-								"const":"offer" 
+								"const":"offer"
 							},
 							"sdp": {
 								"const":"` + sdp + `"
 							}
 						},
 						"required": ["type", "sdp"],
-						"additionalProperties": false  
+						"additionalProperties": false
+					}
+				},
+				"required": ["type", "payload"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["forwarded"],
+		"additionalProperties": false
+	}`
+}
+
+func ectpSchemaIceCandidate(payload string) string {
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"forwarded": {
+				"properties": {
+					"type": {
+						"const":"ICECandidate"
+					},
+					"payload": {
+						"const":` + payload + `
 					}
 				},
 				"required": ["type", "payload"],
 				"additionalProperties": false  
 			}
 		},
-		"required": ["peerStatus", "forwarded"],
-		"additionalProperties": false
-	}`
+		"required": ["forwarded"],
+		"additionalProperties": false
+	}`
+}
+
+func ectpSchemaIceCandidateBundle(candidates string) string {
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"forwarded": {
+				"properties": {
+					"type": {
+						"const":"ICECandidates"
+					},
+					"candidates": {
+						"const":` + candidates + `
+					}
+				},
+				"required": ["type", "candidates"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["forwarded"],
+		"additionalProperties": false
+	}`
+}
+
+func ectpSchemaIceCandidateBatch(payloads ...string) string {
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"forwarded": {
+				"properties": {
+					"type": {
+						"const":"ICECandidateBatch"
+					},
+					"payload": {
+						"const":[` + strings.Join(payloads, ",") + `]
+					}
+				},
+				"required": ["type", "payload"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["forwarded"],
+		"additionalProperties": false
+	}`
+}
+
+// TODO>>
+const sdpOffer = "replace this with an actual offer"
+const sdpAnswer = `replace this with an actual answer`
+const ICECandidate0 = `{
+	"candidate":"an actual ice candidate",
+	"sdpMLineIndex":0,
+	"sdpMid":"...",
+	"usernameFragment":"..."
+}`
+const ICECandidate1 = `{
+	"candidate":"another actual ice candidate",
+	"sdpMLineIndex":0
+}`
+const ICECandidateDone = `{
+	"candidate":"",
+	"sdpMLineIndex":0,
+	"sdpMid":"...",
+	"usernameFragment":"..."
+}`
+
+var ectpStepInitiateOnline = Step{
+	description: "A sends a request, server sends a message to B and tells A that B is ringing",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg: `{
+			"initiate": "sendConnectionRequest",
+			"key": "` + (string)(publicKey1) + `"
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{ectpSchemaInitiateToB},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{ectpSchemaRingingToA},
+			},
+		},
+	},
+}
+
+var ectpStepInitiateOffline = Step{
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg: `{
+			"initiate": "sendConnectionRequest",
+			"key": "` + (string)(publicKey1) + `"
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{ectpSchemaOfflineToA},
+				Done: true,
+			},
+		},
+	},
+}
+
+var ectpStepAcceptAndOffer = Step{
+	description: "B sends an offer and server passes it to A",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey1,
+		Msg: `{
+			"forward": {
+				"type": "acceptAndOffer",
+				"payload": {
+					"type": "offer",
+					"sdp": "` + sdpOffer + `"
+				}
+			}
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey0,
+				Msgs:            []string{ectpSchemaAcceptAndOfferToA(sdpOffer)},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+var ectpStepAccept = Step{
+	description: "B accepts without an offer, server tells A and waits for B's offer",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey1,
+		Msg: `{
+			"forward": {
+				"type": "accept"
+			}
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{ectpSchemaAcceptToA},
+			},
+		},
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+var ectpStepOffer = Step{
+	description: "B sends its offer separately and server passes it to A",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey1,
+		Msg: `{
+			"forward": {
+				"type": "offer",
+				"payload": {
+					"type": "offer",
+					"sdp": "` + sdpOffer + `"
+				}
+			}
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey0,
+				Msgs:            []string{ectpSchemaOfferToA(sdpOffer)},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+var ectpStepReject = Step{
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey1,
+		Msg: `{
+			"forward": {
+				"type": "reject"
+			}
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey1,
+				Msgs: []string{schemaBareTerminate},
+				Done: true,
+			},
+		},
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{ectpSchemaRejectToA},
+				Done: true,
+			},
+		},
+	},
+}
+
+func ectpStepRejectWithReason(reason string) Step {
+	return Step{
+		description: "B rejects with reason " + reason,
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      &publicKey1,
+			Msg: `{
+				"forward": {
+					"type": "reject",
+					"reason": "` + reason + `"
+				}
+			}`,
+		},
+		outputs: []ExpectedOutput{
+			{
+				ro: model.RoutineOutput{
+					Pk:   &publicKey1,
+					Msgs: []string{schemaBareTerminate},
+					Done: true,
+				},
+			},
+			{
+				ro: model.RoutineOutput{
+					Pk:   &publicKey0,
+					Msgs: []string{ectpSchemaRejectWithReasonToA(reason)},
+					Done: true,
+				},
+			},
+		},
+	}
+}
+
+var ectpStepAnswer = Step{
+	description: "A sends an answer and server passes it to B",
+	input: model.RoutineInput{
+		Pk:      &publicKey0,
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Msg: `{
+			"forward": {
+				"type": "answer",
+				"payload": {
+					"type": "answer",
+					"sdp": "` + sdpAnswer + `"
+				}
+			}
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{ectpSchemaAnswerToB(sdpAnswer)},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+	},
 }
 
-func ectpSchemaAnswerToB(sdp string) string {
-	return `{
-		"$schema": "https://json-schema.org/draft/2020-12/schema",
-		"type": "object",
-		"properties": {
-			"forwarded": {
-				"properties": {
-					"type": {
-						"const":"answer"
-					},
-					"payload": {
-						"properties": {
-							"type": {
-								"const":"answer" 
-							},
-							"sdp": {
-								"const":"` + sdp + `"
-							}
-						},
-						"required": ["type", "sdp"],
-						"additionalProperties": false  
-					}
-				},
-				"required": ["type", "payload"],
-				"additionalProperties": false  
+var ectpStepIceAToB = Step{
+	description: "A sends an ICE candidate, server forwards it to B",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg: `{
+			"forward": {
+				"type": "ICECandidate",
+				"payload": ` + ICECandidate0 + `
 			}
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{ectpSchemaIceCandidate(ICECandidate0)},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
 		},
-		"required": ["forwarded"],
-		"additionalProperties": false
-	}`
+	},
 }
 
-func ectpSchemaIceCandidate(payload string) string {
-	return `{
-		"$schema": "https://json-schema.org/draft/2020-12/schema",
-		"type": "object",
-		"properties": {
-			"forwarded": {
-				"properties": {
-					"type": {
-						"const":"ICECandidate"
-					},
-					"payload": {
-						"const":` + payload + `
-					}
-				},
-				"required": ["type", "payload"],
-				"additionalProperties": false  
+var ectpStepIceBtoA = Step{
+	description: "B sends an ICE candidate, server forwards it to A",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey1,
+		Msg: `{
+			"forward": {
+				"type": "ICECandidate",
+				"payload": ` + ICECandidate1 + `
 			}
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey0,
+				Msgs:            []string{ectpSchemaIceCandidate(ICECandidate1)},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
 		},
-		"required": ["forwarded"],
-		"additionalProperties": false
-	}`
+	},
 }
 
-// TODO>>
-const sdpOffer = "replace this with an actual offer"
-const sdpAnswer = `replace this with an actual answer`
-const ICECandidate0 = `{
-	"candidate":"an actual ice candidate",
-	"sdpMLineIndex":0,
-	"sdpMid":"...",
-	"usernameFragment":"..."
-}`
-const ICECandidate1 = `{
-	"candidate":"another actual ice candidate",
-	"sdpMLineIndex":0
-}`
-const ICECandidateDone = `{
-	"candidate":"",
-	"sdpMLineIndex":0,
-	"sdpMid":"...",
-	"usernameFragment":"..."
-}`
-
-var ectpStepInitiateOnline = Step{
-	description: "A sends a request and server sends a message to B",
+var ectpStepFinalIceA = Step{
+	description: "A sends an empty ICE candidate to denote end of ice candidates, server passes it to B",
 	input: model.RoutineInput{
 		MsgType: model.RoutineMsgType_UsrMsg,
 		Pk:      &publicKey0,
 		Msg: `{
-			"initiate": "sendConnectionRequest",
-			"key": "` + (string)(publicKey1) + `"
+			"forward": {
+				"type": "ICECandidate",
+				"payload": ` + ICECandidateDone + `
+			}
 		}`,
 	},
 	outputs: []ExpectedOutput{
@@ -579,7 +3327,7 @@ var ectpStepInitiateOnline = Step{
 			verifyTimeouts: true,
 			ro: model.RoutineOutput{
 				Pk:              &publicKey1,
-				Msgs:            []string{ectpSchemaInitiateToB},
+				Msgs:            []string{ectpSchemaIceCandidate(ICECandidateDone)},
 				TimeoutEnabled:  true,
 				TimeoutDuration: ectpExpectedTimeoutDuration,
 			},
@@ -587,38 +3335,52 @@ var ectpStepInitiateOnline = Step{
 	},
 }
 
-var ectpStepInitiateOffline = Step{
+var ectpStepRepeatedFinalIceA = Step{
+	description: "A sends its empty ICE candidate again, which is ignored",
+	input:       ectpStepFinalIceA.input,
+	outputs:     []ExpectedOutput{},
+}
+
+var ectpStepFinalIceATerminate = Step{
+	description: "A sends an empty ICE candidate to denote end of ice candidates, server passes it to B and terminates both transaction sockets",
 	input: model.RoutineInput{
 		MsgType: model.RoutineMsgType_UsrMsg,
 		Pk:      &publicKey0,
 		Msg: `{
-			"initiate": "sendConnectionRequest",
-			"key": "` + (string)(publicKey1) + `"
+			"forward": {
+				"type": "ICECandidate",
+				"payload": ` + ICECandidateDone + `
+			}
 		}`,
 	},
 	outputs: []ExpectedOutput{
+		{
+			// both clients have finished sending messages, send terminate:done to both
+			ro: model.RoutineOutput{
+				Pk:   &publicKey1,
+				Msgs: []string{ectpSchemaIceCandidate(ICECandidateDone), schemaBareTerminate},
+				Done: true,
+			},
+		},
 		{
 			ro: model.RoutineOutput{
 				Pk:   &publicKey0,
-				Msgs: []string{ectpSchemaOfflineToA},
+				Msgs: []string{schemaBareTerminate},
 				Done: true,
 			},
 		},
 	},
 }
 
-var ectpStepAcceptAndOffer = Step{
-	description: "B sends an offer and server passes it to A",
+var ectpStepFinalIceB = Step{
+	description: "B sends an empty ICE candidate to denote end of ice candidates, server passes it to A",
 	input: model.RoutineInput{
 		MsgType: model.RoutineMsgType_UsrMsg,
 		Pk:      &publicKey1,
 		Msg: `{
 			"forward": {
-				"type": "acceptAndOffer",
-				"payload": {
-					"type": "offer",
-					"sdp": "` + sdpOffer + `"
-				}
+				"type": "ICECandidate",
+				"payload": ` + ICECandidateDone + `
 			}
 		}`,
 	},
@@ -627,7 +3389,7 @@ var ectpStepAcceptAndOffer = Step{
 			verifyTimeouts: true,
 			ro: model.RoutineOutput{
 				Pk:              &publicKey0,
-				Msgs:            []string{ectpSchemaAcceptAndOfferToA(sdpOffer)},
+				Msgs:            []string{ectpSchemaIceCandidate(ICECandidateDone)},
 				TimeoutEnabled:  true,
 				TimeoutDuration: ectpExpectedTimeoutDuration,
 			},
@@ -635,72 +3397,161 @@ var ectpStepAcceptAndOffer = Step{
 	},
 }
 
-var ectpStepReject = Step{
+var ectpStepFinalIceBTerminate = Step{
+	description: "B sends an empty ICE candidate to denote end of ice candidates, server passes it to A and terminates both transaction sockets",
 	input: model.RoutineInput{
 		MsgType: model.RoutineMsgType_UsrMsg,
 		Pk:      &publicKey1,
 		Msg: `{
 			"forward": {
-				"type": "reject"
+				"type": "ICECandidate",
+				"payload": ` + ICECandidateDone + `
 			}
 		}`,
 	},
 	outputs: []ExpectedOutput{
 		{
+			// both clients have finished sending messages, send terminate:done to both
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{ectpSchemaIceCandidate(ICECandidateDone), schemaBareTerminate},
+				Done: true,
+			},
+		},
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey1,
+				Msgs: []string{schemaBareTerminate},
+				Done: true,
+			},
+		},
+	},
+}
+
+var ectpStepInitiateOnlineConfirm = Step{
+	description: "A sends a request asking for the connection to be confirmed, server sends a message to B and tells A that B is ringing",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg: `{
+			"initiate": "sendConnectionRequest",
+			"key": "` + (string)(publicKey1) + `",
+			"confirmConnection": true
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{ectpSchemaInitiateToBConfirm},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{ectpSchemaRingingToA},
+			},
+		},
+	},
+}
+
+var ectpStepConfirmA = Step{
+	description: "A confirms its connection opened, server tells B",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg:     `{"connectionEstablished":true}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{ectpSchemaPeerConnectionEstablished},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+var ectpStepConfirmB = Step{
+	description: "B confirms its connection opened, server tells A",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey1,
+		Msg:     `{"connectionEstablished":true}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey0,
+				Msgs:            []string{ectpSchemaPeerConnectionEstablished},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+var ectpStepConfirmATerminate = Step{
+	description: "A confirms its connection opened, server tells B and terminates both transaction sockets",
+	input:       ectpStepConfirmA.input,
+	outputs: []ExpectedOutput{
+		{
+			// both clients have confirmed, send terminate:done to both
 			ro: model.RoutineOutput{
 				Pk:   &publicKey1,
-				Msgs: []string{schemaBareTerminate},
+				Msgs: []string{ectpSchemaPeerConnectionEstablished, schemaBareTerminate},
 				Done: true,
 			},
 		},
 		{
 			ro: model.RoutineOutput{
 				Pk:   &publicKey0,
-				Msgs: []string{ectpSchemaRejectToA},
+				Msgs: []string{schemaBareTerminate},
 				Done: true,
 			},
 		},
 	},
 }
 
-var ectpStepAnswer = Step{
-	description: "A sends an answer and server passes it to B",
-	input: model.RoutineInput{
-		Pk:      &publicKey0,
-		MsgType: model.RoutineMsgType_UsrMsg,
-		Msg: `{
-			"forward": {
-				"type": "answer",
-				"payload": {
-					"type": "answer",
-					"sdp": "` + sdpAnswer + `"
-				}
-			}
-		}`,
-	},
+var ectpStepConfirmBTerminate = Step{
+	description: "B confirms its connection opened, server tells A and terminates both transaction sockets",
+	input:       ectpStepConfirmB.input,
 	outputs: []ExpectedOutput{
 		{
-			verifyTimeouts: true,
+			// both clients have confirmed, send terminate:done to both
 			ro: model.RoutineOutput{
-				Pk:              &publicKey1,
-				Msgs:            []string{ectpSchemaAnswerToB(sdpAnswer)},
-				TimeoutEnabled:  true,
-				TimeoutDuration: ectpExpectedTimeoutDuration,
+				Pk:   &publicKey0,
+				Msgs: []string{ectpSchemaPeerConnectionEstablished, schemaBareTerminate},
+				Done: true,
+			},
+		},
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey1,
+				Msgs: []string{schemaBareTerminate},
+				Done: true,
 			},
 		},
 	},
 }
 
-var ectpStepIceAToB = Step{
-	description: "A sends an ICE candidate, server forwards it to B",
+var ectpStepInitiateOnlineBundle = Step{
+	description: "A sends a request in bundle mode and server sends a message to B",
 	input: model.RoutineInput{
 		MsgType: model.RoutineMsgType_UsrMsg,
 		Pk:      &publicKey0,
 		Msg: `{
-			"forward": {
-				"type": "ICECandidate",
-				"payload": ` + ICECandidate0 + `
-			}
+			"initiate": "sendConnectionRequest",
+			"key": "` + (string)(publicKey1) + `",
+			"iceMode": "bundle"
 		}`,
 	},
 	outputs: []ExpectedOutput{
@@ -708,48 +3559,30 @@ var ectpStepIceAToB = Step{
 			verifyTimeouts: true,
 			ro: model.RoutineOutput{
 				Pk:              &publicKey1,
-				Msgs:            []string{ectpSchemaIceCandidate(ICECandidate0)},
+				Msgs:            []string{ectpSchemaInitiateToBBundle},
 				TimeoutEnabled:  true,
 				TimeoutDuration: ectpExpectedTimeoutDuration,
 			},
 		},
-	},
-}
-
-var ectpStepIceBtoA = Step{
-	description: "B sends an ICE candidate, server forwards it to A",
-	input: model.RoutineInput{
-		MsgType: model.RoutineMsgType_UsrMsg,
-		Pk:      &publicKey1,
-		Msg: `{
-			"forward": {
-				"type": "ICECandidate",
-				"payload": ` + ICECandidate1 + `
-			}
-		}`,
-	},
-	outputs: []ExpectedOutput{
 		{
 			verifyTimeouts: true,
 			ro: model.RoutineOutput{
-				Pk:              &publicKey0,
-				Msgs:            []string{ectpSchemaIceCandidate(ICECandidate1)},
-				TimeoutEnabled:  true,
-				TimeoutDuration: ectpExpectedTimeoutDuration,
+				Pk:   &publicKey0,
+				Msgs: []string{ectpSchemaRingingToA},
 			},
 		},
 	},
 }
 
-var ectpStepFinalIceA = Step{
-	description: "A sends an empty ICE candidate to denote end of ice candidates, server passes it to B",
+var ectpStepBundleAToB = Step{
+	description: "A sends all of its ICE candidates, server forwards them to B",
 	input: model.RoutineInput{
 		MsgType: model.RoutineMsgType_UsrMsg,
 		Pk:      &publicKey0,
 		Msg: `{
 			"forward": {
-				"type": "ICECandidate",
-				"payload": ` + ICECandidateDone + `
+				"type": "ICECandidates",
+				"candidates": [` + ICECandidate0 + `,` + ICECandidate1 + `]
 			}
 		}`,
 	},
@@ -758,7 +3591,7 @@ var ectpStepFinalIceA = Step{
 			verifyTimeouts: true,
 			ro: model.RoutineOutput{
 				Pk:              &publicKey1,
-				Msgs:            []string{ectpSchemaIceCandidate(ICECandidateDone)},
+				Msgs:            []string{ectpSchemaIceCandidateBundle(`[` + ICECandidate0 + `,` + ICECandidate1 + `]`)},
 				TimeoutEnabled:  true,
 				TimeoutDuration: ectpExpectedTimeoutDuration,
 			},
@@ -766,24 +3599,14 @@ var ectpStepFinalIceA = Step{
 	},
 }
 
-var ectpStepFinalIceATerminate = Step{
-	description: "A sends an empty ICE candidate to denote end of ice candidates, server passes it to B and terminates both transaction sockets",
-	input: model.RoutineInput{
-		MsgType: model.RoutineMsgType_UsrMsg,
-		Pk:      &publicKey0,
-		Msg: `{
-			"forward": {
-				"type": "ICECandidate",
-				"payload": ` + ICECandidateDone + `
-			}
-		}`,
-	},
+var ectpStepBundleAToBTerminate = Step{
+	description: "A sends all of its ICE candidates, server forwards them to B and terminates both transaction sockets",
+	input:       ectpStepBundleAToB.input,
 	outputs: []ExpectedOutput{
 		{
-			// both clients have finished sending messages, send terminate:done to both
 			ro: model.RoutineOutput{
 				Pk:   &publicKey1,
-				Msgs: []string{ectpSchemaIceCandidate(ICECandidateDone), schemaBareTerminate},
+				Msgs: []string{ectpSchemaIceCandidateBundle(`[` + ICECandidate0 + `,` + ICECandidate1 + `]`), schemaBareTerminate},
 				Done: true,
 			},
 		},
@@ -797,62 +3620,77 @@ var ectpStepFinalIceATerminate = Step{
 	},
 }
 
-var ectpStepFinalIceB = Step{
-	description: "B sends an empty ICE candidate to denote end of ice candidates, server passes it to A",
+var ectpStepBundleBToATerminate = Step{
+	description: "B sends all of its ICE candidates, server forwards them to A and terminates both transaction sockets",
 	input: model.RoutineInput{
 		MsgType: model.RoutineMsgType_UsrMsg,
 		Pk:      &publicKey1,
 		Msg: `{
 			"forward": {
-				"type": "ICECandidate",
-				"payload": ` + ICECandidateDone + `
+				"type": "ICECandidates",
+				"candidates": [` + ICECandidate1 + `]
 			}
 		}`,
 	},
 	outputs: []ExpectedOutput{
 		{
-			verifyTimeouts: true,
 			ro: model.RoutineOutput{
-				Pk:              &publicKey0,
-				Msgs:            []string{ectpSchemaIceCandidate(ICECandidateDone)},
-				TimeoutEnabled:  true,
-				TimeoutDuration: ectpExpectedTimeoutDuration,
+				Pk:   &publicKey0,
+				Msgs: []string{ectpSchemaIceCandidateBundle(`[` + ICECandidate1 + `]`), schemaBareTerminate},
+				Done: true,
+			},
+		},
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey1,
+				Msgs: []string{schemaBareTerminate},
+				Done: true,
 			},
 		},
 	},
 }
 
-var ectpStepFinalIceBTerminate = Step{
-	description: "B sends an empty ICE candidate to denote end of ice candidates, server passes it to A and terminates both transaction sockets",
+var ectpStepEmptyBundleBToA = Step{
+	description: "B sends an empty bundle, server forwards it to A",
 	input: model.RoutineInput{
 		MsgType: model.RoutineMsgType_UsrMsg,
 		Pk:      &publicKey1,
-		Msg: `{
-			"forward": {
-				"type": "ICECandidate",
-				"payload": ` + ICECandidateDone + `
-			}
-		}`,
+		Msg:     `{"forward":{"type":"ICECandidates","candidates":[]}}`,
 	},
 	outputs: []ExpectedOutput{
 		{
-			// both clients have finished sending messages, send terminate:done to both
-			ro: model.RoutineOutput{
-				Pk:   &publicKey0,
-				Msgs: []string{ectpSchemaIceCandidate(ICECandidateDone), schemaBareTerminate},
-				Done: true,
-			},
-		},
-		{
+			verifyTimeouts: true,
 			ro: model.RoutineOutput{
-				Pk:   &publicKey1,
-				Msgs: []string{schemaBareTerminate},
-				Done: true,
+				Pk:              &publicKey0,
+				Msgs:            []string{ectpSchemaIceCandidateBundle(`[]`)},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
 			},
 		},
 	},
 }
 
+// step with "rid" added to the input. Every message sent in response must echo it; their other contents aren't checked.
+func ectpStepWithRid(step Step, rid string) Step {
+	step.description += " (request id " + strconv.Quote(rid) + ")"
+	step.input.Msg = strings.Replace(step.input.Msg, "{", `{"rid":"`+rid+`",`, 1)
+	outputs := make([]ExpectedOutput, len(step.outputs))
+	for i, output := range step.outputs {
+		msgs := make([]string, len(output.ro.Msgs))
+		for j := range msgs {
+			msgs[j] = `{
+				"type": "object",
+				"properties": {"rid": {"const": "` + rid + `"}},
+				"required": ["rid"]
+			}`
+		}
+		output.ro.Msgs = msgs
+		outputs[i] = output
+	}
+	step.outputs = outputs
+	return step
+}
+
 var stepPkADisconnect = Step{
 	description: "A disconnects",
 	input: model.RoutineInput{
@@ -888,7 +3726,7 @@ var stepPkACancel = Step{
 		{
 			ro: model.RoutineOutput{
 				Pk:   &publicKey1,
-				Msgs: []string{errorSchemaString("Peer cancelled the transaction")},
+				Msgs: []string{errorCodeSchemaString(ERROR_PEER_CANCELLED, "Peer cancelled the transaction")},
 				Done: true,
 			},
 		},
@@ -911,13 +3749,176 @@ var stepPkBCancel = Step{
 		{
 			ro: model.RoutineOutput{
 				Pk:   &publicKey0,
-				Msgs: []string{errorSchemaString("Peer cancelled the transaction")},
+				Msgs: []string{errorCodeSchemaString(ERROR_PEER_CANCELLED, "Peer cancelled the transaction")},
 				Done: true,
 			},
 		},
 	},
 }
 
+// B cancels with cancelMsg, and A should be told expectedReason ("" for none).
+func stepPkBCancelWithReason(cancelMsg string, expectedReason string) Step {
+	return Step{
+		description: "B cancels with " + cancelMsg,
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      &publicKey1,
+			Msg:     cancelMsg,
+		},
+		outputs: []ExpectedOutput{
+			{
+				ro: model.RoutineOutput{
+					Pk:   &publicKey1,
+					Done: true,
+				},
+			},
+			{
+				ro: model.RoutineOutput{
+					Pk:   &publicKey0,
+					Msgs: []string{peerCancelledSchemaString(expectedReason)},
+					Done: true,
+				},
+			},
+		},
+	}
+}
+
+// "Peer cancelled the transaction" error, with reason if it isn't ""
+func peerCancelledSchemaString(reason string) string {
+	if reason == "" {
+		return errorCodeSchemaString(ERROR_PEER_CANCELLED, "Peer cancelled the transaction")
+	}
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"terminate": {
+				"const":"cancel"
+			},
+			"code": {
+				"const":"` + ERROR_PEER_CANCELLED + `"
+			},
+			"error": {
+				"const":"Peer cancelled the transaction"
+			},
+			"reason": {
+				"const":"` + reason + `"
+			}
+		},
+		"required": ["terminate", "code", "error", "reason"],
+		"additionalProperties": false
+	}`
+}
+
+// cancel messages, and the reason the peer should be told
+var cancelWithReasonCases = []struct {
+	cancelMsg      string
+	expectedReason string
+}{
+	{`{"terminate":"cancel","reason":"changedMind"}`, "changedMind"},
+	{`{"terminate":"cancel","reason":"busy"}`, "busy"},
+	{`{"terminate":"cancel","error":"whoops","reason":"wrongRecipient"}`, "wrongRecipient"},
+	// unknown reasons are dropped
+	{`{"terminate":"cancel","reason":"notAReason"}`, ""},
+	{`{"terminate":"cancel","reason":5}`, ""},
+}
+
+var stepPkAKeepalive = Step{
+	description: "A sends a keepalive, server re-arms A's timeout",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg:     `{"keepalive":true}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey0,
+				Msgs:            []string{},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+var stepPkBKeepalive = Step{
+	description: "B sends a keepalive, server re-arms B's timeout",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey1,
+		Msg:     `{"keepalive":true}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+// wraps an EstablishConnectionToPeer, and once unreachable is set, reports outputs to it as undeliverable for reason like the transaction does.
+type unreachablePeerRoutine struct {
+	*EstablishConnectionToPeer
+	unreachable *model.PublicKey
+	reason      model.UndeliverableReason
+}
+
+func (r *unreachablePeerRoutine) Next(args model.RoutineInput) []model.RoutineOutput {
+	ros := []model.RoutineOutput{}
+	for _, ro := range r.EstablishConnectionToPeer.Next(args) {
+		if r.unreachable != nil && ro.Pk != nil && *ro.Pk == *r.unreachable {
+			ros = append(ros, r.Undeliverable(args, *ro.Pk, ro, r.reason)...)
+		} else {
+			ros = append(ros, ro)
+		}
+	}
+	return ros
+}
+
+// fromPk is typing (or has stopped), server relays it to toPk without touching anyone's timeout
+func ectpStepTyping(fromPk *model.PublicKey, toPk *model.PublicKey, typing bool) Step {
+	typingStr := strconv.FormatBool(typing)
+	return Step{
+		description: pkToStr(fromPk) + " sends typing=" + typingStr + ", server relays it",
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      fromPk,
+			Msg:     `{"typing":` + typingStr + `}`,
+		},
+		outputs: []ExpectedOutput{
+			{
+				verifyTimeouts: true,
+				ro: model.RoutineOutput{
+					Pk:          toPk,
+					Msgs:        []string{`{"const":{"peerTyping":` + typingStr + `}}`},
+					KeepTimeout: true,
+				},
+			},
+		},
+	}
+}
+
+// fromPk sends a typing indicator that is dropped
+func ectpStepTypingIgnored(fromPk *model.PublicKey, typing bool) Step {
+	typingStr := strconv.FormatBool(typing)
+	return Step{
+		description: pkToStr(fromPk) + " sends typing=" + typingStr + ", server ignores it",
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      fromPk,
+			Msg:     `{"typing":` + typingStr + `}`,
+		},
+		outputs: []ExpectedOutput{},
+	}
+}
+
 var stepPkATimeout = Step{
 	description: "A times out",
 	input: model.RoutineInput{
@@ -936,6 +3937,16 @@ var stepPkBTimeout = Step{
 	outputs: outputPkBTimeoutToBoth,
 }
 
+var ectpOutputInvalidKey = []ExpectedOutput{
+	{
+		ro: model.RoutineOutput{
+			Pk:   &publicKey0,
+			Msgs: []string{errorCodeSchemaString(ERROR_MALFORMED, "Invalid public key")},
+			Done: true,
+		},
+	},
+}
+
 var outputPkAError = []ExpectedOutput{
 	{
 		ro: model.RoutineOutput{
@@ -957,7 +3968,7 @@ var outputPkAErrorToBoth = []ExpectedOutput{
 	{
 		ro: model.RoutineOutput{
 			Pk:   &publicKey1,
-			Msgs: []string{errorSchemaString("Peer sent a malformed message")},
+			Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a malformed message")},
 			Done: true,
 		},
 	},
@@ -967,7 +3978,7 @@ var outputPkATimeoutToBoth = []ExpectedOutput{
 	{
 		ro: model.RoutineOutput{
 			Pk:   &publicKey0,
-			Msgs: []string{errorSchemaString("Timeout")},
+			Msgs: []string{errorCodeSchemaString(ERROR_TIMEOUT, "Timeout")},
 			Done: true,
 		},
 	},
@@ -975,7 +3986,7 @@ var outputPkATimeoutToBoth = []ExpectedOutput{
 		ro: model.RoutineOutput{
 
 			Pk:   &publicKey1,
-			Msgs: []string{errorSchemaString("Peer timed out")},
+			Msgs: []string{errorCodeSchemaString(ERROR_PEER_TIMEOUT, "Peer timed out")},
 			Done: true,
 		},
 	},
@@ -993,7 +4004,7 @@ var outputPkBErrorToBoth = []ExpectedOutput{
 		ro: model.RoutineOutput{
 
 			Pk:   &publicKey0,
-			Msgs: []string{errorSchemaString("Peer sent a malformed message")},
+			Msgs: []string{errorCodeSchemaString(ERROR_PEER_MALFORMED, "Peer sent a malformed message")},
 			Done: true,
 		},
 	},
@@ -1003,7 +4014,7 @@ var outputPkBTimeoutToBoth = []ExpectedOutput{
 	{
 		ro: model.RoutineOutput{
 			Pk:   &publicKey1,
-			Msgs: []string{errorSchemaString("Timeout")},
+			Msgs: []string{errorCodeSchemaString(ERROR_TIMEOUT, "Timeout")},
 			Done: true,
 		},
 	},
@@ -1011,7 +4022,7 @@ var outputPkBTimeoutToBoth = []ExpectedOutput{
 		ro: model.RoutineOutput{
 
 			Pk:   &publicKey0,
-			Msgs: []string{errorSchemaString("Peer timed out")},
+			Msgs: []string{errorCodeSchemaString(ERROR_PEER_TIMEOUT, "Peer timed out")},
 			Done: true,
 		},
 	},
@@ -1021,7 +4032,7 @@ var outputPkADisconnectedToB = []ExpectedOutput{
 	{
 		ro: model.RoutineOutput{
 			Pk:   &publicKey1,
-			Msgs: []string{errorSchemaString("Peer disconnected")},
+			Msgs: []string{errorCodeSchemaString(ERROR_PEER_DISCONNECTED, "Peer disconnected")},
 			Done: true,
 		},
 	},
@@ -1031,8 +4042,82 @@ var outputPkBDisconnectedToA = []ExpectedOutput{
 	{
 		ro: model.RoutineOutput{
 			Pk:   &publicKey0,
-			Msgs: []string{errorSchemaString("Peer disconnected")},
+			Msgs: []string{errorCodeSchemaString(ERROR_PEER_DISCONNECTED, "Peer disconnected")},
 			Done: true,
 		},
 	},
 }
+
+var ectpStepRenegotiateB = Step{
+	description: "B sends a new offer during ICE, server forwards it to A",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey1,
+		Msg: `{
+			"forward": {
+				"type": "renegotiate",
+				"payload": {
+					"type": "offer",
+					"sdp": "` + sdpOffer + `"
+				}
+			}
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey0,
+				Msgs:            []string{ectpSchemaRenegotiateOffer(sdpOffer)},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+var ectpStepRestartIceA = Step{
+	description: "A restarts ICE, server tells B",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg: `{
+			"forward": {
+				"type": "restartICE"
+			}
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk: &publicKey1,
+				Msgs: []string{`{
+					"$schema": "https://json-schema.org/draft/2020-12/schema",
+					"type": "object",
+					"properties": {
+						"forwarded": {
+							"properties": {
+								"type": {
+									"const":"restartICE"
+								}
+							},
+							"required": ["type"],
+							"additionalProperties": false
+						}
+					},
+					"required": ["forwarded"],
+					"additionalProperties": false
+				}`},
+				TimeoutEnabled:  true,
+				TimeoutDuration: ectpExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+var ectpStepRenegotiationAnswerA = Step{
+	description: "A answers the new offer, server passes it to B",
+	input:       ectpStepAnswer.input,
+	outputs:     ectpStepAnswer.outputs,
+}
@@ -0,0 +1,639 @@
+package routines
+
+import (
+	"encoding/json"
+	"fmt"
+	"harmony/backend/model"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type EGCState int
+
+const (
+	egc_entry EGCState = iota
+	egc_signalling
+)
+
+const egcTimeoutDuration = 30 * time.Second
+
+// default maximum number of participants in a group, including the initiator
+const defaultMaxGroupSize = 6
+
+type egcMemberStatus int
+
+const (
+	egc_invited egcMemberStatus = iota
+	egc_accepted
+	egc_left
+)
+
+// progress of the SDP exchange between two accepted members
+type egcPairState int
+
+const (
+	egc_pairNew egcPairState = iota
+	egc_pairOffered
+	egc_pairAnswered
+)
+
+// two members, in no particular order
+type egcPair struct {
+	a model.PublicKey
+	b model.PublicKey
+}
+
+func makeEGCPair(x model.PublicKey, y model.PublicKey) egcPair {
+	if x < y {
+		return egcPair{a: x, b: y}
+	}
+	return egcPair{a: y, b: x}
+}
+
+type egcPairProgress struct {
+	state   egcPairState
+	offerer model.PublicKey
+}
+
+// Like EstablishConnectionToPeer, but for a group of peers that connect to each other in a mesh.
+// Once a member has accepted, they exchange an offer, an answer and ICE candidates with every other accepted member,
+// addressing each message to one of them with "to". Members leave with {"leave":true}, and the transaction ends when fewer than two are left.
+type EstablishGroupConnection struct {
+	client *model.Client
+	pkA    *model.PublicKey
+	// members in the order they were invited, starting with the initiator
+	members []model.PublicKey
+	status  map[model.PublicKey]egcMemberStatus
+	pairs   map[egcPair]*egcPairProgress
+	hub     *model.Hub
+	state   EGCState
+	config  egcConfig
+}
+
+// tunable parameters of EstablishGroupConnection
+type egcConfig struct {
+	maxGroupSize int
+	maxSdpLength int
+}
+
+func defaultEGCConfig() egcConfig {
+	return egcConfig{
+		maxGroupSize: defaultMaxGroupSize,
+		maxSdpLength: defaultMaxSdpLength,
+	}
+}
+
+func newEstablishGroupConnection(client *model.Client, hub *model.Hub) model.Routine {
+	return newEstablishGroupConnectionDependencyInj(client, hub, defaultEGCConfig())
+}
+
+func newEstablishGroupConnectionDependencyInj(client *model.Client, hub *model.Hub, config egcConfig) model.Routine {
+	return &EstablishGroupConnection{
+		status: make(map[model.PublicKey]egcMemberStatus),
+		pairs:  make(map[egcPair]*egcPairProgress),
+		client: client,
+		hub:    hub,
+		state:  egc_entry,
+		config: config,
+	}
+}
+
+func (r *EstablishGroupConnection) Next(args model.RoutineInput) []model.RoutineOutput {
+
+	switch args.MsgType {
+	case model.RoutineMsgType_Timeout:
+		if r.state == egc_entry || args.Pk == nil {
+			return egcError(nil, ERROR_TIMEOUT, "Timeout")
+		}
+		return r.leave(*args.Pk, &model.RoutineOutput{DoneReason: model.DoneReason_Timeout, Msgs: []string{MakeJSONErrorWithCode(ERROR_TIMEOUT, "Timeout")}})
+
+	case model.RoutineMsgType_ClientClose:
+		if r.state == egc_entry || args.Pk == nil {
+			return []model.RoutineOutput{}
+		}
+		// the socket is closed by the transaction, so there's nothing to send to the member who left
+		return r.leave(*args.Pk, nil)
+
+	case model.RoutineMsgType_UsrMsg:
+		if r.state == egc_entry {
+			if isClientCancelMsg(args.Msg) {
+				return []model.RoutineOutput{{
+					Done:       true,
+					DoneReason: model.DoneReason_Cancelled,
+				}}
+			}
+			return r.entry(args)
+		}
+		if isClientCancelMsg(args.Msg) {
+			return r.leave(*args.Pk, &model.RoutineOutput{DoneReason: model.DoneReason_Cancelled})
+		}
+		if isKeepaliveMsg(args.Msg) {
+			return keepaliveOutput(egcTimeoutDuration)
+		}
+		switch r.status[*args.Pk] {
+		case egc_invited:
+			return r.acceptOrReject(args)
+		case egc_accepted:
+			return r.signal(args)
+		default:
+			panic("message from a member who has left")
+		}
+	default:
+		panic("unrecognized message type")
+	}
+}
+
+var egcEntrySchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"sendGroupConnectionRequest"
+			},
+			"keys": {
+				"type": "array",
+				"items": {
+					"type":"string",
+					"pattern": "` + publicKeyPattern + `"
+				},
+				"minItems": 1,
+				"uniqueItems": true
+			}
+		},
+		"required": ["initiate", "keys"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+func (r *EstablishGroupConnection) entry(args model.RoutineInput) []model.RoutineOutput {
+
+	if args.Pk == nil {
+		return egcError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
+	}
+	r.pkA = args.Pk
+
+	// validate msg
+	result, err := validateJSON(egcEntrySchema, args.Msg)
+	if err != nil {
+		return egcError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return egcError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Initiate string   `json:"initiate"`
+		Keys     []string `json:"keys"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	if len(usrMsg.Keys)+1 > r.config.maxGroupSize {
+		return egcError(nil, ERROR_LIMIT_EXCEEDED, fmt.Sprintf("Too many participants, the maximum group size is %d", r.config.maxGroupSize))
+	}
+	keys := make([]model.PublicKey, 0, len(usrMsg.Keys))
+	for _, keyStr := range usrMsg.Keys {
+		key, err := parsePublicKey(keyStr)
+		if err != nil {
+			return egcError(nil, ERROR_MALFORMED, err.Error())
+		}
+		if sameKey(*key, *r.pkA) {
+			return egcError(nil, ERROR_SELF_NOT_ALLOWED, "Connecting to yourself is not allowed")
+		}
+		keys = append(keys, *key)
+	}
+
+	// invite the members that are online
+	peerStatuses := make(map[string]string)
+	r.members = []model.PublicKey{*r.pkA}
+	r.status[*r.pkA] = egc_accepted
+	for _, key := range keys {
+		if _, online := r.hub.GetClient(key); online {
+			peerStatuses[publicKeyToString(key)] = "online"
+			r.members = append(r.members, key)
+			r.status[key] = egc_invited
+		} else {
+			peerStatuses[publicKeyToString(key)] = "offline"
+		}
+	}
+
+	if len(r.members) == 1 {
+		msgToA, _ := json.Marshal(struct {
+			PeerStatuses map[string]string `json:"peerStatuses"`
+			Terminate    string            `json:"terminate"`
+		}{peerStatuses, "done"})
+		return []model.RoutineOutput{
+			{
+				Pk:         r.pkA,
+				Msgs:       []string{string(msgToA)},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+			},
+		}
+	}
+
+	r.state = egc_signalling
+	msgToA, _ := json.Marshal(struct {
+		PeerStatuses map[string]string `json:"peerStatuses"`
+	}{peerStatuses})
+	ros := []model.RoutineOutput{
+		{
+			Pk:              r.pkA,
+			Msgs:            []string{string(msgToA)},
+			TimeoutEnabled:  true,
+			TimeoutDuration: egcTimeoutDuration,
+		},
+	}
+	for _, invitee := range r.members[1:] {
+		// the other people that have been invited
+		others := []string{}
+		for _, member := range r.members[1:] {
+			if member != invitee {
+				others = append(others, publicKeyToString(member))
+			}
+		}
+		msgToInvitee, _ := json.Marshal(struct {
+			Initiate string   `json:"initiate"`
+			Key      string   `json:"key"`
+			Keys     []string `json:"keys"`
+		}{"receiveGroupConnectionRequest", publicKeyToString(*r.pkA), others})
+		pk := invitee
+		ros = append(ros, model.RoutineOutput{
+			Pk:              &pk,
+			Msgs:            []string{string(msgToInvitee)},
+			TimeoutEnabled:  true,
+			TimeoutDuration: egcTimeoutDuration,
+		})
+	}
+	return ros
+}
+
+var egcAcceptOrRejectSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"forward": {
+				"type": "object",
+				"properties": {
+					"type": {
+						"enum": ["accept", "reject"]
+					}
+				},
+				"required": ["type"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["forward"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+func (r *EstablishGroupConnection) acceptOrReject(args model.RoutineInput) []model.RoutineOutput {
+
+	pk := *args.Pk
+
+	// validate msg
+	result, err := validateJSON(egcAcceptOrRejectSchema, args.Msg)
+	if err != nil {
+		return r.leave(pk, &model.RoutineOutput{DoneReason: model.DoneReason_Error, Msgs: []string{MakeJSONErrorWithCode(ERROR_MALFORMED, err.Error())}})
+	}
+	if !result.Valid() {
+		return r.leave(pk, &model.RoutineOutput{DoneReason: model.DoneReason_Error, Msgs: []string{MakeJSONErrorWithCode(ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))}})
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Forward struct {
+			Type string `json:"type"`
+		} `json:"forward"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+
+	if usrMsg.Forward.Type == "reject" {
+		return r.leave(pk, &model.RoutineOutput{DoneReason: model.DoneReason_Completed, Msgs: []string{terminateDoneJSONMsg()}})
+	}
+
+	// accepted. the new member sends offers to everyone already in the group.
+	participants := []string{}
+	ros := []model.RoutineOutput{}
+	joinedMsg, _ := json.Marshal(struct {
+		Joined string `json:"joined"`
+	}{publicKeyToString(pk)})
+	for _, member := range r.acceptedMembers() {
+		participants = append(participants, publicKeyToString(member))
+		ros = append(ros, model.RoutineOutput{
+			Pk:              &member,
+			Msgs:            []string{string(joinedMsg)},
+			TimeoutEnabled:  true,
+			TimeoutDuration: egcTimeoutDuration,
+		})
+	}
+	r.status[pk] = egc_accepted
+	participantsMsg, _ := json.Marshal(struct {
+		Participants []string `json:"participants"`
+	}{participants})
+	ros = append(ros, model.RoutineOutput{
+		Pk:              nil, // sender
+		Msgs:            []string{string(participantsMsg)},
+		TimeoutEnabled:  true,
+		TimeoutDuration: egcTimeoutDuration,
+	})
+	return ros
+}
+
+var egcSignalSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"to": {
+				"type": "string",
+				"pattern": "` + publicKeyPattern + `"
+			},
+			"forward": {
+				"oneOf": [
+					{
+						"type": "object",
+						"properties": {
+							"type": {
+								"enum": ["offer", "answer"]
+							},
+							"payload": {
+								"type": "object",
+								"properties": {
+									"type": {
+										"enum": ["offer", "answer"]
+									},
+									"sdp": {
+										"type": "string"
+									}
+								},
+								"required": ["type","sdp"],
+								"additionalProperties": false
+							}
+						},
+						"required": ["type","payload"],
+						"additionalProperties": false
+					},
+					{
+						"type": "object",
+						"properties": {
+							"type": {
+								"const": "iceCandidate"
+							},
+							"payload": {
+								"type": "object",
+								"properties": {
+									"candidate": {
+										"type": "string"
+									},
+									"sdpMLineIndex": {
+										"type": "integer"
+									},
+									"sdpMid": {
+										"type": "string"
+									},
+									"usernameFragment": {
+										"type": "string"
+									}
+								},
+								"required": ["candidate","sdpMLineIndex"],
+								"additionalProperties": false
+							}
+						},
+						"required": ["type","payload"],
+						"additionalProperties": false
+					}
+				]
+			}
+		},
+		"required": ["to", "forward"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+var egcLeaveSchema = func() *gojsonschema.Schema {
+	schemaLoader := gojsonschema.NewStringLoader(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"leave": {
+				"const": true
+			}
+		},
+		"required": ["leave"],
+		"additionalProperties": false
+	}`)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// message from an accepted member: either leaving, or an offer, answer or ICE candidate for another accepted member.
+func (r *EstablishGroupConnection) signal(args model.RoutineInput) []model.RoutineOutput {
+
+	pk := *args.Pk
+
+	leaveResult, err := validateJSON(egcLeaveSchema, args.Msg)
+	if err == nil && leaveResult.Valid() {
+		return r.leave(pk, &model.RoutineOutput{DoneReason: model.DoneReason_Completed, Msgs: []string{terminateDoneJSONMsg()}})
+	}
+
+	// validate msg
+	result, err := validateJSON(egcSignalSchema, args.Msg)
+	if err != nil {
+		return r.leave(pk, &model.RoutineOutput{DoneReason: model.DoneReason_Error, Msgs: []string{MakeJSONErrorWithCode(ERROR_MALFORMED, err.Error())}})
+	}
+	if !result.Valid() {
+		return r.leave(pk, &model.RoutineOutput{DoneReason: model.DoneReason_Error, Msgs: []string{MakeJSONErrorWithCode(ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))}})
+	}
+
+	// parse msg
+	usrMsg := struct {
+		To      string `json:"to"`
+		Forward struct {
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		} `json:"forward"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	to, err := parsePublicKey(usrMsg.To)
+	if err != nil {
+		return r.leave(pk, &model.RoutineOutput{DoneReason: model.DoneReason_Error, Msgs: []string{MakeJSONErrorWithCode(ERROR_MALFORMED, err.Error())}})
+	}
+	if *to == pk || r.status[*to] != egc_accepted {
+		return r.leave(pk, &model.RoutineOutput{DoneReason: model.DoneReason_Error, Msgs: []string{MakeJSONErrorWithCode(ERROR_NOT_IN_GROUP, "Recipient is not in the group")}})
+	}
+
+	// check the message is allowed at this point of the exchange with the recipient
+	pairKey := makeEGCPair(pk, *to)
+	pair, exists := r.pairs[pairKey]
+	if !exists {
+		pair = &egcPairProgress{state: egc_pairNew}
+		r.pairs[pairKey] = pair
+	}
+	forwarded, errCode, errMsg := r.checkSignal(pk, pair, usrMsg.Forward.Type, usrMsg.Forward.Payload)
+	if errCode != "" {
+		return r.leave(pk, &model.RoutineOutput{DoneReason: doneReasonForCode(errCode), Msgs: []string{MakeJSONErrorWithCode(errCode, errMsg)}})
+	}
+
+	forwardedData := struct {
+		From      string `json:"from"`
+		Forwarded struct {
+			Type    string `json:"type"`
+			Payload any    `json:"payload"`
+		} `json:"forwarded"`
+	}{}
+	forwardedData.From = publicKeyToString(pk)
+	forwardedData.Forwarded.Type = usrMsg.Forward.Type
+	forwardedData.Forwarded.Payload = forwarded
+	forwardedStr, _ := json.Marshal(forwardedData)
+
+	return []model.RoutineOutput{
+		{
+			Pk:              to,
+			Msgs:            []string{string(forwardedStr)},
+			TimeoutEnabled:  true,
+			TimeoutDuration: egcTimeoutDuration,
+		},
+		{
+			Pk:              nil, // sender
+			TimeoutEnabled:  true,
+			TimeoutDuration: egcTimeoutDuration,
+		},
+	}
+}
+
+// checks an offer, answer or ICE candidate from sender against the progress of its pair, and advances the pair.
+// Returns the payload to forward, or an error code and message.
+func (r *EstablishGroupConnection) checkSignal(sender model.PublicKey, pair *egcPairProgress, msgType string, rawPayload json.RawMessage) (any, string, string) {
+	switch msgType {
+	case "offer", "answer":
+		payload := struct {
+			Type string `json:"type"`
+			Sdp  string `json:"sdp"`
+		}{}
+		json.Unmarshal(rawPayload, &payload)
+		if payload.Type != msgType {
+			return nil, ERROR_MALFORMED, "Payload type does not match message type"
+		}
+		if len(payload.Sdp) > r.config.maxSdpLength {
+			return nil, ERROR_LIMIT_EXCEEDED, fmt.Sprintf("SDP is longer than %d bytes", r.config.maxSdpLength)
+		}
+		if msgType == "offer" {
+			if pair.state != egc_pairNew {
+				return nil, ERROR_OUT_OF_ORDER, "Message out of order"
+			}
+			pair.state = egc_pairOffered
+			pair.offerer = sender
+		} else {
+			if pair.state != egc_pairOffered || pair.offerer == sender {
+				return nil, ERROR_OUT_OF_ORDER, "Message out of order"
+			}
+			pair.state = egc_pairAnswered
+		}
+		return payload, "", ""
+
+	case "iceCandidate":
+		payload := struct {
+			Candidate        string `json:"candidate"`
+			SdpMLineIndex    int    `json:"sdpMLineIndex"`
+			SdpMid           string `json:"sdpMid,omitempty"`
+			UsernameFragment string `json:"usernameFragment,omitempty"`
+		}{}
+		json.Unmarshal(rawPayload, &payload)
+		// the offerer can send candidates once it has sent its offer, the answerer once it has answered
+		if pair.state == egc_pairNew || (pair.state == egc_pairOffered && pair.offerer != sender) {
+			return nil, ERROR_OUT_OF_ORDER, "Message out of order"
+		}
+		if len(payload.Candidate) > maxIceCandidateLength ||
+			len(payload.SdpMid) > maxIceSdpMidLength ||
+			len(payload.UsernameFragment) > maxIceUfragLength ||
+			payload.SdpMLineIndex < 0 {
+			return nil, ERROR_MALFORMED, "Malformed ICE candidate"
+		}
+		return payload, "", ""
+
+	default:
+		panic("unrecognized signal type")
+	}
+}
+
+// remove pk from the group and tell the accepted members.
+// own is the output to pk, or nil if it should get none. Done is set on it.
+// If fewer than two members are left, the transaction ends for them too.
+func (r *EstablishGroupConnection) leave(pk model.PublicKey, own *model.RoutineOutput) []model.RoutineOutput {
+	r.status[pk] = egc_left
+
+	ros := []model.RoutineOutput{}
+	if own != nil {
+		own.Pk = &pk
+		own.Done = true
+		ros = append(ros, *own)
+	}
+
+	remaining := []model.PublicKey{}
+	for _, member := range r.members {
+		if r.status[member] != egc_left {
+			remaining = append(remaining, member)
+		}
+	}
+	groupOver := len(remaining) < 2
+
+	leftMsg, _ := json.Marshal(struct {
+		Left string `json:"left"`
+	}{publicKeyToString(pk)})
+	for _, member := range remaining {
+		ro := model.RoutineOutput{Pk: &member}
+		// only accepted members have been told who is in the group
+		if r.status[member] == egc_accepted {
+			ro.Msgs = append(ro.Msgs, string(leftMsg))
+		}
+		if groupOver {
+			r.status[member] = egc_left
+			ro.Msgs = append(ro.Msgs, terminateDoneJSONMsg())
+			ro.Done = true
+			ro.DoneReason = model.DoneReason_Completed
+		} else if len(ro.Msgs) == 0 {
+			continue
+		} else {
+			ro.TimeoutEnabled = true
+			ro.TimeoutDuration = egcTimeoutDuration
+		}
+		ros = append(ros, ro)
+	}
+	return ros
+}
+
+// accepted members, in the order they were invited.
+func (r *EstablishGroupConnection) acceptedMembers() []model.PublicKey {
+	accepted := []model.PublicKey{}
+	for _, member := range r.members {
+		if r.status[member] == egc_accepted {
+			accepted = append(accepted, member)
+		}
+	}
+	return accepted
+}
+
+// wrapper for error routine output
+func egcError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
+	return []model.RoutineOutput{
+		{
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
+		},
+	}
+}
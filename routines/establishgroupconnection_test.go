@@ -0,0 +1,593 @@
+package routines
+
+import (
+	"harmony/backend/model"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const egcExpectedTimeoutDuration = 30 * time.Second
+
+func TestEstablishGroupConnection(t *testing.T) {
+
+	// A, B and C are online unless listed in offline. A has started the transaction.
+	newGroup := func(config egcConfig, offline ...model.PublicKey) model.Routine {
+		hub := model.NewHub()
+		var clientA *model.Client
+		for _, pk := range []model.PublicKey{publicKey0, publicKey1, publicKey2} {
+			client := &model.Client{}
+			client.SetPublicKey(&pk)
+			if pk == publicKey0 {
+				clientA = client
+			}
+			isOffline := false
+			for _, o := range offline {
+				isOffline = isOffline || o == pk
+			}
+			if !isOffline {
+				hub.AddClient(pk, client)
+			}
+		}
+		return newEstablishGroupConnectionDependencyInj(clientA, hub, config)
+	}
+
+	t.Run("Valid inputs", func(t *testing.T) {
+
+		t.Run("Three party happy path", func(t *testing.T) {
+			test := []Step{
+				egcStepInitiateABC,
+				egcStepAccept(&publicKey1, &publicKey0),
+				egcStepSdp(&publicKey1, &publicKey0, "offer"),
+				egcStepSdp(&publicKey0, &publicKey1, "answer"),
+				egcStepIce(&publicKey1, &publicKey0),
+				egcStepIce(&publicKey0, &publicKey1),
+				egcStepAccept(&publicKey2, &publicKey0, &publicKey1),
+				egcStepSdp(&publicKey2, &publicKey0, "offer"),
+				egcStepSdp(&publicKey2, &publicKey1, "offer"),
+				egcStepIce(&publicKey2, &publicKey1),
+				egcStepSdp(&publicKey0, &publicKey2, "answer"),
+				egcStepSdp(&publicKey1, &publicKey2, "answer"),
+				egcStepIce(&publicKey1, &publicKey2),
+				egcStepIce(&publicKey0, &publicKey2),
+				egcStepLeave(&publicKey0, []*model.PublicKey{&publicKey1, &publicKey2}, nil),
+				egcStepLeave(&publicKey1, nil, &publicKey2),
+			}
+			testRunner(t, newGroup(defaultEGCConfig()), test)
+		})
+
+		t.Run("Some peers are offline", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "A invites B and C, C is offline",
+					input:       egcStepInitiateABC.input,
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{`{"const":{"peerStatuses":{"` + (string)(publicKey1) + `":"online","` + (string)(publicKey2) + `":"offline"}}}`},
+							},
+						},
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey1,
+								Msgs: []string{`{"const":{"initiate":"receiveGroupConnectionRequest","key":"` + (string)(publicKey0) + `","keys":[]}}`},
+							},
+						},
+					},
+				},
+				egcStepAccept(&publicKey1, &publicKey0),
+				egcStepLeave(&publicKey1, nil, &publicKey0),
+			}
+			testRunner(t, newGroup(defaultEGCConfig(), publicKey2), test)
+		})
+
+		t.Run("All peers are offline", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "A invites B and C, who are both offline",
+					input:       egcStepInitiateABC.input,
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{`{"const":{"peerStatuses":{"` + (string)(publicKey1) + `":"offline","` + (string)(publicKey2) + `":"offline"},"terminate":"done"}}`},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+			testRunner(t, newGroup(defaultEGCConfig(), publicKey1, publicKey2), test)
+		})
+	})
+
+	t.Run("Participant drops out", func(t *testing.T) {
+
+		t.Run("Invitee rejects", func(t *testing.T) {
+			test := []Step{
+				egcStepInitiateABC,
+				egcStepAccept(&publicKey1, &publicKey0),
+				{
+					description: "C rejects",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey2,
+						Msg:     `{"forward":{"type":"reject"}}`,
+					},
+					outputs: append(
+						[]ExpectedOutput{{ro: model.RoutineOutput{Pk: &publicKey2, Msgs: []string{schemaBareTerminate}, Done: true}}},
+						egcOutputsLeft(&publicKey2, &publicKey0, &publicKey1)...,
+					),
+				},
+				egcStepSdp(&publicKey1, &publicKey0, "offer"),
+				egcStepLeave(&publicKey0, nil, &publicKey1),
+			}
+			testRunner(t, newGroup(defaultEGCConfig()), test)
+		})
+
+		t.Run("Invitee disconnects before replying", func(t *testing.T) {
+			test := []Step{
+				egcStepInitiateABC,
+				egcStepAccept(&publicKey1, &publicKey0),
+				{
+					description: "C disconnects",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_ClientClose,
+						Pk:      &publicKey2,
+					},
+					outputs: egcOutputsLeft(&publicKey2, &publicKey0, &publicKey1),
+				},
+				egcStepLeave(&publicKey1, nil, &publicKey0),
+			}
+			testRunner(t, newGroup(defaultEGCConfig()), test)
+		})
+
+		t.Run("Participant disconnects mid negotiation", func(t *testing.T) {
+			test := []Step{
+				egcStepInitiateABC,
+				egcStepAccept(&publicKey1, &publicKey0),
+				egcStepAccept(&publicKey2, &publicKey0, &publicKey1),
+				egcStepSdp(&publicKey1, &publicKey0, "offer"),
+				egcStepSdp(&publicKey2, &publicKey1, "offer"),
+				{
+					description: "B disconnects",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_ClientClose,
+						Pk:      &publicKey1,
+					},
+					outputs: egcOutputsLeft(&publicKey1, &publicKey0, &publicKey2),
+				},
+				// A and C carry on without B
+				egcStepSdp(&publicKey2, &publicKey0, "offer"),
+				egcStepSdp(&publicKey0, &publicKey2, "answer"),
+				{
+					description: "A sends an answer to B, who has left",
+					input:       egcStepSdp(&publicKey0, &publicKey1, "answer").input,
+					outputs: []ExpectedOutput{
+						{ro: model.RoutineOutput{Pk: &publicKey0, Msgs: []string{errorSchemaString("Recipient is not in the group")}, Done: true}},
+						{ro: model.RoutineOutput{Pk: &publicKey2, Msgs: []string{egcSchemaLeft(&publicKey0), schemaBareTerminate}, Done: true}},
+					},
+				},
+			}
+			testRunner(t, newGroup(defaultEGCConfig()), test)
+		})
+
+		t.Run("Participant times out", func(t *testing.T) {
+			test := []Step{
+				egcStepInitiateABC,
+				egcStepAccept(&publicKey1, &publicKey0),
+				{
+					description: "A times out",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_Timeout,
+						Pk:      &publicKey0,
+					},
+					outputs: append(
+						[]ExpectedOutput{{ro: model.RoutineOutput{Pk: &publicKey0, Msgs: []string{errorSchemaString("Timeout")}, Done: true}}},
+						egcOutputsLeft(&publicKey0, &publicKey1)...,
+					),
+				},
+				// C can still join B
+				egcStepAccept(&publicKey2, &publicKey1),
+				egcStepCancel(&publicKey2, nil, &publicKey1),
+			}
+			testRunner(t, newGroup(defaultEGCConfig()), test)
+		})
+
+		t.Run("Initiator leaves before anyone accepts", func(t *testing.T) {
+			test := []Step{
+				egcStepInitiateABC,
+				egcStepCancel(&publicKey0, nil, nil),
+				{
+					description: "B rejects, leaving C on their own",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey1,
+						Msg:     `{"forward":{"type":"reject"}}`,
+					},
+					outputs: []ExpectedOutput{
+						{ro: model.RoutineOutput{Pk: &publicKey1, Msgs: []string{schemaBareTerminate}, Done: true}},
+						{ro: model.RoutineOutput{Pk: &publicKey2, Msgs: []string{schemaBareTerminate}, Done: true}},
+					},
+				},
+			}
+			testRunner(t, newGroup(defaultEGCConfig()), test)
+		})
+	})
+
+	t.Run("Invalid inputs", func(t *testing.T) {
+
+		t.Run("Entry", func(t *testing.T) {
+			tests := []struct {
+				description string
+				pk          *model.PublicKey
+				msg         string
+				error       string
+			}{
+				{"No public key", nil, egcStepInitiateABC.input.Msg, "You have not provided a public key"},
+				{"Includes self", &publicKey0, egcInitiateMsg(publicKey0), "Connecting to yourself is not allowed"},
+				{"Includes self encoded differently", &publicKey0, egcInitiateMsg(publicKey0OtherEncoding), "Connecting to yourself is not allowed"},
+				{"Too many participants", &publicKey0, egcInitiateMsg(publicKey1, publicKey2), "Too many participants, the maximum group size is 2"},
+				{"No keys", &publicKey0, `{"initiate":"sendGroupConnectionRequest","keys":[]}`, ""},
+				{"Duplicate keys", &publicKey0, egcInitiateMsg(publicKey1, publicKey1), ""},
+				{"Invalid key", &publicKey0, egcInitiateMsg(invalidPublicKeyNIST), ""},
+				{"Key instead of keys", &publicKey0, `{"initiate":"sendGroupConnectionRequest","key":"` + (string)(publicKey1) + `"}`, ""},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.description, func(t *testing.T) {
+					expectedError := errorSchemaString()
+					if tt.error != "" {
+						expectedError = errorSchemaString(tt.error)
+					}
+					config := defaultEGCConfig()
+					config.maxGroupSize = 2
+					testRunner(t, newGroup(config), []Step{
+						{
+							description: tt.description,
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      tt.pk,
+								Msg:     tt.msg,
+							},
+							outputs: []ExpectedOutput{
+								{ro: model.RoutineOutput{Pk: tt.pk, Msgs: []string{expectedError}, Done: true}},
+							},
+						},
+					})
+				})
+			}
+		})
+
+		// A and B in the group, C is offline. the sender of a bad message is removed, which leaves the other on their own.
+		badMsg := func(from *model.PublicKey, other *model.PublicKey, msg string, expectedError string) Step {
+			errorSchema := errorSchemaString()
+			if expectedError != "" {
+				errorSchema = errorSchemaString(expectedError)
+			}
+			return Step{
+				description: "bad message " + msg,
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      from,
+					Msg:     msg,
+				},
+				outputs: []ExpectedOutput{
+					{ro: model.RoutineOutput{Pk: from, Msgs: []string{errorSchema}, Done: true}},
+					{ro: model.RoutineOutput{Pk: other, Msgs: []string{egcSchemaLeft(from), schemaBareTerminate}, Done: true}},
+				},
+			}
+		}
+		signalMsg := func(to model.PublicKey, forward string) string {
+			return `{"to":"` + (string)(to) + `","forward":` + forward + `}`
+		}
+		sdp := func(t string, sdp string) string {
+			return `{"type":"` + t + `","payload":{"type":"` + t + `","sdp":"` + sdp + `"}}`
+		}
+		ice := func(candidate string, index int) string {
+			return `{"type":"iceCandidate","payload":{"candidate":"` + candidate + `","sdpMLineIndex":` + strconv.Itoa(index) + `}}`
+		}
+
+		config := defaultEGCConfig()
+		config.maxSdpLength = 100
+
+		tests := []struct {
+			description  string
+			prefaceSteps []Step
+			cases        []Step
+		}{
+			{
+				description:  "Invitee replying",
+				prefaceSteps: []Step{egcStepInitiateAB},
+				cases: []Step{
+					{
+						description: "B sends an offer before accepting",
+						input:       egcStepSdp(&publicKey1, &publicKey0, "offer").input,
+						outputs: []ExpectedOutput{
+							{ro: model.RoutineOutput{Pk: &publicKey1, Msgs: []string{errorSchemaString()}, Done: true}},
+							{ro: model.RoutineOutput{Pk: &publicKey0, Msgs: []string{egcSchemaLeft(&publicKey1), schemaBareTerminate}, Done: true}},
+						},
+					},
+					{
+						description: "B replies with nonsense",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey1,
+							Msg:     `{"forward":{"type":"maybe"}}`,
+						},
+						outputs: []ExpectedOutput{
+							{ro: model.RoutineOutput{Pk: &publicKey1, Msgs: []string{errorSchemaString()}, Done: true}},
+							{ro: model.RoutineOutput{Pk: &publicKey0, Msgs: []string{egcSchemaLeft(&publicKey1), schemaBareTerminate}, Done: true}},
+						},
+					},
+					{
+						description: "A sends an offer to B, who hasn't accepted",
+						input:       egcStepSdp(&publicKey0, &publicKey1, "offer").input,
+						outputs: []ExpectedOutput{
+							{ro: model.RoutineOutput{Pk: &publicKey0, Msgs: []string{errorSchemaString("Recipient is not in the group")}, Done: true}},
+							{ro: model.RoutineOutput{Pk: &publicKey1, Msgs: []string{schemaBareTerminate}, Done: true}},
+						},
+					},
+				},
+			},
+			{
+				description:  "Signalling",
+				prefaceSteps: []Step{egcStepInitiateAB, egcStepAccept(&publicKey1, &publicKey0)},
+				cases: []Step{
+					badMsg(&publicKey1, &publicKey0, "lol", ""),
+					badMsg(&publicKey1, &publicKey0, `{"forward":{"type":"accept"}}`, ""),
+					badMsg(&publicKey1, &publicKey0, signalMsg(publicKey1, sdp("offer", "")), "Recipient is not in the group"),
+					badMsg(&publicKey1, &publicKey0, signalMsg(publicKey2, sdp("offer", "")), "Recipient is not in the group"),
+					badMsg(&publicKey1, &publicKey0, signalMsg(publicKey0, sdp("answer", "")), "Message out of order"),
+					badMsg(&publicKey1, &publicKey0, signalMsg(publicKey0, ice("candidate", 0)), "Message out of order"),
+					badMsg(&publicKey1, &publicKey0, signalMsg(publicKey0, `{"type":"offer","payload":{"type":"answer","sdp":""}}`), "Payload type does not match message type"),
+					badMsg(&publicKey1, &publicKey0, signalMsg(publicKey0, sdp("offer", strings.Repeat("a", 101))), "SDP is longer than 100 bytes"),
+					badMsg(&publicKey1, &publicKey0, `{"to":"`+(string)(publicKey0)+`"}`, ""),
+				},
+			},
+			{
+				description:  "After an offer",
+				prefaceSteps: []Step{egcStepInitiateAB, egcStepAccept(&publicKey1, &publicKey0), egcStepSdp(&publicKey1, &publicKey0, "offer")},
+				cases: []Step{
+					badMsg(&publicKey1, &publicKey0, signalMsg(publicKey0, sdp("offer", "")), "Message out of order"),
+					badMsg(&publicKey0, &publicKey1, signalMsg(publicKey1, sdp("offer", "")), "Message out of order"),
+					badMsg(&publicKey1, &publicKey0, signalMsg(publicKey0, sdp("answer", "")), "Message out of order"),
+					badMsg(&publicKey0, &publicKey1, signalMsg(publicKey1, ice("candidate", 0)), "Message out of order"),
+					badMsg(&publicKey1, &publicKey0, signalMsg(publicKey0, ice("candidate", -1)), "Malformed ICE candidate"),
+					badMsg(&publicKey1, &publicKey0, signalMsg(publicKey0, ice(strings.Repeat("a", maxIceCandidateLength+1), 0)), "Malformed ICE candidate"),
+					egcStepLeave(&publicKey0, nil, &publicKey1),
+				},
+			},
+		}
+
+		for _, test := range tests {
+			for j, testCase := range test.cases {
+				t.Run(test.description+"-"+strconv.Itoa(j), func(t *testing.T) {
+					testRunner(t, newGroup(config, publicKey2), append(test.prefaceSteps, testCase), testRunnerConfig{errorsOnLastStepOnly: true})
+				})
+			}
+		}
+	})
+}
+
+func egcInitiateMsg(keys ...model.PublicKey) string {
+	quoted := []string{}
+	for _, key := range keys {
+		quoted = append(quoted, `"`+(string)(key)+`"`)
+	}
+	return `{"initiate":"sendGroupConnectionRequest","keys":[` + strings.Join(quoted, ",") + `]}`
+}
+
+var egcStepInitiateABC = Step{
+	description: "A invites B and C",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg:     egcInitiateMsg(publicKey1, publicKey2),
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey0,
+				Msgs:            []string{`{"const":{"peerStatuses":{"` + (string)(publicKey1) + `":"online","` + (string)(publicKey2) + `":"online"}}}`},
+				TimeoutEnabled:  true,
+				TimeoutDuration: egcExpectedTimeoutDuration,
+			},
+		},
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{`{"const":{"initiate":"receiveGroupConnectionRequest","key":"` + (string)(publicKey0) + `","keys":["` + (string)(publicKey2) + `"]}}`},
+				TimeoutEnabled:  true,
+				TimeoutDuration: egcExpectedTimeoutDuration,
+			},
+		},
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey2,
+				Msgs:            []string{`{"const":{"initiate":"receiveGroupConnectionRequest","key":"` + (string)(publicKey0) + `","keys":["` + (string)(publicKey1) + `"]}}`},
+				TimeoutEnabled:  true,
+				TimeoutDuration: egcExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+// C is offline
+var egcStepInitiateAB = Step{
+	description: "A invites B and C, C is offline",
+	input:       egcStepInitiateABC.input,
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{`{"type":"object","required":["peerStatuses"]}`},
+			},
+		},
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey1,
+				Msgs: []string{`{"type":"object","required":["initiate"]}`},
+			},
+		},
+	},
+}
+
+// pk accepts. members are the accepted members of the group before pk.
+func egcStepAccept(pk *model.PublicKey, members ...*model.PublicKey) Step {
+	quoted := []string{}
+	outputs := []ExpectedOutput{}
+	for _, member := range members {
+		quoted = append(quoted, `"`+(string)(*member)+`"`)
+		outputs = append(outputs, ExpectedOutput{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              member,
+				Msgs:            []string{`{"const":{"joined":"` + (string)(*pk) + `"}}`},
+				TimeoutEnabled:  true,
+				TimeoutDuration: egcExpectedTimeoutDuration,
+			},
+		})
+	}
+	outputs = append(outputs, ExpectedOutput{
+		verifyTimeouts: true,
+		ro: model.RoutineOutput{
+			Pk:              pk,
+			Msgs:            []string{`{"const":{"participants":[` + strings.Join(quoted, ",") + `]}}`},
+			TimeoutEnabled:  true,
+			TimeoutDuration: egcExpectedTimeoutDuration,
+		},
+	})
+	return Step{
+		description: pkToStr(pk)[:20] + " accepts",
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      pk,
+			Msg:     `{"forward":{"type":"accept"}}`,
+		},
+		outputs: outputs,
+	}
+}
+
+// forwarded message to "to", and the sender's timeout is re-armed
+func egcOutputsSignal(from *model.PublicKey, to *model.PublicKey, forwarded string) []ExpectedOutput {
+	return []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              to,
+				Msgs:            []string{`{"const":{"from":"` + (string)(*from) + `","forwarded":` + forwarded + `}}`},
+				TimeoutEnabled:  true,
+				TimeoutDuration: egcExpectedTimeoutDuration,
+			},
+		},
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              from,
+				Msgs:            []string{},
+				TimeoutEnabled:  true,
+				TimeoutDuration: egcExpectedTimeoutDuration,
+			},
+		},
+	}
+}
+
+// sdpType is "offer" or "answer"
+func egcStepSdp(from *model.PublicKey, to *model.PublicKey, sdpType string) Step {
+	forward := `{"type":"` + sdpType + `","payload":{"type":"` + sdpType + `","sdp":"v=0"}}`
+	return Step{
+		description: pkToStr(from)[:20] + " sends an " + sdpType + " to " + pkToStr(to)[:20],
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      from,
+			Msg:     `{"to":"` + (string)(*to) + `","forward":` + forward + `}`,
+		},
+		outputs: egcOutputsSignal(from, to, forward),
+	}
+}
+
+func egcStepIce(from *model.PublicKey, to *model.PublicKey) Step {
+	forward := `{"type":"iceCandidate","payload":{"candidate":"candidate:0 1 UDP 2122252543 192.168.0.2 50000 typ host","sdpMLineIndex":0,"sdpMid":"0"}}`
+	return Step{
+		description: pkToStr(from)[:20] + " sends an ICE candidate to " + pkToStr(to)[:20],
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      from,
+			Msg:     `{"to":"` + (string)(*to) + `","forward":` + forward + `}`,
+		},
+		outputs: egcOutputsSignal(from, to, forward),
+	}
+}
+
+func egcSchemaLeft(pk *model.PublicKey) string {
+	return `{"const":{"left":"` + (string)(*pk) + `"}}`
+}
+
+// members are told that pk has left
+func egcOutputsLeft(pk *model.PublicKey, members ...*model.PublicKey) []ExpectedOutput {
+	outputs := []ExpectedOutput{}
+	for _, member := range members {
+		outputs = append(outputs, ExpectedOutput{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              member,
+				Msgs:            []string{egcSchemaLeft(pk)},
+				TimeoutEnabled:  true,
+				TimeoutDuration: egcExpectedTimeoutDuration,
+			},
+		})
+	}
+	return outputs
+}
+
+// outputs to the other members when pk leaves.
+// remaining are told and carry on; last, if not nil, is the only member left and is finished too.
+func egcOutputsOthersOnLeave(pk *model.PublicKey, remaining []*model.PublicKey, last *model.PublicKey) []ExpectedOutput {
+	outputs := egcOutputsLeft(pk, remaining...)
+	if last != nil {
+		outputs = append(outputs, ExpectedOutput{
+			ro: model.RoutineOutput{
+				Pk:   last,
+				Msgs: []string{egcSchemaLeft(pk), schemaBareTerminate},
+				Done: true,
+			},
+		})
+	}
+	return outputs
+}
+
+func egcStepLeave(pk *model.PublicKey, remaining []*model.PublicKey, last *model.PublicKey) Step {
+	return Step{
+		description: pkToStr(pk)[:20] + " leaves",
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      pk,
+			Msg:     `{"leave":true}`,
+		},
+		outputs: append(
+			[]ExpectedOutput{{ro: model.RoutineOutput{Pk: pk, Msgs: []string{schemaBareTerminate}, Done: true}}},
+			egcOutputsOthersOnLeave(pk, remaining, last)...,
+		),
+	}
+}
+
+func egcStepCancel(pk *model.PublicKey, remaining []*model.PublicKey, last *model.PublicKey) Step {
+	return Step{
+		description: pkToStr(pk)[:20] + " cancels",
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      pk,
+			Msg:     `{"terminate":"cancel"}`,
+		},
+		outputs: append(
+			[]ExpectedOutput{{ro: model.RoutineOutput{Pk: pk, Msgs: []string{}, Done: true}}},
+			egcOutputsOthersOnLeave(pk, remaining, last)...,
+		),
+	}
+}
@@ -0,0 +1,329 @@
+package routines
+
+import (
+	"encoding/json"
+	"fmt"
+	"harmony/backend/model"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type FOState int
+
+const (
+	fo_entry FOState = iota
+	fo_reply
+)
+
+// how long B has to accept or decline the file by default.
+const defaultFOTimeout = 30 * time.Second
+
+// limits on the file metadata A can offer. The file itself goes over a data channel, never through the server.
+const (
+	// in characters
+	foMaxNameLength = 255
+	// in bytes. Large enough for any real file, small enough to be exact as a JSON number.
+	foMaxFileSize = 1 << 40
+	// in characters
+	foMaxMimeLength = 255
+)
+
+// type/subtype, as in RFC 6838, without parameters.
+const foMimePattern = `^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*$`
+
+// Lets A ask B whether it wants a file before they open a data channel for it.
+type FileOffer struct {
+	client *model.Client
+	pkA    *model.PublicKey
+	pkB    *model.PublicKey
+	hub    *model.Hub
+	state  FOState
+	config foConfig
+}
+
+// tunable parameters of FileOffer
+type foConfig struct {
+	timeout time.Duration
+}
+
+func defaultFOConfig() foConfig {
+	return foConfig{
+		timeout: defaultFOTimeout,
+	}
+}
+
+func newFileOffer(client *model.Client, hub *model.Hub) model.Routine {
+	return newFileOfferDependencyInj(client, hub, defaultFOConfig())
+}
+
+func newFileOfferDependencyInj(client *model.Client, hub *model.Hub, config foConfig) model.Routine {
+	return &FileOffer{
+		client: client,
+		hub:    hub,
+		state:  fo_entry,
+		config: config,
+	}
+}
+
+func (r *FileOffer) Next(args model.RoutineInput) []model.RoutineOutput {
+
+	switch args.MsgType {
+	case model.RoutineMsgType_Timeout:
+		ros := foError(nil, ERROR_TIMEOUT, "Timeout")
+		// before entry has run (or if it failed) there is no peer to tell
+		if args.Pk != nil && r.pkA != nil && r.pkB != nil {
+			switch *args.Pk {
+			case *r.pkA:
+				ros = append(ros, foError(r.pkB, ERROR_PEER_TIMEOUT, "Peer timed out")...)
+			case *r.pkB:
+				ros = append(ros, foError(r.pkA, ERROR_PEER_TIMEOUT, "Peer timed out")...)
+			}
+		}
+		return ros
+	case model.RoutineMsgType_ClientClose:
+		// terminate the other person
+		if args.Pk != nil && r.pkA != nil && r.pkB != nil {
+			switch *args.Pk {
+			case *r.pkA:
+				return peerDisconnected(r.pkB, args.LastWill)
+			case *r.pkB:
+				return peerDisconnected(r.pkA, args.LastWill)
+			}
+		}
+		return []model.RoutineOutput{}
+	case model.RoutineMsgType_UsrMsg:
+		if isClientCancelMsg(args.Msg) {
+			return r.cancel(args)
+		}
+		switch r.state {
+		case fo_entry:
+			return r.entry(args)
+		case fo_reply:
+			return r.reply(args)
+		default:
+			panic("unrecognized state")
+		}
+	default:
+		panic("unrecognized message type")
+	}
+
+}
+
+var foEntrySchema = func() *gojsonschema.Schema {
+	schemaStr := fmt.Sprintf(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"offerFile"
+			},
+			"key": {
+				"type":"string",
+				"pattern": "`+publicKeyPattern+`"
+			},
+			"file": {
+				"type": "object",
+				"properties": {
+					"name": {
+						"type": "string",
+						"minLength": 1,
+						"maxLength": %d
+					},
+					"size": {
+						"type": "integer",
+						"minimum": 0,
+						"maximum": %d
+					},
+					"mime": {
+						"type": "string",
+						"maxLength": %d,
+						"pattern": %q
+					}
+				},
+				"required": ["name", "size", "mime"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["initiate", "key", "file"],
+		"additionalProperties": false
+	}`, foMaxNameLength, foMaxFileSize, foMaxMimeLength, foMimePattern)
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// metadata of the file on offer, as A sent it and B receives it.
+type foFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Mime string `json:"mime"`
+}
+
+func (r *FileOffer) entry(args model.RoutineInput) []model.RoutineOutput {
+
+	// save pkA
+	r.pkA = args.Pk
+	if r.pkA == nil {
+		return foError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
+	}
+
+	// validate msg
+	result, err := validateJSON(foEntrySchema, args.Msg)
+	if err != nil {
+		return foError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return foError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Initiate string `json:"initiate"`
+		Key      string `json:"key"`
+		File     foFile `json:"file"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	r.pkB, err = parsePublicKey(usrMsg.Key)
+	if err != nil {
+		return foError(nil, ERROR_MALFORMED, err.Error())
+	}
+
+	// check pkB is different from pkA
+	if sameKey(*r.pkA, *r.pkB) {
+		return foError(nil, ERROR_SELF_NOT_ALLOWED, "Offering a file to yourself is not allowed")
+	}
+
+	if r.hub.Blocklist().Contains(*r.pkB) {
+		return foError(nil, ERROR_BANNED, "Peer is banned")
+	}
+
+	_, peerOnline := r.hub.GetClient(*r.pkB)
+
+	if !peerOnline {
+		// the file can only be sent while both are online, so the offer isn't held for B
+		return []model.RoutineOutput{
+			{
+				Msgs:       []string{`{"peerStatus":"offline","forwarded":null,"terminate":"done"}`},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+			},
+		}
+	}
+
+	r.state = fo_reply
+	// the metadata is chosen by A, so it is marshalled rather than pasted in, and B shouldn't trust it
+	msgToB, _ := json.Marshal(struct {
+		Initiate string `json:"initiate"`
+		Key      string `json:"key"`
+		File     foFile `json:"file"`
+	}{
+		Initiate: "receiveFileOffer",
+		Key:      publicKeyToString(*r.pkA),
+		File:     usrMsg.File,
+	})
+	return []model.RoutineOutput{
+		{
+			Pk:              r.pkB,
+			TimeoutDuration: r.config.timeout,
+			TimeoutEnabled:  true,
+			Msgs:            []string{string(msgToB)},
+		},
+	}
+}
+
+var foReplySchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"forward": {
+				"properties": {
+					"type": {
+						"enum": ["accept", "decline"]
+					}
+				},
+				"additionalProperties": false,
+				"required": ["type"]
+			}
+		},
+		"required": ["forward"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+func (r *FileOffer) reply(args model.RoutineInput) []model.RoutineOutput {
+
+	// check it's the correct pk
+	if args.Pk == nil || *args.Pk == *r.pkA {
+		return append(foError(nil, ERROR_OUT_OF_ORDER, "Message send out of order"), foError(r.pkB, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// validate msg
+	result, err := validateJSON(foReplySchema, args.Msg)
+	if err != nil {
+		return append(foError(nil, ERROR_MALFORMED, err.Error()), foError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if !result.Valid() {
+		return append(foError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result)), foError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Forward struct {
+			Type string `json:"type"`
+		} `json:"forward"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+
+	return []model.RoutineOutput{
+		{
+			Pk:         r.pkA,
+			Done:       true,
+			DoneReason: model.DoneReason_Completed,
+			Msgs:       []string{`{"peerStatus":"online","forwarded":{"type":"` + usrMsg.Forward.Type + `"},"terminate":"done"}`},
+		},
+		{
+			Pk:         r.pkB,
+			Done:       true,
+			DoneReason: model.DoneReason_Completed,
+			Msgs:       []string{`{"terminate":"done"}`},
+		},
+	}
+}
+
+func (r *FileOffer) cancel(args model.RoutineInput) []model.RoutineOutput {
+	if r.state == fo_entry {
+		return []model.RoutineOutput{{
+			Done:       true,
+			DoneReason: model.DoneReason_Cancelled,
+		}}
+	} else {
+		var peer = r.pkA
+		if *args.Pk == *r.pkA {
+			peer = r.pkB
+		}
+		return []model.RoutineOutput{
+			{
+				Done:       true,
+				DoneReason: model.DoneReason_Cancelled,
+			},
+			peerCancelledOutput(peer, parseCancelReason(args.Msg)),
+		}
+	}
+}
+
+// wrapper for error routine output
+func foError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
+	return []model.RoutineOutput{
+		{
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
+		},
+	}
+}
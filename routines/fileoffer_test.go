@@ -0,0 +1,477 @@
+package routines
+
+import (
+	"encoding/json"
+	"harmony/backend/model"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const foExpectedTimeoutDuration = 30 * time.Second
+
+const foFileJSON = `{"name": "holiday.jpg", "size": 2048, "mime": "image/jpeg"}`
+
+func TestFileOffer(t *testing.T) {
+
+	t.Run("Valid inputs", func(t *testing.T) {
+
+		t.Run("Peer is offline", func(t *testing.T) {
+			client := &model.Client{}
+			client.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			hub.AddClient(*client.GetPublicKey(), client)
+			fo := newFileOffer(client, hub)
+
+			testRunner(t, fo, []Step{foStepInitiateOffline})
+
+			// the offer isn't held for B
+			if msgs := hub.DrainOffline(publicKey1); len(msgs) != 0 {
+				t.Errorf("Expected nothing queued for B, got %v", msgs)
+			}
+		})
+
+		t.Run("Peer is online", func(t *testing.T) {
+
+			for _, status := range []string{"accept", "decline"} {
+				t.Run(status, func(t *testing.T) {
+
+					test := []Step{
+						foStepInitiateOnline,
+						foResponseFromB(status),
+					}
+
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(*clientA.GetPublicKey(), clientA)
+					hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+					fo := newFileOffer(clientA, hub)
+
+					testRunner(t, fo, test)
+				})
+			}
+		})
+
+		t.Run("B cancels with a reason", func(t *testing.T) {
+			for _, tt := range cancelWithReasonCases {
+				t.Run(tt.cancelMsg, func(t *testing.T) {
+					test := []Step{
+						foStepInitiateOnline,
+						stepPkBCancelWithReason(tt.cancelMsg, tt.expectedReason),
+					}
+
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(*clientA.GetPublicKey(), clientA)
+					hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+					fo := newFileOffer(clientA, hub)
+
+					testRunner(t, fo, test)
+				})
+			}
+		})
+
+		t.Run("Metadata is forwarded as sent", func(t *testing.T) {
+
+			// includes characters that would break naive string concatenation
+			files := []string{
+				`{"name": "a", "size": 0, "mime": "application/octet-stream"}`,
+				`{"name": "report \"final\" \\ \"key\":\"injected\"}.pdf", "size": 1, "mime": "application/pdf"}`,
+				`{"name": "` + strings.Repeat("é", foMaxNameLength) + `", "size": ` + strconv.Itoa(foMaxFileSize) + `, "mime": "application/vnd.openxmlformats-officedocument.wordprocessingml.document"}`,
+			}
+
+			for i, file := range files {
+				t.Run(strconv.Itoa(i), func(t *testing.T) {
+					test := []Step{
+						{
+							description: "A offers a file and server forwards it to B",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg:     `{"initiate": "offerFile", "key": "` + (string)(publicKey1) + `", "file": ` + file + `}`,
+							},
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey1,
+										Msgs: []string{foSchemaInitiateToB((string)(publicKey0), file)},
+									},
+								},
+							},
+						},
+						foResponseFromB("accept"),
+					}
+
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(*clientA.GetPublicKey(), clientA)
+					hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+					fo := newFileOffer(clientA, hub)
+
+					testRunner(t, fo, test)
+				})
+			}
+		})
+
+	})
+
+	t.Run("Custom timeout", func(t *testing.T) {
+		customTimeout := 90 * time.Second
+
+		initiate := foStepInitiateOnline
+		initiate.outputs = []ExpectedOutput{
+			{
+				verifyTimeouts: true,
+				ro: model.RoutineOutput{
+					Pk:              &publicKey1,
+					Msgs:            []string{foSchemaInitiateToB((string)(publicKey0), foFileJSON)},
+					TimeoutEnabled:  true,
+					TimeoutDuration: customTimeout,
+				},
+			},
+		}
+
+		clientA := &model.Client{}
+		clientA.SetPublicKey(&publicKey0)
+		clientB := &model.Client{}
+		clientB.SetPublicKey(&publicKey1)
+		hub := model.NewHub()
+		hub.AddClient(publicKey0, clientA)
+		hub.AddClient(publicKey1, clientB)
+		fo := newFileOfferDependencyInj(clientA, hub, foConfig{timeout: customTimeout})
+
+		testRunner(t, fo, []Step{initiate, foResponseFromB("accept")})
+	})
+
+	t.Run("Invalid inputs", func(t *testing.T) {
+		t.Run("User has not provided their public key", func(t *testing.T) {
+
+			test := []Step{
+				{
+					description: "A offers a file without having provided their public key",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      nil,
+						Msg:     foStepInitiateOnline.input.Msg,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   nil,
+								Msgs: []string{errorSchemaString("You have not provided a public key")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			client := &model.Client{}
+			hub := model.NewHub()
+			fo := newFileOffer(client, hub)
+
+			testRunner(t, fo, test)
+		})
+
+		t.Run("User attempts to offer a file to themself", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "User offers a file to themself",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg:     `{"initiate": "offerFile", "key": "` + (string)(publicKey0) + `", "file": ` + foFileJSON + `}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{errorCodeSchemaString(ERROR_SELF_NOT_ALLOWED, "Offering a file to yourself is not allowed")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+			client := &model.Client{}
+			client.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			hub.AddClient(*client.GetPublicKey(), client)
+			fo := newFileOffer(client, hub)
+
+			testRunner(t, fo, test)
+		})
+
+		t.Run("User attempts to offer a file to a banned key", func(t *testing.T) {
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			hub.Blocklist().Add(publicKey1)
+			fo := newFileOffer(clientA, hub)
+
+			testRunner(t, fo, []Step{
+				{
+					description: "A offers a file to B, who is banned",
+					input:       foStepInitiateOnline.input,
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{errorCodeSchemaString(ERROR_BANNED, "Peer is banned")},
+								Done: true,
+							},
+						},
+					},
+				},
+			})
+		})
+
+		// initial message offering file, which is the JSON of the file property
+		offer := func(file string) string {
+			return `{"initiate": "offerFile", "key": "` + (string)(publicKey1) + `", "file": ` + file + `}`
+		}
+
+		// tests where both are signed in
+		tests := []struct {
+			description  string
+			prefaceSteps []Step
+			cases        []Step
+		}{
+			{
+				description:  "A sends a bad initial message",
+				prefaceSteps: []Step{},
+				cases: []Step{
+					{
+						description: "No key",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: `{"initiate": "offerFile", "file": ` + foFileJSON + `}`},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Key in wrong format",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: `{"initiate": "offerFile", "key":"4", "file": ` + foFileJSON + `}`},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Key is not Ed25519 (NIST curve)",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: `{"initiate": "offerFile", "key":"` + invalidPublicKeyNIST + `", "file": ` + foFileJSON + `}`},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "No file",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: `{"initiate": "offerFile", "key":"` + (string)(publicKey1) + `"}`},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Empty name",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: offer(`{"name": "", "size": 1, "mime": "text/plain"}`)},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Name too long",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: offer(`{"name": "` + strings.Repeat("a", foMaxNameLength+1) + `", "size": 1, "mime": "text/plain"}`)},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Negative size",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: offer(`{"name": "a.txt", "size": -1, "mime": "text/plain"}`)},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Size too large",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: offer(`{"name": "a.txt", "size": ` + strconv.Itoa(foMaxFileSize+1) + `, "mime": "text/plain"}`)},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Fractional size",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: offer(`{"name": "a.txt", "size": 1.5, "mime": "text/plain"}`)},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Mime without a subtype",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: offer(`{"name": "a.txt", "size": 1, "mime": "text"}`)},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Mime with parameters",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: offer(`{"name": "a.txt", "size": 1, "mime": "text/plain; charset=utf-8"}`)},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Extra file properties",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: offer(`{"name": "a.txt", "size": 1, "mime": "text/plain", "path": "/etc"}`)},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Invalid JSON",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: `)`},
+						outputs:     outputPkAError,
+					},
+					{
+						description: "Extra properties",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: `{"initiate": "offerFile", "key":"` + (string)(publicKey1) + `", "file": ` + foFileJSON + `, "extraProperty!":{}}`},
+						outputs:     outputPkAError,
+					},
+				},
+			},
+			{
+				description: "A has offered B a file",
+				prefaceSteps: []Step{
+					foStepInitiateOnline,
+				},
+				cases: []Step{
+					stepPkADisconnect,
+					stepPkBDisconnect,
+					stepPkBTimeout,
+					stepPkACancel,
+					stepPkBCancel,
+					{
+						description: "B sends no forward property",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey1, Msg: `{}`},
+						outputs:     outputPkBErrorToBoth,
+					},
+					{
+						description: "B sends malformed JSON",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey1, Msg: `{`},
+						outputs:     outputPkBErrorToBoth,
+					},
+					{
+						description: "B sends invalid response (not accept or decline)",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey1, Msg: `{"forward": {"type": "reject"}}`},
+						outputs:     outputPkBErrorToBoth,
+					},
+					{
+						description: "A sends message out of order",
+						input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey0, Msg: "boo!"},
+						outputs:     outputPkAErrorToBoth,
+					},
+				},
+			},
+		}
+
+		for _, test := range tests {
+
+			for j, testCase := range test.cases {
+
+				t.Run(test.description+"-"+strconv.Itoa(j), func(t *testing.T) {
+
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					hub.AddClient(publicKey1, clientB)
+					fo := newFileOffer(clientA, hub)
+
+					testRunner(t, fo, append(test.prefaceSteps, testCase), testRunnerConfig{errorsOnLastStepOnly: true})
+				})
+
+			}
+		}
+
+	})
+
+}
+
+var foStepInitiateOffline = Step{
+	description: "A offers a file to B, who is offline",
+	input:       foStepInitiateOnline.input,
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{ectpSchemaOfflineToA},
+				Done: true,
+			},
+		},
+	},
+}
+
+var foStepInitiateOnline = Step{
+	description: "A offers a file and server sends it to B",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg:     `{"initiate": "offerFile", "key": "` + (string)(publicKey1) + `", "file": ` + foFileJSON + `}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{foSchemaInitiateToB((string)(publicKey0), foFileJSON)},
+				TimeoutEnabled:  true,
+				TimeoutDuration: foExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+func foResponseFromB(status string) Step {
+	return Step{
+		description: "B responds with " + status,
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      &publicKey1,
+			Msg:     `{"forward": {"type": "` + status + `"}}`,
+		},
+		outputs: []ExpectedOutput{
+			{
+				ro: model.RoutineOutput{
+					Pk:   &publicKey1,
+					Msgs: []string{schemaBareTerminate},
+					Done: true,
+				},
+			},
+			{
+				ro: model.RoutineOutput{
+					Pk: &publicKey0,
+					// same as a friend request's
+					Msgs: []string{frForwardToA(status)},
+					Done: true,
+				},
+			},
+		},
+	}
+}
+
+// fileJSON is the file object A sent, which B should get exactly.
+func foSchemaInitiateToB(pkb32 string, fileJSON string) string {
+	var file map[string]any
+	json.Unmarshal([]byte(fileJSON), &file)
+	fileConst, _ := json.Marshal(file)
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"receiveFileOffer"
+			},
+			"key": {
+				"const": "` + pkb32 + `"
+			},
+			"file": {
+				"const": ` + string(fileConst) + `
+			}
+		},
+		"required": ["initiate", "key", "file"],
+		"additionalProperties": false
+	}`
+}
@@ -0,0 +1,96 @@
+package routines
+
+import (
+	"harmony/backend/model"
+	"strconv"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// most messages held for a peer that has run out of credits. Once a peer has this many waiting, the sender is sending too fast.
+const defaultMaxHeldMessages = 64
+
+// most credits a peer can have at once, or grant in one message. Grants that would take it over are capped, rather than rejected.
+const maxCredits = 1 << 16
+
+// sent to a peer when messages are waiting for it to grant more credits.
+const needCreditsMsg = `{"needCredits":true}`
+
+// Credit-based flow control for routines that forward messages between peers, so that a fast sender can't overwhelm a slow receiver.
+// Each peer grants credits with {"credits":<n>}, and is forwarded one message for each credit.
+// Messages for a peer with no credits left are held, in order, and it is sent {"needCredits":true} until it grants more.
+// Routines opt in by forwarding through a flowControl instead of sending outputs straight to the peer. Peers start with no credits.
+type flowControl struct {
+	// credits each peer has left, by the public key receiving the messages
+	credits map[model.PublicKey]int
+	// messages waiting for each peer to grant credits, oldest first
+	held    map[model.PublicKey][]string
+	maxHeld int
+	// whether each peer has been sent needCredits since it last granted credits, so that it is only asked once
+	asked map[model.PublicKey]bool
+}
+
+func newFlowControl(maxHeld int) *flowControl {
+	return &flowControl{
+		credits: make(map[model.PublicKey]int),
+		held:    make(map[model.PublicKey][]string),
+		maxHeld: maxHeld,
+		asked:   make(map[model.PublicKey]bool),
+	}
+}
+
+// the messages to send to to now that msg is for them: msg if they have a credit for it, needCredits if it has to be held
+// and they haven't been asked for credits yet, or nothing.
+// ok is false if too many messages are already held for to, and msg has been dropped.
+func (f *flowControl) forward(to model.PublicKey, msg string) (msgs []string, ok bool) {
+	if f.credits[to] > 0 && len(f.held[to]) == 0 {
+		f.credits[to]--
+		return []string{msg}, true
+	}
+	if len(f.held[to]) >= f.maxHeld {
+		return nil, false
+	}
+	f.held[to] = append(f.held[to], msg)
+	if f.asked[to] {
+		return []string{}, true
+	}
+	f.asked[to] = true
+	return []string{needCreditsMsg}, true
+}
+
+// from grants n more credits. Returns the held messages that can now be sent to from, followed by needCredits if any are still held.
+func (f *flowControl) grant(from model.PublicKey, n int) []string {
+	f.credits[from] = min(f.credits[from]+n, maxCredits)
+	f.asked[from] = false
+
+	held := f.held[from]
+	released := min(len(held), f.credits[from])
+	msgs := append([]string{}, held[:released]...)
+	f.held[from] = held[released:]
+	f.credits[from] -= released
+	if len(f.held[from]) > 0 {
+		f.asked[from] = true
+		msgs = append(msgs, needCreditsMsg)
+	}
+	return msgs
+}
+
+// {"credits":<n>}, granting n more credits.
+var creditsSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"credits": {
+				"type": "integer",
+				"minimum": 1,
+				"maximum": ` + strconv.Itoa(maxCredits) + `
+			}
+		},
+		"required": ["credits"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
@@ -8,30 +8,30 @@ import (
 )
 
 type FriendRejection struct {
-	hub *model.Hub
-	pkA *model.PublicKey
-	pkB *model.PublicKey
+	client *model.Client
+	hub    *model.Hub
+	pkA    *model.PublicKey
+	pkB    *model.PublicKey
 }
 
 func newFriendRejection(client *model.Client, hub *model.Hub) model.Routine {
-	return &FriendRejection{hub: hub}
+	return &FriendRejection{client: client, hub: hub}
 }
 
 func (r *FriendRejection) Next(args model.RoutineInput) []model.RoutineOutput {
 	// only 1 step, don't need to worry about state.
 	r.pkA = args.Pk
 	if r.pkA == nil {
-		return frejError(nil, "You have not provided a public key")
+		return frejError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
 	}
 
 	// validate msg
-	usrMsgLoader := gojsonschema.NewStringLoader(args.Msg)
-	result, err := frejSchema.Validate(usrMsgLoader)
+	result, err := validateJSON(frejSchema, args.Msg)
 	if err != nil {
-		return frejError(nil, err.Error())
+		return frejError(nil, ERROR_MALFORMED, err.Error())
 	}
 	if !result.Valid() {
-		return frejError(nil, formatJSONError(result))
+		return frejError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
 	}
 
 	// parse msg
@@ -40,11 +40,14 @@ func (r *FriendRejection) Next(args model.RoutineInput) []model.RoutineOutput {
 		Key      string `json:"key"`
 	}{}
 	json.Unmarshal([]byte(args.Msg), &usrMsg)
-	r.pkB, _ = parsePublicKey(usrMsg.Key)
+	r.pkB, err = parsePublicKey(usrMsg.Key)
+	if err != nil {
+		return frejError(nil, ERROR_MALFORMED, err.Error())
+	}
 
 	// check pkB is different from pkA
-	if *(r.pkA) == *(r.pkB) {
-		return ectpError(nil, "You can't reject yourself")
+	if sameKey(*r.pkA, *r.pkB) {
+		return ectpError(nil, ERROR_SELF_NOT_ALLOWED, "You can't reject yourself")
 	}
 
 	_, peerOnline := r.hub.GetClient(*r.pkB)
@@ -52,22 +55,25 @@ func (r *FriendRejection) Next(args model.RoutineInput) []model.RoutineOutput {
 	if peerOnline {
 		return []model.RoutineOutput{
 			{
-				Pk:   r.pkA,
-				Done: true,
-				Msgs: []string{`{"peerStatus":"online","terminate":"done"}`},
+				Pk:         r.pkA,
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Msgs:       []string{`{"peerStatus":"online","terminate":"done"}`},
 			},
 			{
-				Pk:   r.pkB,
-				Done: true,
-				Msgs: []string{`{"initiate":"receiveFriendRejection","terminate":"done","key":"` + publicKeyToString(*r.pkA) + `"}`},
+				Pk:         r.pkB,
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Msgs:       []string{`{"initiate":"receiveFriendRejection","terminate":"done","key":"` + publicKeyToString(*r.pkA) + `"}`},
 			},
 		}
 	} else {
 		return []model.RoutineOutput{
 			{
-				Pk:   r.pkA,
-				Done: true,
-				Msgs: []string{`{"peerStatus":"offline","terminate":"done"}`},
+				Pk:         r.pkA,
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Msgs:       []string{`{"peerStatus":"offline","terminate":"done"}`},
 			},
 		}
 	}
@@ -95,12 +101,13 @@ var frejSchema = func() *gojsonschema.Schema {
 }()
 
 // wrapper for error routine output
-func frejError(pk *model.PublicKey, msgs ...string) []model.RoutineOutput {
+func frejError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
 	return []model.RoutineOutput{
 		{
-			Pk:   pk,
-			Done: true,
-			Msgs: []string{MakeJSONError(msgs...)},
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
 		},
 	}
 }
@@ -132,6 +132,36 @@ func TestFriendRejection(t *testing.T) {
 				outputs: outputPkAError,
 			},
 
+			{
+				description: "Key is not Ed25519 (NIST curve)",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "sendFriendRejection", "key":"` + invalidPublicKeyNIST + `"}`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Key is not Ed25519 (truncated)",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "sendFriendRejection", "key":"` + invalidPublicKeyTruncated + `"}`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Key is not Ed25519 (corrupted DER header)",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "sendFriendRejection", "key":"` + invalidPublicKeyCorruptedHeader + `"}`,
+				},
+				outputs: outputPkAError,
+			},
+
 			{
 				description: "Invalid JSON",
 				input: model.RoutineInput{
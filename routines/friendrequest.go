@@ -2,6 +2,7 @@ package routines
 
 import (
 	"encoding/json"
+	"fmt"
 	"harmony/backend/model"
 	"time"
 
@@ -13,21 +14,51 @@ type FRState int
 const (
 	fr_entry FRState = iota
 	fr_reply
+	// B has said it is deciding, and can only accept or reject now.
+	fr_pending
 )
 
-const frTimeOut = 10 * time.Second
+// how long B has to reply to the request by default.
+const defaultFRTimeout = 10 * time.Second
+
+// how long A has to wait before sending B another request, unless B replies to the first.
+const defaultFRCooldown = 30 * time.Second
+
+// maximum length of the optional message sent with a friend request, in characters
+const frMaxMessageLength = 256
 
 type FriendRequest struct {
-	pkA   *model.PublicKey
-	pkB   *model.PublicKey
-	hub   *model.Hub
-	state FRState
+	client *model.Client
+	pkA    *model.PublicKey
+	pkB    *model.PublicKey
+	hub    *model.Hub
+	state  FRState
+	config frConfig
+}
+
+// tunable parameters of FriendRequest
+type frConfig struct {
+	timeout  time.Duration
+	cooldown time.Duration
+}
+
+func defaultFRConfig() frConfig {
+	return frConfig{
+		timeout:  defaultFRTimeout,
+		cooldown: defaultFRCooldown,
+	}
 }
 
 func newFriendRequest(client *model.Client, hub *model.Hub) model.Routine {
+	return newFriendRequestDependencyInj(client, hub, defaultFRConfig())
+}
+
+func newFriendRequestDependencyInj(client *model.Client, hub *model.Hub, config frConfig) model.Routine {
 	return &FriendRequest{
-		hub:   hub,
-		state: fr_entry,
+		client: client,
+		hub:    hub,
+		state:  fr_entry,
+		config: config,
 	}
 }
 
@@ -35,24 +66,28 @@ func (r *FriendRequest) Next(args model.RoutineInput) []model.RoutineOutput {
 
 	switch args.MsgType {
 	case model.RoutineMsgType_Timeout:
-		ros := frError(nil, "Timeout")
-		switch *args.Pk {
-		case *r.pkA:
-			ros = append(ros, frError(r.pkB, "Peer timed out")...)
-		case *r.pkB:
-			ros = append(ros, frError(r.pkA, "Peer timed out")...)
+		ros := frError(nil, ERROR_TIMEOUT, "Timeout")
+		// before entry has run (or if it failed) there is no peer to tell
+		if args.Pk != nil && r.pkA != nil && r.pkB != nil {
+			switch *args.Pk {
+			case *r.pkA:
+				ros = append(ros, frError(r.pkB, ERROR_PEER_TIMEOUT, "Peer timed out")...)
+			case *r.pkB:
+				ros = append(ros, frError(r.pkA, ERROR_PEER_TIMEOUT, "Peer timed out")...)
+			}
 		}
 		return ros
 	case model.RoutineMsgType_ClientClose:
 		// terminate the other person
-		switch *args.Pk {
-		case *r.pkA:
-			return frError(r.pkB, "Peer disconnected")
-		case *r.pkB:
-			return frError(r.pkA, "Peer disconnected")
-		default:
-			panic("unknown pk")
+		if args.Pk != nil && r.pkA != nil && r.pkB != nil {
+			switch *args.Pk {
+			case *r.pkA:
+				return peerDisconnected(r.pkB, args.LastWill)
+			case *r.pkB:
+				return peerDisconnected(r.pkA, args.LastWill)
+			}
 		}
+		return []model.RoutineOutput{}
 	case model.RoutineMsgType_UsrMsg:
 		if isClientCancelMsg(args.Msg) {
 			return r.cancel(args)
@@ -60,7 +95,7 @@ func (r *FriendRequest) Next(args model.RoutineInput) []model.RoutineOutput {
 		switch r.state {
 		case fr_entry:
 			return r.entry(args)
-		case fr_reply:
+		case fr_reply, fr_pending:
 			return r.reply(args)
 		default:
 			panic("unrecognized state")
@@ -72,7 +107,7 @@ func (r *FriendRequest) Next(args model.RoutineInput) []model.RoutineOutput {
 }
 
 var frEntrySchema = func() *gojsonschema.Schema {
-	schemaStr := `{
+	schemaStr := fmt.Sprintf(`{
 		"$schema": "https://json-schema.org/draft/2020-12/schema",
 		"type": "object",
 		"properties": {
@@ -81,12 +116,16 @@ var frEntrySchema = func() *gojsonschema.Schema {
 			},
 			"key": {
 				"type":"string",
-				"pattern": "` + publicKeyPattern + `"
+				"pattern": "`+publicKeyPattern+`"
+			},
+			"message": {
+				"type":"string",
+				"maxLength": %d
 			}
 		},
 		"required": ["initiate", "key"],
 		"additionalProperties": false
-	}`
+	}`, frMaxMessageLength)
 	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
 	schema, _ := gojsonschema.NewSchema(schemaLoader)
 	return schema
@@ -97,49 +136,83 @@ func (r *FriendRequest) entry(args model.RoutineInput) []model.RoutineOutput {
 	// save pkA
 	r.pkA = args.Pk
 	if r.pkA == nil {
-		return frError(nil, "You have not provided a public key")
+		return frError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
 	}
 
 	// validate msg
-	usrMsgLoader := gojsonschema.NewStringLoader(args.Msg)
-	result, err := frEntrySchema.Validate(usrMsgLoader)
+	result, err := validateJSON(frEntrySchema, args.Msg)
 	if err != nil {
-		return frError(nil, err.Error())
+		return frError(nil, ERROR_MALFORMED, err.Error())
 	}
 	if !result.Valid() {
-		return frError(nil, formatJSONError(result))
+		return frError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
 	}
 
 	// parse msg
 	usrMsg := struct {
 		Initiate string `json:"initiate"`
 		Key      string `json:"key"`
+		Message  string `json:"message"`
 	}{}
 	json.Unmarshal([]byte(args.Msg), &usrMsg)
-	r.pkB, _ = parsePublicKey(usrMsg.Key)
+	r.pkB, err = parsePublicKey(usrMsg.Key)
+	if err != nil {
+		return frError(nil, ERROR_MALFORMED, err.Error())
+	}
 
 	// check pkB is different from pkA
-	if *(r.pkA) == *(r.pkB) {
-		return ectpError(nil, "Sending a friend request to yourself is not allowed")
+	if sameKey(*r.pkA, *r.pkB) {
+		return ectpError(nil, ERROR_SELF_NOT_ALLOWED, "Sending a friend request to yourself is not allowed")
+	}
+
+	if r.hub.Blocklist().Contains(*r.pkB) {
+		return frError(nil, ERROR_BANNED, "Peer is banned")
+	}
+
+	// don't let A flood B with requests
+	if !r.hub.TryStartFriendRequest(*r.pkA, *r.pkB, r.config.cooldown) {
+		return frError(nil, ERROR_RATE_LIMITED, "Too many requests to this peer")
 	}
 
 	_, peerOnline := r.hub.GetClient(*r.pkB)
 
 	if peerOnline {
 		r.state = fr_reply
+		msgToB, _ := json.Marshal(struct {
+			Initiate string `json:"initiate"`
+			Key      string `json:"key"`
+			Message  string `json:"message,omitempty"`
+		}{
+			Initiate: "receiveFriendRequest",
+			Key:      publicKeyToString(*r.pkA),
+			Message:  usrMsg.Message,
+		})
 		return []model.RoutineOutput{
 			{
 				Pk:              r.pkB,
-				TimeoutDuration: frTimeOut,
+				TimeoutDuration: r.config.timeout,
 				TimeoutEnabled:  true,
-				Msgs:            []string{`{"initiate":"receiveFriendRequest","key":"` + publicKeyToString(*r.pkA) + `"}`},
+				Msgs:            []string{string(msgToB)},
 			},
 		}
 	} else {
+		// B gets the request when they next come online, but can't reply to it then.
+		dataToB := struct {
+			OfflineFriendRequest struct {
+				Key     string `json:"key"`
+				Message string `json:"message,omitempty"`
+			} `json:"offlineFriendRequest"`
+		}{}
+		dataToB.OfflineFriendRequest.Key = publicKeyToString(*r.pkA)
+		dataToB.OfflineFriendRequest.Message = usrMsg.Message
+		msgToB, _ := json.Marshal(dataToB)
+		r.hub.EnqueueOffline(*r.pkB, model.OfflineMessage{Msg: string(msgToB)})
+
 		return []model.RoutineOutput{
 			{
-				Msgs: []string{`{"peerStatus":"offline","forwarded":null,"terminate":"done"}`},
-				Done: true,
+				Msgs:       []string{`{"peerStatus":"offline","forwarded":null,"terminate":"done"}`},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
 			},
 		}
 	}
@@ -173,17 +246,16 @@ func (r *FriendRequest) reply(args model.RoutineInput) []model.RoutineOutput {
 
 	// check it's the correct pk
 	if args.Pk == nil || *args.Pk == *r.pkA {
-		return append(frError(nil, "Message send out of order"), frError(r.pkB, "Peer sent a malformed message")...)
+		return append(frError(nil, ERROR_OUT_OF_ORDER, "Message send out of order"), frError(r.pkB, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 
 	// validate msg
-	usrMsgLoader := gojsonschema.NewStringLoader(args.Msg)
-	result, err := frReplySchema.Validate(usrMsgLoader)
+	result, err := validateJSON(frReplySchema, args.Msg)
 	if err != nil {
-		return append(frError(nil, err.Error()), frError(r.pkA, "Peer sent a malformed message")...)
+		return append(frError(nil, ERROR_MALFORMED, err.Error()), frError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 	if !result.Valid() {
-		return append(frError(nil, formatJSONError(result)), frError(r.pkA, "Peer sent a malformed message")...)
+		return append(frError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result)), frError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
 	}
 
 	// parse msg
@@ -194,16 +266,40 @@ func (r *FriendRequest) reply(args model.RoutineInput) []model.RoutineOutput {
 	}{}
 	json.Unmarshal([]byte(args.Msg), &usrMsg)
 
+	// B has seen the request, so A can send another
+	r.hub.ClearFriendRequestCooldown(*r.pkA, *r.pkB)
+
+	// B is still deciding, so it gets more time to accept or reject
+	if usrMsg.Forward.Type == "pending" {
+		if r.state == fr_pending {
+			return append(frError(nil, ERROR_OUT_OF_ORDER, "Request is already pending"), frError(r.pkA, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+		}
+		r.state = fr_pending
+		return []model.RoutineOutput{
+			{
+				Pk:   r.pkA,
+				Msgs: []string{`{"peerStatus":"online","forwarded":{"type":"pending"}}`},
+			},
+			{
+				Pk:              r.pkB,
+				TimeoutEnabled:  true,
+				TimeoutDuration: r.config.timeout,
+			},
+		}
+	}
+
 	return []model.RoutineOutput{
 		{
-			Pk:   r.pkA,
-			Done: true,
-			Msgs: []string{`{"peerStatus":"online","forwarded":{"type":"` + usrMsg.Forward.Type + `"},"terminate":"done"}`},
+			Pk:         r.pkA,
+			Done:       true,
+			DoneReason: model.DoneReason_Completed,
+			Msgs:       []string{`{"peerStatus":"online","forwarded":{"type":"` + usrMsg.Forward.Type + `"},"terminate":"done"}`},
 		},
 		{
-			Pk:   r.pkB,
-			Done: true,
-			Msgs: []string{`{"terminate":"done"}`},
+			Pk:         r.pkB,
+			Done:       true,
+			DoneReason: model.DoneReason_Completed,
+			Msgs:       []string{`{"terminate":"done"}`},
 		},
 	}
 }
@@ -211,7 +307,8 @@ func (r *FriendRequest) reply(args model.RoutineInput) []model.RoutineOutput {
 func (r *FriendRequest) cancel(args model.RoutineInput) []model.RoutineOutput {
 	if r.state == fr_entry {
 		return []model.RoutineOutput{{
-			Done: true,
+			Done:       true,
+			DoneReason: model.DoneReason_Cancelled,
 		}}
 	} else {
 		var peer = r.pkA
@@ -220,20 +317,22 @@ func (r *FriendRequest) cancel(args model.RoutineInput) []model.RoutineOutput {
 		}
 		return []model.RoutineOutput{
 			{
-				Done: true,
+				Done:       true,
+				DoneReason: model.DoneReason_Cancelled,
 			},
-			frError(peer, "Peer cancelled the transaction")[0],
+			peerCancelledOutput(peer, parseCancelReason(args.Msg)),
 		}
 	}
 }
 
 // wrapper for error routine output
-func frError(pk *model.PublicKey, msgs ...string) []model.RoutineOutput {
+func frError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
 	return []model.RoutineOutput{
 		{
-			Pk:   pk,
-			Done: true,
-			Msgs: []string{MakeJSONError(msgs...)},
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
 		},
 	}
 }
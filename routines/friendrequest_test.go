@@ -1,8 +1,10 @@
 package routines
 
 import (
+	"encoding/json"
 	"harmony/backend/model"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,11 +28,17 @@ func TestFriendRequest(t *testing.T) {
 
 			testRunner(t, fr, test)
 
+			// the request is held for B
+			msgs := hub.DrainOffline(publicKey1)
+			expected := `{"offlineFriendRequest":{"key":"` + (string)(publicKey0) + `"}}`
+			if len(msgs) != 1 || msgs[0].Msg != expected {
+				t.Errorf("Expected %s to be queued for B, got %v", expected, msgs)
+			}
 		})
 
 		t.Run("Friend is online", func(t *testing.T) {
 
-			statuses := []string{"accept", "reject", "pending"}
+			statuses := []string{"accept", "reject"}
 
 			for _, status := range statuses {
 				t.Run(status, func(t *testing.T) {
@@ -55,6 +63,239 @@ func TestFriendRequest(t *testing.T) {
 			}
 		})
 
+		t.Run("B says the request is pending before replying", func(t *testing.T) {
+
+			for _, status := range []string{"accept", "reject"} {
+				t.Run(status, func(t *testing.T) {
+
+					test := []Step{
+						frStepInitiateOnline,
+						frStepPendingFromB,
+						frResponseFromB(status),
+					}
+
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(*clientA.GetPublicKey(), clientA)
+					hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+					fr := newFriendRequest(clientA, hub)
+
+					testRunner(t, fr, test)
+				})
+			}
+		})
+
+		t.Run("B times out after saying the request is pending", func(t *testing.T) {
+
+			test := []Step{
+				frStepInitiateOnline,
+				frStepPendingFromB,
+				stepPkBTimeout,
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(*clientA.GetPublicKey(), clientA)
+			hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+			fr := newFriendRequest(clientA, hub)
+
+			testRunner(t, fr, test)
+		})
+
+		t.Run("B cancels with a reason", func(t *testing.T) {
+			for _, tt := range cancelWithReasonCases {
+				t.Run(tt.cancelMsg, func(t *testing.T) {
+					test := []Step{
+						frStepInitiateOnline,
+						stepPkBCancelWithReason(tt.cancelMsg, tt.expectedReason),
+					}
+
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(*clientA.GetPublicKey(), clientA)
+					hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+					fr := newFriendRequest(clientA, hub)
+
+					testRunner(t, fr, test)
+				})
+			}
+		})
+
+		t.Run("Friend is online and A sends a message", func(t *testing.T) {
+
+			// includes characters that would break naive string concatenation
+			messages := []string{
+				"Hi, we met at the conference",
+				`Hi "B", \ "key":"injected"}`,
+				strings.Repeat("é", frMaxMessageLength),
+			}
+
+			for _, message := range messages {
+				t.Run(message, func(t *testing.T) {
+					messageJSON, _ := json.Marshal(message)
+					test := []Step{
+						{
+							description: "A sends a request with a message and server forwards it to B",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg: `{
+									"initiate": "sendFriendRequest",
+									"key": "` + (string)(publicKey1) + `",
+									"message": ` + string(messageJSON) + `
+								}`,
+							},
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey1,
+										Msgs: []string{frSchemaInitiateWithMessageToB((string)(publicKey0), string(messageJSON))},
+									},
+								},
+							},
+						},
+						frResponseFromB("accept"),
+					}
+
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					clientB := &model.Client{}
+					clientB.SetPublicKey(&publicKey1)
+					hub := model.NewHub()
+					hub.AddClient(*clientA.GetPublicKey(), clientA)
+					hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+					fr := newFriendRequest(clientA, hub)
+
+					testRunner(t, fr, test)
+				})
+			}
+		})
+
+	})
+
+	t.Run("Custom timeout", func(t *testing.T) {
+		customTimeout := 90 * time.Second
+
+		initiate := frStepInitiateOnline
+		initiate.outputs = []ExpectedOutput{
+			{
+				verifyTimeouts: true,
+				ro: model.RoutineOutput{
+					Pk:              &publicKey1,
+					Msgs:            []string{frSchemaInitiateToB((string)(publicKey0))},
+					TimeoutEnabled:  true,
+					TimeoutDuration: customTimeout,
+				},
+			},
+		}
+
+		clientA := &model.Client{}
+		clientA.SetPublicKey(&publicKey0)
+		clientB := &model.Client{}
+		clientB.SetPublicKey(&publicKey1)
+		hub := model.NewHub()
+		hub.AddClient(publicKey0, clientA)
+		hub.AddClient(publicKey1, clientB)
+		fr := newFriendRequestDependencyInj(clientA, hub, frConfig{timeout: customTimeout})
+
+		testRunner(t, fr, []Step{initiate, frResponseFromB("accept")})
+	})
+
+	t.Run("Cooldown", func(t *testing.T) {
+
+		// A and B online, on a hub whose clock only moves when told to
+		newHub := func(clock *fakeClock) *model.Hub {
+			hub := model.NewHub()
+			hub.SetClock(clock)
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			return hub
+		}
+		newFR := func(hub *model.Hub) model.Routine {
+			return newFriendRequest(&model.Client{}, hub)
+		}
+
+		t.Run("A second request within the window is blocked", func(t *testing.T) {
+			clock := &fakeClock{}
+			hub := newHub(clock)
+			testRunner(t, newFR(hub), []Step{frStepInitiateOnline, stepPkACancel})
+
+			clock.Advance(defaultFRCooldown - time.Second)
+			testRunner(t, newFR(hub), []Step{frStepBlocked})
+		})
+
+		t.Run("A request after the window proceeds", func(t *testing.T) {
+			clock := &fakeClock{}
+			hub := newHub(clock)
+			testRunner(t, newFR(hub), []Step{frStepInitiateOnline, stepPkACancel})
+
+			clock.Advance(defaultFRCooldown)
+			testRunner(t, newFR(hub), []Step{frStepInitiateOnline, frResponseFromB("accept")})
+		})
+
+		t.Run("A request after B responds proceeds", func(t *testing.T) {
+			clock := &fakeClock{}
+			hub := newHub(clock)
+			testRunner(t, newFR(hub), []Step{frStepInitiateOnline, frStepPendingFromB, stepPkACancel})
+
+			testRunner(t, newFR(hub), []Step{frStepInitiateOnline, frResponseFromB("accept")})
+		})
+
+		t.Run("Requests to offline peers count", func(t *testing.T) {
+			clock := &fakeClock{}
+			hub := model.NewHub()
+			hub.SetClock(clock)
+			testRunner(t, newFR(hub), []Step{frStepInitiateOffline})
+
+			testRunner(t, newFR(hub), []Step{frStepBlocked})
+			if msgs := hub.DrainOffline(publicKey1); len(msgs) != 1 {
+				t.Errorf("Expected only the first request to be queued for B, got %v", msgs)
+			}
+		})
+
+		t.Run("Requests to other peers are not blocked", func(t *testing.T) {
+			hub := newHub(&fakeClock{})
+			clientC := &model.Client{}
+			clientC.SetPublicKey(&publicKey2)
+			hub.AddClient(publicKey2, clientC)
+			testRunner(t, newFR(hub), []Step{frStepInitiateOnline, stepPkACancel})
+
+			toC := frStepInitiateOnline
+			toC.input.Msg = `{"initiate":"sendFriendRequest","key":"` + (string)(publicKey2) + `"}`
+			toC.outputs = []ExpectedOutput{
+				{
+					ro: model.RoutineOutput{
+						Pk:   &publicKey2,
+						Msgs: []string{frSchemaInitiateToB((string)(publicKey0))},
+					},
+				},
+			}
+			testRunner(t, newFR(hub), []Step{toC, {
+				description: "C accepts",
+				input:       model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: &publicKey2, Msg: `{"forward":{"type":"accept"}}`},
+				outputs: []ExpectedOutput{
+					{ro: model.RoutineOutput{Pk: &publicKey2, Msgs: []string{schemaBareTerminate}, Done: true}},
+					{ro: model.RoutineOutput{Pk: &publicKey0, Msgs: []string{frForwardToA("accept")}, Done: true}},
+				},
+			}})
+		})
 	})
 
 	t.Run("Invalid inputs", func(t *testing.T) {
@@ -87,6 +328,72 @@ func TestFriendRequest(t *testing.T) {
 			testRunner(t, fr, test)
 		})
 
+		t.Run("Timeout or disconnect before the request is sent", func(t *testing.T) {
+
+			tests := []Step{
+				{
+					description: "A times out",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_Timeout,
+						Pk:      &publicKey0,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{errorSchemaString("Timeout")},
+								Done: true,
+							},
+						},
+					},
+				},
+				{
+					description: "Timeout without a public key",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_Timeout,
+						Pk:      nil,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   nil,
+								Msgs: []string{errorSchemaString("Timeout")},
+								Done: true,
+							},
+						},
+					},
+				},
+				{
+					description: "A disconnects",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_ClientClose,
+						Pk:      &publicKey0,
+					},
+					outputs: []ExpectedOutput{},
+				},
+				{
+					description: "Disconnect without a public key",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_ClientClose,
+						Pk:      nil,
+					},
+					outputs: []ExpectedOutput{},
+				},
+			}
+
+			for _, test := range tests {
+				t.Run(test.description, func(t *testing.T) {
+					client := &model.Client{}
+					client.SetPublicKey(&publicKey0)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, client)
+					fr := newFriendRequest(client, hub)
+
+					testRunner(t, fr, []Step{test})
+				})
+			}
+		})
+
 		t.Run("User attempts to send a friend request to themself", func(t *testing.T) {
 			test := []Step{
 				{
@@ -119,6 +426,53 @@ func TestFriendRequest(t *testing.T) {
 			testRunner(t, fr, test)
 		})
 
+		t.Run("User attempts to send a friend request to a banned key", func(t *testing.T) {
+			for _, online := range []bool{true, false} {
+				t.Run("online "+strconv.FormatBool(online), func(t *testing.T) {
+					test := []Step{
+						{
+							description: "A sends a friend request to B, who is banned",
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      &publicKey0,
+								Msg: `{
+									"initiate": "sendFriendRequest",
+									"key": "` + (string)(publicKey1) + `"
+								}`,
+							},
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk:   &publicKey0,
+										Msgs: []string{errorCodeSchemaString(ERROR_BANNED, "Peer is banned")},
+										Done: true,
+									},
+								},
+							},
+						},
+					}
+					clientA := &model.Client{}
+					clientA.SetPublicKey(&publicKey0)
+					hub := model.NewHub()
+					hub.AddClient(publicKey0, clientA)
+					if online {
+						clientB := &model.Client{}
+						clientB.SetPublicKey(&publicKey1)
+						hub.AddClient(publicKey1, clientB)
+					}
+					hub.Blocklist().Add(publicKey1)
+					fr := newFriendRequest(clientA, hub)
+
+					testRunner(t, fr, test)
+
+					// nothing is held for B either
+					if queued := hub.DrainOffline(publicKey1); len(queued) != 0 {
+						t.Errorf("Expected nothing queued for B. Got %v", queued)
+					}
+				})
+			}
+		})
+
 		// tests where both are signed in
 		tests := []struct {
 			description  string
@@ -149,6 +503,36 @@ func TestFriendRequest(t *testing.T) {
 						outputs: outputPkAError,
 					},
 
+					{
+						description: "Key is not Ed25519 (NIST curve)",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendFriendRequest", "key":"` + invalidPublicKeyNIST + `"}`,
+						},
+						outputs: outputPkAError,
+					},
+
+					{
+						description: "Key is not Ed25519 (truncated)",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendFriendRequest", "key":"` + invalidPublicKeyTruncated + `"}`,
+						},
+						outputs: outputPkAError,
+					},
+
+					{
+						description: "Key is not Ed25519 (corrupted DER header)",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendFriendRequest", "key":"` + invalidPublicKeyCorruptedHeader + `"}`,
+						},
+						outputs: outputPkAError,
+					},
+
 					{
 						description: "Invalid JSON",
 						input: model.RoutineInput{
@@ -159,6 +543,26 @@ func TestFriendRequest(t *testing.T) {
 						outputs: outputPkAError,
 					},
 
+					{
+						description: "Message too long",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendFriendRequest", "key":"` + (string)(publicKey1) + `", "message":"` + strings.Repeat("a", frMaxMessageLength+1) + `"}`,
+						},
+						outputs: outputPkAError,
+					},
+
+					{
+						description: "Message is not a string",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     `{"initiate": "sendFriendRequest", "key":"` + (string)(publicKey1) + `", "message":{}}`,
+						},
+						outputs: outputPkAError,
+					},
+
 					{
 						description: "Extra properties",
 						input: model.RoutineInput{
@@ -232,6 +636,34 @@ func TestFriendRequest(t *testing.T) {
 					},
 				},
 			},
+			{
+				description: "B has said the request is pending",
+				prefaceSteps: []Step{
+					frStepInitiateOnline,
+					frStepPendingFromB,
+				},
+				cases: []Step{
+					stepPkADisconnect,
+					stepPkBDisconnect,
+					stepPkBTimeout,
+					stepPkACancel,
+					stepPkBCancel,
+					{
+						description: "B says the request is pending again",
+						input:       frStepPendingFromB.input,
+						outputs:     outputPkBErrorToBoth,
+					},
+					{
+						description: "A sends message out of order",
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      &publicKey0,
+							Msg:     "boo!",
+						},
+						outputs: outputPkAErrorToBoth,
+					},
+				},
+			},
 		}
 
 		for _, test := range tests {
@@ -281,6 +713,20 @@ var frStepInitiateOffline = Step{
 	},
 }
 
+var frStepBlocked = Step{
+	description: "A sends another request too soon and B is not told",
+	input:       frStepInitiateOnline.input,
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{errorCodeSchemaString(ERROR_RATE_LIMITED, "Too many requests to this peer")},
+				Done: true,
+			},
+		},
+	},
+}
+
 var frStepInitiateOnline = Step{
 	description: "A sends a request and server sends a message to B",
 	input: model.RoutineInput{
@@ -335,6 +781,32 @@ func frResponseFromB(status string) Step {
 	}
 }
 
+var frStepPendingFromB = Step{
+	description: "B says the request is pending, and A is told without the transaction ending",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey1,
+		Msg:     `{"forward":{"type":"pending"}}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				TimeoutEnabled:  true,
+				TimeoutDuration: frExpectedTimeoutDuration,
+			},
+		},
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{`{"const":{"peerStatus":"online","forwarded":{"type":"pending"}}}`},
+			},
+		},
+	},
+}
+
 func frSchemaInitiateToB(pkb32 string) string {
 	return `{
 		"$schema": "https://json-schema.org/draft/2020-12/schema",
@@ -352,6 +824,26 @@ func frSchemaInitiateToB(pkb32 string) string {
 	}`
 }
 
+func frSchemaInitiateWithMessageToB(pkb32 string, messageJSON string) string {
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"receiveFriendRequest"
+			},
+			"key": {
+				"const": "` + pkb32 + `"
+			},
+			"message": {
+				"const": ` + messageJSON + `
+			}
+		},
+		"required": ["initiate", "key", "message"],
+		"additionalProperties": false
+	}`
+}
+
 func frForwardToA(status string) string {
 	return `{
 		"$schema": "https://json-schema.org/draft/2020-12/schema",
@@ -5,30 +5,45 @@ import (
 	"errors"
 	"fmt"
 	"harmony/backend/model"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/xeipuuv/gojsonschema"
 )
 
+// newest protocol version this server speaks
 const VERSION = "1.0"
 
+// oldest protocol version this server still speaks
+const MIN_SUPPORTED_VERSION = "1.0"
+
 type MasterRoutine struct {
 	isSubRoutineSet bool
 	subRoutine      model.Routine
-	rc              RoutineConstructors
-	client          *model.Client
-	hub             *model.Hub
+	// the `"initiate":` keyword that started subRoutine. Labels its timings.
+	subRoutineName string
+	rc             RoutineConstructors
+	initiateSchema *gojsonschema.Schema
+	client         *model.Client
+	hub            *model.Hub
 }
 
 func NewMasterRoutine(client *model.Client, hub *model.Hub) model.Routine {
-	return newMasterRoutineDependencyInj(routineContructorImplementations, client, hub)
+	return &MasterRoutine{
+		rc:             registeredRoutines,
+		initiateSchema: registeredInitiateSchema,
+		client:         client,
+		hub:            hub,
+	}
 }
 
 func newMasterRoutineDependencyInj(rc RoutineConstructors, client *model.Client, hub *model.Hub) model.Routine {
 	return &MasterRoutine{
-		rc:     rc,
-		client: client,
-		hub:    hub,
+		rc:             rc,
+		initiateSchema: makeInitiateSchema(rc),
+		client:         client,
+		hub:            hub,
 	}
 }
 
@@ -37,23 +52,80 @@ func (r *MasterRoutine) Next(args model.RoutineInput) []model.RoutineOutput {
 	if !r.isSubRoutineSet {
 		err := r.setSubRoutineFromInitialMsg(args.Msg)
 		if err != nil {
-			return []model.RoutineOutput{model.MakeRoutineOutput(true, MakeJSONError(err.Error()))}
+			ro := model.MakeRoutineOutput(true, MakeJSONErrorWithCode(ERROR_MALFORMED, err.Error()))
+			ro.DoneReason = model.DoneReason_Error
+			return []model.RoutineOutput{ro}
 		}
 		r.isSubRoutineSet = true
 	}
 
-	return r.subRoutine.Next(args)
+	labels := model.MetricLabels{Routine: r.subRoutineName}
+	if stater, ok := r.subRoutine.(metricStater); ok {
+		labels.State = stater.metricState()
+	}
+	start := time.Now()
+	ros := r.subRoutine.Next(args)
+	// the sink is only looked up once the call is over, so the hub's lock isn't held while timing
+	r.hub.Metrics().ObserveDuration(model.METRIC_ROUTINE_NEXT_SECONDS, labels, time.Since(start))
+	return ros
+}
+
+// the `"initiate":` keyword of the routine handling inputs. "" until the first message has picked one.
+// Implements model.NamedRoutine.
+func (r *MasterRoutine) RoutineName() string {
+	return r.subRoutineName
+}
+
+// Implements model.EndHandler for the routine handling inputs, if it does.
+func (r *MasterRoutine) Ended() {
+	if handler, ok := r.subRoutine.(model.EndHandler); ok {
+		handler.Ended()
+	}
+}
+
+// implemented by routines whose Next calls are timed separately for each state they can be in.
+type metricStater interface {
+	// label for the state the routine is in, which the next input will be handled in.
+	metricState() string
+}
+
+// the routines NewMasterRoutine can start, by the value of their `"initiate":` property.
+var registeredRoutines = RoutineConstructors{
+	"comeOnline":                 newComeOnline,
+	"sendConnectionRequest":      newEstablishConnectionToPeer,
+	"sendFriendRequest":          newFriendRequest,
+	"sendFriendRejection":        newFriendRejection,
+	"checkPeerOnline":            newCheckPeerOnline,
+	"watchPresence":              newWatchPresence,
+	"removeFriend":               newRemoveFriend,
+	"relayData":                  newRelayData,
+	"sendGroupConnectionRequest": newEstablishGroupConnection,
+	"reconnect":                  newReconnect,
+	"broadcastStatus":            newBroadcastStatus,
+	"offerFile":                  newFileOffer,
+	"publishPreKeys":             newPreKeyExchange,
+	"fetchPreKey":                newPreKeyExchange,
 }
 
-// list of acceptable values of the `"initiate":` property
-var routineNames = []string{"comeOnline", "sendConnectionRequest", "sendFriendRequest", "sendFriendRejection"}
+// accepts the keywords in registeredRoutines. Rebuilt by RegisterRoutine.
+var registeredInitiateSchema = makeInitiateSchema(registeredRoutines)
+
+// Make NewMasterRoutine start the routine made by ctor when a transaction begins with `"initiate": initiateKeyword`.
+// Replaces any routine already registered under that keyword.
+// Not threadsafe: should be called before any clients connect.
+func RegisterRoutine(initiateKeyword string, ctor RoutineConstructor) {
+	registeredRoutines[initiateKeyword] = ctor
+	registeredInitiateSchema = makeInitiateSchema(registeredRoutines)
+}
 
-// schema to look for and validate the "initiate:" property
-var initiateSchema = func() *gojsonschema.Schema {
+// schema to look for and validate the "initiate:" property. Only the keywords in rc are accepted.
+func makeInitiateSchema(rc RoutineConstructors) *gojsonschema.Schema {
 
+	routineNames := sortedRoutineNames(rc)
 	quotedRoutineNames := make([]string, len(routineNames))
 	for i, val := range routineNames {
-		quotedRoutineNames[i] = fmt.Sprintf(`"%s"`, val)
+		quoted, _ := json.Marshal(val)
+		quotedRoutineNames[i] = string(quoted)
 	}
 	// string that looks like: "comeOnline","sendFriendRequest",...
 	joinedQuotedRoutineNames := strings.Join(quotedRoutineNames, ",")
@@ -70,20 +142,28 @@ var initiateSchema = func() *gojsonschema.Schema {
 	var schemaLoader = gojsonschema.NewStringLoader(stringSchema)
 	var schema, _ = gojsonschema.NewSchema(schemaLoader)
 	return schema
-}()
+}
 
-func (r *MasterRoutine) setSubRoutineFromInitialMsg(msg string) error {
+// the keywords in rc, sorted so that lists of them don't change from one run to the next.
+func sortedRoutineNames(rc RoutineConstructors) []string {
+	routineNames := make([]string, 0, len(rc))
+	for name := range rc {
+		routineNames = append(routineNames, name)
+	}
+	slices.Sort(routineNames)
+	return routineNames
+}
 
-	message := gojsonschema.NewStringLoader(msg)
+func (r *MasterRoutine) setSubRoutineFromInitialMsg(msg string) error {
 
 	// check that user message contains `"initiate":` property with a valid value
-	result, err := initiateSchema.Validate(message)
+	result, err := validateJSON(r.initiateSchema, msg)
 
 	if err != nil {
 		return err
 	}
 	if !result.Valid() {
-		return errors.New(formatJSONError(result))
+		return errors.New(jsonErrorMessage(r.hub, r.client, result))
 	}
 
 	parsed := struct {
@@ -95,17 +175,11 @@ func (r *MasterRoutine) setSubRoutineFromInitialMsg(msg string) error {
 		return err
 	}
 
-	switch parsed.Initiate {
-	case "comeOnline":
-		r.subRoutine = r.rc.NewComeOnline(r.client, r.hub)
-	case "sendConnectionRequest":
-		r.subRoutine = r.rc.NewEstablishConnectionToPeer(r.client, r.hub)
-	case "sendFriendRequest":
-		r.subRoutine = r.rc.NewFriendRequest(r.client, r.hub)
-	case "sendFriendRejection":
-		r.subRoutine = r.rc.NewFriendRejection(r.client, r.hub)
-	default:
+	newRoutine, ok := r.rc[parsed.Initiate]
+	if !ok {
 		return errors.New("routine does not exist")
 	}
+	r.subRoutine = newRoutine(r.client, r.hub)
+	r.subRoutineName = parsed.Initiate
 	return nil
 }
@@ -2,6 +2,8 @@ package routines
 
 import (
 	"harmony/backend/model"
+	"maps"
+	"strings"
 	"testing"
 )
 
@@ -15,6 +17,16 @@ func (r *LoggerRoutine) Next(args model.RoutineInput) []model.RoutineOutput {
 	return []model.RoutineOutput{model.MakeRoutineOutput(false)}
 }
 
+// LoggerRoutine that records whether its transaction has ended
+type endedRoutine struct {
+	LoggerRoutine
+	ended bool
+}
+
+func (r *endedRoutine) Ended() {
+	r.ended = true
+}
+
 func TestMasterRoutine(t *testing.T) {
 
 	t.Run("Master routine calls no routines and returns error when schema does not match", func(t *testing.T) {
@@ -36,11 +48,9 @@ func TestMasterRoutine(t *testing.T) {
 				}
 
 				// mock the routine constructors
-				routineImpls := RoutineConstructors{
-					NewComeOnline:                incrementCallCount,
-					NewEstablishConnectionToPeer: incrementCallCount,
-					NewFriendRequest:             incrementCallCount,
-					NewFriendRejection:           incrementCallCount,
+				routineImpls := RoutineConstructors{}
+				for initiateKeyword := range registeredRoutines {
+					routineImpls[initiateKeyword] = incrementCallCount
 				}
 
 				mockClient := &model.Client{}
@@ -76,39 +86,43 @@ func TestMasterRoutine(t *testing.T) {
 
 	t.Run("Master routine calls correct routine", func(t *testing.T) {
 
-		tests := []struct {
-			initiateKeyword        string
-			routineConstructorName string
-		}{
-			{"comeOnline", "NewComeOnline"},
-			{"sendConnectionRequest", "NewEstablishConnectionToPeer"},
-			{"sendFriendRequest", "NewFriendRequest"},
-			{"sendFriendRejection", "NewFriendRejection"},
+		initiateKeywords := []string{
+			"comeOnline",
+			"sendConnectionRequest",
+			"sendFriendRequest",
+			"sendFriendRejection",
+			"checkPeerOnline",
+			"watchPresence",
+			"removeFriend",
+			"relayData",
+			"sendGroupConnectionRequest",
+			"reconnect",
+			"broadcastStatus",
+			"offerFile",
+			"publishPreKeys",
+			"fetchPreKey",
 		}
 
-		for _, tt := range tests {
-			t.Run(tt.initiateKeyword, func(t *testing.T) {
+		if len(initiateKeywords) != len(registeredRoutines) {
+			t.Errorf("Expected %d registered routines got %d", len(initiateKeywords), len(registeredRoutines))
+		}
+
+		for _, initiateKeyword := range initiateKeywords {
+			t.Run(initiateKeyword, func(t *testing.T) {
+
+				if _, ok := registeredRoutines[initiateKeyword]; !ok {
+					t.Errorf("Expected a routine to be registered for %s", initiateKeyword)
+				}
 
 				calls := make([]string, 0)
 
 				// mock the routine constructors to track new routines being created
-				routineImpls := RoutineConstructors{
-					NewComeOnline: func(c *model.Client, h *model.Hub) model.Routine {
-						calls = append(calls, "NewComeOnline")
-						return &EmptyRoutine{}
-					},
-					NewEstablishConnectionToPeer: func(c *model.Client, h *model.Hub) model.Routine {
-						calls = append(calls, "NewEstablishConnectionToPeer")
+				routineImpls := RoutineConstructors{}
+				for keyword := range registeredRoutines {
+					routineImpls[keyword] = func(c *model.Client, h *model.Hub) model.Routine {
+						calls = append(calls, keyword)
 						return &EmptyRoutine{}
-					},
-					NewFriendRequest: func(c *model.Client, h *model.Hub) model.Routine {
-						calls = append(calls, "NewFriendRequest")
-						return &EmptyRoutine{}
-					},
-					NewFriendRejection: func(c *model.Client, h *model.Hub) model.Routine {
-						calls = append(calls, "NewFriendRejection")
-						return &EmptyRoutine{}
-					},
+					}
 				}
 
 				mockClient := &model.Client{}
@@ -119,12 +133,12 @@ func TestMasterRoutine(t *testing.T) {
 					MsgType: model.RoutineMsgType_UsrMsg,
 					Pk:      nil,
 					Msg: `{
-						"initiate": "` + tt.initiateKeyword + `"
+						"initiate": "` + initiateKeyword + `"
 					}`,
 				})
 
 				// check only the correct routines was called
-				thisRoutineCount := countOccurrences(calls, tt.routineConstructorName)
+				thisRoutineCount := countOccurrences(calls, initiateKeyword)
 				totalCount := len(calls)
 
 				if thisRoutineCount != 1 {
@@ -138,6 +152,150 @@ func TestMasterRoutine(t *testing.T) {
 
 	})
 
+	t.Run("The routine handling inputs is told when the transaction has ended", func(t *testing.T) {
+
+		subRoutine := &endedRoutine{}
+		routineImpls := RoutineConstructors{
+			"comeOnline": func(c *model.Client, h *model.Hub) model.Routine {
+				return subRoutine
+			},
+		}
+		master := newMasterRoutineDependencyInj(routineImpls, &model.Client{}, model.NewHub())
+
+		// before the first message there is no routine to tell
+		master.(model.EndHandler).Ended()
+
+		master.Next(model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Msg:     `{"initiate":"comeOnline"}`,
+		})
+		master.(model.EndHandler).Ended()
+		if !subRoutine.ended {
+			t.Errorf("Expected the routine to be told the transaction ended")
+		}
+	})
+
+	t.Run("Registered routines can be started", func(t *testing.T) {
+
+		const initiateKeyword = "testRegisteredRoutine"
+		loggerRoutine := &LoggerRoutine{}
+		RegisterRoutine(initiateKeyword, func(c *model.Client, h *model.Hub) model.Routine {
+			return loggerRoutine
+		})
+		t.Cleanup(func() {
+			delete(registeredRoutines, initiateKeyword)
+			registeredInitiateSchema = makeInitiateSchema(registeredRoutines)
+		})
+
+		master := NewMasterRoutine(&model.Client{}, model.NewHub())
+		msg := `{"initiate":"` + initiateKeyword + `"}`
+		master.Next(model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Msg:     msg,
+		})
+
+		if len(loggerRoutine.msgs) != 1 || loggerRoutine.msgs[0] != msg {
+			t.Errorf("Expected the registered routine to receive %s. Got %v", msg, loggerRoutine.msgs)
+		}
+	})
+
+	t.Run("Master routine rejects messages that are too large or deeply nested before validating them", func(t *testing.T) {
+
+		tests := []struct {
+			description string
+			msg         string
+			error       string
+		}{
+			{
+				"deeply nested",
+				`{"initiate":"checkPeerOnline","key":` + strings.Repeat("[", maxJSONDepth) + strings.Repeat("]", maxJSONDepth) + `}`,
+				"Message is nested more than 32 levels deep",
+			},
+			{
+				"oversized but the right shape",
+				`{"initiate":"checkPeerOnline","key":"` + strings.Repeat("A", maxJSONSize) + `"}`,
+				"Message is longer than 81920 bytes",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				callCount := 0
+				routineImpls := RoutineConstructors{
+					"checkPeerOnline": func(c *model.Client, h *model.Hub) model.Routine {
+						callCount += 1
+						return &EmptyRoutine{}
+					},
+				}
+				master := newMasterRoutineDependencyInj(routineImpls, &model.Client{}, model.NewHub())
+
+				testRunner(t, master, []Step{
+					{
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Msg:     tt.msg,
+						},
+						outputs: []ExpectedOutput{
+							{
+								ro: model.RoutineOutput{
+									Msgs: []string{errorCodeSchemaString(ERROR_MALFORMED, tt.error)},
+									Done: true,
+								},
+							},
+						},
+					},
+				})
+
+				if callCount != 0 {
+					t.Errorf("Expected no routine to be started, %d were", callCount)
+				}
+			})
+		}
+	})
+
+	t.Run("Schema errors are only detailed in debug mode", func(t *testing.T) {
+
+		const msg = `{"initiate":"notARoutine"}`
+
+		t.Run("production", func(t *testing.T) {
+			master := NewMasterRoutine(&model.Client{}, model.NewHub())
+
+			testRunner(t, master, []Step{
+				{
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Msg:     msg,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Msgs: []string{errorCodeSchemaString(ERROR_MALFORMED, "Malformed message")},
+								Done: true,
+							},
+						},
+					},
+				},
+			})
+		})
+
+		t.Run("debug", func(t *testing.T) {
+			hub := model.NewHub()
+			hub.SetErrorVerbosity(model.ErrorVerbosity_Debug)
+			master := NewMasterRoutine(&model.Client{}, hub)
+
+			ros := master.Next(model.RoutineInput{
+				MsgType: model.RoutineMsgType_UsrMsg,
+				Msg:     msg,
+			})
+			if len(ros) != 1 || len(ros[0].Msgs) != 1 {
+				t.Fatalf("Expected one error message. Got %v", ros)
+			}
+			if got := ros[0].Msgs[0]; !strings.Contains(got, "initiate") || strings.Contains(got, "Malformed message") {
+				t.Errorf("Expected the schema error for the initiate property. Got %s", got)
+			}
+		})
+	})
+
 	t.Run("Master routine passes all user messages to handlers", func(t *testing.T) {
 
 		test := []string{
@@ -147,9 +305,9 @@ func TestMasterRoutine(t *testing.T) {
 		}
 
 		// mock comeOnline with a function that just logs all the msgs passed to it
-		mockConstructorImpls := routineContructorImplementations
+		mockConstructorImpls := maps.Clone(registeredRoutines)
 		loggerRoutine := &LoggerRoutine{}
-		mockConstructorImpls.NewComeOnline = func(c *model.Client, h *model.Hub) model.Routine {
+		mockConstructorImpls["comeOnline"] = func(c *model.Client, h *model.Hub) model.Routine {
 			return loggerRoutine
 		}
 
@@ -0,0 +1,191 @@
+package routines
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"harmony/backend/model"
+	"strconv"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// maximum length of a base64 pre-key. Leaves room for a key id and signature alongside the key itself.
+const maxPreKeyLength = 256
+
+// Publishes one-time pre-keys to the hub, or claims one of a peer's, so that clients can start end-to-end encrypted sessions
+// with peers who are offline. Started by either "publishPreKeys" or "fetchPreKey".
+// The server never looks inside the pre-keys, and hands each one out only once.
+type PreKeyExchange struct {
+	client *model.Client
+	hub    *model.Hub
+	pkA    *model.PublicKey
+}
+
+func newPreKeyExchange(client *model.Client, hub *model.Hub) model.Routine {
+	return &PreKeyExchange{client: client, hub: hub}
+}
+
+func (r *PreKeyExchange) Next(args model.RoutineInput) []model.RoutineOutput {
+	// only 1 step, don't need to worry about state.
+	r.pkA = args.Pk
+	if r.pkA == nil {
+		return pkeError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
+	}
+
+	usrMsg := struct {
+		Initiate string `json:"initiate"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	if usrMsg.Initiate == "fetchPreKey" {
+		return r.fetch(args)
+	}
+	return r.publish(args)
+}
+
+// store the client's pre-keys and tell them how many the hub holds for them.
+func (r *PreKeyExchange) publish(args model.RoutineInput) []model.RoutineOutput {
+	result, err := validateJSON(pkePublishSchema, args.Msg)
+	if err != nil {
+		return pkeError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return pkeError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
+	}
+
+	usrMsg := struct {
+		Initiate string   `json:"initiate"`
+		Keys     []string `json:"keys"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+
+	store := r.hub.PreKeys()
+	count, err := store.Publish(*r.pkA, usrMsg.Keys)
+	if errors.Is(err, model.ErrTooManyPreKeys) {
+		return pkeError(nil, ERROR_LIMIT_EXCEEDED, fmt.Sprintf("Too many pre-keys, the maximum is %d", store.MaxPerKey()))
+	}
+
+	return []model.RoutineOutput{
+		{
+			Pk:         r.pkA,
+			Done:       true,
+			DoneReason: model.DoneReason_Completed,
+			Msgs:       []string{`{"preKeyCount":` + strconv.Itoa(count) + `,"terminate":"done"}`},
+		},
+	}
+}
+
+// hand the client one of the peer's pre-keys, which nobody else will be given.
+func (r *PreKeyExchange) fetch(args model.RoutineInput) []model.RoutineOutput {
+	result, err := validateJSON(pkeFetchSchema, args.Msg)
+	if err != nil {
+		return pkeError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return pkeError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
+	}
+
+	usrMsg := struct {
+		Initiate string `json:"initiate"`
+		Key      string `json:"key"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	pkB, err := parsePublicKey(usrMsg.Key)
+	if err != nil {
+		return pkeError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if sameKey(*r.pkA, *pkB) {
+		return pkeError(nil, ERROR_SELF_NOT_ALLOWED, "Fetching your own pre-key is not allowed")
+	}
+	if r.hub.Blocklist().Contains(*pkB) {
+		return pkeError(nil, ERROR_BANNED, "Peer is banned")
+	}
+
+	preKey, published, ok := r.hub.PreKeys().Claim(*pkB)
+	if !published {
+		return pkeError(nil, ERROR_NO_PRE_KEYS, "Peer has not published any pre-keys")
+	}
+	if !ok {
+		return pkeError(nil, ERROR_NO_PRE_KEYS, "Peer has no pre-keys left")
+	}
+
+	reply := struct {
+		Key       string `json:"key"`
+		PreKey    string `json:"preKey"`
+		Terminate string `json:"terminate"`
+	}{
+		Key:       publicKeyToString(*pkB),
+		PreKey:    preKey,
+		Terminate: "done",
+	}
+	replyStr, _ := json.Marshal(reply)
+	return []model.RoutineOutput{
+		{
+			Pk:         r.pkA,
+			Done:       true,
+			DoneReason: model.DoneReason_Completed,
+			Msgs:       []string{string(replyStr)},
+		},
+	}
+}
+
+var pkePublishSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"publishPreKeys"
+			},
+			"keys": {
+				"type": "array",
+				"items": {
+					"type":"string",
+					"pattern": "` + publicKeyPattern + `",
+					"minLength": 1,
+					"maxLength": ` + strconv.Itoa(maxPreKeyLength) + `
+				},
+				"minItems": 1,
+				"uniqueItems": true
+			}
+		},
+		"required": ["initiate", "keys"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+var pkeFetchSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"fetchPreKey"
+			},
+			"key": {
+				"type":"string",
+				"pattern": "` + publicKeyPattern + `"
+			}
+		},
+		"required": ["initiate", "key"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// wrapper for error routine output
+func pkeError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
+	return []model.RoutineOutput{
+		{
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
+		},
+	}
+}
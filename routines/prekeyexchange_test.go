@@ -0,0 +1,228 @@
+package routines
+
+import (
+	"harmony/backend/model"
+	"strings"
+	"testing"
+)
+
+// base64 of "preKey1" and "preKey2"
+const (
+	testPreKey1 = "cHJlS2V5MQ=="
+	testPreKey2 = "cHJlS2V5Mg=="
+)
+
+func TestPreKeyExchange(t *testing.T) {
+
+	// A and B online, with pre-keys limited to 2 per key
+	newHub := func() *model.Hub {
+		clientA := &model.Client{}
+		clientA.SetPublicKey(&publicKey0)
+		clientB := &model.Client{}
+		clientB.SetPublicKey(&publicKey1)
+		hub := model.NewHub()
+		hub.SetPreKeyStore(model.NewPreKeyStore(2))
+		hub.AddClient(publicKey0, clientA)
+		hub.AddClient(publicKey1, clientB)
+		return hub
+	}
+	// each step is a transaction of its own
+	runSteps := func(t *testing.T, hub *model.Hub, steps ...Step) {
+		for _, step := range steps {
+			testRunner(t, newPreKeyExchange(&model.Client{}, hub), []Step{step})
+		}
+	}
+
+	publish := func(pk *model.PublicKey, preKeys []string, count string) Step {
+		return Step{
+			description: "Client publishes pre-keys",
+			input: model.RoutineInput{
+				MsgType: model.RoutineMsgType_UsrMsg,
+				Pk:      pk,
+				Msg:     `{"initiate":"publishPreKeys","keys":["` + strings.Join(preKeys, `","`) + `"]}`,
+			},
+			outputs: []ExpectedOutput{
+				{
+					ro: model.RoutineOutput{
+						Pk:   pk,
+						Msgs: []string{`{"const":{"preKeyCount":` + count + `,"terminate":"done"}}`},
+						Done: true,
+					},
+				},
+			},
+		}
+	}
+	fetchMsg := func(key model.PublicKey) string {
+		return `{"initiate":"fetchPreKey","key":"` + (string)(key) + `"}`
+	}
+	fetch := func(pk *model.PublicKey, key model.PublicKey, preKey string) Step {
+		return Step{
+			description: "Client fetches a pre-key of a peer",
+			input: model.RoutineInput{
+				MsgType: model.RoutineMsgType_UsrMsg,
+				Pk:      pk,
+				Msg:     fetchMsg(key),
+			},
+			outputs: []ExpectedOutput{
+				{
+					ro: model.RoutineOutput{
+						Pk:   pk,
+						Msgs: []string{`{"const":{"key":"` + (string)(key) + `","preKey":"` + preKey + `","terminate":"done"}}`},
+						Done: true,
+					},
+				},
+			},
+		}
+	}
+	fetchError := func(pk *model.PublicKey, key model.PublicKey, code string, msg string) Step {
+		return Step{
+			description: "Client fails to fetch a pre-key of a peer",
+			input: model.RoutineInput{
+				MsgType: model.RoutineMsgType_UsrMsg,
+				Pk:      pk,
+				Msg:     fetchMsg(key),
+			},
+			outputs: []ExpectedOutput{
+				{
+					ro: model.RoutineOutput{
+						Pk:   pk,
+						Msgs: []string{errorCodeSchemaString(code, msg)},
+						Done: true,
+					},
+				},
+			},
+		}
+	}
+
+	t.Run("Valid inputs", func(t *testing.T) {
+
+		t.Run("Pre-keys are handed out once each, oldest first", func(t *testing.T) {
+			runSteps(t, newHub(),
+				publish(&publicKey1, []string{testPreKey1}, "1"),
+				publish(&publicKey1, []string{testPreKey2}, "2"),
+				fetch(&publicKey0, publicKey1, testPreKey1),
+				fetch(&publicKey0, publicKey1, testPreKey2),
+			)
+		})
+
+		t.Run("Peer can be fetched from while offline", func(t *testing.T) {
+			hub := newHub()
+			runSteps(t, hub, publish(&publicKey2, []string{testPreKey1}, "1"))
+			if _, online := hub.GetClient(publicKey2); online {
+				t.Fatalf("Expected C to be offline")
+			}
+			runSteps(t, hub, fetch(&publicKey0, publicKey2, testPreKey1))
+		})
+
+		t.Run("Claimed pre-keys free up room to publish more", func(t *testing.T) {
+			runSteps(t, newHub(),
+				publish(&publicKey1, []string{testPreKey1, testPreKey2}, "2"),
+				fetch(&publicKey0, publicKey1, testPreKey1),
+				publish(&publicKey1, []string{testPreKey1}, "2"),
+			)
+		})
+	})
+
+	t.Run("Invalid inputs", func(t *testing.T) {
+
+		t.Run("Peer has no pre-keys left", func(t *testing.T) {
+			runSteps(t, newHub(),
+				publish(&publicKey1, []string{testPreKey1}, "1"),
+				fetch(&publicKey0, publicKey1, testPreKey1),
+				fetchError(&publicKey0, publicKey1, ERROR_NO_PRE_KEYS, "Peer has no pre-keys left"),
+			)
+		})
+
+		t.Run("Peer has never published pre-keys", func(t *testing.T) {
+			runSteps(t, newHub(),
+				fetchError(&publicKey0, publicKey2, ERROR_NO_PRE_KEYS, "Peer has not published any pre-keys"),
+			)
+		})
+
+		t.Run("Too many pre-keys are published", func(t *testing.T) {
+			hub := newHub()
+			runSteps(t, hub,
+				publish(&publicKey1, []string{testPreKey1}, "1"),
+				Step{
+					description: "B publishes more pre-keys than the store holds",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey1,
+						Msg:     `{"initiate":"publishPreKeys","keys":["` + testPreKey2 + `","cHJlS2V5Mw=="]}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey1,
+								Msgs: []string{errorCodeSchemaString(ERROR_LIMIT_EXCEEDED, "Too many pre-keys, the maximum is 2")},
+								Done: true,
+							},
+						},
+					},
+				},
+			)
+			// none of the rejected pre-keys were stored
+			if count := hub.PreKeys().Count(publicKey1); count != 1 {
+				t.Errorf("Expected 1 pre-key, got %d", count)
+			}
+		})
+
+		t.Run("Fetching from a banned peer", func(t *testing.T) {
+			hub := newHub()
+			runSteps(t, hub, publish(&publicKey1, []string{testPreKey1}, "1"))
+			hub.Blocklist().Add(publicKey1)
+			runSteps(t, hub, fetchError(&publicKey0, publicKey1, ERROR_BANNED, "Peer is banned"))
+			if count := hub.PreKeys().Count(publicKey1); count != 1 {
+				t.Errorf("Expected the pre-key not to be claimed, got %d left", count)
+			}
+		})
+
+		tests := []struct {
+			description string
+			pk          *model.PublicKey
+			msg         string
+			code        string
+			error       string
+		}{
+			{"Publish without a public key", nil, `{"initiate":"publishPreKeys","keys":["` + testPreKey1 + `"]}`, ERROR_NOT_AUTHENTICATED, "You have not provided a public key"},
+			{"Fetch without a public key", nil, fetchMsg(publicKey1), ERROR_NOT_AUTHENTICATED, "You have not provided a public key"},
+			{"Fetch own pre-key", &publicKey0, fetchMsg(publicKey0), ERROR_SELF_NOT_ALLOWED, "Fetching your own pre-key is not allowed"},
+			{"Fetch own pre-key encoded differently", &publicKey0, fetchMsg(publicKey0OtherEncoding), ERROR_SELF_NOT_ALLOWED, "Fetching your own pre-key is not allowed"},
+			{"No pre-keys", &publicKey0, `{"initiate":"publishPreKeys","keys":[]}`, ERROR_MALFORMED, ""},
+			{"Duplicate pre-keys", &publicKey0, `{"initiate":"publishPreKeys","keys":["` + testPreKey1 + `","` + testPreKey1 + `"]}`, ERROR_MALFORMED, ""},
+			{"Pre-key is not base64", &publicKey0, `{"initiate":"publishPreKeys","keys":["not base64!"]}`, ERROR_MALFORMED, ""},
+			{"Pre-key too long", &publicKey0, `{"initiate":"publishPreKeys","keys":["` + strings.Repeat("A", maxPreKeyLength+4) + `"]}`, ERROR_MALFORMED, ""},
+			{"Fetch without a key", &publicKey0, `{"initiate":"fetchPreKey"}`, ERROR_MALFORMED, ""},
+			{"Fetch with an invalid key", &publicKey0, fetchMsg(invalidPublicKeyNIST), ERROR_MALFORMED, ""},
+			{"Extra property", &publicKey0, `{"initiate":"fetchPreKey","key":"` + (string)(publicKey1) + `","extra":1}`, ERROR_MALFORMED, ""},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				test := []Step{
+					{
+						description: tt.description,
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Pk:      tt.pk,
+							Msg:     tt.msg,
+						},
+						outputs: []ExpectedOutput{
+							{
+								ro: model.RoutineOutput{
+									Pk:   tt.pk,
+									Msgs: []string{errorCodeSchemaString(tt.code, tt.error)},
+									Done: true,
+								},
+							},
+						},
+					},
+				}
+				if tt.error == "" {
+					test[0].outputs[0].ro.Msgs = []string{errorCodeSchemaString(tt.code)}
+				}
+				runSteps(t, newHub(), test...)
+			})
+		}
+	})
+}
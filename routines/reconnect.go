@@ -0,0 +1,118 @@
+package routines
+
+import (
+	"encoding/json"
+	"errors"
+	"harmony/backend/model"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Signs a client back in with a reconnection token from its last welcome message,
+// instead of signing a challenge again.
+type Reconnect struct {
+	client *model.Client
+	hub    *model.Hub
+}
+
+func newReconnect(client *model.Client, hub *model.Hub) model.Routine {
+	return &Reconnect{client: client, hub: hub}
+}
+
+func (r *Reconnect) Next(args model.RoutineInput) []model.RoutineOutput {
+	// only 1 step, don't need to worry about state.
+
+	// shares the comeOnline lock so the client can't be signed in twice at once
+	if !r.client.ComeOnlineLock.TryLock() {
+		return recError(nil, ERROR_BUSY, "Another comeOnline routine is in progress")
+	}
+	defer r.client.ComeOnlineLock.Unlock()
+
+	if r.client.GetPublicKey() != nil {
+		return recError(nil, ERROR_ALREADY_ONLINE, "Public key already set")
+	}
+
+	// validate msg
+	result, err := validateJSON(recSchema, args.Msg)
+	if err != nil {
+		return recError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return recError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Initiate string `json:"initiate"`
+		Key      string `json:"key"`
+		Token    string `json:"token"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	pk, err := parsePublicKey(usrMsg.Key)
+	if err != nil {
+		return recError(nil, ERROR_MALFORMED, err.Error())
+	}
+
+	if r.hub.Blocklist().Contains(*pk) {
+		return recError(nil, ERROR_BANNED, "Key is banned")
+	}
+
+	// tokens are single use, the welcome message carries the next one
+	if !r.hub.RedeemReconnectToken(*pk, usrMsg.Token) {
+		return recError(nil, ERROR_INVALID_TOKEN, "Invalid or expired reconnection token")
+	}
+
+	err = r.hub.AddClient(*pk, r.client)
+	if errors.Is(err, model.ErrHubAtCapacity) {
+		return recError(nil, ERROR_AT_CAPACITY, "Server at capacity")
+	}
+	if errors.Is(err, model.ErrTooManyDevices) {
+		return recError(nil, ERROR_TOO_MANY_DEVICES, "Too many devices signed in with this key")
+	}
+	if err != nil {
+		return recError(nil, ERROR_INTERNAL, err.Error())
+	}
+	r.client.SetPublicKey(pk)
+
+	ro := model.MakeRoutineOutput(true, welcomeMessages(r.hub, r.client, *pk)...)
+	ro.DoneReason = model.DoneReason_Completed
+	return []model.RoutineOutput{ro}
+}
+
+var recSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"reconnect"
+			},
+			"key": {
+				"type":"string",
+				"pattern": "` + publicKeyPattern + `"
+			},
+			"token": {
+				"type":"string",
+				"minLength": 1,
+				"maxLength": 256
+			}
+		},
+		"required": ["initiate", "key", "token"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// wrapper for error routine output
+func recError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
+	return []model.RoutineOutput{
+		{
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
+		},
+	}
+}
@@ -0,0 +1,155 @@
+package routines
+
+import (
+	"harmony/backend/model"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+
+	t.Run("Valid inputs", func(t *testing.T) {
+
+		t.Run("Signs the client back in with a fresh token", func(t *testing.T) {
+			hub := model.NewHub()
+			token, _ := hub.IssueReconnectToken(publicKey0)
+			hub.EnqueueOffline(publicKey0, model.OfflineMessage{Msg: `{"queued":0}`})
+			client := &model.Client{}
+
+			testRunner(t, newReconnect(client, hub), []Step{
+				{
+					description: "Client reconnects with its token",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Msg:     recMsg(publicKey0, token),
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Msgs: []string{`{"const":{"queued":0}}`, comeOnlineWelcomeResponseSchema},
+								Done: true,
+							},
+						},
+					},
+				},
+			})
+
+			if pk := client.GetPublicKey(); pk == nil || *pk != publicKey0 {
+				t.Errorf("Expected the public key of the client to be set")
+			}
+			if clients := hub.GetClients(publicKey0); len(clients) != 1 || clients[0] != client {
+				t.Errorf("Expected the client to be in the hub")
+			}
+		})
+	})
+
+	t.Run("Invalid inputs", func(t *testing.T) {
+
+		clock := &fakeClock{}
+
+		tests := []struct {
+			description string
+			// returns the message to send
+			setup func(hub *model.Hub) string
+			code  string
+		}{
+			{"Expired token", func(hub *model.Hub) string {
+				token, _ := hub.IssueReconnectToken(publicKey0)
+				clock.Advance(model.DEFAULT_RECONNECT_TOKEN_TTL + time.Second)
+				return recMsg(publicKey0, token)
+			}, ERROR_INVALID_TOKEN},
+			{"Reused token", func(hub *model.Hub) string {
+				token, _ := hub.IssueReconnectToken(publicKey0)
+				earlier := &model.Client{}
+				newReconnect(earlier, hub).Next(model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Msg: recMsg(publicKey0, token)})
+				hub.DeleteClient(publicKey0, earlier)
+				return recMsg(publicKey0, token)
+			}, ERROR_INVALID_TOKEN},
+			{"Wrong key", func(hub *model.Hub) string {
+				token, _ := hub.IssueReconnectToken(publicKey0)
+				return recMsg(publicKey1, token)
+			}, ERROR_INVALID_TOKEN},
+			{"Made up token", func(hub *model.Hub) string {
+				hub.IssueReconnectToken(publicKey0)
+				return recMsg(publicKey0, "AAAA")
+			}, ERROR_INVALID_TOKEN},
+			{"Banned key", func(hub *model.Hub) string {
+				token, _ := hub.IssueReconnectToken(publicKey0)
+				hub.Blocklist().Add(publicKey0)
+				return recMsg(publicKey0, token)
+			}, ERROR_BANNED},
+			{"Missing token", func(hub *model.Hub) string {
+				return `{"initiate":"reconnect","key":"` + (string)(publicKey0) + `"}`
+			}, ERROR_MALFORMED},
+			{"Invalid key", func(hub *model.Hub) string {
+				token, _ := hub.IssueReconnectToken(publicKey0)
+				return recMsg(invalidPublicKeyNIST, token)
+			}, ERROR_MALFORMED},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				hub := model.NewHub()
+				hub.SetClock(clock)
+				msg := tt.setup(hub)
+				client := &model.Client{}
+
+				testRunner(t, newReconnect(client, hub), []Step{
+					{
+						description: tt.description,
+						input: model.RoutineInput{
+							MsgType: model.RoutineMsgType_UsrMsg,
+							Msg:     msg,
+						},
+						outputs: []ExpectedOutput{
+							{
+								ro: model.RoutineOutput{
+									Msgs: []string{errorCodeSchemaString(tt.code)},
+									Done: true,
+								},
+							},
+						},
+					},
+				})
+
+				if client.GetPublicKey() != nil {
+					t.Errorf("Expected public key of client to be nil")
+				}
+			})
+		}
+
+		t.Run("Client is already online", func(t *testing.T) {
+			hub := model.NewHub()
+			token, _ := hub.IssueReconnectToken(publicKey0)
+			client := &model.Client{}
+			client.SetPublicKey(&publicKey1)
+
+			testRunner(t, newReconnect(client, hub), []Step{
+				{
+					description: "Client that has already come online reconnects",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Msg:     recMsg(publicKey0, token),
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Msgs: []string{errorCodeSchemaString(ERROR_ALREADY_ONLINE, "Public key already set")},
+								Done: true,
+							},
+						},
+					},
+				},
+			})
+
+			// the token was not spent
+			if !hub.RedeemReconnectToken(publicKey0, token) {
+				t.Errorf("Expected the token to still be redeemable")
+			}
+		})
+	})
+}
+
+func recMsg(pk model.PublicKey, token string) string {
+	return `{"initiate":"reconnect","key":"` + (string)(pk) + `","token":"` + token + `"}`
+}
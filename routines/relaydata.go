@@ -0,0 +1,366 @@
+package routines
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"harmony/backend/model"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type RDState int
+
+const (
+	rd_entry RDState = iota
+	rd_relay
+)
+
+const rdTimeoutDuration = 30 * time.Second
+
+// maximum length of a single relayed payload, in base64 characters
+const defaultMaxRelayPayloadLength = 16 * 1024
+
+// maximum number of decoded bytes relayed in one transaction, in both directions combined
+const defaultRelayByteBudget = 16 * 1024 * 1024
+
+// Relays opaque (already encrypted) data between two peers that could not establish a peer to peer connection.
+type RelayData struct {
+	client    *model.Client
+	pkA       *model.PublicKey
+	pkB       *model.PublicKey
+	hub       *model.Hub
+	state     RDState
+	bytesSent int
+	config    rdConfig
+	// nil unless A asked for flow control
+	flow *flowControl
+}
+
+// tunable parameters of RelayData
+type rdConfig struct {
+	maxPayloadLength int
+	byteBudget       int
+	// most relayed messages held for a peer with no credits left, when flow control is on
+	maxHeldMessages int
+}
+
+func defaultRDConfig() rdConfig {
+	return rdConfig{
+		maxPayloadLength: defaultMaxRelayPayloadLength,
+		byteBudget:       defaultRelayByteBudget,
+		maxHeldMessages:  defaultMaxHeldMessages,
+	}
+}
+
+func newRelayData(client *model.Client, hub *model.Hub) model.Routine {
+	return newRelayDataDependencyInj(client, hub, defaultRDConfig())
+}
+
+func newRelayDataDependencyInj(client *model.Client, hub *model.Hub, config rdConfig) model.Routine {
+	return &RelayData{
+		client: client,
+		hub:    hub,
+		state:  rd_entry,
+		config: config,
+	}
+}
+
+func (r *RelayData) Next(args model.RoutineInput) []model.RoutineOutput {
+
+	switch args.MsgType {
+	case model.RoutineMsgType_Timeout:
+		ros := rdError(nil, ERROR_TIMEOUT, "Timeout")
+		if args.Pk != nil && r.pkA != nil && r.pkB != nil {
+			switch *args.Pk {
+			case *r.pkA:
+				ros = append(ros, rdError(r.pkB, ERROR_PEER_TIMEOUT, "Peer timed out")...)
+			case *r.pkB:
+				ros = append(ros, rdError(r.pkA, ERROR_PEER_TIMEOUT, "Peer timed out")...)
+			}
+		}
+		return ros
+
+	case model.RoutineMsgType_ClientClose:
+		// terminate the other person
+		if args.Pk != nil && r.pkA != nil && r.pkB != nil {
+			switch *args.Pk {
+			case *r.pkA:
+				return peerDisconnected(r.pkB, args.LastWill)
+			case *r.pkB:
+				return peerDisconnected(r.pkA, args.LastWill)
+			}
+		}
+		return []model.RoutineOutput{}
+
+	case model.RoutineMsgType_UsrMsg:
+		if isClientCancelMsg(args.Msg) {
+			return r.cancel(args)
+		}
+		if r.state != rd_entry && isKeepaliveMsg(args.Msg) {
+			return keepaliveOutput(rdTimeoutDuration)
+		}
+		switch r.state {
+		case rd_entry:
+			return r.entry(args)
+		case rd_relay:
+			return r.relay(args)
+		default:
+			panic("unrecognized state")
+		}
+	default:
+		panic("unrecognized message type")
+	}
+}
+
+// client sends a {"terminate":"cancel"} message.
+func (r *RelayData) cancel(args model.RoutineInput) []model.RoutineOutput {
+	if r.state == rd_entry {
+		return []model.RoutineOutput{{
+			Done:       true,
+			DoneReason: model.DoneReason_Cancelled,
+		}}
+	}
+	var peer = r.pkA
+	if *args.Pk == *r.pkA {
+		peer = r.pkB
+	}
+	return []model.RoutineOutput{
+		{
+			Done:       true,
+			DoneReason: model.DoneReason_Cancelled,
+		},
+		peerCancelledOutput(peer, parseCancelReason(args.Msg)),
+	}
+}
+
+var rdEntrySchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"relayData"
+			},
+			"key": {
+				"type":"string",
+				"pattern": "` + publicKeyPattern + `"
+			},
+			"flowControl": {
+				"type": "boolean"
+			}
+		},
+		"required": ["initiate", "key"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+func (r *RelayData) entry(args model.RoutineInput) []model.RoutineOutput {
+
+	if args.Pk == nil {
+		return rdError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
+	}
+	r.pkA = args.Pk
+
+	// validate msg
+	result, err := validateJSON(rdEntrySchema, args.Msg)
+	if err != nil {
+		return rdError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return rdError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Initiate    string `json:"initiate"`
+		Key         string `json:"key"`
+		FlowControl bool   `json:"flowControl"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	pkB, err := parsePublicKey(usrMsg.Key)
+	if err != nil {
+		return rdError(nil, ERROR_MALFORMED, err.Error())
+	}
+
+	// check pkB is different from pkA
+	if sameKey(*r.pkA, *pkB) {
+		return rdError(nil, ERROR_SELF_NOT_ALLOWED, "Relaying to yourself is not allowed")
+	}
+
+	_, peerOnline := r.hub.GetClient(*pkB)
+	if !peerOnline {
+		return []model.RoutineOutput{
+			{
+				Pk:         r.pkA,
+				Msgs:       []string{`{"peerStatus":"offline","terminate":"done"}`},
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+			},
+		}
+	}
+
+	r.pkB = pkB
+	r.state = rd_relay
+	receiveRelayMsg := `{"initiate":"receiveRelay","key":"` + publicKeyToString(*r.pkA) + `"}`
+	if usrMsg.FlowControl {
+		r.flow = newFlowControl(r.config.maxHeldMessages)
+		receiveRelayMsg = `{"initiate":"receiveRelay","key":"` + publicKeyToString(*r.pkA) + `","flowControl":true}`
+	}
+	return []model.RoutineOutput{
+		{
+			Pk:              r.pkB,
+			Msgs:            []string{receiveRelayMsg},
+			TimeoutEnabled:  true,
+			TimeoutDuration: rdTimeoutDuration,
+		},
+		{
+			Pk:              r.pkA,
+			Msgs:            []string{`{"peerStatus":"online"}`},
+			TimeoutEnabled:  true,
+			TimeoutDuration: rdTimeoutDuration,
+		},
+	}
+}
+
+var rdRelaySchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"relay": {
+				"type": "object",
+				"properties": {
+					"payload": {
+						"type": "string"
+					}
+				},
+				"required": ["payload"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["relay"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+func (r *RelayData) relay(args model.RoutineInput) []model.RoutineOutput {
+
+	var toPk *model.PublicKey
+	switch *args.Pk {
+	case *r.pkA:
+		toPk = r.pkB
+	case *r.pkB:
+		toPk = r.pkA
+	default:
+		panic("received relay data from unknown client")
+	}
+
+	if r.flow != nil {
+		if result, err := validateJSON(creditsSchema, args.Msg); err == nil && result.Valid() {
+			return r.grantCredits(args)
+		}
+	}
+
+	// validate msg
+	result, err := validateJSON(rdRelaySchema, args.Msg)
+	if err != nil {
+		return append(rdError(nil, ERROR_MALFORMED, err.Error()), rdError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	if !result.Valid() {
+		return append(rdError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result)), rdError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Relay struct {
+			Payload string `json:"payload"`
+		} `json:"relay"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	payload := usrMsg.Relay.Payload
+
+	// check the payload before counting it
+	if len(payload) > r.config.maxPayloadLength {
+		return append(rdError(nil, ERROR_LIMIT_EXCEEDED, fmt.Sprintf("Relay payload is longer than %d characters", r.config.maxPayloadLength)), rdError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return append(rdError(nil, ERROR_MALFORMED, "Relay payload is not valid base64"), rdError(toPk, ERROR_PEER_MALFORMED, "Peer sent a malformed message")...)
+	}
+	r.bytesSent += len(data)
+	if r.bytesSent > r.config.byteBudget {
+		return append(rdError(nil, ERROR_LIMIT_EXCEEDED, "Relay byte budget exceeded"), rdError(toPk, ERROR_LIMIT_EXCEEDED, "Relay byte budget exceeded")...)
+	}
+
+	forwarded := struct {
+		Relayed struct {
+			Payload string `json:"payload"`
+		} `json:"relayed"`
+	}{}
+	forwarded.Relayed.Payload = payload
+	forwardedStr, _ := json.Marshal(forwarded)
+
+	toMsgs := []string{string(forwardedStr)}
+	if r.flow != nil {
+		var ok bool
+		toMsgs, ok = r.flow.forward(*toPk, string(forwardedStr))
+		if !ok {
+			return append(rdError(nil, ERROR_LIMIT_EXCEEDED, "Too many relayed messages waiting for credits"), rdError(toPk, ERROR_LIMIT_EXCEEDED, "Too many relayed messages waiting for credits")...)
+		}
+	}
+
+	ros := []model.RoutineOutput{
+		{
+			Pk:              nil, // sender
+			TimeoutEnabled:  true,
+			TimeoutDuration: rdTimeoutDuration,
+		},
+	}
+	// a peer out of credits isn't sent anything until it grants more
+	if len(toMsgs) > 0 {
+		ros = append([]model.RoutineOutput{{
+			Pk:              toPk,
+			Msgs:            toMsgs,
+			TimeoutEnabled:  true,
+			TimeoutDuration: rdTimeoutDuration,
+		}}, ros...)
+	}
+	return ros
+}
+
+// the client grants credits with {"credits":<n>}, and is sent the relayed messages that were waiting for them.
+func (r *RelayData) grantCredits(args model.RoutineInput) []model.RoutineOutput {
+	usrMsg := struct {
+		Credits int `json:"credits"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+
+	return []model.RoutineOutput{
+		{
+			Pk:              nil, // sender
+			Msgs:            r.flow.grant(*args.Pk, usrMsg.Credits),
+			TimeoutEnabled:  true,
+			TimeoutDuration: rdTimeoutDuration,
+		},
+	}
+}
+
+// wrapper for error routine output
+func rdError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
+	return []model.RoutineOutput{
+		{
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
+		},
+	}
+}
@@ -0,0 +1,482 @@
+package routines
+
+import (
+	"encoding/base64"
+	"harmony/backend/model"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rdExpectedTimeoutDuration = 30 * time.Second
+
+func TestRelayData(t *testing.T) {
+
+	// A and B online, A has started the transaction
+	newRelay := func(config rdConfig) model.Routine {
+		clientA := &model.Client{}
+		clientA.SetPublicKey(&publicKey0)
+		clientB := &model.Client{}
+		clientB.SetPublicKey(&publicKey1)
+		hub := model.NewHub()
+		hub.AddClient(publicKey0, clientA)
+		hub.AddClient(publicKey1, clientB)
+		return newRelayDataDependencyInj(clientA, hub, config)
+	}
+
+	t.Run("Valid inputs", func(t *testing.T) {
+
+		t.Run("Peer is offline", func(t *testing.T) {
+			client := &model.Client{}
+			client.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, client)
+			rd := newRelayData(client, hub)
+
+			testRunner(t, rd, []Step{rdStepInitiateOffline})
+		})
+
+		t.Run("Bidirectional relay", func(t *testing.T) {
+			test := []Step{
+				rdStepInitiateOnline,
+				rdStepRelay(&publicKey0, &publicKey1, "hello B"),
+				rdStepRelay(&publicKey1, &publicKey0, "hello A"),
+				rdStepRelay(&publicKey1, &publicKey0, "again"),
+				rdStepRelay(&publicKey0, &publicKey1, ""),
+				stepPkACancel,
+			}
+			testRunner(t, newRelay(defaultRDConfig()), test)
+		})
+
+		t.Run("Keepalive", func(t *testing.T) {
+			test := []Step{
+				rdStepInitiateOnline,
+				{
+					description: "B sends a keepalive",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey1,
+						Msg:     `{"keepalive":true}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							verifyTimeouts: true,
+							ro: model.RoutineOutput{
+								Pk:              &publicKey1,
+								Msgs:            []string{},
+								TimeoutEnabled:  true,
+								TimeoutDuration: rdExpectedTimeoutDuration,
+							},
+						},
+					},
+				},
+				rdStepRelay(&publicKey1, &publicKey0, "still here"),
+				stepPkBCancel,
+			}
+			testRunner(t, newRelay(defaultRDConfig()), test)
+		})
+
+		t.Run("Relay up to the byte budget", func(t *testing.T) {
+			test := []Step{
+				rdStepInitiateOnline,
+				rdStepRelay(&publicKey0, &publicKey1, "12345"),
+				rdStepRelay(&publicKey1, &publicKey0, "12345"),
+				stepPkACancel,
+			}
+			testRunner(t, newRelay(rdConfig{maxPayloadLength: 100, byteBudget: 10}), test)
+		})
+
+		t.Run("Flow control", func(t *testing.T) {
+			test := []Step{
+				rdStepInitiateFlowControl,
+				rdStepRelayHeld(&publicKey0, &publicKey1, "1", true),
+				rdStepRelayHeld(&publicKey0, &publicKey1, "2", false),
+				rdStepRelayHeld(&publicKey0, &publicKey1, "3", false),
+				// released in order, and asked again for the one still held
+				rdStepGrantCredits(&publicKey1, 2, []string{"1", "2"}, true),
+				rdStepGrantCredits(&publicKey1, 3, []string{"3"}, false),
+				// 2 credits left
+				rdStepRelay(&publicKey0, &publicKey1, "4"),
+				rdStepRelay(&publicKey0, &publicKey1, "5"),
+				rdStepRelayHeld(&publicKey0, &publicKey1, "6", true),
+				// the other direction has credits of its own
+				rdStepRelayHeld(&publicKey1, &publicKey0, "hello A", true),
+				rdStepGrantCredits(&publicKey0, 1, []string{"hello A"}, false),
+				rdStepGrantCredits(&publicKey1, 1, []string{"6"}, false),
+				stepPkACancel,
+			}
+			testRunner(t, newRelay(defaultRDConfig()), test)
+		})
+	})
+
+	t.Run("Invalid inputs", func(t *testing.T) {
+
+		t.Run("Entry", func(t *testing.T) {
+			tests := []struct {
+				description string
+				pk          *model.PublicKey
+				msg         string
+				error       string
+			}{
+				{"No public key", nil, rdStepInitiateOnline.input.Msg, "You have not provided a public key"},
+				{"Relay to self", &publicKey0, `{"initiate":"relayData","key":"` + (string)(publicKey0) + `"}`, "Relaying to yourself is not allowed"},
+				{"Relay to self encoded differently", &publicKey0, `{"initiate":"relayData","key":"` + (string)(publicKey0OtherEncoding) + `"}`, "Relaying to yourself is not allowed"},
+				{"Missing key", &publicKey0, `{"initiate":"relayData"}`, ""},
+				{"Invalid key", &publicKey0, `{"initiate":"relayData","key":"` + invalidPublicKeyNIST + `"}`, ""},
+				{"Extra property", &publicKey0, `{"initiate":"relayData","key":"` + (string)(publicKey1) + `","extra":1}`, ""},
+				{"Relay before initiating", &publicKey0, `{"relay":{"payload":"aGk="}}`, ""},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.description, func(t *testing.T) {
+					expectedError := errorSchemaString()
+					if tt.error != "" {
+						expectedError = errorSchemaString(tt.error)
+					}
+					test := []Step{
+						{
+							description: tt.description,
+							input: model.RoutineInput{
+								MsgType: model.RoutineMsgType_UsrMsg,
+								Pk:      tt.pk,
+								Msg:     tt.msg,
+							},
+							outputs: []ExpectedOutput{
+								{
+									ro: model.RoutineOutput{
+										Pk:   tt.pk,
+										Msgs: []string{expectedError},
+										Done: true,
+									},
+								},
+							},
+						},
+					}
+					testRunner(t, newRelay(defaultRDConfig()), test)
+				})
+			}
+		})
+
+		tests := []struct {
+			description  string
+			config       rdConfig
+			prefaceSteps []Step
+			cases        []Step
+		}{
+			{
+				description:  "After initiating",
+				config:       defaultRDConfig(),
+				prefaceSteps: []Step{rdStepInitiateOnline},
+				cases: []Step{
+					stepPkADisconnect,
+					stepPkBDisconnect,
+					stepPkATimeout,
+					stepPkBTimeout,
+					stepPkBCancel,
+					rdStepBadRelay(&publicKey0, "lol", "", outputPkAErrorToBoth),
+					rdStepBadRelay(&publicKey1, `{"relay":{}}`, "", outputPkBErrorToBoth),
+					rdStepBadRelay(&publicKey1, `{"relay":{"payload":"aGk="},"extra":1}`, "", outputPkBErrorToBoth),
+					rdStepBadRelay(&publicKey1, `{"relay":{"payload":"not base64!"}}`, "", outputPkBErrorToBoth),
+					rdStepBadRelay(&publicKey0, `{"initiate":"relayData","key":"`+(string)(publicKey1)+`"}`, "", outputPkAErrorToBoth),
+					rdStepBadRelay(&publicKey1, `{"credits":1}`, "", outputPkBErrorToBoth),
+				},
+			},
+			{
+				description:  "Mid relay",
+				config:       defaultRDConfig(),
+				prefaceSteps: []Step{rdStepInitiateOnline, rdStepRelay(&publicKey0, &publicKey1, "hi"), rdStepRelay(&publicKey1, &publicKey0, "hi")},
+				cases: []Step{
+					stepPkADisconnect,
+					stepPkBDisconnect,
+					stepPkATimeout,
+					stepPkBCancel,
+				},
+			},
+			{
+				description:  "Size cap",
+				config:       rdConfig{maxPayloadLength: 8, byteBudget: defaultRelayByteBudget},
+				prefaceSteps: []Step{rdStepInitiateOnline, rdStepRelay(&publicKey0, &publicKey1, "123456")},
+				cases: []Step{
+					rdStepBadRelay(&publicKey0, `{"relay":{"payload":"`+base64.StdEncoding.EncodeToString([]byte("1234567"))+`"}}`, "Relay payload is longer than 8 characters", outputPkAErrorToBoth),
+					rdStepBadRelay(&publicKey1, `{"relay":{"payload":"`+strings.Repeat("A", 12)+`"}}`, "Relay payload is longer than 8 characters", outputPkBErrorToBoth),
+				},
+			},
+			{
+				description:  "Byte budget",
+				config:       rdConfig{maxPayloadLength: 100, byteBudget: 10},
+				prefaceSteps: []Step{rdStepInitiateOnline, rdStepRelay(&publicKey0, &publicKey1, "12345"), rdStepRelay(&publicKey1, &publicKey0, "1234")},
+				cases: []Step{
+					rdStepBadRelay(&publicKey0, `{"relay":{"payload":"`+base64.StdEncoding.EncodeToString([]byte("12"))+`"}}`, "Relay byte budget exceeded", rdOutputBudgetExceeded(&publicKey0, &publicKey1)),
+					rdStepBadRelay(&publicKey1, `{"relay":{"payload":"`+base64.StdEncoding.EncodeToString([]byte("12"))+`"}}`, "Relay byte budget exceeded", rdOutputBudgetExceeded(&publicKey1, &publicKey0)),
+				},
+			},
+			{
+				description:  "Flow control",
+				config:       rdConfig{maxPayloadLength: 100, byteBudget: 100, maxHeldMessages: 2},
+				prefaceSteps: []Step{rdStepInitiateFlowControl, rdStepRelayHeld(&publicKey0, &publicKey1, "1", true), rdStepRelayHeld(&publicKey0, &publicKey1, "2", false)},
+				cases: []Step{
+					rdStepBadRelay(&publicKey0, `{"relay":{"payload":"Mw=="}}`, "Too many relayed messages waiting for credits", rdOutputHeldExceeded(&publicKey0, &publicKey1)),
+					rdStepBadRelay(&publicKey1, `{"credits":0}`, "", outputPkBErrorToBoth),
+					rdStepBadRelay(&publicKey1, `{"credits":1.5}`, "", outputPkBErrorToBoth),
+					rdStepBadRelay(&publicKey1, `{"credits":"1"}`, "", outputPkBErrorToBoth),
+					rdStepBadRelay(&publicKey1, `{"credits":`+strconv.Itoa(maxCredits+1)+`}`, "", outputPkBErrorToBoth),
+					rdStepBadRelay(&publicKey1, `{"credits":1,"extra":1}`, "", outputPkBErrorToBoth),
+					stepPkADisconnect,
+					stepPkBTimeout,
+				},
+			},
+		}
+
+		for _, test := range tests {
+			for j, testCase := range test.cases {
+				t.Run(test.description+"-"+strconv.Itoa(j), func(t *testing.T) {
+					testRunner(t, newRelay(test.config), append(test.prefaceSteps, testCase), testRunnerConfig{errorsOnLastStepOnly: true})
+				})
+			}
+		}
+	})
+}
+
+var rdStepInitiateOffline = Step{
+	description: "A starts a relay to B, who is offline",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg:     `{"initiate":"relayData","key":"` + (string)(publicKey1) + `"}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{`{"const":{"peerStatus":"offline","terminate":"done"}}`},
+				Done: true,
+			},
+		},
+	},
+}
+
+var rdStepInitiateOnline = Step{
+	description: "A starts a relay to B",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg:     `{"initiate":"relayData","key":"` + (string)(publicKey1) + `"}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{`{"const":{"initiate":"receiveRelay","key":"` + (string)(publicKey0) + `"}}`},
+				TimeoutEnabled:  true,
+				TimeoutDuration: rdExpectedTimeoutDuration,
+			},
+		},
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey0,
+				Msgs:            []string{`{"const":{"peerStatus":"online"}}`},
+				TimeoutEnabled:  true,
+				TimeoutDuration: rdExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+var rdStepInitiateFlowControl = Step{
+	description: "A starts a relay to B with flow control",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg:     `{"initiate":"relayData","key":"` + (string)(publicKey1) + `","flowControl":true}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey1,
+				Msgs:            []string{`{"const":{"initiate":"receiveRelay","key":"` + (string)(publicKey0) + `","flowControl":true}}`},
+				TimeoutEnabled:  true,
+				TimeoutDuration: rdExpectedTimeoutDuration,
+			},
+		},
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              &publicKey0,
+				Msgs:            []string{`{"const":{"peerStatus":"online"}}`},
+				TimeoutEnabled:  true,
+				TimeoutDuration: rdExpectedTimeoutDuration,
+			},
+		},
+	},
+}
+
+func rdRelayedSchema(data string) string {
+	return `{"const":{"relayed":{"payload":"` + base64.StdEncoding.EncodeToString([]byte(data)) + `"}}}`
+}
+
+// from relays data to to, which has no credits left, so it is held.
+// to is asked for credits if needCredits, and sent nothing otherwise.
+func rdStepRelayHeld(from *model.PublicKey, to *model.PublicKey, data string, needCredits bool) Step {
+	outputs := []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:              from,
+				Msgs:            []string{},
+				TimeoutEnabled:  true,
+				TimeoutDuration: rdExpectedTimeoutDuration,
+			},
+		},
+	}
+	if needCredits {
+		outputs = append([]ExpectedOutput{
+			{
+				verifyTimeouts: true,
+				ro: model.RoutineOutput{
+					Pk:              to,
+					Msgs:            []string{`{"const":{"needCredits":true}}`},
+					TimeoutEnabled:  true,
+					TimeoutDuration: rdExpectedTimeoutDuration,
+				},
+			},
+		}, outputs...)
+	}
+	return Step{
+		description: "relay " + strconv.Quote(data) + " without credits",
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      from,
+			Msg:     `{"relay":{"payload":"` + base64.StdEncoding.EncodeToString([]byte(data)) + `"}}`,
+		},
+		outputs: outputs,
+	}
+}
+
+// pk grants credits and is sent the held messages released, followed by needCredits if stillHeld.
+func rdStepGrantCredits(pk *model.PublicKey, credits int, released []string, stillHeld bool) Step {
+	msgs := []string{}
+	for _, data := range released {
+		msgs = append(msgs, rdRelayedSchema(data))
+	}
+	if stillHeld {
+		msgs = append(msgs, `{"const":{"needCredits":true}}`)
+	}
+	return Step{
+		description: "grant " + strconv.Itoa(credits) + " credits",
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      pk,
+			Msg:     `{"credits":` + strconv.Itoa(credits) + `}`,
+		},
+		outputs: []ExpectedOutput{
+			{
+				verifyTimeouts: true,
+				ro: model.RoutineOutput{
+					Pk:              pk,
+					Msgs:            msgs,
+					TimeoutEnabled:  true,
+					TimeoutDuration: rdExpectedTimeoutDuration,
+				},
+			},
+		},
+	}
+}
+
+// from relays data to to, which receives it unchanged.
+func rdStepRelay(from *model.PublicKey, to *model.PublicKey, data string) Step {
+	payload := base64.StdEncoding.EncodeToString([]byte(data))
+	return Step{
+		description: "relay " + strconv.Quote(data),
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      from,
+			Msg:     `{"relay":{"payload":"` + payload + `"}}`,
+		},
+		outputs: []ExpectedOutput{
+			{
+				verifyTimeouts: true,
+				ro: model.RoutineOutput{
+					Pk:              to,
+					Msgs:            []string{`{"const":{"relayed":{"payload":"` + payload + `"}}}`},
+					TimeoutEnabled:  true,
+					TimeoutDuration: rdExpectedTimeoutDuration,
+				},
+			},
+			{
+				verifyTimeouts: true,
+				ro: model.RoutineOutput{
+					Pk:              from,
+					Msgs:            []string{},
+					TimeoutEnabled:  true,
+					TimeoutDuration: rdExpectedTimeoutDuration,
+				},
+			},
+		},
+	}
+}
+
+// expectedError is only used to describe the step; outputs are what is checked.
+func rdStepBadRelay(from *model.PublicKey, msg string, expectedError string, outputs []ExpectedOutput) Step {
+	description := "bad relay message " + msg
+	if expectedError != "" {
+		description += ": " + expectedError
+		// the sender gets the specific error
+		outputs = append([]ExpectedOutput{}, outputs...)
+		for i, output := range outputs {
+			if *output.ro.Pk == *from {
+				outputs[i].ro.Msgs = []string{errorSchemaString(expectedError)}
+			}
+		}
+	}
+	return Step{
+		description: description,
+		input: model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Pk:      from,
+			Msg:     msg,
+		},
+		outputs: outputs,
+	}
+}
+
+func rdOutputBudgetExceeded(from *model.PublicKey, to *model.PublicKey) []ExpectedOutput {
+	return []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   from,
+				Msgs: []string{errorSchemaString("Relay byte budget exceeded")},
+				Done: true,
+			},
+		},
+		{
+			ro: model.RoutineOutput{
+				Pk:   to,
+				Msgs: []string{errorSchemaString("Relay byte budget exceeded")},
+				Done: true,
+			},
+		},
+	}
+}
+
+func rdOutputHeldExceeded(from *model.PublicKey, to *model.PublicKey) []ExpectedOutput {
+	return []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   from,
+				Msgs: []string{errorSchemaString("Too many relayed messages waiting for credits")},
+				Done: true,
+			},
+		},
+		{
+			ro: model.RoutineOutput{
+				Pk:   to,
+				Msgs: []string{errorSchemaString("Too many relayed messages waiting for credits")},
+				Done: true,
+			},
+		},
+	}
+}
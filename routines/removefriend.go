@@ -0,0 +1,113 @@
+package routines
+
+import (
+	"encoding/json"
+	"harmony/backend/model"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type RemoveFriend struct {
+	client *model.Client
+	hub    *model.Hub
+	pkA    *model.PublicKey
+	pkB    *model.PublicKey
+}
+
+func newRemoveFriend(client *model.Client, hub *model.Hub) model.Routine {
+	return &RemoveFriend{client: client, hub: hub}
+}
+
+func (r *RemoveFriend) Next(args model.RoutineInput) []model.RoutineOutput {
+	// only 1 step, don't need to worry about state.
+	r.pkA = args.Pk
+	if r.pkA == nil {
+		return rmfError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
+	}
+
+	// validate msg
+	result, err := validateJSON(rmfSchema, args.Msg)
+	if err != nil {
+		return rmfError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return rmfError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Initiate string `json:"initiate"`
+		Key      string `json:"key"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+	r.pkB, err = parsePublicKey(usrMsg.Key)
+	if err != nil {
+		return rmfError(nil, ERROR_MALFORMED, err.Error())
+	}
+
+	// check pkB is different from pkA
+	if sameKey(*r.pkA, *r.pkB) {
+		return rmfError(nil, ERROR_SELF_NOT_ALLOWED, "You can't remove yourself")
+	}
+
+	_, peerOnline := r.hub.GetClient(*r.pkB)
+
+	if peerOnline {
+		return []model.RoutineOutput{
+			{
+				Pk:         r.pkA,
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Msgs:       []string{`{"peerStatus":"online","terminate":"done"}`},
+			},
+			{
+				Pk:         r.pkB,
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Msgs:       []string{`{"initiate":"receiveFriendRemoval","terminate":"done","key":"` + publicKeyToString(*r.pkA) + `"}`},
+			},
+		}
+	} else {
+		return []model.RoutineOutput{
+			{
+				Pk:         r.pkA,
+				Done:       true,
+				DoneReason: model.DoneReason_Completed,
+				Msgs:       []string{`{"peerStatus":"offline","terminate":"done"}`},
+			},
+		}
+	}
+}
+
+var rmfSchema = func() *gojsonschema.Schema {
+	schemaStr := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"removeFriend"
+			},
+			"key": {
+				"type":"string",
+				"pattern": "` + publicKeyPattern + `"
+			}
+		},
+		"required": ["initiate", "key"],
+		"additionalProperties": false
+	}`
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// wrapper for error routine output
+func rmfError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
+	return []model.RoutineOutput{
+		{
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
+		},
+	}
+}
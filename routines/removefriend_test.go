@@ -0,0 +1,298 @@
+package routines
+
+import (
+	"harmony/backend/model"
+	"testing"
+)
+
+func TestRemoveFriend(t *testing.T) {
+
+	t.Run("Valid inputs", func(t *testing.T) {
+
+		t.Run("Peer is online", func(t *testing.T) {
+			test := []Step{
+				rmfStepOnline,
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(*clientA.GetPublicKey(), clientA)
+			hub.AddClient(*clientB.GetPublicKey(), clientB)
+			rmf := newRemoveFriend(clientA, hub)
+
+			testRunner(t, rmf, test)
+
+		})
+
+		t.Run("Peer is offline", func(t *testing.T) {
+
+			test := []Step{
+				rmfStepOffline,
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			hub.AddClient(*clientA.GetPublicKey(), clientA)
+			rmf := newRemoveFriend(clientA, hub)
+
+			testRunner(t, rmf, test)
+		})
+	})
+
+	t.Run("Invalid inputs", func(t *testing.T) {
+		t.Run("User has not provided their public key", func(t *testing.T) {
+
+			test := []Step{
+				{
+					description: "A sends a friend removal without having provided their public key",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      nil,
+						Msg:     rmfStepOnline.input.Msg,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   nil,
+								Msgs: []string{errorSchemaString("You have not provided a public key")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			clientA := &model.Client{}
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+			rmf := newRemoveFriend(clientA, hub)
+
+			testRunner(t, rmf, test)
+		})
+
+		t.Run("User sends a message to themself", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "User removes themself",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg: `{
+							"initiate": "removeFriend",
+							"key": "` + (string)(publicKey0) + `"
+						}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{errorSchemaString("You can't remove yourself")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			hub.AddClient(*clientA.GetPublicKey(), clientA)
+
+			rmf := newRemoveFriend(clientA, hub)
+
+			testRunner(t, rmf, test)
+		})
+
+		tests := []Step{
+			{
+				description: "No key",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "removeFriend"}`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Key in wrong format",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "removeFriend", "key":"4"}`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Key is not Ed25519 (NIST curve)",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "removeFriend", "key":"` + invalidPublicKeyNIST + `"}`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Key is not Ed25519 (truncated)",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "removeFriend", "key":"` + invalidPublicKeyTruncated + `"}`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Key is not Ed25519 (corrupted DER header)",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "removeFriend", "key":"` + invalidPublicKeyCorruptedHeader + `"}`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Invalid JSON",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `)`,
+				},
+				outputs: outputPkAError,
+			},
+
+			{
+				description: "Extra properties",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate": "removeFriend", "key":"` + (string)(publicKey1) + `", "extraProperty!":{}}`,
+				},
+				outputs: outputPkAError,
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.description, func(t *testing.T) {
+				clientA := &model.Client{}
+				clientA.SetPublicKey(&publicKey0)
+				clientB := &model.Client{}
+				clientB.SetPublicKey(&publicKey1)
+				hub := model.NewHub()
+				hub.AddClient(*clientA.GetPublicKey(), clientA)
+				hub.AddClient(*clientB.GetPublicKey(), clientB)
+
+				rmf := newRemoveFriend(clientA, hub)
+
+				testRunner(t, rmf, []Step{test})
+			})
+		}
+	})
+}
+
+var rmfStepOnline = Step{
+	description: "Remove an online friend",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg: `{
+			"initiate": "removeFriend",
+			"key": "` + (string)(publicKey1) + `"
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{rmfSchemaOnlineToA},
+				Done: true,
+			},
+		}, {
+			ro: model.RoutineOutput{
+				Pk:   &publicKey1,
+				Msgs: []string{rmfSchemaOnlineToB},
+				Done: true,
+			},
+		},
+	},
+}
+
+var rmfStepOffline = Step{
+	description: "Remove an offline friend",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg: `{
+			"initiate": "removeFriend",
+			"key": "` + (string)(publicKey1) + `"
+		}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{rmfSchemaOfflineToA},
+				Done: true,
+			},
+		},
+	},
+}
+
+const rmfSchemaOfflineToA = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"peerStatus": {
+			"const": "offline"
+		},
+		"terminate": {
+			"const": "done"
+		}
+	},
+	"additionalProperties": false,
+	"required": ["peerStatus", "terminate"]
+}`
+
+const rmfSchemaOnlineToA = `{
+"$schema": "https://json-schema.org/draft/2020-12/schema",
+"type": "object",
+"properties": {
+	"peerStatus": {
+		"const": "online"
+	},
+	"terminate": {
+		"const": "done"
+	}
+},
+"additionalProperties": false,
+"required": ["peerStatus", "terminate"]
+}`
+
+var rmfSchemaOnlineToB = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"properties": {
+		"initiate": {
+			"const": "receiveFriendRemoval"
+		},
+		"terminate": {
+			"const": "done"
+		},
+		"key": {
+			"const": "` + (string)(publicKey0) + `"
+		}
+	},
+	"additionalProperties": false,
+	"required": ["initiate", "terminate", "key"]
+}`
@@ -4,9 +4,5 @@ import "harmony/backend/model"
 
 type RoutineConstructor func(*model.Client, *model.Hub) model.Routine
 
-type RoutineConstructors struct {
-	NewComeOnline                RoutineConstructor
-	NewEstablishConnectionToPeer RoutineConstructor
-	NewFriendRequest             RoutineConstructor
-	NewFriendRejection           RoutineConstructor
-}
+// routine constructors by the `"initiate":` keyword that starts them
+type RoutineConstructors map[string]RoutineConstructor
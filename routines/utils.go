@@ -1,9 +1,23 @@
 package routines
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"harmony/backend/model"
+	"math/big"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/xeipuuv/gojsonschema"
 )
@@ -28,6 +42,121 @@ func MakeJSONError(msg ...string) string {
 	return string(b)
 }
 
+/*
+Make error in format `{"terminate":"cancel", "code": "...", error: "..."}`
+
+The code is one of the ERROR_ constants and is meant for clients to match on,
+the error message is meant for humans. If no message is supplied the
+`"error":"..."` part is omitted.
+*/
+func MakeJSONErrorWithCode(code string, msg ...string) string {
+	type JsonError struct {
+		Terminate string `json:"terminate"`
+		Code      string `json:"code"`
+		Error     string `json:"error,omitempty"`
+	}
+	jsonError := JsonError{Terminate: "cancel", Code: code}
+	if len(msg) > 0 {
+		jsonError.Error = msg[0]
+	}
+	b, _ := json.Marshal(jsonError)
+	return string(b)
+}
+
+/*
+End pk's transaction because its peer disconnected, with
+`{"terminate":"cancel","code":"PEER_DISCONNECTED","error":"Peer disconnected"}`.
+
+If the peer registered a last will it is passed on as well, in `"lastWill":{...}`.
+*/
+func peerDisconnected(pk *model.PublicKey, lastWill string) []model.RoutineOutput {
+	msg := MakeJSONErrorWithCode(ERROR_PEER_DISCONNECTED, "Peer disconnected")
+	if lastWill != "" {
+		b, _ := json.Marshal(struct {
+			Terminate string          `json:"terminate"`
+			Code      string          `json:"code"`
+			Error     string          `json:"error"`
+			LastWill  json.RawMessage `json:"lastWill"`
+		}{"cancel", ERROR_PEER_DISCONNECTED, "Peer disconnected", json.RawMessage(lastWill)})
+		msg = string(b)
+	}
+	return []model.RoutineOutput{
+		{
+			Pk:         pk,
+			Done:       true,
+			DoneReason: model.DoneReason_PeerDisconnected,
+			Msgs:       []string{msg},
+			Critical:   true,
+		},
+	}
+}
+
+// machine-readable codes sent alongside error messages
+const (
+	// the routine timed out waiting for this client
+	ERROR_TIMEOUT = "TIMEOUT"
+	// the message was not valid at this point of the routine
+	ERROR_MALFORMED = "MALFORMED"
+	// a message was valid but arrived out of order
+	ERROR_OUT_OF_ORDER = "OUT_OF_ORDER"
+	// a size or count limit was exceeded
+	ERROR_LIMIT_EXCEEDED = "LIMIT_EXCEEDED"
+	// the message was valid, but the server's policy doesn't allow it
+	ERROR_NOT_PERMITTED = "NOT_PERMITTED"
+	// the routine requires the client to have come online first
+	ERROR_NOT_AUTHENTICATED = "NOT_AUTHENTICATED"
+	// the client targeted itself
+	ERROR_SELF_NOT_ALLOWED = "SELF_NOT_ALLOWED"
+	// the other side of the transaction timed out
+	ERROR_PEER_TIMEOUT = "PEER_TIMEOUT"
+	// the other side of the transaction disconnected
+	ERROR_PEER_DISCONNECTED = "PEER_DISCONNECTED"
+	// the other side of the transaction sent an invalid message
+	ERROR_PEER_MALFORMED = "PEER_MALFORMED"
+	// the other side of the transaction cancelled it
+	ERROR_PEER_CANCELLED = "PEER_CANCELLED"
+	// a message was addressed to someone who is not in the group
+	ERROR_NOT_IN_GROUP = "NOT_IN_GROUP"
+	// another routine is already doing the same thing on this connection, e.g. comeOnline, or a connection request to the same peer
+	ERROR_BUSY = "BUSY"
+	// the client already has a public key
+	ERROR_ALREADY_ONLINE = "ALREADY_ONLINE"
+	// the client asked for a protocol version the server does not support
+	ERROR_UNSUPPORTED_VERSION = "UNSUPPORTED_VERSION"
+	// the signed challenge was too old
+	ERROR_CHALLENGE_EXPIRED = "CHALLENGE_EXPIRED"
+	// the challenge signature did not verify
+	ERROR_INVALID_SIGNATURE = "INVALID_SIGNATURE"
+	// the client is sending requests too quickly
+	ERROR_RATE_LIMITED = "RATE_LIMITED"
+	// the reconnection token did not match the key or has expired
+	ERROR_INVALID_TOKEN = "INVALID_TOKEN"
+	// the key, or the peer being sent a request, is banned
+	ERROR_BANNED = "BANNED"
+	// the server has as many clients signed in as it allows
+	ERROR_AT_CAPACITY = "AT_CAPACITY"
+	// the key has as many devices signed in as the server allows
+	ERROR_TOO_MANY_DEVICES = "TOO_MANY_DEVICES"
+	// the peer has no pre-keys to hand out
+	ERROR_NO_PRE_KEYS = "NO_PRE_KEYS"
+	// something went wrong on the server
+	ERROR_INTERNAL = "INTERNAL"
+)
+
+// why a transaction ended with an error with this code, for the DoneReason of the output carrying it.
+func doneReasonForCode(code string) model.DoneReason {
+	switch code {
+	case ERROR_TIMEOUT, ERROR_PEER_TIMEOUT:
+		return model.DoneReason_Timeout
+	case ERROR_PEER_DISCONNECTED:
+		return model.DoneReason_PeerDisconnected
+	case ERROR_PEER_CANCELLED:
+		return model.DoneReason_Cancelled
+	default:
+		return model.DoneReason_Error
+	}
+}
+
 func terminateDoneJSONMsg() string {
 	return `{"terminate":"done"}`
 }
@@ -53,13 +182,173 @@ var clientCancelSchema = func() *gojsonschema.Schema {
 	return schema
 }()
 
+// largest client message that is validated against a schema. Leaves room for an SDP of defaultMaxSdpLength.
+const maxJSONSize = 80 * 1024
+
+// deepest nesting of objects and arrays in a client message that is validated against a schema. No routine's messages come close.
+const maxJSONDepth = 32
+
+// Reject msg if validating it could be expensive: if it is longer than maxJSONSize, or nested deeper than maxJSONDepth.
+// Only counts brackets outside strings, so msg isn't checked to be valid JSON.
+func checkJSONLimits(msg string) error {
+	if len(msg) > maxJSONSize {
+		return fmt.Errorf("Message is longer than %d bytes", maxJSONSize)
+	}
+	depth := 0
+	inString := false
+	escaped := false
+	for i := 0; i < len(msg); i++ {
+		switch b := msg[i]; {
+		case escaped:
+			escaped = false
+		case inString:
+			if b == '\\' {
+				escaped = true
+			} else if b == '"' {
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			depth++
+			if depth > maxJSONDepth {
+				return fmt.Errorf("Message is nested more than %d levels deep", maxJSONDepth)
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+// Validate msg against schema, once it has passed checkJSONLimits. Every client message should be validated through this.
+func validateJSON(schema *gojsonschema.Schema, msg string) (*gojsonschema.Result, error) {
+	err := checkJSONLimits(msg)
+	if err != nil {
+		return nil, err
+	}
+	return schema.Validate(gojsonschema.NewStringLoader(msg))
+}
+
 // {"terminate":"cancel"}
 func isClientCancelMsg(msg string) bool {
-	msgLoader := gojsonschema.NewStringLoader(msg)
-	result, err := clientCancelSchema.Validate(msgLoader)
+	result, err := validateJSON(clientCancelSchema, msg)
 	return err == nil && result.Valid()
 }
 
+var keepaliveSchema = func() *gojsonschema.Schema {
+	schemaLoader := gojsonschema.NewStringLoader(`
+	{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"keepalive": {
+				"const": true
+			}
+		},
+		"required": ["keepalive"],
+		"additionalProperties": false
+	}
+	`)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+// {"keepalive":true}
+func isKeepaliveMsg(msg string) bool {
+	result, err := validateJSON(keepaliveSchema, msg)
+	return err == nil && result.Valid()
+}
+
+// reply to a keepalive: re-arm the sender's timeout without sending them anything.
+func keepaliveOutput(timeout time.Duration) []model.RoutineOutput {
+	return []model.RoutineOutput{
+		{
+			Pk:              nil, // sender
+			TimeoutEnabled:  true,
+			TimeoutDuration: timeout,
+		},
+	}
+}
+
+// reasons a client can give when cancelling, e.g. {"terminate":"cancel","reason":"changedMind"}
+var cancelReasons = []string{"changedMind", "busy", "wrongRecipient", "other"}
+
+// reason given in a {"terminate":"cancel"} message.
+// "" if there is none, or it isn't one of cancelReasons.
+func parseCancelReason(msg string) string {
+	cancelMsg := struct {
+		Reason string `json:"reason"`
+	}{}
+	json.Unmarshal([]byte(msg), &cancelMsg)
+	if !slices.Contains(cancelReasons, cancelMsg.Reason) {
+		return ""
+	}
+	return cancelMsg.Reason
+}
+
+// {"terminate":"cancel","error":"Peer cancelled the transaction"}, with the reason the peer gave if there is one.
+func peerCancelledOutput(pk *model.PublicKey, reason string) model.RoutineOutput {
+	data := struct {
+		Terminate string `json:"terminate"`
+		Code      string `json:"code"`
+		Error     string `json:"error"`
+		Reason    string `json:"reason,omitempty"`
+	}{
+		Terminate: "cancel",
+		Code:      ERROR_PEER_CANCELLED,
+		Error:     "Peer cancelled the transaction",
+		Reason:    reason,
+	}
+	msg, _ := json.Marshal(data)
+	return model.RoutineOutput{
+		Pk:         pk,
+		Done:       true,
+		DoneReason: model.DoneReason_Cancelled,
+		Msgs:       []string{string(msg)},
+	}
+}
+
+// optional "rid" (request id) that a client can put on a message so that it can match up the messages sent in response.
+// Routines that support it add it to the top level properties of their schemas.
+var requestIdSchema = `{"type": "string", "minLength": 1, "maxLength": ` + strconv.Itoa(maxRequestIdLength) + `}`
+
+const maxRequestIdLength = 64
+
+// "rid" of a client message. "" if there is none, or it doesn't match requestIdSchema.
+func parseRequestId(msg string) string {
+	ridMsg := struct {
+		Rid string `json:"rid"`
+	}{}
+	json.Unmarshal([]byte(msg), &ridMsg)
+	if utf8.RuneCountInString(ridMsg.Rid) > maxRequestIdLength {
+		return ""
+	}
+	return ridMsg.Rid
+}
+
+// adds "rid" to every message in ros. Messages must be JSON objects.
+// ros is returned unchanged if rid is "".
+func withRequestId(ros []model.RoutineOutput, rid string) []model.RoutineOutput {
+	if rid == "" {
+		return ros
+	}
+	quotedRid, _ := json.Marshal(rid)
+	for i, ro := range ros {
+		msgs := make([]string, len(ro.Msgs))
+		for j, msg := range ro.Msgs {
+			// splice it in before the closing brace, so the rest of the message is untouched
+			msg = strings.TrimSuffix(strings.TrimRight(msg, " \t\r\n"), "}")
+			if strings.TrimSpace(msg) != "{" {
+				msg += ","
+			}
+			msgs[j] = msg + `"rid":` + string(quotedRid) + "}"
+		}
+		ros[i].Msgs = msgs
+	}
+	return ros
+}
+
 // helper function to convert json schema parse error to string
 func formatJSONError(result *gojsonschema.Result) string {
 	var errorStrings []string
@@ -69,31 +358,133 @@ func formatJSONError(result *gojsonschema.Result) string {
 	return strings.Join(errorStrings, ", ")
 }
 
-var routineContructorImplementations = RoutineConstructors{
-	NewComeOnline:                newComeOnline,
-	NewEstablishConnectionToPeer: newEstablishConnectionToPeer,
-	NewFriendRequest:             newFriendRequest,
-	NewFriendRejection:           newFriendRejection,
+// the error sent to a client whose message failed schema validation.
+// the details describe the schema, so unless the hub is in debug mode they are only logged, with the client's logger.
+func jsonErrorMessage(hub *model.Hub, client *model.Client, result *gojsonschema.Result) string {
+	details := formatJSONError(result)
+	if hub.ErrorVerbosity() == model.ErrorVerbosity_Debug {
+		return details
+	}
+	logger := model.DefaultLogger()
+	pk := "nil"
+	if client != nil {
+		logger = client.Logger()
+		if key := client.GetPublicKey(); key != nil {
+			pk = (string)(*key)
+		}
+	}
+	logger.Info("Malformed message", "publicKey", pk, "error", details)
+	return "Malformed message"
 }
 
+// Parse a base64 encoded DER (PKIX) public key, checking that it is a valid key of a kind clients can sign in with.
+// Whether the server allows that kind is up to the routine that signs clients in.
 func parsePublicKey(pkstr string) (*model.PublicKey, error) {
-	// if len(pkstr) != publicKeyBase32Len {
-	// 	return nil, errors.New("key incorrect length")
-	// }
-	// pk, err := base32.StdEncoding.DecodeString(pkstr)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
+	_, err := parseClientKey(pkstr, []model.KeyAlgorithm{model.KeyAlgorithm_Ed25519, model.KeyAlgorithm_P256})
+	if err != nil {
+		return nil, err
+	}
 	return (*model.PublicKey)(&pkstr), nil
 }
 
+// a client's decoded public key, which can check the client's signatures.
+type clientKey struct {
+	algorithm model.KeyAlgorithm
+	// ed25519.PublicKey or *ecdsa.PublicKey
+	key any
+}
+
+// Decode a base64 encoded DER (PKIX) public key and assert that it is one of the allowed kinds.
+func parseClientKey(pkstr string, allowed []model.KeyAlgorithm) (clientKey, error) {
+	notAllowed := errors.New("public key is not " + joinKeyAlgorithms(allowed))
+
+	// decode base64
+	keyDER, err := base64.StdEncoding.DecodeString(pkstr)
+	if err != nil {
+		return clientKey{}, errors.New("public key is not valid base64")
+	}
+
+	// parse DER
+	keyDecoded, err := x509.ParsePKIXPublicKey(keyDER)
+	if err != nil {
+		return clientKey{}, notAllowed
+	}
+
+	var parsed clientKey
+	switch key := keyDecoded.(type) {
+	case ed25519.PublicKey:
+		parsed = clientKey{model.KeyAlgorithm_Ed25519, key}
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return clientKey{}, notAllowed
+		}
+		parsed = clientKey{model.KeyAlgorithm_P256, key}
+	default:
+		return clientKey{}, notAllowed
+	}
+	if !slices.Contains(allowed, parsed.algorithm) {
+		return clientKey{}, notAllowed
+	}
+	return parsed, nil
+}
+
+// whether sig is the key's signature of msg.
+// P-256 signatures can be ASN.1 encoded, or the raw r and s that WebCrypto produces.
+func (k clientKey) verify(msg []byte, sig []byte) bool {
+	switch key := k.key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, msg, sig)
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(msg)
+		if len(sig) == 64 {
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			return ecdsa.Verify(key, hash[:], r, s)
+		}
+		return ecdsa.VerifyASN1(key, hash[:], sig)
+	default:
+		return false
+	}
+}
+
+// "ed25519 or p256"
+func joinKeyAlgorithms(algorithms []model.KeyAlgorithm) string {
+	names := make([]string, len(algorithms))
+	for i, algorithm := range algorithms {
+		names[i] = string(algorithm)
+	}
+	return strings.Join(names, " or ")
+}
+
+// whether a and b are encodings of the same key. Different strings can decode to the same DER,
+// e.g. if the unused bits before the base64 padding are set, so the strings are only compared if either isn't a valid key.
+func sameKey(a model.PublicKey, b model.PublicKey) bool {
+	derA, okA := canonicalKeyDER(a)
+	derB, okB := canonicalKeyDER(b)
+	if !okA || !okB {
+		return a == b
+	}
+	return bytes.Equal(derA, derB)
+}
+
+// the DER of the key once it has been parsed and encoded again. ok is false if pk isn't a valid key.
+func canonicalKeyDER(pk model.PublicKey) (der []byte, ok bool) {
+	keyDER, err := base64.StdEncoding.DecodeString(string(pk))
+	if err != nil {
+		return nil, false
+	}
+	key, err := x509.ParsePKIXPublicKey(keyDER)
+	if err != nil {
+		return nil, false
+	}
+	der, err = x509.MarshalPKIXPublicKey(key)
+	return der, err == nil
+}
+
 func publicKeyToString(pk model.PublicKey) string {
 	return (string)(pk)
 }
 
-// const publicKeyBase32Len = 472
-
 // from https://stackoverflow.com/questions/475074/regex-to-parse-or-validate-base64-data
 const publicKeyPattern = "^(?:[A-Za-z0-9+/]{4})*(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=)?$"
 const signaturePattern = "^(?:[A-Za-z0-9+/]{4})*(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=)?$"
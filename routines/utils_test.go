@@ -0,0 +1,425 @@
+package routines
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"harmony/backend/model"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+func TestParsePublicKey(t *testing.T) {
+
+	t.Run("Accepts valid Ed25519 keys", func(t *testing.T) {
+		tests := []string{
+			(string)(publicKey0),
+			(string)(publicKey1),
+		}
+
+		for _, tt := range tests {
+			t.Run(tt, func(t *testing.T) {
+				pk, err := parsePublicKey(tt)
+				if err != nil {
+					t.Errorf("Expected no error, got %s", err.Error())
+				} else if (string)(*pk) != tt {
+					t.Errorf("Expected %s got %s", tt, *pk)
+				}
+			})
+		}
+	})
+
+	t.Run("Accepts P-256 keys, which clients can be allowed to sign in with", func(t *testing.T) {
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, _ := x509.MarshalPKIXPublicKey(&private.PublicKey)
+		if _, err := parsePublicKey(base64.StdEncoding.EncodeToString(der)); err != nil {
+			t.Errorf("Expected no error, got %s", err.Error())
+		}
+	})
+
+	t.Run("Rejects keys that are not valid Ed25519 keys", func(t *testing.T) {
+		tests := []struct {
+			description string
+			key         string
+		}{
+			{"NIST curve", invalidPublicKeyNIST},
+			{"truncated", invalidPublicKeyTruncated},
+			{"corrupted DER header", invalidPublicKeyCorruptedHeader},
+			{"not base64", "!!!!"},
+			{"empty", ""},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.description, func(t *testing.T) {
+				pk, err := parsePublicKey(tt.key)
+				if err == nil {
+					t.Errorf("Expected an error, got key %v", *pk)
+				}
+			})
+		}
+	})
+}
+
+func TestSameKey(t *testing.T) {
+	tests := []struct {
+		description string
+		a           model.PublicKey
+		b           model.PublicKey
+		same        bool
+	}{
+		{"identical", publicKey0, publicKey0, true},
+		{"different encodings of one key", publicKey0, publicKey0OtherEncoding, true},
+		{"different keys", publicKey0, publicKey1, false},
+		{"invalid keys are compared as strings", invalidPublicKeyTruncated, invalidPublicKeyTruncated, true},
+		{"invalid and valid key", invalidPublicKeyTruncated, publicKey0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			if got := sameKey(tt.a, tt.b); got != tt.same {
+				t.Errorf("Expected %t got %t", tt.same, got)
+			}
+		})
+	}
+}
+
+func TestWithRequestId(t *testing.T) {
+
+	t.Run("Adds the request id to every message", func(t *testing.T) {
+		tests := []struct {
+			msg      string
+			expected string
+		}{
+			{`{"a":1}`, `{"a":1,"rid":"r1"}`},
+			{`{"a":{"b":"}"}}`, `{"a":{"b":"}"},"rid":"r1"}`},
+			{"{\n\t\"a\": 1\n}\n", "{\n\t\"a\": 1\n,\"rid\":\"r1\"}"},
+			{`{}`, `{"rid":"r1"}`},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.msg, func(t *testing.T) {
+				ros := withRequestId([]model.RoutineOutput{{Msgs: []string{tt.msg}}}, "r1")
+				if ros[0].Msgs[0] != tt.expected {
+					t.Errorf("Expected %s got %s", tt.expected, ros[0].Msgs[0])
+				}
+			})
+		}
+	})
+
+	t.Run("Escapes the request id", func(t *testing.T) {
+		ros := withRequestId([]model.RoutineOutput{{Msgs: []string{`{"a":1}`}}}, `"},"x":"`)
+		expected := `{"a":1,"rid":"\"},\"x\":\""}`
+		if ros[0].Msgs[0] != expected {
+			t.Errorf("Expected %s got %s", expected, ros[0].Msgs[0])
+		}
+	})
+
+	t.Run("Leaves messages unchanged without a request id", func(t *testing.T) {
+		ros := withRequestId([]model.RoutineOutput{{Msgs: []string{`{"a":1}`}}}, "")
+		if ros[0].Msgs[0] != `{"a":1}` {
+			t.Errorf("Expected the message to be unchanged, got %s", ros[0].Msgs[0])
+		}
+	})
+}
+
+func TestCheckJSONLimits(t *testing.T) {
+
+	nested := func(depth int) string {
+		return strings.Repeat("[", depth) + strings.Repeat("]", depth)
+	}
+
+	t.Run("Accepts messages within the limits", func(t *testing.T) {
+		tests := []string{
+			`{"initiate":"checkPeerOnline"}`,
+			nested(maxJSONDepth),
+			// brackets inside strings aren't nesting
+			`{"a":"` + strings.Repeat("[", maxJSONDepth+1) + `"}`,
+			`{"a":"\"[[[[","b":[` + nested(maxJSONDepth-2) + `]}`,
+			`{"a":"` + strings.Repeat("a", maxJSONSize-8) + `"}`,
+		}
+		for _, tt := range tests {
+			if err := checkJSONLimits(tt); err != nil {
+				t.Errorf("Expected no error for %.40s, got %s", tt, err.Error())
+			}
+		}
+	})
+
+	t.Run("Rejects messages over the limits", func(t *testing.T) {
+		tests := []string{
+			nested(maxJSONDepth + 1),
+			`{"a":"\\",` + `"b":` + nested(maxJSONDepth) + `}`,
+			`{"a":"` + strings.Repeat("a", maxJSONSize-7) + `"}`,
+		}
+		for _, tt := range tests {
+			if err := checkJSONLimits(tt); err == nil {
+				t.Errorf("Expected an error for %.40s", tt)
+			}
+		}
+	})
+}
+
+// logger that records each line logged, with its key-value fields
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) record(msg string, keyvals ...any) {
+	l.lines = append(l.lines, fmt.Sprint(append([]any{msg}, keyvals...)...))
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...any) { l.record(msg, keyvals...) }
+func (l *recordingLogger) Info(msg string, keyvals ...any)  { l.record(msg, keyvals...) }
+func (l *recordingLogger) Warn(msg string, keyvals ...any)  { l.record(msg, keyvals...) }
+func (l *recordingLogger) Error(msg string, keyvals ...any) { l.record(msg, keyvals...) }
+
+func TestJSONErrorMessage(t *testing.T) {
+
+	schema, _ := gojsonschema.NewSchema(gojsonschema.NewStringLoader(`{
+		"type": "object",
+		"properties": {
+			"secretProperty": {"type": "string"}
+		},
+		"required": ["secretProperty"]
+	}`))
+	result, _ := validateJSON(schema, `{}`)
+
+	t.Run("Production mode sends a generic error", func(t *testing.T) {
+		hub := model.NewHub()
+		if msg := jsonErrorMessage(hub, &model.Client{}, result); msg != "Malformed message" {
+			t.Errorf(`Expected "Malformed message", got %q`, msg)
+		}
+	})
+
+	t.Run("Production mode logs the schema errors with the client's logger", func(t *testing.T) {
+		hub := model.NewHub()
+		logger := &recordingLogger{}
+		client := model.MakeClient(nil, model.ClientOptions{Logger: logger})
+		client.SetPublicKey(&publicKey0)
+		jsonErrorMessage(hub, &client, result)
+		if len(logger.lines) != 1 {
+			t.Fatalf("Expected 1 line to be logged, got %d", len(logger.lines))
+		}
+		if line := logger.lines[0]; !strings.Contains(line, "secretProperty") || !strings.Contains(line, (string)(publicKey0)) {
+			t.Errorf("Expected the log to name the missing property and the client's public key, got %q", line)
+		}
+	})
+
+	t.Run("Debug mode sends the schema errors", func(t *testing.T) {
+		hub := model.NewHub()
+		hub.SetErrorVerbosity(model.ErrorVerbosity_Debug)
+		msg := jsonErrorMessage(hub, &model.Client{}, result)
+		if !strings.Contains(msg, "secretProperty") {
+			t.Errorf("Expected the error to name the missing property, got %q", msg)
+		}
+	})
+}
+
+func TestDoneReasons(t *testing.T) {
+
+	// A and B online, C offline. A has started the transaction.
+	withAB := func(constructor func(*model.Client, *model.Hub) model.Routine) func() model.Routine {
+		return func() model.Routine {
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			return constructor(clientA, hub)
+		}
+	}
+	// a client that hasn't signed in yet
+	signedOut := func(constructor func(*model.Client, *model.Hub) model.Routine) func() model.Routine {
+		return func() model.Routine {
+			return constructor(&model.Client{}, model.NewHub())
+		}
+	}
+	steps := func(steps ...Step) []model.RoutineInput {
+		inputs := []model.RoutineInput{}
+		for _, step := range steps {
+			inputs = append(inputs, step.input)
+		}
+		return inputs
+	}
+	badInput := func(pk *model.PublicKey) Step {
+		return Step{input: model.RoutineInput{MsgType: model.RoutineMsgType_UsrMsg, Pk: pk, Msg: "lol"}}
+	}
+	a := pkToStr(&publicKey0)
+	b := pkToStr(&publicKey1)
+
+	tests := []struct {
+		description string
+		newRoutine  func() model.Routine
+		inputs      []model.RoutineInput
+		// the reason each socket was ended with, by pkToStr of the public key.
+		expected map[string]model.DoneReason
+	}{
+		{
+			"checkPeerOnline completes",
+			withAB(newCheckPeerOnline),
+			steps(cpoStepOnline),
+			map[string]model.DoneReason{a: model.DoneReason_Completed},
+		},
+		{
+			"broadcastStatus completes",
+			withAB(newBroadcastStatus),
+			[]model.RoutineInput{{
+				MsgType: model.RoutineMsgType_UsrMsg,
+				Pk:      &publicKey0,
+				Msg:     `{"initiate":"broadcastStatus","keys":["` + (string)(publicKey1) + `"],"status":{}}`,
+			}},
+			map[string]model.DoneReason{a: model.DoneReason_Completed, b: model.DoneReason_Completed},
+		},
+		{
+			"sendFriendRejection completes",
+			withAB(newFriendRejection),
+			steps(frejStepOnline),
+			map[string]model.DoneReason{a: model.DoneReason_Completed, b: model.DoneReason_Completed},
+		},
+		{
+			"removeFriend completes",
+			withAB(newRemoveFriend),
+			steps(rmfStepOnline),
+			map[string]model.DoneReason{a: model.DoneReason_Completed, b: model.DoneReason_Completed},
+		},
+		{
+			"sendFriendRequest completes when answered",
+			withAB(newFriendRequest),
+			steps(frStepInitiateOnline, frResponseFromB("accept")),
+			map[string]model.DoneReason{a: model.DoneReason_Completed, b: model.DoneReason_Completed},
+		},
+		{
+			"sendFriendRequest is cancelled",
+			withAB(newFriendRequest),
+			steps(frStepInitiateOnline, stepPkACancel),
+			map[string]model.DoneReason{a: model.DoneReason_Cancelled, b: model.DoneReason_Cancelled},
+		},
+		{
+			"sendFileOffer completes when answered",
+			withAB(newFileOffer),
+			steps(foStepInitiateOnline, foResponseFromB("decline")),
+			map[string]model.DoneReason{a: model.DoneReason_Completed, b: model.DoneReason_Completed},
+		},
+		{
+			"establishConnectionToPeer completes when rejected",
+			withAB(newEstablishConnectionToPeer),
+			steps(ectpStepInitiateOnline, ectpStepReject),
+			map[string]model.DoneReason{a: model.DoneReason_Completed, b: model.DoneReason_Completed},
+		},
+		{
+			"establishConnectionToPeer completes when connected",
+			withAB(newEstablishConnectionToPeer),
+			steps(ectpStepInitiateOnline, ectpStepAcceptAndOffer, ectpStepAnswer, ectpStepFinalIceA, ectpStepFinalIceBTerminate),
+			map[string]model.DoneReason{a: model.DoneReason_Completed, b: model.DoneReason_Completed},
+		},
+		{
+			"establishConnectionToPeer times out",
+			withAB(newEstablishConnectionToPeer),
+			steps(ectpStepInitiateOnline, stepPkATimeout),
+			map[string]model.DoneReason{a: model.DoneReason_Timeout, b: model.DoneReason_Timeout},
+		},
+		{
+			"establishConnectionToPeer peer disconnects",
+			withAB(newEstablishConnectionToPeer),
+			steps(ectpStepInitiateOnline, stepPkBDisconnect),
+			map[string]model.DoneReason{a: model.DoneReason_PeerDisconnected},
+		},
+		{
+			"establishConnectionToPeer is sent bad input",
+			withAB(newEstablishConnectionToPeer),
+			steps(ectpStepInitiateOnline, badInput(&publicKey0)),
+			map[string]model.DoneReason{a: model.DoneReason_Error, b: model.DoneReason_Error},
+		},
+		{
+			"establishGroupConnection completes when everyone else leaves",
+			withAB(newEstablishGroupConnection),
+			steps(egcStepInitiateAB, egcStepAccept(&publicKey1, &publicKey0), egcStepLeave(&publicKey0, nil, &publicKey1)),
+			map[string]model.DoneReason{a: model.DoneReason_Completed, b: model.DoneReason_Completed},
+		},
+		{
+			"relayData is cancelled",
+			withAB(newRelayData),
+			steps(rdStepInitiateOnline, stepPkBCancel),
+			map[string]model.DoneReason{a: model.DoneReason_Cancelled, b: model.DoneReason_Cancelled},
+		},
+		{
+			"watchPresence is cancelled",
+			withAB(newWatchPresence),
+			steps(wpStepInitiate, stepPkACancel),
+			map[string]model.DoneReason{a: model.DoneReason_Cancelled},
+		},
+		{
+			"watchPresence times out",
+			withAB(newWatchPresence),
+			steps(wpStepInitiate, stepPkATimeout),
+			map[string]model.DoneReason{a: model.DoneReason_Timeout},
+		},
+		{
+			"comeOnline times out",
+			signedOut(newComeOnline),
+			steps(coStepInitiate, coStepTimeout),
+			map[string]model.DoneReason{"nil": model.DoneReason_Timeout},
+		},
+		{
+			"comeOnline is cancelled",
+			signedOut(newComeOnline),
+			steps(coStepInitiate, coStepClientCancel),
+			map[string]model.DoneReason{"nil": model.DoneReason_Cancelled},
+		},
+		{
+			"comeOnline is sent bad input",
+			signedOut(newComeOnline),
+			steps(coStepInitiate, badInput(nil)),
+			map[string]model.DoneReason{"nil": model.DoneReason_Error},
+		},
+		{
+			"the master routine is sent bad input",
+			signedOut(NewMasterRoutine),
+			steps(badInput(nil)),
+			map[string]model.DoneReason{"nil": model.DoneReason_Error},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			r := tt.newRoutine()
+			got := make(map[string]model.DoneReason)
+			for _, input := range tt.inputs {
+				for _, ro := range r.Next(input) {
+					pk := ro.Pk
+					if pk == nil {
+						pk = input.Pk
+					}
+					if ro.Done {
+						got[pkToStr(pk)] = ro.DoneReason
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected done reasons %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	t.Run("reconnect completes", func(t *testing.T) {
+		hub := model.NewHub()
+		token, _ := hub.IssueReconnectToken(publicKey0)
+		ros := newReconnect(&model.Client{}, hub).Next(model.RoutineInput{
+			MsgType: model.RoutineMsgType_UsrMsg,
+			Msg:     recMsg(publicKey0, token),
+		})
+		if len(ros) != 1 || !ros[0].Done || ros[0].DoneReason != model.DoneReason_Completed {
+			t.Errorf("Expected the reconnect to complete, got %+v", ros)
+		}
+	})
+}
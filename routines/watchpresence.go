@@ -0,0 +1,182 @@
+package routines
+
+import (
+	"encoding/json"
+	"fmt"
+	"harmony/backend/model"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// maximum number of public keys that can be watched by a single routine
+const maxWatchedKeys = 100
+
+// Notifies the client whenever one of a set of public keys comes online or goes offline.
+// Runs until the client cancels or disconnects, or the transaction's lifetime runs out. The client has to start watching again after that.
+// Implements model.EndHandler, so that it unsubscribes however the transaction ends.
+type WatchPresence struct {
+	client *model.Client
+	hub    *model.Hub
+	pk     *model.PublicKey
+	keys   []model.PublicKey
+	notify chan model.PresenceEvent
+}
+
+func newWatchPresence(client *model.Client, hub *model.Hub) model.Routine {
+	return &WatchPresence{client: client, hub: hub}
+}
+
+func (r *WatchPresence) Next(args model.RoutineInput) []model.RoutineOutput {
+
+	switch args.MsgType {
+	case model.RoutineMsgType_ClientClose:
+		r.unsubscribe()
+		return []model.RoutineOutput{}
+	case model.RoutineMsgType_Timeout:
+		// no timeouts are set, but handle it anyway
+		r.unsubscribe()
+		return wpError(nil, ERROR_TIMEOUT, "Timeout")
+	case model.RoutineMsgType_PresenceEvent:
+		return []model.RoutineOutput{
+			model.MakeRoutineOutput(false, presenceMsg(args.PresenceEvent.Pk, args.PresenceEvent.Online)),
+		}
+	case model.RoutineMsgType_UsrMsg:
+		if isClientCancelMsg(args.Msg) {
+			r.unsubscribe()
+			return []model.RoutineOutput{{
+				Done:       true,
+				DoneReason: model.DoneReason_Cancelled,
+			}}
+		}
+		if r.notify == nil {
+			return r.entry(args)
+		}
+		r.unsubscribe()
+		return wpError(nil, ERROR_MALFORMED, "Unexpected message")
+	default:
+		panic("unrecognized message type")
+	}
+}
+
+var wpEntrySchema = func() *gojsonschema.Schema {
+	schemaStr := fmt.Sprintf(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"initiate": {
+				"const":"watchPresence"
+			},
+			"keys": {
+				"type": "array",
+				"items": {
+					"type":"string",
+					"pattern": "`+publicKeyPattern+`"
+				},
+				"minItems": 1,
+				"maxItems": %d,
+				"uniqueItems": true
+			}
+		},
+		"required": ["initiate", "keys"],
+		"additionalProperties": false
+	}`, maxWatchedKeys)
+	schemaLoader := gojsonschema.NewStringLoader(schemaStr)
+	schema, _ := gojsonschema.NewSchema(schemaLoader)
+	return schema
+}()
+
+func (r *WatchPresence) entry(args model.RoutineInput) []model.RoutineOutput {
+
+	r.pk = args.Pk
+	if r.pk == nil {
+		return wpError(nil, ERROR_NOT_AUTHENTICATED, "You have not provided a public key")
+	}
+
+	// validate msg
+	result, err := validateJSON(wpEntrySchema, args.Msg)
+	if err != nil {
+		return wpError(nil, ERROR_MALFORMED, err.Error())
+	}
+	if !result.Valid() {
+		return wpError(nil, ERROR_MALFORMED, jsonErrorMessage(r.hub, r.client, result))
+	}
+
+	// parse msg
+	usrMsg := struct {
+		Initiate string   `json:"initiate"`
+		Keys     []string `json:"keys"`
+	}{}
+	json.Unmarshal([]byte(args.Msg), &usrMsg)
+
+	keys := make([]model.PublicKey, 0, len(usrMsg.Keys))
+	for _, keyStr := range usrMsg.Keys {
+		key, err := parsePublicKey(keyStr)
+		if err != nil {
+			return wpError(nil, ERROR_MALFORMED, err.Error())
+		}
+		keys = append(keys, *key)
+	}
+
+	// subscribe before looking up the current status, so that no changes are missed in between.
+	// buffer so that the hub doesn't have to drop events in a burst.
+	r.keys = keys
+	r.notify = make(chan model.PresenceEvent, maxWatchedKeys)
+	for _, key := range r.keys {
+		r.hub.Subscribe(key, r.notify)
+	}
+
+	// reply with the current status of every key
+	msgs := make([]string, 0, len(r.keys))
+	for _, key := range r.keys {
+		_, online := r.hub.GetClient(key)
+		msgs = append(msgs, presenceMsg(key, online))
+	}
+
+	return []model.RoutineOutput{
+		{
+			Msgs:           msgs,
+			PresenceEvents: r.notify,
+		},
+	}
+}
+
+// Implements model.EndHandler. The routine isn't told when the transaction is cancelled for exceeding its lifetime.
+func (r *WatchPresence) Ended() {
+	r.unsubscribe()
+}
+
+func (r *WatchPresence) unsubscribe() {
+	for _, key := range r.keys {
+		r.hub.Unsubscribe(key, r.notify)
+	}
+	r.keys = nil
+}
+
+// {"presence":{"key":"...","status":"online"|"offline"}}
+func presenceMsg(pk model.PublicKey, online bool) string {
+	data := struct {
+		Presence struct {
+			Key    string `json:"key"`
+			Status string `json:"status"`
+		} `json:"presence"`
+	}{}
+	data.Presence.Key = publicKeyToString(pk)
+	data.Presence.Status = "offline"
+	if online {
+		data.Presence.Status = "online"
+	}
+	msg, _ := json.Marshal(data)
+	return string(msg)
+}
+
+// wrapper for error routine output
+func wpError(pk *model.PublicKey, code string, msgs ...string) []model.RoutineOutput {
+	return []model.RoutineOutput{
+		{
+			Pk:         pk,
+			Done:       true,
+			DoneReason: doneReasonForCode(code),
+			Msgs:       []string{MakeJSONErrorWithCode(code, msgs...)},
+		},
+	}
+}
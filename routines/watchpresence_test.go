@@ -0,0 +1,297 @@
+package routines
+
+import (
+	"harmony/backend/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchPresence(t *testing.T) {
+
+	t.Run("Valid inputs", func(t *testing.T) {
+
+		t.Run("Reports current status then changes until cancelled", func(t *testing.T) {
+			test := []Step{
+				wpStepInitiate,
+				{
+					description: "B goes offline",
+					input: model.RoutineInput{
+						MsgType:       model.RoutineMsgType_PresenceEvent,
+						Pk:            &publicKey0,
+						PresenceEvent: model.PresenceEvent{Pk: publicKey1, Online: false},
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{wpSchemaPresence((string)(publicKey1), "offline")},
+							},
+						},
+					},
+				},
+				{
+					description: "B comes online",
+					input: model.RoutineInput{
+						MsgType:       model.RoutineMsgType_PresenceEvent,
+						Pk:            &publicKey0,
+						PresenceEvent: model.PresenceEvent{Pk: publicKey1, Online: true},
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Msgs: []string{wpSchemaPresence((string)(publicKey1), "online")},
+							},
+						},
+					},
+				},
+				{
+					description: "A cancels",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg:     `{"terminate":"cancel"}`,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   &publicKey0,
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			wp := newWatchPresence(clientA, hub)
+
+			testRunner(t, wp, test)
+		})
+
+		t.Run("Subscribes to the hub", func(t *testing.T) {
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			wp := newWatchPresence(clientA, hub)
+
+			ros := wp.Next(wpStepInitiate.input)
+			if len(ros) != 1 || ros[0].PresenceEvents == nil {
+				t.Fatalf("Expected a single RoutineOutput with PresenceEvents set. Got %v", ros)
+			}
+
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub.AddClient(publicKey1, clientB)
+
+			select {
+			case event := <-ros[0].PresenceEvents:
+				if event != (model.PresenceEvent{Pk: publicKey1, Online: true}) {
+					t.Errorf("Expected B to come online. Got %v", event)
+				}
+			default:
+				t.Errorf("Expected a presence event when B came online")
+			}
+
+			// no more events after the client disconnects
+			wp.Next(stepPkADisconnect.input)
+			hub.DeleteClient(publicKey1, clientB)
+			select {
+			case event := <-ros[0].PresenceEvents:
+				t.Errorf("Expected no presence event after unsubscribing. Got %v", event)
+			default:
+			}
+		})
+	})
+
+	t.Run("Unsubscribes once the transaction's lifetime runs out", func(t *testing.T) {
+		lifetime := 20 * time.Millisecond
+		conn := &scriptedConn{fromCl: make(chan []byte, 1)}
+		client := model.MakeClient(conn, model.ClientOptions{MaxTransactionLifetime: lifetime})
+		client.SetPublicKey(&publicKey0)
+		hub := model.NewHub()
+		hub.AddClient(publicKey0, &client)
+		router := client.RouteSync(hub, func() model.Routine { return NewMasterRoutine(&client, hub) })
+
+		id := strings.Repeat("w", model.IDLEN)
+		conn.fromCl <- []byte(id + wpStepInitiate.input.Msg)
+		router.Step()
+		if count := hub.SubscriberCount(); count != 1 {
+			t.Fatalf("Expected 1 subscriber while watching, got %d", count)
+		}
+
+		// cancelled without the routine's involvement
+		time.Sleep(2 * lifetime)
+		router.Step()
+		expected := id + `{"terminate":"cancel","error":"Transaction lifetime exceeded"}`
+		if last := conn.written[len(conn.written)-1]; last != expected {
+			t.Errorf("Expected %q, got %q", expected, last)
+		}
+		if count := hub.SubscriberCount(); count != 0 {
+			t.Errorf("Expected no subscribers after the lifetime ran out, got %d", count)
+		}
+	})
+
+	t.Run("Invalid inputs", func(t *testing.T) {
+		t.Run("User has not provided their public key", func(t *testing.T) {
+			test := []Step{
+				{
+					description: "A watches B without having provided their public key",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      nil,
+						Msg:     wpStepInitiate.input.Msg,
+					},
+					outputs: []ExpectedOutput{
+						{
+							ro: model.RoutineOutput{
+								Pk:   nil,
+								Msgs: []string{errorSchemaString("You have not provided a public key")},
+								Done: true,
+							},
+						},
+					},
+				},
+			}
+
+			wp := newWatchPresence(&model.Client{}, model.NewHub())
+			testRunner(t, wp, test)
+		})
+
+		cases := []Step{
+			{
+				description: "No keys",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate":"watchPresence","keys":[]}`,
+				},
+				outputs: outputPkAError,
+			},
+			{
+				description: "Key in wrong format",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate":"watchPresence","keys":["4"]}`,
+				},
+				outputs: outputPkAError,
+			},
+			{
+				description: "Key is not Ed25519",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate":"watchPresence","keys":["` + invalidPublicKeyNIST + `"]}`,
+				},
+				outputs: outputPkAError,
+			},
+			{
+				description: "Extra properties",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{"initiate":"watchPresence","keys":["` + (string)(publicKey1) + `"],"extra":1}`,
+				},
+				outputs: outputPkAError,
+			},
+			{
+				description: "Invalid JSON",
+				input: model.RoutineInput{
+					MsgType: model.RoutineMsgType_UsrMsg,
+					Pk:      &publicKey0,
+					Msg:     `{`,
+				},
+				outputs: outputPkAError,
+			},
+		}
+
+		for _, testCase := range cases {
+			t.Run(testCase.description, func(t *testing.T) {
+				client := &model.Client{}
+				client.SetPublicKey(&publicKey0)
+				hub := model.NewHub()
+				hub.AddClient(publicKey0, client)
+				wp := newWatchPresence(client, hub)
+
+				testRunner(t, wp, []Step{testCase})
+			})
+		}
+
+		t.Run("A sends a message after initiating", func(t *testing.T) {
+			test := []Step{
+				wpStepInitiate,
+				{
+					description: "A sends an unexpected message",
+					input: model.RoutineInput{
+						MsgType: model.RoutineMsgType_UsrMsg,
+						Pk:      &publicKey0,
+						Msg:     `{}`,
+					},
+					outputs: outputPkAError,
+				},
+			}
+
+			clientA := &model.Client{}
+			clientA.SetPublicKey(&publicKey0)
+			clientB := &model.Client{}
+			clientB.SetPublicKey(&publicKey1)
+			hub := model.NewHub()
+			hub.AddClient(publicKey0, clientA)
+			hub.AddClient(publicKey1, clientB)
+			wp := newWatchPresence(clientA, hub)
+
+			testRunner(t, wp, test, testRunnerConfig{errorsOnLastStepOnly: true})
+		})
+	})
+}
+
+var wpStepInitiate = Step{
+	description: "A starts watching B",
+	input: model.RoutineInput{
+		MsgType: model.RoutineMsgType_UsrMsg,
+		Pk:      &publicKey0,
+		Msg:     `{"initiate":"watchPresence","keys":["` + (string)(publicKey1) + `"]}`,
+	},
+	outputs: []ExpectedOutput{
+		{
+			verifyTimeouts: true,
+			ro: model.RoutineOutput{
+				Pk:   &publicKey0,
+				Msgs: []string{wpSchemaPresence((string)(publicKey1), "online")},
+			},
+		},
+	},
+}
+
+func wpSchemaPresence(pk string, status string) string {
+	return `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"presence": {
+				"type": "object",
+				"properties": {
+					"key": {
+						"const": "` + pk + `"
+					},
+					"status": {
+						"const": "` + status + `"
+					}
+				},
+				"required": ["key", "status"],
+				"additionalProperties": false
+			}
+		},
+		"required": ["presence"],
+		"additionalProperties": false
+	}`
+}